@@ -5,14 +5,19 @@ user_name=pmcgrath
 password=pass
 cookie_jar=/tmp/ab-cookie-jar
 
-# Make root call - this will give us a session
-curl $app_address --cookie-jar $cookie_jar >> /dev/null
-session_id=$(grep SessionId $cookie_jar | cut -f 7)
-session_id_cookie="SessionId=$session_id"
+function csrftoken() {
+  grep -i '^x-csrf-token:' | cut -d' ' -f2 | tr -d '\r'
+}
 
-# Login
-curl $app_address/api/v1/login --cookie $session_id_cookie --cookie-jar $cookie_jar -XPOST -d "{ \"UserName\": \"$user_name\", \"Password\": \"$password\" }" -vvv
+# Get a CSRF token - this will give us a session
+csrf_token=$(curl -s -o /dev/null -D - $app_address/api/v1/login --cookie-jar $cookie_jar | csrftoken)
+
+# Login, this replaces the session id and CSRF token
+csrf_token=$(curl -s -o /dev/null -D - $app_address/api/v1/login --cookie $cookie_jar --cookie-jar $cookie_jar -H "X-CSRF-Token: $csrf_token" -XPOST -d "{ \"UserName\": \"$user_name\", \"Password\": \"$password\" }" | csrftoken)
+
+# Create an API token so ab does not need cookies
+api_token=$(curl -s $app_address/api/v1/users/$user_name/tokens --cookie $cookie_jar -H "X-CSRF-Token: $csrf_token" -XPOST -d '{ "Name": "ab" }' | sed -n 's/.*"Token":"\([^"]*\)".*/\1/p')
 
 # See http://httpd.apache.org/docs/current/programs/ab.html
 # sudo install -y apache2-utils # Only need utils do not need apache server
-ab -n 100 -c 10 -C $session_id_cookie $app_address/api/v1/contacts/$user_name
+ab -n 100 -c 10 -H "Authorization: Bearer $api_token" $app_address/api/v1/contacts/$user_name
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+/*
+Access control - users have read-write access to their own contacts, admins to everyone's
+Other users only have what the owner has granted them, see Grant
+*/
+
+// The context's user is an admin, loads the user so a role change applies to existing sessions and API tokens
+func IsAdmin(store UserStore, c *RequestContext) (bool, error) {
+	user, err := store.Get(c.GetUserName())
+	if err == ErrUserNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return user.HasRole(AdminRole), nil
+}
+
+// The access the context's user has to the owner's contacts as a grant, ErrGrantNotFound if they have none
+func GetContactAccess(store UserStore, c *RequestContext, ownerId string) (*Grant, error) {
+	userName := c.GetUserName()
+	fullAccess := &Grant{OwnerId: ownerId, GranteeId: userName, Access: ReadWriteAccess}
+	if userName == ownerId {
+		return fullAccess, nil
+	}
+
+	isAdmin, err := IsAdmin(store, c)
+	if err != nil {
+		return nil, err
+	}
+	if isAdmin {
+		return fullAccess, nil
+	}
+
+	return store.GetGrant(ownerId, userName)
+}
+
+/*
+Applies the forbidden check for a contact, a contact id of "" is the whole address book
+Reading the whole address book only needs access to some of it, callers filter the contacts with the grant
+Writing the whole address book, i.e. creating contacts or importing, needs a grant for all contacts
+*/
+func checkContactAccess(store UserStore, w http.ResponseWriter, c *RequestContext, ownerId, contactId string, write bool) (*Grant, bool) {
+	grant, err := GetContactAccess(store, c, ownerId)
+	if err != nil && err != ErrGrantNotFound {
+		log.Printf("%s Error detected when trying to get access to contacts for user with id %s : %s\n", c.GetLogMessagePrefix(), ownerId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return nil, false
+	}
+
+	permitted := err == nil
+	if permitted && write && grant.Access != ReadWriteAccess {
+		permitted = false
+	}
+	if permitted && contactId != "" && !grant.Covers(contactId) {
+		permitted = false
+	}
+	if permitted && contactId == "" && write && !grant.Covers("") {
+		permitted = false
+	}
+	if !permitted {
+		log.Printf("%s Forbidden, context user id %s\n", c.GetLogMessagePrefix(), c.GetUserName())
+		WriteProblem(w, c, http.StatusForbidden, "Not permitted to access another user's resources")
+		return nil, false
+	}
+
+	return grant, true
+}
+
+func isReadMethod(r *http.Request) bool {
+	return r.Method == "GET" || r.Method == "HEAD"
+}
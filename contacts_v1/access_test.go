@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func GetSharingUserStore() UserStore {
+	store := GetInitialisedUserStore()
+	for _, user := range []*User{
+		&User{Id: "reader", FirstName: "Rita", LastName: "Reader", Password: "pass"},
+		&User{Id: "writer", FirstName: "Wim", LastName: "Writer", Password: "pass"},
+		&User{Id: "picker", FirstName: "Pia", LastName: "Picker", Password: "pass"},
+		&User{Id: "stranger", FirstName: "Sam", LastName: "Stranger", Password: "pass"},
+		&User{Id: "theadmin", FirstName: "Ada", LastName: "Admin", Password: "pass", Roles: []string{AdminRole}},
+	} {
+		store.Save(user)
+	}
+	store.SaveGrant(&Grant{OwnerId: "pmcgrath", GranteeId: "reader", Access: ReadAccess})
+	store.SaveGrant(&Grant{OwnerId: "pmcgrath", GranteeId: "writer", Access: ReadWriteAccess})
+	store.SaveGrant(&Grant{OwnerId: "pmcgrath", GranteeId: "picker", Access: ReadWriteAccess, ContactIds: []string{"ted"}})
+
+	return store
+}
+
+func GetRequestContextForUser(userName string) *RequestContext {
+	c := GetLoggedInRequestContext()
+	c.Session.UserName = userName
+	return c
+}
+
+func TestIsAdmin(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetSharingUserStore()
+
+	testCases := []struct {
+		// Input
+		UserName string
+		// Expected result
+		IsAdmin bool
+	}{
+		{"theadmin", true},
+		{"pmcgrath", false},
+		{"deleted", false},
+	}
+
+	for index, testCase := range testCases {
+		isAdmin, err := IsAdmin(store, GetRequestContextForUser(testCase.UserName))
+
+		spec.Assert(err == nil, "Unexpected error for test case %d : %s", index, err)
+		spec.Assert(isAdmin == testCase.IsAdmin, "Expected %t for test case %d", testCase.IsAdmin, index)
+	}
+}
+
+func TestCheckContactAccess(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetSharingUserStore()
+
+	testCases := []struct {
+		// Input
+		UserName  string
+		ContactId string
+		Write     bool
+		// Expected result
+		IsPermitted bool
+	}{
+		{"pmcgrath", "", true, true},
+		{"theadmin", "ted", true, true},
+		{"theadmin", "", true, true},
+		{"reader", "ted", false, true},
+		{"reader", "", false, true},
+		{"reader", "ted", true, false},
+		{"writer", "ted", true, true},
+		{"writer", "", true, true},
+		{"picker", "ted", true, true},
+		{"picker", "pmcgrath", false, false},
+		{"picker", "", false, true}, // Listing is filtered to the granted contacts
+		{"picker", "", true, false}, // Creating needs all contacts
+		{"stranger", "ted", false, false},
+		{"stranger", "", false, false},
+	}
+
+	for index, testCase := range testCases {
+		response := httptest.NewRecorder()
+
+		grant, ok := checkContactAccess(store, response, GetRequestContextForUser(testCase.UserName), "pmcgrath", testCase.ContactId, testCase.Write)
+
+		spec.Assert(ok == testCase.IsPermitted, "Expected %t for test case %d", testCase.IsPermitted, index)
+		if testCase.IsPermitted {
+			spec.Assert(grant != nil, "Expected a grant for test case %d", index)
+		} else {
+			spec.Assert(response.Code == http.StatusForbidden, "Unexpected status code %d for test case %d", response.Code, index)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+/*
+API tokens for non-browser clients, sent as "Authorization: Bearer <token>"
+Only a SHA-256 hash of the token is stored, tokens are 256 bit random values so a slow password hash adds nothing and
+the hash can be the lookup key, the token itself is only ever returned when it is created
+*/
+const (
+	apiTokenPrefix        = "ct_" // So a leaked token is recognisable, i.e. by secret scanners
+	apiTokenLengthBytes   = 32
+	maxApiTokenNameLength = 100
+)
+
+// Returns the record to store and the token to give to the client
+func NewApiToken(userId, name string) (*ApiToken, string, error) {
+	buf := make([]byte, apiTokenLengthBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", err
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	return &ApiToken{
+		Id:        Uuid(),
+		UserId:    userId,
+		Name:      strings.TrimSpace(name),
+		Hash:      HashApiToken(token),
+		CreatedAt: time.Now().UTC(),
+	}, token, nil
+}
+
+func HashApiToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Token from an "Authorization: Bearer <token>" header value, ok is false for any other scheme
+func ParseBearerToken(authorization string) (token string, ok bool) {
+	const scheme = "bearer "
+	if len(authorization) < len(scheme) || !strings.EqualFold(authorization[:len(scheme)], scheme) {
+		return "", false
+	}
+
+	return strings.TrimSpace(authorization[len(scheme):]), true
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewApiToken(t *testing.T) {
+	spec := &Spec{t}
+
+	apiToken, token, err := NewApiToken("pmcgrath", " ci ")
+	spec.Assert(err == nil, "Unexpected error %s", err)
+
+	spec.Assert(strings.HasPrefix(token, "ct_") && len(token) == 46, "Unexpected token %s", token)
+	spec.Assert(apiToken.UserId == "pmcgrath", "Unexpected user id %s", apiToken.UserId)
+	spec.Assert(apiToken.Name == "ci", "Unexpected name [%s]", apiToken.Name)
+	spec.Assert(apiToken.Hash == HashApiToken(token), "Hash does not match the token")
+	spec.Assert(!strings.Contains(apiToken.Hash, token), "Token is stored in the record")
+
+	_, other, _ := NewApiToken("pmcgrath", "ci")
+	spec.Assert(other != token, "Tokens are not unique")
+}
+
+func TestParseBearerToken(t *testing.T) {
+	spec := &Spec{t}
+	testCases := []struct {
+		// Input
+		Authorization string
+		// Expected result
+		Token string
+		Ok    bool
+	}{
+		{"Bearer ct_abc", "ct_abc", true},
+		{"bearer  ct_abc ", "ct_abc", true},
+		{"Bearer ", "", true},
+		{"Basic dXNlcjpwYXNz", "", false},
+		{"Bearer", "", false},
+		{"", "", false},
+	}
+
+	for _, testCase := range testCases {
+		token, ok := ParseBearerToken(testCase.Authorization)
+
+		spec.Assert(token == testCase.Token && ok == testCase.Ok, "Unexpected result [%s] %t for [%s]", token, ok, testCase.Authorization)
+	}
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
 	_ "expvar" // So we can access debug/vars
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 func init() {
@@ -14,71 +22,308 @@ func init() {
 	log.SetPrefix(fmt.Sprintf("%d ", pid))
 }
 
-func openStores() (sessionStore SessionStore, userStore UserStore) {
+// The revocation store is only set for cookie sessions, see CookieSessionStore
+func openStores() (sessionStore SessionStore, userStore UserStore, loginAttemptStore LoginAttemptStore, revocationStore SessionRevocationStore) {
 	redisAddress := GetOrDefaultEnv("REDIS_ADDRESS", "")
 	redisPassword := GetOrDefaultEnv("REDIS_PASSWORD", "")
 	sessionTimeoutInMinutes, _ := strconv.Atoi(GetOrDefaultEnv("WEBAPP_SESSION_TIMEOUT_IN_MINUTES", "20"))
 
+	sessionStoreType := GetOrDefaultEnv("WEBAPP_SESSION_STORE", "") // Empty for the same type as the user store
+	sessionKeys := GetOrDefaultEnv("WEBAPP_SESSION_KEYS", "")
+	encryptSessions := GetOrDefaultEnv("WEBAPP_SESSION_ENCRYPT", "false") == "true"
+
 	sessionTimeoutInSeconds := uint(sessionTimeoutInMinutes * 60)
 
+	var pool *redis.Pool
 	if redisAddress != "" {
 		log.Printf("Using redis stores %s\n", redisAddress)
-		pool := NewRedisPool(redisAddress, redisPassword)
+		pool = NewRedisPool(redisAddress, redisPassword)
+	}
+
+	if sessionStoreType == "cookie" {
+		log.Printf("Using cookie session store, encrypted : %t\n", encryptSessions)
+		keys, err := ParseCookieSessionKeys(sessionKeys)
+		if err != nil {
+			log.Fatalf("Error detected when parsing WEBAPP_SESSION_KEYS : %s\n", err)
+		}
+		if pool != nil {
+			revocationStore = NewRedisSessionRevocationStore(pool)
+		} else {
+			log.Println("Warning: cookie session revocations are held in memory, other replicas and restarts accept logged out cookies until they expire, set REDIS_ADDRESS to share them")
+			revocationStore = NewInMemorySessionRevocationStore(sessionTimeoutInSeconds)
+		}
+		if sessionStore, err = NewCookieSessionStore(keys, encryptSessions, sessionTimeoutInSeconds, revocationStore); err != nil {
+			log.Fatalf("Error detected when creating cookie session store : %s\n", err)
+		}
+	} else if sessionStoreType != "" {
+		log.Fatalf("Unknown WEBAPP_SESSION_STORE %s\n", sessionStoreType)
+	}
+
+	if pool != nil {
+		if sessionStore == nil {
+			sessionStore = NewRedisSessionStore(pool, sessionTimeoutInSeconds)
+		}
+		redisUserStore := NewRedisUserStore(pool)
+		userStore = redisUserStore
+		loginAttemptStore = NewRedisLoginAttemptStore(pool)
 
-		sessionStore = NewRedisSessionStore(pool, sessionTimeoutInSeconds)
-		userStore = NewRedisUserStore(pool)
+		// Move any legacy single ContactsAsJson user records to the per contact layout
+		migrated, err := redisUserStore.Migrate()
+		if err != nil {
+			log.Fatalf("Error detected when migrating redis user store : %s\n", err)
+		}
+		log.Printf("Redis user store migration completed, %d user(s) migrated\n", migrated)
 	} else {
 		log.Println("Using in memory stores - will add 'pmcgrath' user")
 
-		sessionStore = NewInMemorySessionStore(sessionTimeoutInSeconds, sessionTimeoutInSeconds) // Purge and timeout are same value
+		if sessionStore == nil {
+			sessionStore = NewInMemorySessionStore(sessionTimeoutInSeconds, sessionTimeoutInSeconds) // Purge and timeout are same value
+		}
 		userStore = NewInMemoryUserStore()
+		loginAttemptStore = NewInMemoryLoginAttemptStore(3600)
 
 		// Add a user so we have a user to work with
-		userStore.Save(&User{
+		user := &User{
 			Id:        "pmcgrath",
 			FirstName: "Pat",
 			LastName:  "Mc Grath",
 			Email:     "pmcgrat@gmail.com",
-			Password:  "pass",
 			Contacts:  make([]Contact, 0),
-		})
+		}
+		if err := user.SetPassword("pass"); err != nil {
+			log.Fatalf("Error detected when trying to hash seed user password : %s\n", err)
+		}
+		userStore.Save(user)
 	}
 
 	return
 }
 
-func closeStores(sessionStore SessionStore, userStore UserStore) {
-	// If redis stores, close redis pool - same pool shared by both stores
-	if store, ok := sessionStore.(*RedisSessionStore); ok {
+/*
+Contact photos are kept on the file system if WEBAPP_BLOB_DIRECTORY is set, otherwise in redis with the other stores
+With in memory stores and no directory a temporary directory is used, so photos are lost with the users
+*/
+func openBlobStore(userStore UserStore) BlobStore {
+	blobDirectory := GetOrDefaultEnv("WEBAPP_BLOB_DIRECTORY", "")
+
+	if redisUserStore, ok := userStore.(*RedisUserStore); ok && blobDirectory == "" {
+		log.Println("Using redis blob store")
+		return NewRedisBlobStore(redisUserStore.pool)
+	}
+
+	if blobDirectory == "" {
+		var err error
+		if blobDirectory, err = ioutil.TempDir("", "contacts-blobs-"); err != nil {
+			log.Fatalf("Error detected when creating temporary blob directory : %s\n", err)
+		}
+	}
+	log.Printf("Using file blob store %s\n", blobDirectory)
+	blobStore, err := NewFileBlobStore(blobDirectory)
+	if err != nil {
+		log.Fatalf("Error detected when opening blob directory %s : %s\n", blobDirectory, err)
+	}
+
+	return blobStore
+}
+
+// So there is an admin to grant other roles, users that do not exist yet are skipped
+func grantAdminRoles(userStore UserStore, userIds string) {
+	for _, userId := range strings.Split(userIds, ",") {
+		userId = strings.TrimSpace(userId)
+		if userId == "" {
+			continue
+		}
+
+		user, err := userStore.Get(userId)
+		if err == ErrUserNotFound {
+			log.Printf("Admin user %s not found, skipping\n", userId)
+			continue
+		}
+		if err != nil {
+			log.Fatalf("Error detected when trying to get admin user %s : %s\n", userId, err)
+		}
+		if user.HasRole(AdminRole) {
+			continue
+		}
+
+		if err := userStore.SetRoles(userId, append(user.Roles, AdminRole)); err != nil {
+			log.Fatalf("Error detected when trying to grant admin role to user %s : %s\n", userId, err)
+		}
+		log.Printf("Granted admin role to user %s\n", userId)
+	}
+}
+
+func closeStores(sessionStore SessionStore, userStore UserStore, loginAttemptStore LoginAttemptStore, revocationStore SessionRevocationStore) {
+	if store, ok := sessionStore.(*InMemorySessionStore); ok {
+		log.Println("Stopping in memory session store purging")
+		store.Close()
+	}
+	if store, ok := revocationStore.(*InMemorySessionRevocationStore); ok {
+		store.Close()
+	}
+	if store, ok := loginAttemptStore.(*InMemoryLoginAttemptStore); ok {
+		store.Close()
+	}
+
+	// If redis stores, close redis pool - same pool shared by both stores, the session store may be a cookie store
+	if store, ok := userStore.(*RedisUserStore); ok {
 		log.Println("Closing redis pool")
 		store.pool.Close()
 	}
 }
 
+/*
+Handler chains for each path prefix, CORS comes before the session and authorisation handlers so preflights, which never
+carry credentials, are answered rather than getting a 401, see CorsHandler
+*/
+func registerHandlers(mux *http.ServeMux, router *router, sessionStore SessionStore, userStore UserStore, newSessionHandler func(SessionStore, ContextualHandler) ContextualHandler, corsAllowedOrigins string) {
+	withCors := func(next ContextualHandler) ContextualHandler {
+		return NewCorsHandler(router, corsAllowedOrigins, next)
+	}
+
+	// Api requests with an API token skip the session chain, see BearerTokenHandler
+	apiSessionChain := newSessionHandler(sessionStore, NewCsrfHandler(NewAuthorisationHandler(router)))
+
+	// All session routes have CSRF checks as the session cookie is sent on cross site requests, log in included so an attacker cannot log a victim in to the attacker's account
+	mux.Handle("/", CreateInitHandlerFunc(NewLoggingHandler(newSessionHandler(sessionStore, NewCsrfHandler(router)))))                                             // Don't need to be an authenticated user
+	mux.Handle("/assets/", CreateInitHandlerFunc(NewLoggingHandler(router)))                                                                                       // Don't need a session
+	mux.Handle("/api/v1/", CreateInitHandlerFunc(NewLoggingHandler(withCors(NewBearerTokenHandler(userStore, NewAuthorisationHandler(router), apiSessionChain))))) // Must be an authenticated user
+	mux.Handle("/api/v1/login", CreateInitHandlerFunc(NewLoggingHandler(withCors(newSessionHandler(sessionStore, NewCsrfHandler(router))))))                       // Subset of api that does not need to be an authenticated user, this is a single exception, if we move log in\out out of api we can avoid this
+	mux.Handle("/api/v1/users", CreateInitHandlerFunc(NewLoggingHandler(withCors(newSessionHandler(sessionStore, NewCsrfHandler(router))))))                       // Sign up, also does not need an authenticated user
+}
+
 func main() {
 	webAppAddress := GetOrDefaultEnv("WEBAPP_ADDRESS", ":8080")
+	tlsCertFile := GetOrDefaultEnv("WEBAPP_TLS_CERT_FILE", "")
+	tlsKeyFile := GetOrDefaultEnv("WEBAPP_TLS_KEY_FILE", "")
+	httpRedirectAddress := GetOrDefaultEnv("WEBAPP_HTTP_REDIRECT_ADDRESS", "")
+
+	auditLogFile := GetOrDefaultEnv("WEBAPP_AUDIT_LOG_FILE", "")
+	adminUserIds := GetOrDefaultEnv("WEBAPP_ADMIN_USERS", "")
 
-	sessionStore, userStore := openStores()
-	defer closeStores(sessionStore, userStore)
+	sessionStore, userStore, loginAttemptStore, revocationStore := openStores()
+	blobStore := openBlobStore(userStore)
+	grantAdminRoles(userStore, adminUserIds)
+
+	auditLog, err := NewAuditLogger(auditLogFile)
+	if err != nil {
+		log.Fatalf("Error detected when trying to open audit log %s : %s\n", auditLogFile, err)
+	}
+	loginThrottle := NewLoginThrottle(loginAttemptStore, auditLog)
+	loginThrottle.UserNameFreeAttempts = getEnvInt("WEBAPP_LOGIN_FREE_ATTEMPTS", loginThrottle.UserNameFreeAttempts)
+	loginThrottle.IpFreeAttempts = getEnvInt("WEBAPP_LOGIN_IP_FREE_ATTEMPTS", loginThrottle.IpFreeAttempts)
+	loginThrottle.BaseDelay = getEnvSeconds("WEBAPP_LOGIN_BACKOFF_BASE_IN_SECONDS", 1)
+	loginThrottle.MaxDelay = getEnvSeconds("WEBAPP_LOGIN_BACKOFF_MAX_IN_SECONDS", 900)
 
 	rootHandler := &RootHandler{}
 	assetsHandler := &AssetsHandler{}
-	contactApiHandler := &ContactApiHandler{PathPrefix: "/api/v1/contacts/", Store: userStore}
-	contactsApiHandler := &ContactsApiHandler{PathPrefix: "/api/v1/contacts/", Store: userStore}
-	logInApiHandler := &LogInApiHandler{Store: userStore}
+	contactApiHandler := &ContactApiHandler{Store: userStore, Blobs: blobStore}
+	contactPhotoApiHandler := &ContactPhotoApiHandler{Store: userStore, Blobs: blobStore}
+	contactDuplicatesApiHandler := &ContactDuplicatesApiHandler{Store: userStore}
+	contactMergeApiHandler := &ContactMergeApiHandler{Store: userStore, Blobs: blobStore}
+	contactsApiHandler := &ContactsApiHandler{Store: userStore}
+	vCardApiHandler := &VCardApiHandler{Store: userStore}
+	vCardsApiHandler := &VCardsApiHandler{Store: userStore}
+	csvApiHandler := &CsvApiHandler{Store: userStore}
+	logInApiHandler := &LogInApiHandler{Store: userStore, Throttle: loginThrottle}
+	usersApiHandler := &UsersApiHandler{Store: userStore}
+	userApiHandler := &UserApiHandler{Store: userStore, Blobs: blobStore}
+	userPasswordApiHandler := &UserPasswordApiHandler{Store: userStore}
+	apiTokensApiHandler := &ApiTokensApiHandler{Store: userStore}
+	apiTokenApiHandler := &ApiTokenApiHandler{Store: userStore}
+	userRolesApiHandler := &UserRolesApiHandler{Store: userStore}
+	grantsApiHandler := &GrantsApiHandler{Store: userStore}
+	grantApiHandler := &GrantApiHandler{Store: userStore}
+	sharedGrantsApiHandler := &SharedGrantsApiHandler{Store: userStore}
+	groupsApiHandler := &GroupsApiHandler{Store: userStore}
+	groupApiHandler := &GroupApiHandler{Store: userStore}
+	groupContactApiHandler := &GroupContactApiHandler{Store: userStore}
 
 	router := NewRouter()
-	router.Add(`^/?$`, rootHandler)
-	router.Add(`^/assets/.*`, assetsHandler)
-	router.Add(`^/api/v1/contacts/[\w-]{5,36}/[\w-]{5,36}/?$`, contactApiHandler)
-	router.Add(`^/api/v1/contacts/[\w-]{5,36}/?$`, contactsApiHandler)
-	router.Add(`^/api/v1/login/?$`, logInApiHandler)
-
-	http.Handle("/", CreateInitHandlerFunc(NewLoggingHandler(NewSessionHandler(sessionStore, router))))                                 // Don't need to be an authenticated user
-	http.Handle("/assets/", CreateInitHandlerFunc(NewLoggingHandler(router)))                                                           // Don't need a session
-	http.Handle("/api/v1/", CreateInitHandlerFunc(NewLoggingHandler(NewSessionHandler(sessionStore, NewAuthorisationHandler(router))))) // Must be an authenticated user
-	http.Handle("/api/v1/login", CreateInitHandlerFunc(NewLoggingHandler(NewSessionHandler(sessionStore, router))))                     // Subset of api that does not need to be an authenticated user, this is a single exception, if we move log in\out out of api we can avoid this
-
-	log.Printf("Started, listening on %s\n", webAppAddress)
-	http.ListenAndServe(webAppAddress, nil)
+	err = router.AddRoutes(
+		Route{`/`, rootHandler},
+		Route{`/assets/*path`, assetsHandler},
+		Route{`/api/v1/contacts/{userId:[\w-]{5,36}}/{contactId:[\w-]{5,36}}`, contactApiHandler},
+		Route{`/api/v1/contacts/{userId:[\w-]{5,36}}`, contactsApiHandler},
+		Route{`/api/v1/contacts/{userId:[\w-]{5,36}}/duplicates`, contactDuplicatesApiHandler},
+		Route{`/api/v1/contacts/{userId:[\w-]{5,36}}/merge`, contactMergeApiHandler},
+		Route{`/api/v1/contacts/{userId:[\w-]{5,36}}/{contactId:[\w-]{5,36}}.vcf`, vCardApiHandler},
+		Route{`/api/v1/contacts/{userId:[\w-]{5,36}}/{contactId:[\w-]{5,36}}/photo`, contactPhotoApiHandler},
+		Route{`/api/v1/contacts/{userId:[\w-]{5,36}}.vcf`, vCardsApiHandler},
+		Route{`/api/v1/contacts/{userId:[\w-]{5,36}}.csv`, csvApiHandler},
+		Route{`/api/v1/login`, logInApiHandler},
+		Route{`/api/v1/users`, usersApiHandler},
+		Route{`/api/v1/users/{userId:[\w-]{5,36}}`, userApiHandler},
+		Route{`/api/v1/users/{userId:[\w-]{5,36}}/password`, userPasswordApiHandler},
+		Route{`/api/v1/users/{userId:[\w-]{5,36}}/tokens`, apiTokensApiHandler},
+		Route{`/api/v1/users/{userId:[\w-]{5,36}}/tokens/{tokenId:[\w-]{5,36}}`, apiTokenApiHandler},
+		Route{`/api/v1/users/{userId:[\w-]{5,36}}/roles`, userRolesApiHandler},
+		Route{`/api/v1/users/{userId:[\w-]{5,36}}/grants`, grantsApiHandler},
+		Route{`/api/v1/users/{userId:[\w-]{5,36}}/grants/{granteeId:[\w-]{5,36}}`, grantApiHandler},
+		Route{`/api/v1/users/{userId:[\w-]{5,36}}/shared`, sharedGrantsApiHandler},
+		Route{`/api/v1/users/{userId:[\w-]{5,36}}/groups`, groupsApiHandler},
+		Route{`/api/v1/users/{userId:[\w-]{5,36}}/groups/{groupId:[\w-]{5,36}}`, groupApiHandler},
+		Route{`/api/v1/users/{userId:[\w-]{5,36}}/groups/{groupId:[\w-]{5,36}}/contacts/{contactId:[\w-]{5,36}}`, groupContactApiHandler},
+	)
+	if err != nil {
+		closeStores(sessionStore, userStore, loginAttemptStore, revocationStore)
+		log.Fatalf("%s\n", err)
+	}
+	for _, line := range router.GetRouteTable() {
+		log.Printf("Route %s\n", line)
+	}
+
+	// Buffering lets session save failures become 500s, at the cost of holding each response in memory
+	newSessionHandler := NewSessionHandler
+	if bufferResponses, _ := strconv.ParseBool(GetOrDefaultEnv("WEBAPP_SESSION_BUFFER_RESPONSES", "false")); bufferResponses {
+		newSessionHandler = NewBufferedSessionHandler
+	}
+
+	corsAllowedOrigins := GetOrDefaultEnv("WEBAPP_CORS_ALLOWED_ORIGINS", "") // Comma separated, empty for same origin only
+	registerHandlers(http.DefaultServeMux, router, sessionStore, userStore, newSessionHandler, corsAllowedOrigins)
+
+	// Signals are registered before we listen so a signal during start up is not lost
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	listener, err := net.Listen("tcp", webAppAddress)
+	if err != nil {
+		closeStores(sessionStore, userStore, loginAttemptStore, revocationStore)
+		log.Fatalf("Error detected when trying to listen on %s : %s\n", webAppAddress, err)
+	}
+	servers := []ServerListener{{NewServer(webAppAddress, nil), listener}}
+
+	if tlsCertFile != "" || tlsKeyFile != "" {
+		reloader, err := NewCertificateReloader(tlsCertFile, tlsKeyFile, getEnvSeconds("WEBAPP_TLS_RELOAD_INTERVAL_IN_SECONDS", 60))
+		if err != nil {
+			closeStores(sessionStore, userStore, loginAttemptStore, revocationStore)
+			log.Fatalf("Error detected when trying to load the TLS certificate : %s\n", err)
+		}
+		defer reloader.Close()
+
+		hstsMaxAge := getEnvSeconds("WEBAPP_HSTS_MAX_AGE_IN_SECONDS", 365*24*60*60)
+		servers[0].Server.Handler = NewHstsHandler(int(hstsMaxAge.Seconds()), http.DefaultServeMux)
+		servers[0].Server.TLSConfig = NewTlsConfig(reloader)
+		servers[0].Listener = tls.NewListener(listener, servers[0].Server.TLSConfig)
+
+		if httpRedirectAddress != "" {
+			redirectListener, err := net.Listen("tcp", httpRedirectAddress)
+			if err != nil {
+				closeStores(sessionStore, userStore, loginAttemptStore, revocationStore)
+				log.Fatalf("Error detected when trying to listen on %s : %s\n", httpRedirectAddress, err)
+			}
+			servers = append(servers, ServerListener{NewServer(httpRedirectAddress, NewHttpsRedirectHandler(webAppAddress)), redirectListener})
+			log.Printf("Redirecting http on %s to https\n", httpRedirectAddress)
+		}
+	}
+
+	log.Printf("Started, listening on %s, TLS is %t\n", webAppAddress, servers[0].Server.TLSConfig != nil)
+	err = ServeUntilSignalled(GetShutdownTimeout(), signals, servers...)
+
+	// Stores are closed after the servers so in flight requests can still save sessions
+	closeStores(sessionStore, userStore, loginAttemptStore, revocationStore)
+	if err != nil {
+		log.Fatalf("Server stopped with error : %s\n", err)
+	}
+	log.Println("Stopped")
 }
@@ -19,6 +19,7 @@ const mainJS = `
 var app = function() {
   var state = {
     userName: {{.Session.UserName}},
+    csrfToken: document.querySelector('meta[name="csrf-token"]').getAttribute("content"), // Refreshed from every api response
     contacts: [],
     urls: {
       contactsPrefix: "/api/v1/contacts/",
@@ -57,6 +58,20 @@ var app = function() {
 
   var makeLogInAttempt = function() {
     document.getElementById("logIn").disabled = true;
+
+    if (!state.csrfToken) {
+      // Anonymous sessions only get a CSRF token when asked for one, makeApiCall keeps the token from the response
+      makeApiCall(
+        state.urls.logIn,
+        "GET",
+        null,
+        function(response) { makeLogInAttempt(); },
+        function(status) {
+          document.getElementById("logInMessage").innerHTML = "Log in is not available, try again";
+          document.getElementById("logIn").disabled = false;
+        });
+      return;
+    }
  
     makeApiCall(
       state.urls.logIn,
@@ -210,7 +225,8 @@ var app = function() {
     var xhr = new XMLHttpRequest();
     xhr.onreadystatechange = function() {
       if (xhr.readyState == 4) {
-        if(xhr.status == 200 || xhr.status == 201) {
+        state.csrfToken = xhr.getResponseHeader('X-CSRF-Token') || state.csrfToken;
+        if(xhr.status == 200 || xhr.status == 201 || xhr.status == 204) {
           completionFunc(xhr.response, xhr.getResponseHeader('Location'));
         } else {
           errorFunc(xhr.status);
@@ -223,6 +239,7 @@ var app = function() {
 
     xhr.open(method, url, true);
     xhr.setRequestHeader('Content-Type', 'application/json');
+    xhr.setRequestHeader('X-CSRF-Token', state.csrfToken);
     xhr.send(dataAsJson);
   };
 
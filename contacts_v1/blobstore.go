@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+/*
+Blob store - binary values such as contact photos, keys are slash separated paths, i.e. photos/<userId>/<contactId>.photo
+*/
+type BlobStore interface {
+	Get(key string) (*Blob, error)    // ErrBlobNotFound if there is no blob
+	Put(key string, blob *Blob) error // Replaces any existing blob, sets the blob's ModifiedAt
+	Delete(key string) error          // Not an error if the blob does not exist
+}
+
+type Blob struct {
+	ContentType string
+	Data        []byte
+	ModifiedAt  time.Time
+}
+
+var (
+	ErrBlobNotFound   = errors.New("Blob not found")
+	ErrInvalidBlobKey = errors.New("Invalid blob key")
+)
+
+var blobKeySegmentPattern = regexp.MustCompile(`^[\w.-]+$`)
+
+// Keys become file paths so must not be able to escape the store's directory
+func isValidBlobKey(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." || !blobKeySegmentPattern.MatchString(segment) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+File system blob store - a file per blob, the first line is the content type and the rest the data
+Files are written to a temporary file and renamed so readers never see a partial blob
+*/
+type FileBlobStore struct {
+	directory string
+}
+
+func (store *FileBlobStore) Get(key string) (*Blob, error) {
+	if !isValidBlobKey(key) {
+		return nil, ErrInvalidBlobKey
+	}
+
+	file, err := os.Open(store.getPath(key))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	index := bytes.IndexByte(content, '\n')
+	if index == -1 {
+		return nil, errors.New("Blob file has no content type line : " + key)
+	}
+
+	return &Blob{
+		ContentType: string(content[:index]),
+		Data:        content[index+1:],
+		ModifiedAt:  info.ModTime().UTC(),
+	}, nil
+}
+
+func (store *FileBlobStore) Put(key string, blob *Blob) error {
+	if !isValidBlobKey(key) {
+		return ErrInvalidBlobKey
+	}
+	if strings.ContainsAny(blob.ContentType, "\r\n") {
+		return errors.New("Blob content type cannot contain a new line")
+	}
+
+	path := store.getPath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), ".blob-")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append([]byte(blob.ContentType+"\n"), blob.Data...))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	blob.ModifiedAt = info.ModTime().UTC()
+	return nil
+}
+
+func (store *FileBlobStore) Delete(key string) error {
+	if !isValidBlobKey(key) {
+		return ErrInvalidBlobKey
+	}
+
+	err := os.Remove(store.getPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (store *FileBlobStore) getPath(key string) string {
+	return filepath.Join(store.directory, filepath.FromSlash(key))
+}
+
+func NewFileBlobStore(directory string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileBlobStore{directory: directory}, nil
+}
+
+/*
+Redis blob store - a hash per blob, blob:<key> with ContentType, Data and ModifiedAt (unix nanoseconds) fields
+*/
+type RedisBlobStore struct {
+	pool *redis.Pool
+}
+
+func (store *RedisBlobStore) Get(key string) (*Blob, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.Values(conn.Do("HGETALL", getRedisBlobKey(key)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, ErrBlobNotFound
+	}
+
+	var data struct {
+		ContentType string
+		Data        []byte
+		ModifiedAt  int64
+	}
+	if err = redis.ScanStruct(values, &data); err != nil {
+		return nil, err
+	}
+
+	return &Blob{
+		ContentType: data.ContentType,
+		Data:        data.Data,
+		ModifiedAt:  time.Unix(0, data.ModifiedAt).UTC(),
+	}, nil
+}
+
+func (store *RedisBlobStore) Put(key string, blob *Blob) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	modifiedAt := time.Now().UTC()
+	if _, err := conn.Do("HMSET", getRedisBlobKey(key), "ContentType", blob.ContentType, "Data", blob.Data, "ModifiedAt", modifiedAt.UnixNano()); err != nil {
+		return err
+	}
+
+	blob.ModifiedAt = modifiedAt
+	return nil
+}
+
+func (store *RedisBlobStore) Delete(key string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", getRedisBlobKey(key))
+	return err
+}
+
+func getRedisBlobKey(key string) string {
+	return "blob:" + key
+}
+
+func NewRedisBlobStore(pool *redis.Pool) *RedisBlobStore {
+	return &RedisBlobStore{pool: pool}
+}
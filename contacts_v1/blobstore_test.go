@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestIsValidBlobKey(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Key string
+		// Expected result
+		IsValid bool
+	}{
+		{"photos/pmcgrath/ted.photo", true},
+		{"photos/pmcgrath/ted-1_a.thumbnail", true},
+		{"single", true},
+		{"", false},
+		{"photos//ted.photo", false},
+		{"/photos/ted.photo", false},
+		{"photos/../ted.photo", false},
+		{"photos/./ted.photo", false},
+		{"..", false},
+		{"photos/ted photo", false},
+		{`photos\ted.photo`, false},
+	}
+
+	for _, testCase := range testCases {
+		result := isValidBlobKey(testCase.Key)
+		spec.Assert(result == testCase.IsValid, "Unexpected result for [%s] %t", testCase.Key, result)
+	}
+}
+
+func TestFileBlobStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "blobstore-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed : %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := NewFileBlobStore(directory)
+	if err != nil {
+		t.Fatalf("NewFileBlobStore failed : %s", err)
+	}
+
+	RunBlobStoreTest(t, store)
+}
+
+func TestFileBlobStoreRejectsInvalidKeys(t *testing.T) {
+	spec := &Spec{t}
+
+	directory, _ := ioutil.TempDir("", "blobstore-test-")
+	defer os.RemoveAll(directory)
+	store, _ := NewFileBlobStore(directory)
+
+	_, err := store.Get("../outside")
+	spec.Assert(err == ErrInvalidBlobKey, "Unexpected Get error %v", err)
+
+	err = store.Put("../outside", &Blob{ContentType: "text/plain", Data: []byte("a")})
+	spec.Assert(err == ErrInvalidBlobKey, "Unexpected Put error %v", err)
+
+	err = store.Delete("../outside")
+	spec.Assert(err == ErrInvalidBlobKey, "Unexpected Delete error %v", err)
+
+	err = store.Put("inside", &Blob{ContentType: "text/plain\nX: y", Data: []byte("a")})
+	spec.Assert(err != nil, "Expected an error for a content type with a new line")
+}
+
+func TestRedisBlobStore(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	RunBlobStoreTest(t, NewRedisBlobStore(pool))
+}
+
+func RunBlobStoreTest(t *testing.T, store BlobStore) {
+	spec := &Spec{t}
+	key := "photos/blobstoretest/" + Uuid() + ".photo"
+
+	_, err := store.Get(key)
+	spec.Assert(err == ErrBlobNotFound, "Unexpected error for missing blob %v", err)
+
+	err = store.Delete(key)
+	spec.Assert(err == nil, "Deleting a missing blob failed : %s", err)
+
+	data := []byte{0, 1, 2, '\n', 255}
+	blob := &Blob{ContentType: "image/png", Data: data}
+	err = store.Put(key, blob)
+	spec.Assert(err == nil, "Put failed : %s", err)
+	spec.Assert(!blob.ModifiedAt.IsZero(), "Put did not set ModifiedAt")
+
+	stored, err := store.Get(key)
+	spec.Assert(err == nil, "Get failed : %s", err)
+	spec.Assert(stored.ContentType == "image/png", "Unexpected content type %s", stored.ContentType)
+	spec.Assert(bytes.Equal(stored.Data, data), "Unexpected data %v", stored.Data)
+	spec.Assert(stored.ModifiedAt.Equal(blob.ModifiedAt), "Unexpected modified at %s, expected %s", stored.ModifiedAt, blob.ModifiedAt)
+
+	err = store.Put(key, &Blob{ContentType: "image/jpeg", Data: []byte("replaced")})
+	spec.Assert(err == nil, "Replacing Put failed : %s", err)
+
+	stored, _ = store.Get(key)
+	spec.Assert(stored.ContentType == "image/jpeg", "Unexpected replaced content type %s", stored.ContentType)
+	spec.Assert(string(stored.Data) == "replaced", "Unexpected replaced data %s", stored.Data)
+
+	err = store.Delete(key)
+	spec.Assert(err == nil, "Delete failed : %s", err)
+
+	_, err = store.Get(key)
+	spec.Assert(err == ErrBlobNotFound, "Unexpected error after delete %v", err)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Contact query - search, filter, sort and offset\limit pagination for a user's contacts
+
+	q=ted toe			Full text, all terms must match somewhere in names, organisation, title, emails, phones, twitter or notes
+	firstName=ted&email=gmail	Field filters, case insensitive contains
+	tag=customers&tag=on-call	Tags, case insensitive, contacts must have all of them
+	sort=lastName,-firstName	Sort keys, - prefix for descending
+	offset=0&limit=50		Pagination, no limit means all matching contacts
+*/
+const maxContactQueryLimit = 1000
+
+var contactQueryFilterFields = []string{"firstName", "lastName", "organisation", "title", "email", "phone", "twitter", "notes"}
+
+var contactSortFields = map[string]func(*Contact) string{
+	"id":           func(c *Contact) string { return c.Id },
+	"firstName":    func(c *Contact) string { return c.FirstName },
+	"lastName":     func(c *Contact) string { return c.LastName },
+	"organisation": func(c *Contact) string { return c.Organisation },
+	"twitter":      func(c *Contact) string { return c.Twitter },
+}
+
+type contactSortKey struct {
+	field      string
+	descending bool
+}
+
+type ContactQuery struct {
+	Terms   []string
+	Filters map[string]string
+	Tags    []string
+	Sort    []contactSortKey
+	Offset  int
+	Limit   int // 0 means no limit
+}
+
+func ParseContactQuery(values url.Values) (*ContactQuery, error) {
+	query := &ContactQuery{
+		Terms:   strings.Fields(strings.ToLower(values.Get("q"))),
+		Filters: make(map[string]string),
+	}
+
+	for _, field := range contactQueryFilterFields {
+		if value := strings.TrimSpace(values.Get(field)); value != "" {
+			query.Filters[field] = strings.ToLower(value)
+		}
+	}
+
+	for _, tag := range values["tag"] {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			query.Tags = append(query.Tags, tag)
+		}
+	}
+
+	if sortValue := values.Get("sort"); sortValue != "" {
+		for _, field := range strings.Split(sortValue, ",") {
+			key := contactSortKey{field: strings.TrimSpace(field)}
+			if strings.HasPrefix(key.field, "-") {
+				key.field, key.descending = key.field[1:], true
+			}
+			if _, ok := contactSortFields[key.field]; !ok {
+				return nil, fmt.Errorf("Unknown sort field [%s]", key.field)
+			}
+			query.Sort = append(query.Sort, key)
+		}
+	}
+
+	var err error
+	if query.Offset, err = parseContactQueryInt(values, "offset", 0); err != nil {
+		return nil, err
+	}
+	if query.Limit, err = parseContactQueryInt(values, "limit", maxContactQueryLimit); err != nil {
+		return nil, err
+	}
+
+	return query, nil
+}
+
+func parseContactQueryInt(values url.Values, name string, max int) (int, error) {
+	value := values.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	result, err := strconv.Atoi(value)
+	if err != nil || result < 0 || (max > 0 && result > max) {
+		return 0, fmt.Errorf("Invalid %s [%s]", name, value)
+	}
+
+	return result, nil
+}
+
+// Returns the requested page of matching contacts and the total number of matching contacts
+func (query *ContactQuery) Apply(contacts []Contact) ([]Contact, int) {
+	matches := make([]Contact, 0)
+	for index := range contacts {
+		if query.IsMatch(&contacts[index]) {
+			matches = append(matches, contacts[index])
+		}
+	}
+
+	if len(query.Sort) > 0 {
+		sort.SliceStable(matches, func(i, j int) bool {
+			for _, key := range query.Sort {
+				getValue := contactSortFields[key.field]
+				a, b := strings.ToLower(getValue(&matches[i])), strings.ToLower(getValue(&matches[j]))
+				if a == b {
+					continue
+				}
+				if key.descending {
+					return a > b
+				}
+				return a < b
+			}
+			return false
+		})
+	}
+
+	total := len(matches)
+	if query.Offset >= total {
+		return make([]Contact, 0), total
+	}
+
+	end := total
+	if query.Limit > 0 && query.Offset+query.Limit < total {
+		end = query.Offset + query.Limit
+	}
+
+	return matches[query.Offset:end], total
+}
+
+func (query *ContactQuery) IsMatch(contact *Contact) bool {
+	for field, value := range query.Filters {
+		if !containsAny(getContactFieldValues(contact, field), value) {
+			return false
+		}
+	}
+
+	for _, tag := range query.Tags {
+		if !contact.HasTag(tag) {
+			return false
+		}
+	}
+
+	if len(query.Terms) > 0 {
+		var values []string
+		for _, field := range contactQueryFilterFields {
+			values = append(values, getContactFieldValues(contact, field)...)
+		}
+		for _, term := range query.Terms {
+			if !containsAny(values, term) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Link header value with next and prev relations, empty if there is no other page
+func (query *ContactQuery) GetLinkHeader(requestUrl *url.URL, total int) string {
+	if query.Limit == 0 {
+		return ""
+	}
+
+	links := make([]string, 0, 2)
+	if query.Offset+query.Limit < total {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, getPageUrl(requestUrl, query.Offset+query.Limit, query.Limit)))
+	}
+	if query.Offset > 0 {
+		prevOffset := query.Offset - query.Limit
+		if prevOffset < 0 {
+			prevOffset = 0
+		}
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, getPageUrl(requestUrl, prevOffset, query.Limit)))
+	}
+
+	return strings.Join(links, ", ")
+}
+
+func getPageUrl(requestUrl *url.URL, offset, limit int) string {
+	values := requestUrl.Query()
+	values.Set("offset", strconv.Itoa(offset))
+	values.Set("limit", strconv.Itoa(limit))
+
+	pageUrl := url.URL{Path: requestUrl.Path, RawQuery: values.Encode()}
+	return pageUrl.String()
+}
+
+func getContactFieldValues(contact *Contact, field string) []string {
+	switch field {
+	case "firstName":
+		return []string{contact.FirstName}
+	case "lastName":
+		return []string{contact.LastName}
+	case "organisation":
+		return []string{contact.Organisation}
+	case "title":
+		return []string{contact.Title}
+	case "email":
+		values := make([]string, 0, len(contact.Emails))
+		for _, email := range contact.Emails {
+			values = append(values, email.Address)
+		}
+		return values
+	case "phone":
+		values := make([]string, 0, len(contact.Phones))
+		for _, phone := range contact.Phones {
+			values = append(values, phone.Number)
+		}
+		return values
+	case "twitter":
+		return []string{contact.Twitter}
+	case "notes":
+		return []string{contact.Notes}
+	}
+
+	return nil
+}
+
+// Case insensitive contains, value must already be lower case
+func containsAny(values []string, value string) bool {
+	for _, candidate := range values {
+		if strings.Contains(strings.ToLower(candidate), value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func getQueryTestContacts() []Contact {
+	return []Contact{
+		Contact{Id: "c1", FirstName: "Ted", LastName: "Toe", Emails: []Email{Email{Address: "ted@gmail.com"}}, Twitter: "@tedtoe", Tags: []string{"Customers", "on-call"}},
+		Contact{Id: "c2", FirstName: "Tom", LastName: "Toe", Phones: []Phone{Phone{Number: "353 066 7132310"}}, Tags: []string{"customers"}},
+		Contact{Id: "c3", FirstName: "Anne", LastName: "Bee", Organisation: "Acme", Title: "Engineer", Notes: "Met at the Gmail conference"},
+		Contact{Id: "c4", FirstName: "Bob", LastName: "Ant", Emails: []Email{Email{Address: "bob@example.com"}}},
+	}
+}
+
+func getContactIds(contacts []Contact) string {
+	ids := make([]string, 0, len(contacts))
+	for _, contact := range contacts {
+		ids = append(ids, contact.Id)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestContactQueryApply(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		rawQuery      string // Input
+		expectedIds   string // Expected result
+		expectedTotal int    // Expected total
+	}{
+		{"", "c1,c2,c3,c4", 4},
+		{"q=gmail", "c1,c3", 2},
+		{"q=toe+ted", "c1", 1},
+		{"q=7132310", "c2", 1},
+		{"lastName=TOE", "c1,c2", 2},
+		{"lastName=toe&firstName=tom", "c2", 1},
+		{"email=example", "c4", 1},
+		{"twitter=tedtoe", "c1", 1},
+		{"organisation=acme", "c3", 1},
+		{"q=engineer", "c3", 1},
+		{"sort=-organisation,id", "c3,c1,c2,c4", 4},
+		{"tag=customers", "c1,c2", 2},
+		{"tag=CUSTOMERS&tag=on-call", "c1", 1},
+		{"tag=on", "", 0},
+		{"tag=+", "c1,c2,c3,c4", 4},
+		{"sort=lastName", "c4,c3,c1,c2", 4},
+		{"sort=lastName,-firstName", "c4,c3,c2,c1", 4},
+		{"sort=-id&limit=2", "c4,c3", 4},
+		{"sort=id&offset=1&limit=2", "c2,c3", 4},
+		{"offset=10", "", 4},
+		{"q=nomatch", "", 0},
+	}
+
+	for _, testCase := range testCases {
+		values, _ := url.ParseQuery(testCase.rawQuery)
+		query, err := ParseContactQuery(values)
+		spec.Assert(err == nil, "Unexpected error %s for input [%s]", err, testCase.rawQuery)
+
+		actual, total := query.Apply(getQueryTestContacts())
+		actualIds := getContactIds(actual)
+		spec.Assert(actualIds == testCase.expectedIds, "Unexpected result %s for input [%s]", actualIds, testCase.rawQuery)
+		spec.Assert(total == testCase.expectedTotal, "Unexpected total %d for input [%s]", total, testCase.rawQuery)
+	}
+}
+
+func TestParseContactQueryInvalid(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []string{"sort=unknown", "sort=-", "offset=-1", "offset=a", "limit=0x10", "limit=100000"}
+
+	for _, testCase := range testCases {
+		values, _ := url.ParseQuery(testCase)
+		_, err := ParseContactQuery(values)
+		spec.Assert(err != nil, "Expected error for input [%s]", testCase)
+	}
+}
+
+func TestContactQueryGetLinkHeader(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		rawUrl   string // Input
+		total    int    // Input
+		expected string // Expected result
+	}{
+		{"/api/v1/contacts/pmcgrath", 100, ""},
+		{"/api/v1/contacts/pmcgrath?limit=10", 100, `</api/v1/contacts/pmcgrath?limit=10&offset=10>; rel="next"`},
+		{"/api/v1/contacts/pmcgrath?limit=10&offset=5&q=ted", 20, `</api/v1/contacts/pmcgrath?limit=10&offset=15&q=ted>; rel="next", </api/v1/contacts/pmcgrath?limit=10&offset=0&q=ted>; rel="prev"`},
+		{"/api/v1/contacts/pmcgrath?limit=10&offset=10", 20, `</api/v1/contacts/pmcgrath?limit=10&offset=0>; rel="prev"`},
+	}
+
+	for _, testCase := range testCases {
+		requestUrl, _ := url.Parse(testCase.rawUrl)
+		query, _ := ParseContactQuery(requestUrl.Query())
+
+		actual := query.GetLinkHeader(requestUrl, testCase.total)
+		spec.Assert(actual == testCase.expected, "Unexpected result %s for input [%s]", actual, testCase.rawUrl)
+	}
+}
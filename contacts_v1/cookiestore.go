@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+Implemented by session stores that keep the whole session in the cookie, the SessionHandler then writes the encoded
+session as the cookie value rather than the session id, and Get is passed that cookie value
+*/
+type SessionCookieEncoder interface {
+	EncodeSession(s *Session) (string, error)
+}
+
+/*
+Cookie session store errors
+*/
+var (
+	ErrInvalidSessionCookie  = errors.New("Invalid session cookie")
+	ErrExpiredSessionCookie  = errors.New("Expired session cookie")
+	ErrRevokedSessionCookie  = errors.New("Revoked session cookie")
+	ErrSessionCookieTooLarge = errors.New("Session cookie too large")
+)
+
+const (
+	cookieSessionKeySize        = 32   // HMAC-SHA256 and AES-256 keys
+	cookieSessionMaxCookieBytes = 4000 // Browsers only have to store 4096 bytes per cookie including the name and attributes
+)
+
+type CookieSessionKey struct {
+	Id     string // Written as the kid header so the key can be found when reading
+	Secret []byte
+}
+
+/*
+Parses a comma separated list of kid:base64-secret pairs, secrets must be 32 bytes
+The first key is used for new cookies, the rest are only used to read existing cookies which allows the keys to be rotated
+*/
+func ParseCookieSessionKeys(value string) ([]CookieSessionKey, error) {
+	keys := make([]CookieSessionKey, 0)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Session key [%s] is not in kid:secret format", pair)
+		}
+		secret, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Session key %s secret is not base64 encoded : %s", parts[0], err)
+		}
+		if len(secret) != cookieSessionKeySize {
+			return nil, fmt.Errorf("Session key %s secret must be %d bytes, got %d", parts[0], cookieSessionKeySize, len(secret))
+		}
+		for _, key := range keys {
+			if key.Id == parts[0] {
+				return nil, fmt.Errorf("Duplicate session key id %s", parts[0])
+			}
+		}
+
+		keys = append(keys, CookieSessionKey{Id: parts[0], Secret: secret})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("No session keys")
+	}
+
+	return keys, nil
+}
+
+/*
+Session ids deleted before their cookies expire, cookie sessions are only checked against this list so it only needs
+to keep each id for the session age
+*/
+type SessionRevocationStore interface {
+	Revoke(id string, age uint) error
+	IsRevoked(id string) (bool, error)
+}
+
+/*
+Cookie session store - stateless, the session is a JWT held in the cookie so replicas do not need a shared store
+Signed cookies are JWS (HS256), encrypted cookies are JWE (dir, A256GCM) so the session data cannot be read by the client
+Delete revokes the session id so a rotated or logged out session's old cookie is rejected even if the client kept a
+copy, with no revocation store Delete is a no-op and old cookies stay valid until they expire
+*/
+type CookieSessionStore struct {
+	keys        []CookieSessionKey
+	encrypt     bool
+	age         uint
+	revocations SessionRevocationStore // Can be nil
+}
+
+type cookieSessionHeader struct {
+	Algorithm  string `json:"alg"`
+	Encryption string `json:"enc,omitempty"`
+	KeyId      string `json:"kid"`
+	Type       string `json:"typ,omitempty"`
+}
+
+type cookieSessionClaims struct {
+	SessionId string `json:"sid"`
+	UserName  string `json:"sub,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Data      string `json:"dat,omitempty"` // Gob encoded as the values are interface{}, json would turn ints into float64s
+}
+
+func (store *CookieSessionStore) Get(value string) (*Session, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) == 0 {
+		return nil, ErrInvalidSessionCookie
+	}
+
+	header := &cookieSessionHeader{}
+	if err := decodeCookieSessionPart(parts[0], header); err != nil {
+		return nil, ErrInvalidSessionCookie
+	}
+	key, ok := store.getKey(header.KeyId)
+	if !ok {
+		return nil, ErrInvalidSessionCookie
+	}
+
+	var payload []byte
+	var err error
+	if store.encrypt {
+		payload, err = store.decrypt(parts, header, key)
+	} else {
+		payload, err = store.verify(parts, header, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &cookieSessionClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil || claims.SessionId == "" {
+		return nil, ErrInvalidSessionCookie
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredSessionCookie
+	}
+	if store.revocations != nil {
+		revoked, err := store.revocations.IsRevoked(claims.SessionId)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrRevokedSessionCookie
+		}
+	}
+
+	session := &Session{
+		Id:         claims.SessionId,
+		UserName:   claims.UserName,
+		Data:       make(map[string]interface{}),
+		LastAccess: time.Unix(claims.IssuedAt, 0),
+	}
+	if claims.Data != "" {
+		data, err := base64.RawURLEncoding.DecodeString(claims.Data)
+		if err != nil {
+			return nil, ErrInvalidSessionCookie
+		}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Data); err != nil {
+			return nil, ErrInvalidSessionCookie
+		}
+	}
+
+	return session, nil
+}
+
+// Nothing to store, the SessionHandler writes the cookie using EncodeSession
+func (store *CookieSessionStore) Save(s *Session) error {
+	s.LastAccess = time.Now()
+
+	return nil
+}
+
+// Cookies are issued for the session age at most, so the id only needs to stay revoked that long
+func (store *CookieSessionStore) Delete(id string) error {
+	if store.revocations == nil {
+		return nil
+	}
+
+	return store.revocations.Revoke(id, store.age)
+}
+
+func (store *CookieSessionStore) GetAge() uint {
+	return store.age
+}
+
+func (store *CookieSessionStore) EncodeSession(s *Session) (string, error) {
+	claims := &cookieSessionClaims{
+		SessionId: s.Id,
+		UserName:  s.UserName,
+		IssuedAt:  s.LastAccess.Unix(),
+		ExpiresAt: s.LastAccess.Add(time.Duration(store.age) * time.Second).Unix(),
+	}
+	if len(s.Data) > 0 {
+		data := new(bytes.Buffer)
+		if err := gob.NewEncoder(data).Encode(s.Data); err != nil {
+			return "", err
+		}
+		claims.Data = base64.RawURLEncoding.EncodeToString(data.Bytes())
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	key := store.keys[0]
+	var value string
+	if store.encrypt {
+		value, err = store.seal(payload, key)
+	} else {
+		value, err = store.sign(payload, key)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(value) > cookieSessionMaxCookieBytes {
+		return "", ErrSessionCookieTooLarge
+	}
+
+	return value, nil
+}
+
+func (store *CookieSessionStore) getKey(id string) (CookieSessionKey, bool) {
+	for _, key := range store.keys {
+		if key.Id == id {
+			return key, true
+		}
+	}
+
+	return CookieSessionKey{}, false
+}
+
+// JWS compact serialisation - header.payload.signature
+func (store *CookieSessionStore) sign(payload []byte, key CookieSessionKey) (string, error) {
+	header, err := encodeCookieSessionPart(&cookieSessionHeader{Algorithm: "HS256", KeyId: key.Id, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signCookieSession(signingInput, key)), nil
+}
+
+func (store *CookieSessionStore) verify(parts []string, header *cookieSessionHeader, key CookieSessionKey) ([]byte, error) {
+	if len(parts) != 3 || header.Algorithm != "HS256" {
+		return nil, ErrInvalidSessionCookie
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, signCookieSession(parts[0]+"."+parts[1], key)) {
+		return nil, ErrInvalidSessionCookie
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidSessionCookie
+	}
+
+	return payload, nil
+}
+
+// JWE compact serialisation - header.encryptedkey.iv.ciphertext.tag, the encrypted key is empty for direct encryption
+func (store *CookieSessionStore) seal(payload []byte, key CookieSessionKey) (string, error) {
+	header, err := encodeCookieSessionPart(&cookieSessionHeader{Algorithm: "dir", Encryption: "A256GCM", KeyId: key.Id, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newCookieSessionCipher(key)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	// The header is the additional authenticated data, the tag is appended to the ciphertext by Seal
+	sealed := aead.Seal(nil, iv, payload, []byte(header))
+	ciphertext, tag := sealed[:len(payload)], sealed[len(payload):]
+
+	return strings.Join([]string{
+		header,
+		"",
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+func (store *CookieSessionStore) decrypt(parts []string, header *cookieSessionHeader, key CookieSessionKey) ([]byte, error) {
+	if len(parts) != 5 || header.Algorithm != "dir" || header.Encryption != "A256GCM" || parts[1] != "" {
+		return nil, ErrInvalidSessionCookie
+	}
+
+	aead, err := newCookieSessionCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(iv) != aead.NonceSize() {
+		return nil, ErrInvalidSessionCookie
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, ErrInvalidSessionCookie
+	}
+	tag, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, ErrInvalidSessionCookie
+	}
+
+	payload, err := aead.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return nil, ErrInvalidSessionCookie
+	}
+
+	return payload, nil
+}
+
+func NewCookieSessionStore(keys []CookieSessionKey, encrypt bool, age uint, revocations SessionRevocationStore) (*CookieSessionStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("No session keys")
+	}
+	for _, key := range keys {
+		if len(key.Secret) != cookieSessionKeySize {
+			return nil, fmt.Errorf("Session key %s secret must be %d bytes, got %d", key.Id, cookieSessionKeySize, len(key.Secret))
+		}
+	}
+
+	return &CookieSessionStore{
+		keys:        keys,
+		encrypt:     encrypt,
+		age:         age,
+		revocations: revocations,
+	}, nil
+}
+
+func signCookieSession(signingInput string, key CookieSessionKey) []byte {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(signingInput))
+
+	return mac.Sum(nil)
+}
+
+func newCookieSessionCipher(key CookieSessionKey) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func encodeCookieSessionPart(value interface{}) (string, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(encoded), nil
+}
+
+func decodeCookieSessionPart(part string, value interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(decoded, value)
+}
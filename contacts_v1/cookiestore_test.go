@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCookieSessionKey(id string, fill byte) CookieSessionKey {
+	return CookieSessionKey{Id: id, Secret: bytes.Repeat([]byte{fill}, cookieSessionKeySize)}
+}
+
+func newTestCookieSessionStore(t *testing.T, encrypt bool, keys ...CookieSessionKey) *CookieSessionStore {
+	store, err := NewCookieSessionStore(keys, encrypt, 60, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error : %s", err)
+	}
+
+	return store
+}
+
+func TestRoundTripCookieSessionStore(t *testing.T) {
+	spec := &Spec{t}
+
+	for _, encrypt := range []bool{false, true} {
+		store := newTestCookieSessionStore(t, encrypt, newTestCookieSessionKey("k1", 1))
+		original := &Session{
+			Id:       "s100",
+			UserName: "Ted",
+			Data:     map[string]interface{}{"A1": 1, "A2": "...."},
+		}
+
+		err := store.Save(original)
+		spec.Assert(err == nil, "Unexpected error : %s", err)
+		value, err := store.EncodeSession(original)
+		spec.Assert(err == nil, "Unexpected error : %s", err)
+
+		retrieved, err := store.Get(value)
+		spec.Assert(err == nil, "Unexpected error for encrypt %t : %s", encrypt, err)
+
+		original.LastAccess = time.Unix(original.LastAccess.Unix(), 0) // Only has second precision
+		spec.Assert(reflect.DeepEqual(original, retrieved), "Expected [%v] but got [%v] for encrypt %t", original, retrieved, encrypt)
+	}
+}
+
+func TestCookieSessionStoreRecordNotFound(t *testing.T) {
+	RunSessionStoreRecordNotFoundTest(t, newTestCookieSessionStore(t, false, newTestCookieSessionKey("k1", 1)))
+}
+
+func TestCookieSessionStoreEncryptedCookieHidesSession(t *testing.T) {
+	spec := &Spec{t}
+
+	store := newTestCookieSessionStore(t, true, newTestCookieSessionKey("k1", 1))
+	session := &Session{Id: "s100", UserName: "ted"}
+	store.Save(session)
+
+	value, _ := store.EncodeSession(session)
+	parts := strings.Split(value, ".")
+	spec.Assert(len(parts) == 5, "Expected a JWE with 5 parts but got %d", len(parts))
+
+	ciphertext, _ := base64.RawURLEncoding.DecodeString(parts[3])
+	spec.Assert(!bytes.Contains(ciphertext, []byte("ted")), "Ciphertext contains the user name")
+}
+
+func TestCookieSessionStoreKeyRotation(t *testing.T) {
+	spec := &Spec{t}
+
+	oldKey, newKey := newTestCookieSessionKey("old", 1), newTestCookieSessionKey("new", 2)
+	for _, encrypt := range []bool{false, true} {
+		oldStore := newTestCookieSessionStore(t, encrypt, oldKey)
+		rotatedStore := newTestCookieSessionStore(t, encrypt, newKey, oldKey)
+		retiredStore := newTestCookieSessionStore(t, encrypt, newKey)
+
+		session := &Session{Id: "s100", UserName: "ted"}
+		oldStore.Save(session)
+		value, _ := oldStore.EncodeSession(session)
+
+		retrieved, err := rotatedStore.Get(value)
+		spec.Assert(err == nil, "Unexpected error reading an old key cookie for encrypt %t : %s", encrypt, err)
+		spec.Assert(retrieved != nil && retrieved.UserName == "ted", "Unexpected session %v", retrieved)
+
+		// New cookies use the first key so the old key can be retired
+		value, _ = rotatedStore.EncodeSession(retrieved)
+		_, err = retiredStore.Get(value)
+		spec.Assert(err == nil, "Unexpected error reading a new key cookie for encrypt %t : %s", encrypt, err)
+
+		_, err = retiredStore.Get(mustEncodeSession(t, oldStore, session))
+		spec.Assert(err == ErrInvalidSessionCookie, "Expected invalid cookie for a retired key but got %v", err)
+	}
+}
+
+func mustEncodeSession(t *testing.T, store *CookieSessionStore, s *Session) string {
+	value, err := store.EncodeSession(s)
+	if err != nil {
+		t.Fatalf("Unexpected error : %s", err)
+	}
+
+	return value
+}
+
+func TestCookieSessionStoreRejectsInvalidCookies(t *testing.T) {
+	spec := &Spec{t}
+
+	key := newTestCookieSessionKey("k1", 1)
+	signedStore := newTestCookieSessionStore(t, false, key)
+	encryptedStore := newTestCookieSessionStore(t, true, key)
+	otherSecretStore := newTestCookieSessionStore(t, false, newTestCookieSessionKey("k1", 2))
+	session := &Session{Id: "s100", UserName: "ted"}
+	signedStore.Save(session)
+	signed := mustEncodeSession(t, signedStore, session)
+	encrypted := mustEncodeSession(t, encryptedStore, session)
+
+	parts := strings.Split(signed, ".")
+	forgedPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"sid":"s100","sub":"admin","iat":0,"exp":9999999999}`))
+	unsignedHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`))
+
+	testCases := []struct {
+		Store *CookieSessionStore
+		Value string
+	}{
+		{signedStore, ""},
+		{signedStore, "garbage"},
+		{signedStore, parts[0] + "." + forgedPayload + "." + parts[2]},
+		{signedStore, unsignedHeader + "." + parts[1] + "."},
+		{signedStore, encrypted},
+		{encryptedStore, signed},
+		{encryptedStore, encrypted[:len(encrypted)-2]},
+		{otherSecretStore, signed},
+	}
+
+	for index, testCase := range testCases {
+		retrieved, err := testCase.Store.Get(testCase.Value)
+
+		spec.Assert(err == ErrInvalidSessionCookie, "Expected invalid cookie for test case %d but got %v", index, err)
+		spec.Assert(retrieved == nil, "Expected nil session for test case %d", index)
+	}
+}
+
+func TestCookieSessionStoreExpiredCookie(t *testing.T) {
+	spec := &Spec{t}
+
+	store := newTestCookieSessionStore(t, false, newTestCookieSessionKey("k1", 1))
+	session := &Session{Id: "s100", UserName: "ted", LastAccess: time.Now().Add(-2 * time.Minute)} // Age is 60 seconds
+
+	retrieved, err := store.Get(mustEncodeSession(t, store, session))
+
+	spec.Assert(err == ErrExpiredSessionCookie, "Expected expired cookie but got %v", err)
+	spec.Assert(retrieved == nil, "Expected nil session")
+}
+
+func TestCookieSessionStoreCookieTooLarge(t *testing.T) {
+	spec := &Spec{t}
+
+	store := newTestCookieSessionStore(t, false, newTestCookieSessionKey("k1", 1))
+	session := &Session{Id: "s100", Data: map[string]interface{}{"Big": strings.Repeat("x", cookieSessionMaxCookieBytes)}}
+	store.Save(session)
+
+	_, err := store.EncodeSession(session)
+
+	spec.Assert(err == ErrSessionCookieTooLarge, "Expected too large error but got %v", err)
+}
+
+func TestParseCookieSessionKeys(t *testing.T) {
+	spec := &Spec{t}
+
+	secret1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, cookieSessionKeySize))
+	secret2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, cookieSessionKeySize))
+	shortSecret := base64.StdEncoding.EncodeToString([]byte("short"))
+
+	testCases := []struct {
+		// Input
+		Value string
+		// Expected result
+		KeyIds  []string
+		IsValid bool
+	}{
+		{"k1:" + secret1, []string{"k1"}, true},
+		{"k2:" + secret2 + ", k1:" + secret1, []string{"k2", "k1"}, true},
+		{"", nil, false},
+		{secret1, nil, false},
+		{":" + secret1, nil, false},
+		{"k1:not base64!", nil, false},
+		{"k1:" + shortSecret, nil, false},
+		{"k1:" + secret1 + ",k1:" + secret2, nil, false},
+	}
+
+	for index, testCase := range testCases {
+		keys, err := ParseCookieSessionKeys(testCase.Value)
+
+		spec.Assert((err == nil) == testCase.IsValid, "Unexpected error for test case %d : %v", index, err)
+		keyIds := make([]string, 0)
+		for _, key := range keys {
+			keyIds = append(keyIds, key.Id)
+		}
+		if testCase.IsValid {
+			spec.Assert(reflect.DeepEqual(keyIds, testCase.KeyIds), "Unexpected key ids %v for test case %d", keyIds, index)
+		}
+	}
+}
+
+func TestSessionHandlerWithCookieSessionStore(t *testing.T) {
+	spec := &Spec{t}
+
+	store := newTestCookieSessionStore(t, true, newTestCookieSessionKey("k1", 1))
+
+	response, requestContext := serveSessionRequest(NewSessionHandler(store, &SessionTestHandler{UserName: "ted"}), "")
+	cookies := response.Result().Cookies()
+	spec.Assert(len(cookies) == 1, "Expected a session cookie")
+	spec.Assert(cookies[0].Value != requestContext.Session.Id, "Cookie should hold the encoded session rather than the id")
+
+	// The next request gets the session back from the cookie alone
+	next := &ContextCaptureTestHandler{}
+	request, _ := http.NewRequest("GET", "/api/v1/login", nil)
+	request.AddCookie(cookies[0])
+	NewSessionHandler(store, next).ServeHTTP(httptest.NewRecorder(), request, &RequestContext{Id: "r2", Data: make(map[string]interface{})})
+
+	spec.Assert(next.Context.Session.Id == requestContext.Session.Id, "Unexpected session id %s", next.Context.Session.Id)
+	spec.Assert(next.Context.Session.UserName == "ted", "Unexpected user name %s", next.Context.Session.UserName)
+}
+
+func TestCookieSessionStoreDeleteRevokesSession(t *testing.T) {
+	spec := &Spec{t}
+
+	revocations := NewInMemorySessionRevocationStore(60)
+	defer revocations.Close()
+	store, _ := NewCookieSessionStore([]CookieSessionKey{newTestCookieSessionKey("k1", 1)}, false, 60, revocations)
+
+	session := &Session{Id: "s1", UserName: "ted", Data: make(map[string]interface{})}
+	store.Save(session)
+	value, _ := store.EncodeSession(session)
+
+	_, err := store.Get(value)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	err = store.Delete("s1")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	_, err = store.Get(value)
+	spec.Assert(err == ErrRevokedSessionCookie, "Expected revoked session cookie error but got %v", err)
+
+	// Without a revocation store old cookies are still accepted
+	store, _ = NewCookieSessionStore([]CookieSessionKey{newTestCookieSessionKey("k1", 1)}, false, 60, nil)
+	store.Delete("s1")
+	_, err = store.Get(value)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+}
+
+func TestSessionHandlerWithCookieSessionStoreRejectsRotatedCookie(t *testing.T) {
+	spec := &Spec{t}
+
+	revocations := NewInMemorySessionRevocationStore(60)
+	defer revocations.Close()
+	store, _ := NewCookieSessionStore([]CookieSessionKey{newTestCookieSessionKey("k1", 1)}, true, 60, revocations)
+
+	response, requestContext := serveSessionRequest(NewSessionHandler(store, &SessionTestHandler{UserName: "ted"}), "")
+	original := response.Result().Cookies()[0]
+
+	// Log out, or log in again, moves the session to a new id
+	response, _ = serveSessionRequest(NewSessionHandler(store, &SessionTestHandler{Rotate: true, UserName: "anne"}), original.Value)
+	spec.Assert(len(response.Result().Cookies()) == 1, "Expected a cookie for the new session id")
+
+	// Replaying the old cookie gets a new anonymous session
+	next := &ContextCaptureTestHandler{}
+	request, _ := http.NewRequest("GET", "/api/v1/login", nil)
+	request.AddCookie(original)
+	NewSessionHandler(store, next).ServeHTTP(httptest.NewRecorder(), request, &RequestContext{Id: "r3", Data: make(map[string]interface{})})
+	spec.Assert(next.Context.Session.Id != requestContext.Session.Id, "Revoked session id was accepted")
+	spec.Assert(next.Context.Session.UserName == "", "Unexpected user name %s", next.Context.Session.UserName)
+}
+
+func TestSessionHandlerWithCookieSessionStoreDropsChangesAfterResponse(t *testing.T) {
+	spec := &Spec{t}
+
+	revocations := NewInMemorySessionRevocationStore(60)
+	defer revocations.Close()
+	store, _ := NewCookieSessionStore([]CookieSessionKey{newTestCookieSessionKey("k1", 1)}, true, 60, revocations)
+
+	response, _ := serveSessionRequest(NewSessionHandler(store, &SessionTestHandler{UserName: "ted"}), "")
+	original := response.Result().Cookies()[0]
+
+	// Rotated after the body was written, the new cookie cannot be sent so the old one must stay valid
+	handler := &SessionTestHandler{WriteBody: true}
+	response, _ = serveSessionRequest(NewSessionHandler(store, &lateRotatingTestHandler{Next: handler}), original.Value)
+	spec.Assert(len(response.Result().Cookies()) == 0, "Unexpected cookie %v", response.Result().Cookies())
+
+	session, err := store.Get(original.Value)
+	spec.Assert(err == nil, "Original cookie was revoked : %v", err)
+	spec.Assert(session != nil && session.UserName == "ted", "Unexpected session %v", session)
+}
+
+type lateRotatingTestHandler struct {
+	Next ContextualHandler
+}
+
+func (h *lateRotatingTestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	h.Next.ServeHTTP(w, r, c)
+	c.RegenerateSessionId()
+}
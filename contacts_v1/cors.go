@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+CORS middleware - goes before authentication as browsers never send credentials on a preflight
+OPTIONS, preflight or not, is answered by the router, see serveOptions, so needs no session or API token
+Allowed origins get the Access-Control-* headers with credentials allowed so the session cookie is sent, their requests
+still need a CSRF token, other origins get no CORS headers so browsers do not let them read responses
+*/
+type CorsHandler struct {
+	Router         *router
+	AllowedOrigins map[string]bool
+	Next           ContextualHandler
+}
+
+const (
+	corsAllowedHeaders  = "Authorization, Content-Type, If-Match, If-None-Match, If-Modified-Since, X-CSRF-Token"
+	corsExposedHeaders  = "ETag, Last-Modified, Link, Location, Content-Location, Retry-After, X-CSRF-Token, X-Total-Count"
+	corsMaxAgeInSeconds = 600
+)
+
+func (h *CorsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	origin := r.Header.Get("Origin")
+	allowed := origin != "" && h.AllowedOrigins[origin]
+	if origin != "" {
+		w.Header().Add("Vary", "Origin")
+	}
+	if allowed {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if r.Method != "OPTIONS" {
+		if allowed {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+		h.Next.ServeHTTP(w, r, c)
+		return
+	}
+
+	if pathEntry, _ := h.Router.Get(r.URL.Path); pathEntry != nil && allowed && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", pathEntry.GetAllowHeader())
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAgeInSeconds))
+	}
+	h.Router.ServeHTTP(w, r, c)
+}
+
+// Origins are comma separated, i.e. https://app.example.com,https://admin.example.com, empty for none
+func NewCorsHandler(router *router, allowedOrigins string, next ContextualHandler) ContextualHandler {
+	origins := make(map[string]bool)
+	for _, origin := range strings.Split(allowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins[origin] = true
+		}
+	}
+
+	return &CorsHandler{Router: router, AllowedOrigins: origins, Next: next}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The handler chains main registers, with the routes preflights are sent for
+func GetCorsTestMux(t *testing.T, allowedOrigins string) *http.ServeMux {
+	userStore := GetInitialisedUserStore()
+	router := NewRouter()
+	err := router.AddRoutes(
+		Route{`/api/v1/contacts/{userId:[\w-]{5,36}}/{contactId:[\w-]{3,36}}`, &ContactApiHandler{Store: userStore}},
+		Route{`/api/v1/contacts/{userId:[\w-]{5,36}}`, &ContactsApiHandler{Store: userStore}},
+		Route{`/api/v1/login`, &LogInApiHandler{Store: userStore}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error adding routes : %s", err)
+	}
+
+	mux := http.NewServeMux()
+	registerHandlers(mux, router, NewInMemorySessionStore(60, 60), userStore, NewSessionHandler, allowedOrigins)
+	return mux
+}
+
+func TestCorsPreflightIsAnsweredWithoutAuthentication(t *testing.T) {
+	spec := &Spec{t}
+
+	mux := GetCorsTestMux(t, "https://app.example.com, https://admin.example.com")
+
+	testCases := []struct {
+		// Input
+		Path   string
+		Origin string
+		// Expected result
+		Allow        string
+		AllowOrigin  string
+		AllowMethods string
+	}{
+		{"/api/v1/contacts/pmcgrath/ted", "https://app.example.com", "GET, HEAD, PUT, PATCH, DELETE, OPTIONS", "https://app.example.com", "GET, HEAD, PUT, PATCH, DELETE, OPTIONS"},
+		{"/api/v1/contacts/pmcgrath", "https://admin.example.com", "GET, HEAD, POST, OPTIONS", "https://admin.example.com", "GET, HEAD, POST, OPTIONS"},
+		{"/api/v1/login", "https://app.example.com", "GET, HEAD, POST, DELETE, OPTIONS", "https://app.example.com", "GET, HEAD, POST, DELETE, OPTIONS"},
+		{"/api/v1/contacts/pmcgrath", "https://evil.example.com", "GET, HEAD, POST, OPTIONS", "", ""},
+	}
+
+	for _, testCase := range testCases {
+		request, _ := http.NewRequest("OPTIONS", testCase.Path, nil)
+		request.Header.Set("Origin", testCase.Origin)
+		request.Header.Set("Access-Control-Request-Method", "PUT")
+		request.Header.Set("Access-Control-Request-Headers", "content-type, if-match, x-csrf-token")
+		response := httptest.NewRecorder()
+
+		mux.ServeHTTP(response, request)
+
+		spec.Assert(response.Code == http.StatusNoContent, "Unexpected status for [%s] %d", testCase.Path, response.Code)
+		spec.Assert(response.Header().Get("Allow") == testCase.Allow, "Unexpected Allow for [%s] [%s]", testCase.Path, response.Header().Get("Allow"))
+		spec.Assert(response.Header().Get("Access-Control-Allow-Origin") == testCase.AllowOrigin, "Unexpected allow origin for [%s] [%s]", testCase.Origin, response.Header().Get("Access-Control-Allow-Origin"))
+		spec.Assert(response.Header().Get("Access-Control-Allow-Methods") == testCase.AllowMethods, "Unexpected allow methods for [%s] [%s]", testCase.Path, response.Header().Get("Access-Control-Allow-Methods"))
+		spec.Assert(response.Header().Get("Vary") == "Origin", "Expected Vary for [%s] [%s]", testCase.Origin, response.Header().Get("Vary"))
+		spec.Assert(response.Header().Get("Set-Cookie") == "", "Preflight should not start a session [%s]", response.Header().Get("Set-Cookie"))
+		if testCase.AllowOrigin != "" {
+			spec.Assert(response.Header().Get("Access-Control-Allow-Headers") == corsAllowedHeaders, "Unexpected allow headers [%s]", response.Header().Get("Access-Control-Allow-Headers"))
+			spec.Assert(response.Header().Get("Access-Control-Allow-Credentials") == "true", "Expected credentials to be allowed for [%s]", testCase.Origin)
+			spec.Assert(response.Header().Get("Access-Control-Max-Age") == "600", "Unexpected max age [%s]", response.Header().Get("Access-Control-Max-Age"))
+		}
+	}
+}
+
+func TestCorsNonPreflightRequests(t *testing.T) {
+	spec := &Spec{t}
+
+	mux := GetCorsTestMux(t, "https://app.example.com")
+
+	// Still needs authentication, CORS headers are added so the browser can read the problem
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath", nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	spec.Assert(response.Code == http.StatusUnauthorized, "Unexpected status for an unauthenticated GET %d", response.Code)
+	spec.Assert(response.Header().Get("Access-Control-Allow-Origin") == "https://app.example.com", "Unexpected allow origin [%s]", response.Header().Get("Access-Control-Allow-Origin"))
+	spec.Assert(response.Header().Get("Access-Control-Expose-Headers") == corsExposedHeaders, "Unexpected expose headers [%s]", response.Header().Get("Access-Control-Expose-Headers"))
+	spec.Assert(response.Header().Get("Access-Control-Allow-Methods") == "", "Allow methods only belongs on a preflight [%s]", response.Header().Get("Access-Control-Allow-Methods"))
+
+	// Plain OPTIONS without an origin, i.e. from curl, is also answered without authentication
+	request, _ = http.NewRequest("OPTIONS", "/api/v1/contacts/pmcgrath", nil)
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	spec.Assert(response.Code == http.StatusNoContent, "Unexpected status for OPTIONS %d", response.Code)
+	spec.Assert(response.Header().Get("Allow") == "GET, HEAD, POST, OPTIONS", "Unexpected Allow [%s]", response.Header().Get("Allow"))
+	spec.Assert(response.Header().Get("Access-Control-Allow-Origin") == "", "No CORS headers without an origin [%s]", response.Header().Get("Access-Control-Allow-Origin"))
+	spec.Assert(response.Header().Get("Vary") == "", "No Vary without an origin [%s]", response.Header().Get("Vary"))
+
+	// Unknown paths are still a 404
+	request, _ = http.NewRequest("OPTIONS", "/api/v1/nothing", nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	request.Header.Set("Access-Control-Request-Method", "GET")
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	spec.Assert(response.Code == http.StatusNotFound, "Unexpected status for an unknown path %d", response.Code)
+	spec.Assert(response.Header().Get("Access-Control-Allow-Methods") == "", "Unexpected allow methods [%s]", response.Header().Get("Access-Control-Allow-Methods"))
+}
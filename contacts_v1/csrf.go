@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+)
+
+/*
+CSRF protection - synchronizer token pattern
+A random token is kept in the session data, state changing requests must echo it in the X-CSRF-Token header
+A cross site form or fetch gets the session cookie but cannot read the token, which is only available in the root page
+and in our response headers
+Tokens are only created by GET /api/v1/login and on log in and out, so anonymous requests do not create sessions
+*/
+const (
+	csrfTokenHeader      = "X-CSRF-Token"
+	csrfTokenSessionKey  = "CsrfToken"
+	csrfTokenLengthBytes = 32
+)
+
+// Methods that must not change state so are not checked
+var csrfSafeMethods = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true, "TRACE": true}
+
+// Creates the token on first use so every session gets one
+func GetCsrfToken(s *Session) string {
+	if token, ok := s.Data[csrfTokenSessionKey].(string); ok && token != "" {
+		return token
+	}
+
+	buf := make([]byte, csrfTokenLengthBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	if s.Data == nil {
+		s.Data = make(map[string]interface{})
+	}
+	s.Data[csrfTokenSessionKey] = token
+
+	return token
+}
+
+// Empty if the session does not have a token yet
+func GetExistingCsrfToken(s *Session) string {
+	token, _ := s.Data[csrfTokenSessionKey].(string)
+	return token
+}
+
+func IsValidCsrfToken(s *Session, token string) bool {
+	expected := GetExistingCsrfToken(s)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// Creates the token if needed, handlers that replace the session must call this again so the client gets the new token
+func SetCsrfTokenHeader(w http.ResponseWriter, s *Session) {
+	w.Header().Set(csrfTokenHeader, GetCsrfToken(s))
+}
+
+/*
+CSRF middleware, must follow the session middleware
+*/
+type CsrfHandler struct {
+	Next ContextualHandler
+}
+
+func (h *CsrfHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if c.Session == nil {
+		log.Printf("%s No session for CSRF check, session middleware missing\n", c.GetLogMessagePrefix())
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	if !csrfSafeMethods[r.Method] && !IsValidCsrfToken(c.Session, r.Header.Get(csrfTokenHeader)) {
+		log.Printf("%s Missing or invalid CSRF token for %s %s\n", c.GetLogMessagePrefix(), r.Method, r.URL.Path)
+		WriteProblem(w, c, http.StatusForbidden, "Missing or invalid CSRF token")
+		return
+	}
+
+	// Sent on every response so clients always have the current token
+	if token := GetExistingCsrfToken(c.Session); token != "" {
+		w.Header().Set(csrfTokenHeader, token)
+	}
+
+	h.Next.ServeHTTP(w, r, c)
+}
+
+func NewCsrfHandler(next ContextualHandler) ContextualHandler {
+	return &CsrfHandler{Next: next}
+}
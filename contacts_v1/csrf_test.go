@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type CsrfTestNextHandler struct {
+	Called bool
+}
+
+func (h *CsrfTestNextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	h.Called = true
+}
+
+func TestGetCsrfTokenIsStablePerSession(t *testing.T) {
+	spec := &Spec{t}
+
+	session := &Session{Id: "s1"}
+	token := GetCsrfToken(session)
+	spec.Assert(len(token) == 43, "Unexpected token length %d", len(token))
+	spec.Assert(GetCsrfToken(session) == token, "Token changed on second call")
+	spec.Assert(GetCsrfToken(&Session{Id: "s2"}) != token, "Token shared across sessions")
+}
+
+func TestCsrfHandler(t *testing.T) {
+	spec := &Spec{t}
+
+	tokenSession := &Session{Id: "s1", Data: make(map[string]interface{})}
+	token := GetCsrfToken(tokenSession)
+
+	testCases := []struct {
+		// Input
+		Method  string
+		Session *Session
+		Token   string
+		// Expected result
+		StatusCode int
+		Called     bool
+	}{
+		{"GET", &Session{Id: "s2"}, "", http.StatusOK, true},
+		{"HEAD", tokenSession, "", http.StatusOK, true},
+		{"OPTIONS", tokenSession, "", http.StatusOK, true},
+		{"POST", tokenSession, token, http.StatusOK, true},
+		{"PUT", tokenSession, token, http.StatusOK, true},
+		{"PATCH", tokenSession, token, http.StatusOK, true},
+		{"DELETE", tokenSession, token, http.StatusOK, true},
+		{"POST", tokenSession, "", http.StatusForbidden, false},
+		{"DELETE", tokenSession, token + "x", http.StatusForbidden, false},
+		{"POST", &Session{Id: "s3"}, "", http.StatusForbidden, false}, // Session with no token yet
+	}
+
+	for _, testCase := range testCases {
+		next := &CsrfTestNextHandler{}
+		handler := NewCsrfHandler(next)
+
+		c := &RequestContext{Id: "r1", Session: testCase.Session, Data: make(map[string]interface{})}
+		request, _ := http.NewRequest(testCase.Method, "/api/v1/contacts/pmcgrath", nil)
+		if testCase.Token != "" {
+			request.Header.Set("X-CSRF-Token", testCase.Token)
+		}
+		response := httptest.NewRecorder()
+
+		handler.ServeHTTP(response, request, c)
+
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code %d for %s with token [%s]", response.Code, testCase.Method, testCase.Token)
+		spec.Assert(next.Called == testCase.Called, "Unexpected next handler call for %s with token [%s]", testCase.Method, testCase.Token)
+		if testCase.Called {
+			spec.Assert(response.Header().Get("X-CSRF-Token") == GetExistingCsrfToken(testCase.Session), "Expected the session token, if any, in the response header")
+		} else {
+			spec.Assert(strings.Contains(response.Body.String(), `"detail":"Missing or invalid CSRF token"`), "Unexpected body %s", response.Body.String())
+		}
+	}
+}
+
+func TestCsrfHandlerWithoutSession(t *testing.T) {
+	spec := &Spec{t}
+
+	next := &CsrfTestNextHandler{}
+	c := &RequestContext{Id: "r1", Data: make(map[string]interface{})}
+	request, _ := http.NewRequest("GET", "/", nil)
+	response := httptest.NewRecorder()
+
+	NewCsrfHandler(next).ServeHTTP(response, request, c)
+
+	spec.Assert(response.Code == http.StatusInternalServerError, "Unexpected status code %d", response.Code)
+	spec.Assert(!next.Called, "Next handler should not be called")
+}
+
+func TestRootPageIncludesCsrfToken(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		HasToken bool
+	}{
+		{true},
+		{false}, // Anonymous page hits must not create a token, and so a session
+	}
+
+	for _, testCase := range testCases {
+		c := &RequestContext{Id: "r1", Session: &Session{Id: "s1"}, Data: make(map[string]interface{})}
+		expectedToken := ""
+		if testCase.HasToken {
+			expectedToken = GetCsrfToken(c.Session)
+		}
+		request, _ := http.NewRequest("GET", "/", nil)
+		response := httptest.NewRecorder()
+
+		(&RootHandler{}).Get(response, request, c)
+
+		expected := `<meta name="csrf-token" content="` + expectedToken + `">`
+		spec.Assert(strings.Contains(response.Body.String(), expected), "Root page did not include the expected CSRF token, session has token is %t", testCase.HasToken)
+		spec.Assert(GetExistingCsrfToken(c.Session) == expectedToken, "Root page changed the session's CSRF token")
+	}
+}
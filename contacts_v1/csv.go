@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+CSV encoding and decoding for contacts
+Repeated emails and phones are flattened into numbered columns
+
+	Id, FirstName, LastName, Organisation, Title, Birthday, Email1Description, Email1Address, ..., Phone1Description, Phone1Number, ..., Twitter, Notes, Tags
+
+Tags are comma separated with commas in a tag escaped as \, as in vCard CATEGORIES
+Addresses, websites and custom fields are not mapped, use json or vCard for those
+On import a column mapping can map arbitrary CSV headers to these fields, unmapped headers are used as is if they are field names
+*/
+const maxCsvRepeatedFieldIndex = 99
+
+var ErrNoCsvRows = errors.New("No CSV rows found")
+
+var csvRepeatedFieldPattern = regexp.MustCompile(`^(Email|Phone)([1-9][0-9]?)(Address|Number|Description)$`)
+
+// Spreadsheets run cells starting with these as formulas, so they are exported with a leading ' which they display as text
+const csvFormulaPrefixes = "=+-@\t\r"
+
+var csvSimpleFields = []string{"Id", "FirstName", "LastName", "Organisation", "Title", "Birthday", "Twitter", "Notes", "Tags"}
+
+// CSV header to contact field
+type CsvColumnMapping map[string]string
+
+// Parses "CSV header:Field" values, the last colon separates the two so headers may contain colons
+func ParseCsvColumnMapping(values []string) (CsvColumnMapping, error) {
+	mapping := make(CsvColumnMapping)
+	for _, value := range values {
+		index := strings.LastIndex(value, ":")
+		if index == -1 {
+			return nil, fmt.Errorf("Invalid column mapping [%s], expected header:field", value)
+		}
+
+		header, field := strings.TrimSpace(value[:index]), strings.TrimSpace(value[index+1:])
+		if _, err := parseCsvField(field); err != nil {
+			return nil, err
+		}
+		mapping[header] = field
+	}
+
+	return mapping, nil
+}
+
+type csvField struct {
+	name  string // One of csvSimpleFields, Email or Phone
+	index int    // 1 based, for Email and Phone only
+	part  string // Address, Number or Description, for Email and Phone only
+}
+
+func parseCsvField(field string) (csvField, error) {
+	for _, simpleField := range csvSimpleFields {
+		if strings.EqualFold(field, simpleField) {
+			return csvField{name: simpleField}, nil
+		}
+	}
+
+	matches := csvRepeatedFieldPattern.FindStringSubmatch(field)
+	if matches == nil || (matches[1] == "Email" && matches[3] == "Number") || (matches[1] == "Phone" && matches[3] == "Address") {
+		return csvField{}, fmt.Errorf("Unknown contact field [%s]", field)
+	}
+
+	index, _ := strconv.Atoi(matches[2])
+	return csvField{name: matches[1], index: index, part: matches[3]}, nil
+}
+
+func EncodeContactsCsv(w io.Writer, contacts []Contact) error {
+	emailCount, phoneCount := 0, 0
+	for index := range contacts {
+		if len(contacts[index].Emails) > emailCount {
+			emailCount = len(contacts[index].Emails)
+		}
+		if len(contacts[index].Phones) > phoneCount {
+			phoneCount = len(contacts[index].Phones)
+		}
+	}
+
+	header := []string{"Id", "FirstName", "LastName", "Organisation", "Title", "Birthday"}
+	for index := 1; index <= emailCount; index++ {
+		header = append(header, fmt.Sprintf("Email%dDescription", index), fmt.Sprintf("Email%dAddress", index))
+	}
+	for index := 1; index <= phoneCount; index++ {
+		header = append(header, fmt.Sprintf("Phone%dDescription", index), fmt.Sprintf("Phone%dNumber", index))
+	}
+	header = append(header, "Twitter", "Notes", "Tags")
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, contact := range contacts {
+		record := []string{contact.Id, contact.FirstName, contact.LastName, contact.Organisation, contact.Title, contact.Birthday}
+		for index := 0; index < emailCount; index++ {
+			if index < len(contact.Emails) {
+				record = append(record, contact.Emails[index].Description, contact.Emails[index].Address)
+			} else {
+				record = append(record, "", "")
+			}
+		}
+		for index := 0; index < phoneCount; index++ {
+			if index < len(contact.Phones) {
+				record = append(record, contact.Phones[index].Description, contact.Phones[index].Number)
+			} else {
+				record = append(record, "", "")
+			}
+		}
+		record = append(record, contact.Twitter, contact.Notes, encodeCsvTags(contact.Tags))
+		for index := range record {
+			record[index] = escapeCsvFormula(record[index])
+		}
+
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func encodeCsvTags(tags []string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, ",", `\,`)
+	escaped := make([]string, len(tags))
+	for index, tag := range tags {
+		escaped[index] = replacer.Replace(tag)
+	}
+
+	return strings.Join(escaped, ",")
+}
+
+// Empty tags are dropped when the contact is normalised
+func decodeCsvTags(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	replacer := strings.NewReplacer(`\\`, `\`, `\,`, ",")
+	tags := splitVCardValue(value, ',')
+	for index := range tags {
+		tags[index] = replacer.Replace(tags[index])
+	}
+
+	return tags
+}
+
+func escapeCsvFormula(value string) string {
+	if value != "" && strings.IndexByte(csvFormulaPrefixes, value[0]) >= 0 {
+		return "'" + value
+	}
+	return value
+}
+
+// Reverses escapeCsvFormula so exports round trip, a ' before anything else is kept
+func unescapeCsvFormula(value string) string {
+	if len(value) > 1 && value[0] == '\'' && strings.IndexByte(csvFormulaPrefixes, value[1]) >= 0 {
+		return value[1:]
+	}
+	return value
+}
+
+/*
+Decodes all rows, the error is only for an unreadable header or no rows at all
+Each row gets its own result so one bad row does not prevent the others being imported
+*/
+func DecodeContactsCsv(r io.Reader, mapping CsvColumnMapping) ([]ContactDecodeResult, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // Ragged rows are common in spreadsheet exports, missing trailing cells are empty
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, ErrNoCsvRows
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]*csvField, len(header))
+	mappedColumnCount := 0
+	for index, headerValue := range header {
+		headerValue = strings.TrimSpace(strings.TrimPrefix(headerValue, "\ufeff")) // Excel adds a byte order mark
+		fieldName, ok := mapping[headerValue]
+		if !ok {
+			fieldName = headerValue
+		}
+		if field, err := parseCsvField(fieldName); err == nil {
+			columns[index] = &field
+			mappedColumnCount++
+		}
+	}
+	if mappedColumnCount == 0 {
+		return nil, errors.New("No CSV columns map to contact fields")
+	}
+	unmapped := getCsvUnmappedFields(columns)
+
+	results := make([]ContactDecodeResult, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			results = append(results, ContactDecodeResult{Err: parseErr})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		result := decodeContactCsvRecord(columns, record)
+		result.Unmapped = unmapped
+		results = append(results, result)
+	}
+
+	if len(results) == 0 {
+		return nil, ErrNoCsvRows
+	}
+
+	return results, nil
+}
+
+// Fields with no CSV column and fields whose columns are not in this file, see ContactDecodeResult
+func getCsvUnmappedFields(columns []*csvField) []string {
+	mapped := make(map[string]bool)
+	for _, column := range columns {
+		if column != nil {
+			mapped[column.name] = true
+		}
+	}
+
+	unmapped := []string{"Addresses", "Websites", "CustomFields"}
+	for _, field := range csvSimpleFields {
+		if field != "Id" && !mapped[field] {
+			unmapped = append(unmapped, field)
+		}
+	}
+	if !mapped["Email"] {
+		unmapped = append(unmapped, "Emails")
+	}
+	if !mapped["Phone"] {
+		unmapped = append(unmapped, "Phones")
+	}
+
+	return unmapped
+}
+
+func decodeContactCsvRecord(columns []*csvField, record []string) ContactDecodeResult {
+	var contact Contact
+	emails, phones := make(map[int]*Email), make(map[int]*Phone)
+	maxEmailIndex, maxPhoneIndex := 0, 0
+	for index, value := range record {
+		if index >= len(columns) || columns[index] == nil {
+			continue
+		}
+		value = strings.TrimSpace(unescapeCsvFormula(value))
+
+		field := columns[index]
+		switch field.name {
+		case "Id":
+			contact.Id = value
+		case "FirstName":
+			contact.FirstName = value
+		case "LastName":
+			contact.LastName = value
+		case "Organisation":
+			contact.Organisation = value
+		case "Title":
+			contact.Title = value
+		case "Birthday":
+			contact.Birthday = value
+		case "Twitter":
+			contact.Twitter = value
+		case "Notes":
+			contact.Notes = value
+		case "Tags":
+			contact.Tags = decodeCsvTags(value)
+		case "Email":
+			if emails[field.index] == nil {
+				emails[field.index] = &Email{}
+			}
+			if field.part == "Address" {
+				emails[field.index].Address = value
+			} else {
+				emails[field.index].Description = value
+			}
+			if field.index > maxEmailIndex {
+				maxEmailIndex = field.index
+			}
+		case "Phone":
+			if phones[field.index] == nil {
+				phones[field.index] = &Phone{}
+			}
+			if field.part == "Number" {
+				phones[field.index].Number = value
+			} else {
+				phones[field.index].Description = value
+			}
+			if field.index > maxPhoneIndex {
+				maxPhoneIndex = field.index
+			}
+		}
+	}
+
+	// Keep numbered order, skipping empty cells
+	for index := 1; index <= maxEmailIndex && index <= maxCsvRepeatedFieldIndex; index++ {
+		if email, ok := emails[index]; ok && email.Address != "" {
+			contact.Emails = append(contact.Emails, *email)
+		}
+	}
+	for index := 1; index <= maxPhoneIndex && index <= maxCsvRepeatedFieldIndex; index++ {
+		if phone, ok := phones[index]; ok && phone.Number != "" {
+			contact.Phones = append(contact.Phones, *phone)
+		}
+	}
+
+	return ContactDecodeResult{Contact: contact}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestEncodeContactsCsv(t *testing.T) {
+	spec := &Spec{t}
+
+	contacts := []Contact{
+		Contact{
+			Id:           "c1",
+			FirstName:    "Ted",
+			LastName:     "Toe",
+			Organisation: "Acme",
+			Birthday:     "--04-15",
+			Emails:       []Email{Email{Description: "Work", Address: "ted@example.com"}, Email{Address: "ted@gmail.com"}},
+			Phones:       []Phone{Phone{Description: "Home", Number: "353 066 7132310"}},
+			Notes:        "Likes, commas",
+			Tags:         []string{"customers", "on, call"},
+		},
+		Contact{Id: "c2", FirstName: "Anne", LastName: "Other", Twitter: "@anne"},
+	}
+
+	buf := new(bytes.Buffer)
+	err := EncodeContactsCsv(buf, contacts)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	expected := "Id,FirstName,LastName,Organisation,Title,Birthday,Email1Description,Email1Address,Email2Description,Email2Address,Phone1Description,Phone1Number,Twitter,Notes,Tags\n" +
+		"c1,Ted,Toe,Acme,,'--04-15,Work,ted@example.com,,ted@gmail.com,Home,353 066 7132310,,\"Likes, commas\",\"customers,on\\, call\"\n" +
+		"c2,Anne,Other,,,,,,,,,,'@anne,,\n"
+	spec.Assert(buf.String() == expected, "Unexpected CSV %q", buf.String())
+}
+
+func TestEncodeContactsCsvEscapesFormulas(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Notes string
+		// Expected result
+		Cell string
+	}{
+		{"=HYPERLINK(\"http://evil.example.com\")", "\"'=HYPERLINK(\"\"http://evil.example.com\"\")\""},
+		{"+353 66 7132310", "'+353 66 7132310"},
+		{"-2+3", "'-2+3"},
+		{"@SUM(A1:A2)", "'@SUM(A1:A2)"},
+		{"\t=1+1", "'\t=1+1"},
+		{"\r=1+1", "\"'\r=1+1\""},
+		{"1+1=2", "1+1=2"},
+		{"'quoted", "'quoted"},
+	}
+
+	for _, testCase := range testCases {
+		buf := new(bytes.Buffer)
+		err := EncodeContactsCsv(buf, []Contact{Contact{Id: "c1", FirstName: "Ted", LastName: "Toe", Notes: testCase.Notes}})
+		spec.Assert(err == nil, "Unexpected error : %s", err)
+
+		expected := "Id,FirstName,LastName,Organisation,Title,Birthday,Twitter,Notes,Tags\nc1,Ted,Toe,,,,," + testCase.Cell + ",\n"
+		spec.Assert(buf.String() == expected, "Unexpected CSV for [%q] %q", testCase.Notes, buf.String())
+	}
+}
+
+func TestContactsCsvRoundTrip(t *testing.T) {
+	spec := &Spec{t}
+
+	contacts := []Contact{
+		Contact{
+			Id:           "c1",
+			FirstName:    "Ted",
+			LastName:     "Toe",
+			Organisation: "Acme",
+			Title:        "Engineer",
+			Birthday:     "1996-04-15",
+			Emails:       []Email{Email{Description: "Work", Address: "ted@example.com"}},
+			Phones:       []Phone{Phone{Description: "Home", Number: "353 066 7132310"}, Phone{Description: "Mobile", Number: "087 1234567"}},
+			Twitter:      "@tedtoe",
+			Notes:        "Multi\nline \"notes\"",
+			Tags:         []string{"customers", "on, call", `back\slash`},
+		},
+		Contact{Id: "c2", FirstName: "Anne", LastName: "Other", Phones: []Phone{Phone{Number: "+353 66 7132310"}}, Notes: "'quoted"},
+	}
+
+	buf := new(bytes.Buffer)
+	EncodeContactsCsv(buf, contacts)
+
+	results, err := DecodeContactsCsv(buf, nil)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(len(results) == len(contacts), "Unexpected result count %d", len(results))
+	for index, result := range results {
+		spec.Assert(result.Err == nil, "Unexpected row error : %s", result.Err)
+		spec.Assert(reflect.DeepEqual(result.Contact, contacts[index]), "Unexpected contact %#v", result.Contact)
+	}
+}
+
+func TestDecodeContactsCsvWithMapping(t *testing.T) {
+	spec := &Spec{t}
+
+	data := "Given Name,Family Name,E-mail: Home,Mobile,Ignored\n" +
+		"Ted,Toe,ted@example.com,087 1234567,x\n" +
+		"Anne,Other,,,\n"
+	mapping, err := ParseCsvColumnMapping([]string{"Given Name:FirstName", "Family Name:LastName", "E-mail: Home:Email1Address", "Mobile:Phone1Number"})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	results, err := DecodeContactsCsv(strings.NewReader(data), mapping)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(len(results) == 2, "Unexpected result count %d", len(results))
+
+	expected := Contact{FirstName: "Ted", LastName: "Toe", Emails: []Email{Email{Address: "ted@example.com"}}, Phones: []Phone{Phone{Number: "087 1234567"}}}
+	spec.Assert(reflect.DeepEqual(results[0].Contact, expected), "Unexpected contact %#v", results[0].Contact)
+
+	// Empty cells are not emails or phones
+	spec.Assert(results[1].Contact.Emails == nil && results[1].Contact.Phones == nil, "Unexpected contact %#v", results[1].Contact)
+}
+
+func TestDecodeContactsCsvHeaderFieldNamesAreCaseInsensitive(t *testing.T) {
+	spec := &Spec{t}
+
+	results, err := DecodeContactsCsv(strings.NewReader("\ufefffirstname,LASTNAME\nTed,Toe\n"), nil)
+
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(results[0].Contact.FirstName == "Ted" && results[0].Contact.LastName == "Toe", "Unexpected contact %#v", results[0].Contact)
+}
+
+func TestDecodeContactsCsvErrors(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Data string
+		// Expected result
+		ExpectError bool
+	}{
+		{"", true},
+		{"Id,FirstName\n", true},
+		{"Unknown,Other\nTed,Toe\n", true},
+		{"FirstName,LastName\nTed,Toe\n", false},
+	}
+
+	for _, testCase := range testCases {
+		_, err := DecodeContactsCsv(strings.NewReader(testCase.Data), nil)
+		spec.Assert((err != nil) == testCase.ExpectError, "Unexpected error result for %q : %v", testCase.Data, err)
+	}
+}
+
+func TestDecodeContactsCsvReportsBadRows(t *testing.T) {
+	spec := &Spec{t}
+
+	results, err := DecodeContactsCsv(strings.NewReader("FirstName,LastName\nTed,Toe\nAnne,\"Oth\"er\"\nPeter,Toad\n"), nil)
+
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(len(results) == 3, "Unexpected result count %d", len(results))
+	spec.Assert(results[1].Err != nil, "Expected row error")
+	spec.Assert(results[2].Contact.FirstName == "Peter", "Unexpected contact %#v", results[2].Contact)
+}
+
+func TestParseCsvColumnMapping(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Value string
+		// Expected result
+		ExpectError bool
+		Header      string
+		Field       string
+	}{
+		{"Name:FirstName", false, "Name", "FirstName"},
+		{"Time: Work:Phone2Number", false, "Time: Work", "Phone2Number"},
+		{"E-mail:Email10Description", false, "E-mail", "Email10Description"},
+		{"Name", true, "", ""},
+		{"Name:Surname", true, "", ""},
+		{"E-mail:Email1Number", true, "", ""},
+		{"Tel:Phone0Number", true, "", ""},
+	}
+
+	for _, testCase := range testCases {
+		mapping, err := ParseCsvColumnMapping([]string{testCase.Value})
+		spec.Assert((err != nil) == testCase.ExpectError, "Unexpected error result for %s : %v", testCase.Value, err)
+		if err == nil {
+			spec.Assert(mapping[testCase.Header] == testCase.Field, "Unexpected mapping for %s : %v", testCase.Value, mapping)
+		}
+	}
+}
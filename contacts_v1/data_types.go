@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -18,12 +19,98 @@ type User struct {
 	FirstName string
 	LastName  string
 	Email     string
-	Password  string
+	Password  string // Tagged hash, see password.go, may be plaintext for legacy records which are upgraded on log in
+	Roles     []string
 	Contacts  []Contact
 }
 
+// Admins can manage every user and access every user's contacts
+const AdminRole = "admin"
+
+var validRoles = []string{AdminRole}
+
+func IsValidRole(role string) bool {
+	for _, validRole := range validRoles {
+		if role == validRole {
+			return true
+		}
+	}
+	return false
+}
+
+// Same id constraint the router applies to url paths
+var resourceIdPattern = regexp.MustCompile(`^[\w-]{5,36}$`)
+
+// Literal path segments under /api/v1/contacts/{userId}, a contact with one of these ids could not be reached
+var reservedContactIds = []string{"duplicates", "merge"}
+
+func IsReservedContactId(id string) bool {
+	return containsFold(reservedContactIds, id)
+}
+
+type UserProfile struct {
+	Id        string   `json:",omitempty"`
+	FirstName string   `json:",omitempty"`
+	LastName  string   `json:",omitempty"`
+	Email     string   `json:",omitempty"`
+	Roles     []string `json:",omitempty"` // Read only, see UserRolesApiHandler
+}
+
 func (user *User) Authenticate(password string) bool {
-	return password == user.Password // This is much too simplistic, but for now
+	return VerifyPassword(user.Password, password)
+}
+
+func (user *User) SetPassword(password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	user.Password = hash
+	return nil
+}
+
+func (user *User) PasswordNeedsRehash() bool {
+	return PasswordNeedsRehash(user.Password)
+}
+
+func (user *User) IsValidForSaving() (bool, error) {
+	err := ""
+	if !resourceIdPattern.MatchString(user.Id) {
+		err += "Invalid Id, "
+	}
+	if isEmptyString(user.FirstName) {
+		err += "Missing first name, "
+	}
+	if isEmptyString(user.LastName) {
+		err += "Missing last name, "
+	}
+	if isEmptyString(user.Password) {
+		err += "Missing password, "
+	}
+
+	err = strings.TrimSuffix(err, ", ")
+
+	return (len(err) == 0), fmt.Errorf(err)
+}
+
+func (user *User) GetProfile() UserProfile {
+	return UserProfile{
+		Id:        user.Id,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Email:     user.Email,
+		Roles:     user.Roles,
+	}
+}
+
+func (user *User) HasRole(role string) bool {
+	for _, userRole := range user.Roles {
+		if userRole == role {
+			return true
+		}
+	}
+	return false
 }
 
 func (user *User) GetContactIndex(id string) (int, bool) {
@@ -35,14 +122,148 @@ func (user *User) GetContactIndex(id string) (int, bool) {
 	return -1, false
 }
 
+/*
+API token record, Hash is the SHA-256 of the token, see apitoken.go
+*/
+type ApiToken struct {
+	Id        string
+	UserId    string
+	Name      string `json:",omitempty"`
+	Hash      string
+	CreatedAt time.Time
+}
+
+type ApiTokenInfo struct {
+	Id        string
+	Name      string `json:",omitempty"`
+	CreatedAt time.Time
+}
+
+func (token *ApiToken) GetInfo() ApiTokenInfo {
+	return ApiTokenInfo{
+		Id:        token.Id,
+		Name:      token.Name,
+		CreatedAt: token.CreatedAt,
+	}
+}
+
+/*
+Contact sharing, the owner grants the grantee read or read-write access to all of their contacts or to selected contacts
+There is at most one grant per owner and grantee
+*/
+type Grant struct {
+	OwnerId    string
+	GranteeId  string
+	Access     string
+	ContactIds []string `json:",omitempty"` // Empty for all contacts
+	CreatedAt  time.Time
+}
+
+const (
+	ReadAccess      = "read"
+	ReadWriteAccess = "readwrite"
+)
+
+const maxGrantContactIds = 1000
+
+func (grant *Grant) IsValidForSaving() (bool, error) {
+	var errs ValidationErrors
+	if grant.Access != ReadAccess && grant.Access != ReadWriteAccess {
+		errs.Add("Access", fmt.Sprintf("Access must be %s or %s", ReadAccess, ReadWriteAccess))
+	}
+	if grant.GranteeId == grant.OwnerId {
+		errs.Add("GranteeId", "Cannot grant access to your own contacts")
+	}
+	if len(grant.ContactIds) > maxGrantContactIds {
+		errs.Add("ContactIds", fmt.Sprintf("No more than %d contact ids", maxGrantContactIds))
+	}
+	for index, contactId := range grant.ContactIds {
+		if !resourceIdPattern.MatchString(contactId) {
+			errs.Add(fmt.Sprintf("ContactIds[%d]", index), fmt.Sprintf("Invalid contact id [%s]", contactId))
+		}
+	}
+
+	return (len(errs) == 0), errs.AsError()
+}
+
+// Whether the grant covers the contact, an empty contact id means the whole address book
+func (grant *Grant) Covers(contactId string) bool {
+	if len(grant.ContactIds) == 0 {
+		return true
+	}
+	if contactId == "" {
+		return false
+	}
+
+	for _, grantedContactId := range grant.ContactIds {
+		if grantedContactId == contactId {
+			return true
+		}
+	}
+	return false
+}
+
+func (grant *Grant) FilterContacts(contacts []Contact) []Contact {
+	if len(grant.ContactIds) == 0 {
+		return contacts
+	}
+
+	filtered := make([]Contact, 0, len(grant.ContactIds))
+	for _, contact := range contacts {
+		if grant.Covers(contact.Id) {
+			filtered = append(filtered, contact)
+		}
+	}
+	return filtered
+}
+
+/*
+Named group of a user's contacts, names are unique per user ignoring case
+ContactIds are maintained by the store, see UserStore.AddGroupContact
+*/
+type Group struct {
+	Id         string
+	Name       string
+	ContactIds []string `json:",omitempty"`
+}
+
+func (group *Group) IsValidForSaving() (bool, error) {
+	var errs ValidationErrors
+	if isEmptyString(group.Name) {
+		errs.Add("Name", "Missing name")
+	}
+	errs.CheckLength("Name", group.Name, "Name", maxGroupNameLength)
+
+	return (len(errs) == 0), errs.AsError()
+}
+
+// Recent failed log in attempts for a user name or client IP, see LoginThrottle
+type LoginAttempts struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+/*
+Contact, all fields are omitted from json when empty so records stored before a field was added still decode
+*/
 type Contact struct {
-	Id        string  `json:",omitempty"`
-	FirstName string  `json:",omitempty"`
-	LastName  string  `json:",omitempty"`
-	Emails    []Email `json:",omitempty"`
-	Phones    []Phone `json:",omitempty"`
-	Twitter   string  `json:",omitempty"`
-	Notes     string  `json:",omitempty"`
+	Id           string        `json:",omitempty"`
+	FirstName    string        `json:",omitempty"`
+	LastName     string        `json:",omitempty"`
+	Organisation string        `json:",omitempty"`
+	Title        string        `json:",omitempty"`
+	Birthday     string        `json:",omitempty"` // YYYY-MM-DD or --MM-DD, see IsValidBirthday
+	Emails       []Email       `json:",omitempty"`
+	Phones       []Phone       `json:",omitempty"`
+	Addresses    []Address     `json:",omitempty"`
+	Websites     []Website     `json:",omitempty"`
+	Twitter      string        `json:",omitempty"`
+	Notes        string        `json:",omitempty"`
+	CustomFields []CustomField `json:",omitempty"`
+	Tags         []string      `json:",omitempty"`
+	MergedIds    []string      `json:",omitempty"` // Maintained by the store, contacts merged into this one, see UserStore.MergeContacts
+	Version      int64         `json:",omitempty"` // Maintained by the store, incremented on every save
+	Incarnation  string        `json:",omitempty"` // Maintained by the store, new each time a contact with this id is created
 }
 
 type Email struct {
@@ -55,19 +276,257 @@ type Phone struct {
 	Number      string `json:",omitempty"`
 }
 
+// Postal address, components as in the vCard ADR property
+type Address struct {
+	Description string `json:",omitempty"`
+	Street      string `json:",omitempty"`
+	Locality    string `json:",omitempty"`
+	Region      string `json:",omitempty"`
+	PostalCode  string `json:",omitempty"`
+	Country     string `json:",omitempty"`
+}
+
+type Website struct {
+	Description string `json:",omitempty"`
+	Url         string `json:",omitempty"`
+}
+
+// User defined field, i.e. {"Name": "Account manager", "Value": "Ted"}, names are unique per contact ignoring case
+type CustomField struct {
+	Name  string `json:",omitempty"`
+	Value string `json:",omitempty"`
+}
+
+func (address *Address) IsEmpty() bool {
+	return isEmptyString(address.Street + address.Locality + address.Region + address.PostalCode + address.Country)
+}
+
+/*
+Trims names and normalises phone numbers to E.164, numbers that cannot be normalised are left for validation to report
+*/
+func (contact *Contact) Normalise() {
+	contact.FirstName = strings.TrimSpace(contact.FirstName)
+	contact.LastName = strings.TrimSpace(contact.LastName)
+	contact.Organisation = strings.TrimSpace(contact.Organisation)
+	contact.Title = strings.TrimSpace(contact.Title)
+	contact.Birthday = strings.TrimSpace(contact.Birthday)
+	contact.Twitter = strings.TrimSpace(contact.Twitter)
+	for index := range contact.Emails {
+		contact.Emails[index].Address = strings.TrimSpace(contact.Emails[index].Address)
+	}
+	for index := range contact.Phones {
+		if number, err := NormalisePhoneNumber(contact.Phones[index].Number); err == nil {
+			contact.Phones[index].Number = number
+		}
+	}
+	for index := range contact.Addresses {
+		address := &contact.Addresses[index]
+		address.Street = strings.TrimSpace(address.Street)
+		address.Locality = strings.TrimSpace(address.Locality)
+		address.Region = strings.TrimSpace(address.Region)
+		address.PostalCode = strings.TrimSpace(address.PostalCode)
+		address.Country = strings.TrimSpace(address.Country)
+	}
+	for index := range contact.Websites {
+		contact.Websites[index].Url = strings.TrimSpace(contact.Websites[index].Url)
+	}
+	for index := range contact.CustomFields {
+		contact.CustomFields[index].Name = strings.TrimSpace(contact.CustomFields[index].Name)
+	}
+	contact.Tags = normaliseTags(contact.Tags)
+}
+
+// Trims and drops empty tags and case insensitive duplicates, keeping the first spelling
+func normaliseTags(tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	result := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		key := strings.ToLower(tag)
+		if tag == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, tag)
+	}
+	return result
+}
+
+// Copies the named fields, Id and the store maintained fields are never copied
+func (contact *Contact) CopyFields(from *Contact, fields []string) {
+	for _, field := range fields {
+		switch field {
+		case "FirstName":
+			contact.FirstName = from.FirstName
+		case "LastName":
+			contact.LastName = from.LastName
+		case "Organisation":
+			contact.Organisation = from.Organisation
+		case "Title":
+			contact.Title = from.Title
+		case "Birthday":
+			contact.Birthday = from.Birthday
+		case "Emails":
+			contact.Emails = from.Emails
+		case "Phones":
+			contact.Phones = from.Phones
+		case "Addresses":
+			contact.Addresses = from.Addresses
+		case "Websites":
+			contact.Websites = from.Websites
+		case "Twitter":
+			contact.Twitter = from.Twitter
+		case "Notes":
+			contact.Notes = from.Notes
+		case "CustomFields":
+			contact.CustomFields = from.CustomFields
+		case "Tags":
+			contact.Tags = from.Tags
+		}
+	}
+}
+
+// Case insensitive
+func (contact *Contact) HasTag(tag string) bool {
+	for _, contactTag := range contact.Tags {
+		if strings.EqualFold(contactTag, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+The error is nil if valid, otherwise ValidationErrors with an entry per invalid field
+Phone numbers must already be normalised, see Normalise
+*/
 func (contact *Contact) IsValidForSaving() (bool, error) {
-	err := ""
+	var errs ValidationErrors
 	if isEmptyString(contact.Id) {
-		err += "Missing Id, "
+		errs.Add("Id", "Missing Id")
+	}
+	errs.CheckLength("Id", contact.Id, "Id", maxContactIdLength)
+	if IsReservedContactId(contact.Id) {
+		errs.Add("Id", fmt.Sprintf("Reserved Id [%s]", contact.Id))
 	}
 	if isEmptyString(contact.FirstName) {
-		err += "Missing first name, "
+		errs.Add("FirstName", "Missing first name")
 	}
+	errs.CheckLength("FirstName", contact.FirstName, "First name", maxNameLength)
 	if isEmptyString(contact.LastName) {
-		err += "Missing last name, "
+		errs.Add("LastName", "Missing last name")
 	}
+	errs.CheckLength("LastName", contact.LastName, "Last name", maxNameLength)
 
-	err = strings.TrimSuffix(err, ", ")
+	for index, email := range contact.Emails {
+		field := fmt.Sprintf("Emails[%d]", index)
+		if !IsValidEmailAddress(email.Address) {
+			errs.Add(field+".Address", fmt.Sprintf("Invalid email address [%s]", email.Address))
+		}
+		errs.CheckLength(field+".Description", email.Description, "Email description", maxDescriptionLength)
+	}
+	for index, phone := range contact.Phones {
+		field := fmt.Sprintf("Phones[%d]", index)
+		if normalised, err := NormalisePhoneNumber(phone.Number); err != nil {
+			errs.Add(field+".Number", fmt.Sprintf("%s [%s]", err, phone.Number))
+		} else if normalised != phone.Number {
+			errs.Add(field+".Number", fmt.Sprintf("Phone number is not in E.164 format [%s]", phone.Number))
+		}
+		errs.CheckLength(field+".Description", phone.Description, "Phone description", maxDescriptionLength)
+	}
 
-	return (len(err) == 0), fmt.Errorf(err)
+	errs.CheckLength("Organisation", contact.Organisation, "Organisation", maxNameLength)
+	errs.CheckLength("Title", contact.Title, "Title", maxNameLength)
+	if contact.Birthday != "" && !IsValidBirthday(contact.Birthday) {
+		errs.Add("Birthday", fmt.Sprintf("Invalid birthday [%s], expected YYYY-MM-DD or --MM-DD", contact.Birthday))
+	}
+
+	for index, address := range contact.Addresses {
+		field := fmt.Sprintf("Addresses[%d]", index)
+		if address.IsEmpty() {
+			errs.Add(field, "Empty address")
+		}
+		errs.CheckLength(field+".Street", address.Street, "Street", maxStreetLength)
+		errs.CheckLength(field+".Locality", address.Locality, "Locality", maxNameLength)
+		errs.CheckLength(field+".Region", address.Region, "Region", maxNameLength)
+		errs.CheckLength(field+".PostalCode", address.PostalCode, "Postal code", maxDescriptionLength)
+		errs.CheckLength(field+".Country", address.Country, "Country", maxNameLength)
+		errs.CheckLength(field+".Description", address.Description, "Address description", maxDescriptionLength)
+	}
+	for index, website := range contact.Websites {
+		field := fmt.Sprintf("Websites[%d]", index)
+		if !IsValidWebsiteUrl(website.Url) {
+			errs.Add(field+".Url", fmt.Sprintf("Invalid website url [%s], must be an http or https url", website.Url))
+		}
+		errs.CheckLength(field+".Description", website.Description, "Website description", maxDescriptionLength)
+	}
+
+	if contact.Twitter != "" && !IsValidTwitterHandle(contact.Twitter) {
+		errs.Add("Twitter", fmt.Sprintf("Invalid twitter handle [%s]", contact.Twitter))
+	}
+	errs.CheckLength("Notes", contact.Notes, "Notes", maxNotesLength)
+
+	if len(contact.CustomFields) > maxCustomFields {
+		errs.Add("CustomFields", fmt.Sprintf("No more than %d custom fields", maxCustomFields))
+	}
+	customFieldNames := make(map[string]bool)
+	for index, customField := range contact.CustomFields {
+		field := fmt.Sprintf("CustomFields[%d]", index)
+		name := strings.ToLower(customField.Name)
+		if isEmptyString(name) {
+			errs.Add(field+".Name", "Missing custom field name")
+		} else if customFieldNames[name] {
+			errs.Add(field+".Name", fmt.Sprintf("Duplicate custom field name [%s]", customField.Name))
+		}
+		customFieldNames[name] = true
+		errs.CheckLength(field+".Name", customField.Name, "Custom field name", maxDescriptionLength)
+		errs.CheckLength(field+".Value", customField.Value, "Custom field value", maxCustomFieldValueLength)
+	}
+
+	if len(contact.Tags) > maxTags {
+		errs.Add("Tags", fmt.Sprintf("No more than %d tags", maxTags))
+	}
+	for index, tag := range contact.Tags {
+		field := fmt.Sprintf("Tags[%d]", index)
+		if isEmptyString(tag) {
+			errs.Add(field, "Empty tag")
+		}
+		errs.CheckLength(field, tag, "Tag", maxTagLength)
+	}
+
+	return (len(errs) == 0), errs.AsError()
+}
+
+/*
+Bulk import decoding result, one per imported item so one bad item does not prevent the others being imported
+*/
+type ContactDecodeResult struct {
+	Contact  Contact
+	Err      error
+	Unmapped []string // Contact fields the import has no values for, a stored contact with the same id keeps its own, see CopyFields
+}
+
+/*
+Bulk import report, errors are per imported item with the item's 1 based index in the import
+*/
+type ImportReport struct {
+	DryRun   bool `json:",omitempty"`
+	Imported int
+	Failed   int
+	Errors   []ImportError `json:",omitempty"`
+}
+
+type ImportError struct {
+	Index int
+	Id    string `json:",omitempty"`
+	Error string
+}
+
+func (report *ImportReport) AddError(index int, id string, err error) {
+	report.Failed++
+	report.Errors = append(report.Errors, ImportError{Index: index, Id: id, Error: err.Error()})
 }
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -21,6 +25,19 @@ func TestUserAuthentication(t *testing.T) {
 	spec.Assert(user.Authenticate("Tim"), "Should have passed")
 }
 
+func TestUserAuthenticationWithHashedPassword(t *testing.T) {
+	spec := &Spec{t}
+
+	user := &User{}
+	err := user.SetPassword("Tim")
+
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(user.Password != "Tim", "Password was not hashed")
+	spec.Assert(user.PasswordNeedsRehash() == false, "Should not need a rehash")
+	spec.Assert(user.Authenticate("Bad") == false, "Should have failed")
+	spec.Assert(user.Authenticate("Tim"), "Should have passed")
+}
+
 func TestUserGetContactIndexWhereContactExists(t *testing.T) {
 	spec := &Spec{t}
 
@@ -72,6 +89,111 @@ func TestContactIsValidForSavingForValidCase(t *testing.T) {
 	for _, testCase := range testCases {
 		actual, actualError := testCase.c.IsValidForSaving()
 		spec.Assert(actual == testCase.expected, "Unexpected result %t for input [%v]", actual, testCase.c)
-		spec.Assert(actualError.Error() == testCase.expectedError, "Unexpected error %s for input [%v]", actualError.Error(), testCase.c)
+		spec.Assert((actualError == nil) == testCase.expected, "Unexpected error %v for input [%v]", actualError, testCase.c)
+		if actualError != nil {
+			spec.Assert(actualError.Error() == testCase.expectedError, "Unexpected error %s for input [%v]", actualError.Error(), testCase.c)
+		}
+	}
+}
+
+func TestContactIsValidForSavingFieldErrors(t *testing.T) {
+	spec := &Spec{t}
+
+	tooManyTags := make([]string, maxTags+1)
+	for index := range tooManyTags {
+		tooManyTags[index] = fmt.Sprintf("tag%d", index)
+	}
+
+	testCases := []struct {
+		c              *Contact // Input
+		expectedFields []string // Expected result
+	}{
+		{c: &Contact{Id: "Id1", FirstName: "Ted", LastName: "Toe", Emails: []Email{Email{Address: "ted@example.com"}}, Phones: []Phone{Phone{Number: "+3530667132310"}}, Twitter: "@ted_toe"}, expectedFields: nil},
+		{c: &Contact{Id: "Id1", FirstName: "Ted", LastName: "Toe", Emails: []Email{Email{Address: "ted@example.com"}, Email{Address: "Ted <ted@example.com>"}}}, expectedFields: []string{"Emails[1].Address"}},
+		{c: &Contact{Id: "Id1", FirstName: "Ted", LastName: "Toe", Phones: []Phone{Phone{Number: "066 7132310"}, Phone{Number: "353 66 7132310"}}}, expectedFields: []string{"Phones[0].Number", "Phones[1].Number"}},
+		{c: &Contact{Id: "Id1", FirstName: "Ted", LastName: "Toe", Twitter: "@ted-toe"}, expectedFields: []string{"Twitter"}},
+		{c: &Contact{Id: "Id1", FirstName: strings.Repeat("a", 101), LastName: "Toe", Notes: strings.Repeat("n", 4001)}, expectedFields: []string{"FirstName", "Notes"}},
+		{c: &Contact{Id: strings.Repeat("i", 37), LastName: "Toe", Emails: []Email{Email{Description: strings.Repeat("d", 51), Address: "ted@example.com"}}}, expectedFields: []string{"Id", "FirstName", "Emails[0].Description"}},
+		{c: &Contact{Id: "Id1", FirstName: "Ted", LastName: "Toe", Tags: []string{"customers", "", strings.Repeat("t", 51)}}, expectedFields: []string{"Tags[1]", "Tags[2]"}},
+		{c: &Contact{Id: "Id1", FirstName: "Ted", LastName: "Toe", Tags: tooManyTags}, expectedFields: []string{"Tags"}},
+		{c: &Contact{Id: "Id1", FirstName: "Ted", LastName: "Toe", Organisation: "Acme", Title: "Engineer", Birthday: "--04-15", Addresses: []Address{Address{Locality: "Tralee"}}, Websites: []Website{Website{Url: "https://example.com"}}, CustomFields: []CustomField{CustomField{Name: "Account", Value: "123"}}}, expectedFields: nil},
+		{c: &Contact{Id: "Id1", FirstName: "Ted", LastName: "Toe", Organisation: strings.Repeat("o", 101), Birthday: "1996-02-30"}, expectedFields: []string{"Organisation", "Birthday"}},
+		{c: &Contact{Id: "Id1", FirstName: "Ted", LastName: "Toe", Addresses: []Address{Address{Description: "Home"}, Address{Street: strings.Repeat("s", 201)}}}, expectedFields: []string{"Addresses[0]", "Addresses[1].Street"}},
+		{c: &Contact{Id: "Id1", FirstName: "Ted", LastName: "Toe", Websites: []Website{Website{Url: "example.com"}}}, expectedFields: []string{"Websites[0].Url"}},
+		{c: &Contact{Id: "duplicates", FirstName: "Ted", LastName: "Toe"}, expectedFields: []string{"Id"}},
+		{c: &Contact{Id: "Merge", FirstName: "Ted", LastName: "Toe"}, expectedFields: []string{"Id"}},
+		{c: &Contact{Id: "Id1", FirstName: "Ted", LastName: "Toe", CustomFields: []CustomField{CustomField{Name: "Account"}, CustomField{Name: "ACCOUNT"}, CustomField{Value: "1"}}}, expectedFields: []string{"CustomFields[1].Name", "CustomFields[2].Name"}},
+	}
+
+	for _, testCase := range testCases {
+		_, err := testCase.c.IsValidForSaving()
+
+		var actualFields []string
+		if errs, ok := err.(ValidationErrors); ok {
+			for _, fieldError := range errs {
+				actualFields = append(actualFields, fieldError.Field)
+			}
+		}
+		spec.Assert(reflect.DeepEqual(actualFields, testCase.expectedFields), "Unexpected fields %v for input [%v]", actualFields, testCase.c)
+	}
+}
+
+func TestContactNormalise(t *testing.T) {
+	spec := &Spec{t}
+
+	contact := &Contact{
+		FirstName: " Ted ",
+		Emails:    []Email{Email{Address: " ted@example.com "}},
+		Phones:    []Phone{Phone{Number: "+353 (66) 713-2310"}, Phone{Number: "066 7132310"}},
+		Tags:      []string{" Customers", "", "on-call", "customers "},
+		Addresses: []Address{Address{Street: " 1 Main St ", Country: "Ireland "}},
+		Websites:  []Website{Website{Url: " https://example.com "}},
+	}
+
+	contact.Normalise()
+
+	spec.Assert(contact.FirstName == "Ted", "Unexpected first name [%s]", contact.FirstName)
+	spec.Assert(contact.Emails[0].Address == "ted@example.com", "Unexpected email address [%s]", contact.Emails[0].Address)
+	spec.Assert(contact.Phones[0].Number == "+353667132310", "Unexpected phone number [%s]", contact.Phones[0].Number)
+	spec.Assert(contact.Phones[1].Number == "066 7132310", "Unexpected phone number [%s]", contact.Phones[1].Number)
+	spec.Assert(reflect.DeepEqual(contact.Tags, []string{"Customers", "on-call"}), "Unexpected tags %v", contact.Tags)
+	spec.Assert(contact.Addresses[0].Street == "1 Main St" && contact.Addresses[0].Country == "Ireland", "Unexpected address %v", contact.Addresses[0])
+	spec.Assert(contact.Websites[0].Url == "https://example.com", "Unexpected website url [%s]", contact.Websites[0].Url)
+}
+
+// Contacts stored before the extended fields, i.e. in legacy ContactsAsJson, decode and encode unchanged
+func TestContactJsonIsBackwardsCompatible(t *testing.T) {
+	spec := &Spec{t}
+
+	legacyJson := `{"Id":"c1","FirstName":"Ted","LastName":"Toe","Emails":[{"Address":"ted@example.com"}],"Notes":"Old"}`
+
+	var contact Contact
+	err := json.Unmarshal([]byte(legacyJson), &contact)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	valid, err := contact.IsValidForSaving()
+	spec.Assert(valid, "Unexpected validation error : %s", err)
+
+	encoded, _ := json.Marshal(&contact)
+	spec.Assert(string(encoded) == legacyJson, "Unexpected json %s", encoded)
+}
+
+func TestGroupIsValidForSaving(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Group *Group
+		// Expected result
+		IsValid bool
+	}{
+		{&Group{Name: "Customers"}, true},
+		{&Group{Name: " "}, false},
+		{&Group{Name: strings.Repeat("g", 101)}, false},
+	}
+
+	for index, testCase := range testCases {
+		isValid, _ := testCase.Group.IsValidForSaving()
+
+		spec.Assert(isValid == testCase.IsValid, "Expected %t for test case %d", testCase.IsValid, index)
 	}
 }
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/*
+Duplicate detection - contacts are compared in pairs, a shared email address or phone number and similar names each
+add to the pair's score, scores are combined as independent evidence so a pair matching on more than one scores higher
+
+	email	Same address ignoring case
+	phone	Same number once normalised to E.164, or the same digits if a number cannot be normalised
+	name	Names at least minDuplicateNameSimilarity similar, first and last names may be swapped
+*/
+const (
+	duplicateEmailScore        = 0.8
+	duplicatePhoneScore        = 0.7
+	duplicateNameScore         = 0.7 // Scaled by the similarity
+	minDuplicateNameSimilarity = 0.8
+	DefaultMinDuplicateScore   = 0.5
+	maxMergeContacts           = 20
+)
+
+type DuplicateContacts struct {
+	ContactIds []string // The pair, in the user's contact order
+	Score      float64  // Greater than 0 and up to 1
+	Reasons    []string // email, phone and\or name
+}
+
+var (
+	ErrTooFewMergeContacts  = errors.New("At least two contacts are needed to merge")
+	ErrTooManyMergeContacts = errors.New("Too many contacts to merge")
+	ErrDuplicateMergeId     = errors.New("Contact ids to merge must be different")
+)
+
+// Pairs scoring at least minScore, highest score first
+func FindDuplicateContacts(contacts []Contact, minScore float64) []DuplicateContacts {
+	keys := make([]duplicateKeys, len(contacts))
+	for index := range contacts {
+		keys[index] = getDuplicateKeys(&contacts[index])
+	}
+
+	duplicates := make([]DuplicateContacts, 0)
+	for index := range contacts {
+		for otherIndex := index + 1; otherIndex < len(contacts); otherIndex++ {
+			score, reasons := scoreDuplicate(&keys[index], &keys[otherIndex])
+			if len(reasons) == 0 || score < minScore {
+				continue
+			}
+			duplicates = append(duplicates, DuplicateContacts{
+				ContactIds: []string{contacts[index].Id, contacts[otherIndex].Id},
+				Score:      score,
+				Reasons:    reasons,
+			})
+		}
+	}
+
+	// Stable so equal scores stay in contact order
+	sort.SliceStable(duplicates, func(i, j int) bool { return duplicates[i].Score > duplicates[j].Score })
+	return duplicates
+}
+
+// Normalised values compared for each contact, worked out once per contact rather than once per pair
+type duplicateKeys struct {
+	Emails       map[string]bool
+	Phones       map[string]bool
+	Name         string
+	SwappedName  string
+	HasFirstName bool
+}
+
+func getDuplicateKeys(contact *Contact) duplicateKeys {
+	keys := duplicateKeys{
+		Emails:       make(map[string]bool),
+		Phones:       make(map[string]bool),
+		Name:         normaliseDuplicateName(contact.FirstName + " " + contact.LastName),
+		SwappedName:  normaliseDuplicateName(contact.LastName + " " + contact.FirstName),
+		HasFirstName: !isEmptyString(contact.FirstName),
+	}
+	for _, email := range contact.Emails {
+		if address := strings.ToLower(strings.TrimSpace(email.Address)); address != "" {
+			keys.Emails[address] = true
+		}
+	}
+	for _, phone := range contact.Phones {
+		if number := normaliseDuplicatePhone(phone.Number); number != "" {
+			keys.Phones[number] = true
+		}
+	}
+	return keys
+}
+
+func scoreDuplicate(a, b *duplicateKeys) (float64, []string) {
+	reasons := make([]string, 0, 3)
+	unlikely := 1.0 // Chance the pair is not a duplicate, each match reduces it
+
+	if sharesKey(a.Emails, b.Emails) {
+		reasons = append(reasons, "email")
+		unlikely *= 1 - duplicateEmailScore
+	}
+	if sharesKey(a.Phones, b.Phones) {
+		reasons = append(reasons, "phone")
+		unlikely *= 1 - duplicatePhoneScore
+	}
+	if a.Name != "" && b.Name != "" {
+		similarity := nameSimilarity(a.Name, b.Name)
+		if a.HasFirstName && b.HasFirstName {
+			similarity = math.Max(similarity, nameSimilarity(a.SwappedName, b.Name))
+		}
+		if similarity >= minDuplicateNameSimilarity {
+			reasons = append(reasons, "name")
+			unlikely *= 1 - duplicateNameScore*similarity
+		}
+	}
+
+	// Rounded so scores are readable in responses
+	return math.Round((1-unlikely)*100) / 100, reasons
+}
+
+func sharesKey(a, b map[string]bool) bool {
+	for key := range a {
+		if b[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// Lower case letters and digits with single spaces, so case and punctuation do not matter, i.e. "O'Brien" is "obrien"
+func normaliseDuplicateName(name string) string {
+	var result []rune
+	space := false
+	for _, ch := range strings.ToLower(name) {
+		switch {
+		case unicode.IsLetter(ch) || unicode.IsDigit(ch):
+			if space && len(result) > 0 {
+				result = append(result, ' ')
+			}
+			result = append(result, ch)
+			space = false
+		case unicode.IsSpace(ch) || ch == '-':
+			space = true
+		}
+	}
+	return string(result)
+}
+
+func normaliseDuplicatePhone(number string) string {
+	if normalised, err := NormalisePhoneNumber(number); err == nil {
+		return normalised
+	}
+
+	digits := make([]rune, 0, len(number))
+	for _, ch := range number {
+		if ch >= '0' && ch <= '9' {
+			digits = append(digits, ch)
+		}
+	}
+	return string(digits)
+}
+
+// 1 for identical names down to 0, based on the Levenshtein edit distance
+func nameSimilarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+
+	aRunes, bRunes := []rune(a), []rune(b)
+	longest := maxInt(len(aRunes), len(bRunes))
+	// Cannot reach the threshold if the lengths differ too much, saves comparing most pairs in large contact lists
+	if float64(maxInt(len(aRunes)-len(bRunes), len(bRunes)-len(aRunes))) > float64(longest)*(1-minDuplicateNameSimilarity) {
+		return 0
+	}
+
+	return 1 - float64(levenshteinDistance(aRunes, bRunes))/float64(longest)
+}
+
+func levenshteinDistance(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for index := range previous {
+		previous[index] = index
+	}
+
+	for aIndex := 1; aIndex <= len(a); aIndex++ {
+		current[0] = aIndex
+		for bIndex := 1; bIndex <= len(b); bIndex++ {
+			cost := 1
+			if a[aIndex-1] == b[bIndex-1] {
+				cost = 0
+			}
+			current[bIndex] = minInt(minInt(previous[bIndex]+1, current[bIndex-1]+1), previous[bIndex-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+/*
+Combines contacts into the first, which keeps its id and version
+The first contact's names and other single values are kept, empty ones are taken from the later contacts in order
+Emails, phones, addresses, websites, custom fields and tags are unioned without repeats, notes are appended
+The other contacts' ids, and any ids already merged into them, are added to MergedIds
+*/
+func CombineContacts(contacts []Contact) (*Contact, error) {
+	ids := make([]string, len(contacts))
+	for index := range contacts {
+		ids[index] = contacts[index].Id
+	}
+	if err := CheckMergeContactIds(ids); err != nil {
+		return nil, err
+	}
+
+	result := contacts[0]
+	result.Emails, result.Phones, result.Addresses, result.Websites, result.CustomFields = nil, nil, nil, nil, nil
+	result.Notes, result.Tags, result.MergedIds = "", nil, nil
+
+	// Keys already in the result, values are compared ignoring case and whitespace where that is not significant
+	emails, phones, websites := make(map[string]bool), make(map[string]bool), make(map[string]bool)
+	addresses, customFields, mergedIds := make(map[Address]bool), make(map[string]bool), make(map[string]bool)
+	notes := make([]string, 0)
+	for index := range contacts {
+		contact := &contacts[index]
+
+		result.FirstName = firstNonEmpty(result.FirstName, contact.FirstName)
+		result.LastName = firstNonEmpty(result.LastName, contact.LastName)
+		result.Organisation = firstNonEmpty(result.Organisation, contact.Organisation)
+		result.Title = firstNonEmpty(result.Title, contact.Title)
+		result.Birthday = firstNonEmpty(result.Birthday, contact.Birthday)
+		result.Twitter = firstNonEmpty(result.Twitter, contact.Twitter)
+
+		for _, email := range contact.Emails {
+			if key := strings.ToLower(strings.TrimSpace(email.Address)); !emails[key] {
+				emails[key] = true
+				result.Emails = append(result.Emails, email)
+			}
+		}
+		for _, phone := range contact.Phones {
+			if key := normaliseDuplicatePhone(phone.Number); !phones[key] {
+				phones[key] = true
+				result.Phones = append(result.Phones, phone)
+			}
+		}
+		for _, address := range contact.Addresses {
+			key := Address{
+				Street:     strings.ToLower(strings.TrimSpace(address.Street)),
+				Locality:   strings.ToLower(strings.TrimSpace(address.Locality)),
+				Region:     strings.ToLower(strings.TrimSpace(address.Region)),
+				PostalCode: strings.ToLower(strings.TrimSpace(address.PostalCode)),
+				Country:    strings.ToLower(strings.TrimSpace(address.Country)),
+			}
+			if !addresses[key] {
+				addresses[key] = true
+				result.Addresses = append(result.Addresses, address)
+			}
+		}
+		for _, website := range contact.Websites {
+			if key := strings.TrimSpace(website.Url); !websites[key] {
+				websites[key] = true
+				result.Websites = append(result.Websites, website)
+			}
+		}
+		for _, customField := range contact.CustomFields {
+			if key := strings.ToLower(strings.TrimSpace(customField.Name)); !customFields[key] {
+				customFields[key] = true
+				result.CustomFields = append(result.CustomFields, customField)
+			}
+		}
+		result.Tags = append(result.Tags, contact.Tags...)
+
+		if note := strings.TrimSpace(contact.Notes); note != "" && !containsString(notes, note) {
+			notes = append(notes, note)
+		}
+
+		if index > 0 && !mergedIds[contact.Id] {
+			mergedIds[contact.Id] = true
+			result.MergedIds = append(result.MergedIds, contact.Id)
+		}
+		for _, mergedId := range contact.MergedIds {
+			if !mergedIds[mergedId] && mergedId != result.Id {
+				mergedIds[mergedId] = true
+				result.MergedIds = append(result.MergedIds, mergedId)
+			}
+		}
+	}
+	result.Notes = strings.Join(notes, "\n\n")
+	result.Normalise()
+
+	return &result, nil
+}
+
+// Between 2 and maxMergeContacts different ids, cheap so requests can be checked before any contacts are read
+func CheckMergeContactIds(contactIds []string) error {
+	if len(contactIds) < 2 {
+		return ErrTooFewMergeContacts
+	}
+	if len(contactIds) > maxMergeContacts {
+		return ErrTooManyMergeContacts
+	}
+
+	seen := make(map[string]bool)
+	for _, contactId := range contactIds {
+		if seen[contactId] {
+			return ErrDuplicateMergeId
+		}
+		seen[contactId] = true
+	}
+	return nil
+}
+
+func firstNonEmpty(value, other string) string {
+	if isEmptyString(value) {
+		return other
+	}
+	return value
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestFindDuplicateContactsScores(t *testing.T) {
+	spec := &Spec{t}
+
+	ted := Contact{Id: "ted", FirstName: "Ted", LastName: "Toe"}
+	testCases := []struct {
+		// Input
+		A Contact
+		B Contact
+		// Expected result
+		Score   float64
+		Reasons []string
+	}{
+		{
+			Contact{Id: "a", FirstName: "Ted", LastName: "Toe", Emails: []Email{Email{Address: "ted@example.com"}}},
+			Contact{Id: "b", FirstName: "Edward", LastName: "Smith", Emails: []Email{Email{Address: " TED@Example.com"}}},
+			0.8, []string{"email"},
+		},
+		{
+			Contact{Id: "a", FirstName: "Ted", LastName: "Toe", Phones: []Phone{Phone{Number: "+353 66 713 2310"}}},
+			Contact{Id: "b", FirstName: "Edward", LastName: "Smith", Phones: []Phone{Phone{Number: "00353667132310"}}},
+			0.7, []string{"phone"},
+		},
+		{
+			Contact{Id: "a", FirstName: "Ted", LastName: "Toe", Phones: []Phone{Phone{Number: "066 7132310"}}},
+			Contact{Id: "b", FirstName: "Edward", LastName: "Smith", Phones: []Phone{Phone{Number: "(066) 713-2310"}}},
+			0.7, []string{"phone"},
+		},
+		{ted, Contact{Id: "b", FirstName: "TED", LastName: "toe"}, 0.7, []string{"name"}},
+		{ted, Contact{Id: "b", FirstName: "Toe", LastName: "Ted"}, 0.7, []string{"name"}},
+		{ted, Contact{Id: "b", FirstName: "Ted", LastName: "O'Toe"}, 0.61, []string{"name"}},
+		{
+			Contact{Id: "a", FirstName: "Ted", LastName: "Toe", Emails: []Email{Email{Address: "ted@example.com"}}},
+			Contact{Id: "b", FirstName: "Ted", LastName: "Toe", Emails: []Email{Email{Address: "ted@example.com"}}},
+			0.94, []string{"email", "name"},
+		},
+		{
+			Contact{Id: "a", FirstName: "Ted", LastName: "Toe", Emails: []Email{Email{Address: "ted@example.com"}}, Phones: []Phone{Phone{Number: "+353667132310"}}},
+			Contact{Id: "b", FirstName: "Ted", LastName: "Toe", Emails: []Email{Email{Address: "ted@example.com"}}, Phones: []Phone{Phone{Number: "+353667132310"}}},
+			0.98, []string{"email", "phone", "name"},
+		},
+		{ted, Contact{Id: "b", FirstName: "Tom", LastName: "Toe"}, 0, nil},
+		{ted, Contact{Id: "b", FirstName: "Ann", LastName: "Bee"}, 0, nil},
+	}
+
+	for index, testCase := range testCases {
+		duplicates := FindDuplicateContacts([]Contact{testCase.A, testCase.B}, 0.01)
+		if testCase.Reasons == nil {
+			spec.Assert(len(duplicates) == 0, "Unexpected duplicates for case %d %v", index, duplicates)
+			continue
+		}
+
+		spec.Assert(len(duplicates) == 1, "Unexpected duplicate count for case %d %d", index, len(duplicates))
+		if len(duplicates) == 1 {
+			spec.Assert(duplicates[0].Score == testCase.Score, "Unexpected score for case %d %v", index, duplicates[0].Score)
+			spec.Assert(reflect.DeepEqual(duplicates[0].Reasons, testCase.Reasons), "Unexpected reasons for case %d %v", index, duplicates[0].Reasons)
+			spec.Assert(reflect.DeepEqual(duplicates[0].ContactIds, []string{testCase.A.Id, testCase.B.Id}), "Unexpected ids for case %d %v", index, duplicates[0].ContactIds)
+		}
+	}
+}
+
+func TestFindDuplicateContactsOrderAndMinScore(t *testing.T) {
+	spec := &Spec{t}
+
+	contacts := []Contact{
+		Contact{Id: "ted1", FirstName: "Ted", LastName: "Toe", Emails: []Email{Email{Address: "ted@example.com"}}},
+		Contact{Id: "ann", FirstName: "Ann", LastName: "Bee"},
+		Contact{Id: "ted2", FirstName: "Toe", LastName: "Ted"},
+		Contact{Id: "ted3", FirstName: "Ted", LastName: "Toe", Emails: []Email{Email{Address: "ted@example.com"}}},
+	}
+
+	duplicates := FindDuplicateContacts(contacts, DefaultMinDuplicateScore)
+	spec.Assert(len(duplicates) == 3, "Unexpected duplicate count %d", len(duplicates))
+	spec.Assert(reflect.DeepEqual(duplicates[0].ContactIds, []string{"ted1", "ted3"}), "Unexpected first duplicate %v", duplicates[0])
+	spec.Assert(reflect.DeepEqual(duplicates[1].ContactIds, []string{"ted1", "ted2"}), "Unexpected second duplicate %v", duplicates[1])
+	spec.Assert(reflect.DeepEqual(duplicates[2].ContactIds, []string{"ted2", "ted3"}), "Unexpected third duplicate %v", duplicates[2])
+
+	duplicates = FindDuplicateContacts(contacts, 0.9)
+	spec.Assert(len(duplicates) == 1, "Unexpected duplicate count with a higher min score %d", len(duplicates))
+
+	duplicates = FindDuplicateContacts(nil, DefaultMinDuplicateScore)
+	spec.Assert(duplicates != nil && len(duplicates) == 0, "Expected an empty list for no contacts %v", duplicates)
+}
+
+func TestNameSimilarity(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		A string
+		B string
+		// Expected result
+		Similarity float64
+	}{
+		{"ted toe", "ted toe", 1},
+		{"ted toe", "ted toa", 1 - 1.0/7},
+		{"ted toe", "tedd toe", 1 - 1.0/8},
+		{"ted toe", "ann bee", 1 - 5.0/7},
+		{"ted toe", "theodore toe", 0}, // Lengths differ too much to be compared
+		{"séan", "sean", 0.75},
+	}
+
+	for _, testCase := range testCases {
+		result := nameSimilarity(testCase.A, testCase.B)
+		spec.Assert(math.Abs(result-testCase.Similarity) < 0.0001, "Unexpected similarity for [%s] and [%s] %v", testCase.A, testCase.B, result)
+	}
+}
+
+func TestNormaliseDuplicateName(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Name string
+		// Expected result
+		Normalised string
+	}{
+		{"Ted Toe", "ted toe"},
+		{"  Ted   O'Toe ", "ted otoe"},
+		{"Mary-Ann Bee", "mary ann bee"},
+		{" ", ""},
+	}
+
+	for _, testCase := range testCases {
+		result := normaliseDuplicateName(testCase.Name)
+		spec.Assert(result == testCase.Normalised, "Unexpected result for [%s] [%s]", testCase.Name, result)
+	}
+}
+
+func TestCombineContacts(t *testing.T) {
+	spec := &Spec{t}
+
+	contacts := []Contact{
+		Contact{
+			Id:        "ted",
+			FirstName: "Ted",
+			LastName:  "Toe",
+			Emails:    []Email{Email{Description: "Work", Address: "ted@example.com"}},
+			Phones:    []Phone{Phone{Description: "Home", Number: "+353667132310"}},
+			Notes:     "Met at the conference",
+			Tags:      []string{"customers"},
+			MergedIds: []string{"ted-old"},
+			Version:   3,
+		},
+		Contact{
+			Id:           "ted2",
+			FirstName:    "Theodore",
+			LastName:     "Toe",
+			Organisation: "Acme",
+			Emails:       []Email{Email{Address: "TED@example.com"}, Email{Description: "Home", Address: "ted@home.example.com"}},
+			Phones:       []Phone{Phone{Number: "00353 66 713 2310"}, Phone{Description: "Mobile", Number: "+353871234567"}},
+			Addresses:    []Address{Address{Locality: "Tralee", Country: "Ireland"}},
+			Websites:     []Website{Website{Url: "https://example.com"}},
+			CustomFields: []CustomField{CustomField{Name: "Account", Value: "123"}},
+			Notes:        "Met at the conference",
+			Tags:         []string{"Customers", "on-call"},
+			Version:      1,
+		},
+		Contact{
+			Id:           "ted3",
+			FirstName:    "Ted",
+			LastName:     "Toe",
+			Title:        "Engineer",
+			Organisation: "Other",
+			Addresses:    []Address{Address{Description: "Home", Locality: "tralee", Country: "IRELAND"}},
+			Websites:     []Website{Website{Url: "https://example.com"}, Website{Url: "https://ted.example.com"}},
+			CustomFields: []CustomField{CustomField{Name: "account", Value: "456"}},
+			Notes:        "Prefers email",
+			MergedIds:    []string{"ted", "ted-older"},
+		},
+	}
+
+	merged, err := CombineContacts(contacts)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	expected := &Contact{
+		Id:           "ted",
+		FirstName:    "Ted",
+		LastName:     "Toe",
+		Organisation: "Acme",
+		Title:        "Engineer",
+		Emails:       []Email{Email{Description: "Work", Address: "ted@example.com"}, Email{Description: "Home", Address: "ted@home.example.com"}},
+		Phones:       []Phone{Phone{Description: "Home", Number: "+353667132310"}, Phone{Description: "Mobile", Number: "+353871234567"}},
+		Addresses:    []Address{Address{Locality: "Tralee", Country: "Ireland"}},
+		Websites:     []Website{Website{Url: "https://example.com"}, Website{Url: "https://ted.example.com"}},
+		CustomFields: []CustomField{CustomField{Name: "Account", Value: "123"}},
+		Notes:        "Met at the conference\n\nPrefers email",
+		Tags:         []string{"customers", "on-call"},
+		MergedIds:    []string{"ted-old", "ted2", "ted3", "ted-older"},
+		Version:      3,
+	}
+	spec.Assert(reflect.DeepEqual(merged, expected), "Expected [%+v] but got [%+v]", expected, merged)
+
+	// The contacts passed in are not changed
+	spec.Assert(len(contacts[0].Emails) == 1 && len(contacts[0].MergedIds) == 1, "First contact was changed %+v", contacts[0])
+}
+
+func TestCombineContactsFailures(t *testing.T) {
+	spec := &Spec{t}
+
+	tooMany := make([]Contact, maxMergeContacts+1)
+	for index := range tooMany {
+		tooMany[index] = Contact{Id: Uuid(), FirstName: "Ted", LastName: "Toe"}
+	}
+
+	testCases := []struct {
+		// Input
+		Contacts []Contact
+		// Expected result
+		Err error
+	}{
+		{nil, ErrTooFewMergeContacts},
+		{[]Contact{Contact{Id: "ted"}}, ErrTooFewMergeContacts},
+		{[]Contact{Contact{Id: "ted"}, Contact{Id: "ted"}}, ErrDuplicateMergeId},
+		{tooMany, ErrTooManyMergeContacts},
+	}
+
+	for index, testCase := range testCases {
+		_, err := CombineContacts(testCase.Contacts)
+		spec.Assert(err == testCase.Err, "Unexpected error for case %d %v", index, err)
+	}
+}
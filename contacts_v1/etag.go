@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+)
+
+// Version and incarnation, the version alone restarts at 1 when a contact is deleted and created again
+// Contacts stored before incarnations were added have none until they are next saved
+func GetContactETag(contact *Contact) string {
+	if contact.Incarnation == "" {
+		return fmt.Sprintf(`"%d"`, contact.Version)
+	}
+
+	return fmt.Sprintf(`"%d-%s"`, contact.Version, contact.Incarnation)
+}
+
+func GetContentETag(content []byte) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum(content))
+}
+
+/*
+Checks an If-Match or If-None-Match header value against an entity tag, see https://tools.ietf.org/html/rfc7232#section-2.3.2
+If-Match uses strong comparison, If-None-Match uses weak comparison which ignores any W/ prefix
+*/
+func IsETagMatch(headerValue, etag string, weak bool) bool {
+	headerValue = strings.TrimSpace(headerValue)
+	if headerValue == "*" {
+		return true
+	}
+
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	} else if strings.HasPrefix(etag, "W/") {
+		return false
+	}
+
+	for _, candidate := range strings.Split(headerValue, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGetContactETag(t *testing.T) {
+	spec := &Spec{t}
+
+	spec.Assert(GetContactETag(&Contact{}) == `"0"`, "Unexpected etag %s", GetContactETag(&Contact{}))
+	spec.Assert(GetContactETag(&Contact{Version: 12}) == `"12"`, "Unexpected etag %s", GetContactETag(&Contact{Version: 12}))
+	spec.Assert(GetContactETag(&Contact{Version: 12, Incarnation: "abc"}) == `"12-abc"`, "Unexpected etag %s", GetContactETag(&Contact{Version: 12, Incarnation: "abc"}))
+}
+
+func TestGetContentETag(t *testing.T) {
+	spec := &Spec{t}
+
+	etag1, etag2 := GetContentETag([]byte("a")), GetContentETag([]byte("b"))
+
+	spec.Assert(etag1 != etag2, "Expected different etags")
+	spec.Assert(etag1 == GetContentETag([]byte("a")), "Expected same etag for same content")
+}
+
+func TestIsETagMatch(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		headerValue string // Input
+		etag        string // Input
+		weak        bool   // Input
+		expected    bool   // Expected result
+	}{
+		{`*`, `"1"`, false, true},
+		{`"1"`, `"1"`, false, true},
+		{`"2"`, `"1"`, false, false},
+		{`"2", "1"`, `"1"`, false, true},
+		{`W/"1"`, `"1"`, false, false},
+		{`W/"1"`, `"1"`, true, true},
+		{`"1"`, `W/"1"`, true, true},
+		{`"1"`, `W/"1"`, false, false},
+		{``, `"1"`, true, false},
+	}
+
+	for _, testCase := range testCases {
+		actual := IsETagMatch(testCase.headerValue, testCase.etag, testCase.weak)
+		spec.Assert(actual == testCase.expected, "Unexpected result %t for input [%s, %s, %t]", actual, testCase.headerValue, testCase.etag, testCase.weak)
+	}
+}
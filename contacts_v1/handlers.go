@@ -4,9 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Root handler
@@ -17,7 +22,8 @@ func (h *RootHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestCont
 	t, _ := template.New("Html").Parse(rootHtmlTemplate)
 	err := t.Execute(w, c)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s Error detected when trying to execute root template : %s\n", c.GetLogMessagePrefix(), err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
 	}
 }
 
@@ -32,43 +38,29 @@ func (h *AssetsHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestCo
 
 		if _, err := fmt.Fprintf(w, content); err != nil {
 			log.Printf("%s Error detected when trying write asset : %s\n", c.GetLogMessagePrefix(), err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			WriteProblem(w, c, http.StatusInternalServerError, "")
 		}
 		return
 	}
 
-	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	WriteProblem(w, c, http.StatusNotFound, "Asset not found")
 }
 
-// Contact api handler
+// Contact api handler - each method only touches the one contact
 type ContactApiHandler struct {
-	PathPrefix string
-	Store      UserStore
+	Store UserStore
+	Blobs BlobStore // Optional, deleting a contact deletes its photo
 }
 
-func (h *ContactApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
-	ids, err := getIdsFromUrlPath(r.URL.Path, h.PathPrefix)
-	if err != nil {
-		log.Printf("%s Error detected when trying to get ids from url : %s\n", c.GetLogMessagePrefix(), err)
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		return false
-	}
-
-	userId, contactId := ids[0], ids[1]
-	if userId != c.GetUserName() {
-		log.Printf("%s Forbidden, context user id %s\n", c.GetLogMessagePrefix(), c.GetUserName())
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-		return false
-	}
+const maxContactPatchSize = 64 * 1024
 
-	user, err := h.Store.Get(userId)
-	if err != nil {
-		log.Printf("%s Error detected when trying to get user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+func (h *ContactApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	userId, contactId := c.GetParam("userId"), c.GetParam("contactId")
+	if _, ok := checkContactAccess(h.Store, w, c, userId, contactId, !isReadMethod(r)); !ok {
 		return false
 	}
 
-	c.Data["User"] = user
+	c.Data["UserId"] = userId
 	c.Data["ContactId"] = contactId
 	return true
 }
@@ -77,40 +69,75 @@ func (h *ContactApiHandler) Delete(w http.ResponseWriter, r *http.Request, c *Re
 	if !h.PreProcess(w, r, c) {
 		return
 	}
-	user := c.Data["User"].(*User)
+	userId := c.Data["UserId"].(string)
 	contactId := c.Data["ContactId"].(string)
 
-	index, ok := user.GetContactIndex(contactId)
+	expectedVersion, ok := h.GetExpectedVersion(w, r, c)
 	if !ok {
-		log.Printf("%s Contact not found for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), user.Id, contactId)
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 
-	newContacts := append(user.Contacts[:index], user.Contacts[index+1:]...)
-	user.Contacts = newContacts
-	h.Store.Save(user)
+	err := h.Store.DeleteContact(userId, contactId, expectedVersion)
+	if err == ErrVersionConflict {
+		log.Printf("%s Version conflict when deleting contact for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusPreconditionFailed, "Contact has been changed by another request")
+		return
+	}
+	if err == ErrStoreContention {
+		log.Printf("%s Contention when deleting contact for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		writeStoreContentionProblem(w, c)
+		return
+	}
+	if err == ErrContactNotFound || err == ErrUserNotFound {
+		log.Printf("%s Contact not found for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusNotFound, "Contact not found")
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when deleting contact for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	// The contact is gone so a photo left behind is only wasted space, not a reason to fail
+	if h.Blobs != nil {
+		if err := DeleteContactPhoto(h.Blobs, userId, contactId); err != nil {
+			log.Printf("%s Error detected when deleting photo for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		}
+	}
 }
 
 func (h *ContactApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
 	if !h.PreProcess(w, r, c) {
 		return
 	}
-	user := c.Data["User"].(*User)
+	userId := c.Data["UserId"].(string)
 	contactId := c.Data["ContactId"].(string)
 
-	index, ok := user.GetContactIndex(contactId)
-	if !ok {
-		log.Printf("%s Contact not found for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), user.Id, contactId)
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	contact, err := h.Store.GetContact(userId, contactId)
+	if err == ErrContactNotFound || err == ErrUserNotFound {
+		log.Printf("%s Contact not found for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusNotFound, "Contact not found")
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when trying to get contact for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	etag := GetContactETag(contact)
+	w.Header().Set("ETag", etag)
+	if IsETagMatch(r.Header.Get("If-None-Match"), etag, true) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
-	if err := encoder.Encode(user.Contacts[index]); err != nil {
-		log.Printf("%s Error detected when trying to encode contact for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, contactId, err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if err := encoder.Encode(contact); err != nil {
+		log.Printf("%s Error detected when trying to encode contact for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
 		return
 	}
 }
@@ -119,15 +146,15 @@ func (h *ContactApiHandler) Put(w http.ResponseWriter, r *http.Request, c *Reque
 	if !h.PreProcess(w, r, c) {
 		return
 	}
-	user := c.Data["User"].(*User)
+	userId := c.Data["UserId"].(string)
 	contactId := c.Data["ContactId"].(string)
 
 	var contact Contact
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&contact)
 	if err != nil {
-		log.Printf("%s Error detected when trying to decode contact for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, contactId, err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		log.Printf("%s Error detected when trying to decode contact for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusBadRequest, "Request body is not a valid contact")
 		return
 	}
 	if contact.Id == "" {
@@ -135,179 +162,1857 @@ func (h *ContactApiHandler) Put(w http.ResponseWriter, r *http.Request, c *Reque
 	}
 	if contact.Id != contactId {
 		log.Printf("%s Contact id conflict url is %s put body is %s\n", c.GetLogMessagePrefix(), contactId, contact.Id)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		WriteProblem(w, c, http.StatusBadRequest, "Contact id in the body does not match the url")
 		return
 	}
+	contact.Normalise()
 	if valid, err := (&contact).IsValidForSaving(); !valid {
-		log.Printf("%s Contact state is not valid for saving for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		log.Printf("%s Contact state is not valid for saving for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteValidationProblem(w, c, err)
 		return
 	}
 
-	index, ok := user.GetContactIndex(contactId)
-	if ok {
-		user.Contacts[index] = contact
-	} else {
-		user.Contacts = append(user.Contacts, contact)
+	expectedVersion, ok := h.GetExpectedVersion(w, r, c)
+	if !ok {
+		return
 	}
 
-	err = h.Store.Save(user)
+	err = h.Store.SaveContact(userId, &contact, expectedVersion)
+	if err == ErrVersionConflict {
+		log.Printf("%s Version conflict when saving contact for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusPreconditionFailed, "Contact has been changed by another request")
+		return
+	}
+	if err == ErrStoreContention {
+		log.Printf("%s Contention when saving contact for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		writeStoreContentionProblem(w, c)
+		return
+	}
+	if err == ErrUserNotFound {
+		log.Printf("%s User not found when saving contact for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusNotFound, "User not found")
+		return
+	}
 	if err != nil {
-		log.Printf("%s Error detected when saving user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, contactId, err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("%s Error detected when saving user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
 		return
 	}
+
+	w.Header().Set("ETag", GetContactETag(&contact))
 }
 
-// Contacts api handler
-type ContactsApiHandler struct {
-	PathPrefix string
-	Store      UserStore
+/*
+JSON Merge Patch (RFC 7396), i.e. {"Twitter": null, "Notes": "Met at the conference"}
+Emails and Phones are replaced as a whole as merge patch has no way to address array entries
+The patch is applied to the version we read, so a concurrent change between the read and the save is a 412
+*/
+func (h *ContactApiHandler) Patch(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	userId := c.Data["UserId"].(string)
+	contactId := c.Data["ContactId"].(string)
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != mergePatchContentType {
+		log.Printf("%s Unsupported patch content type %s\n", c.GetLogMessagePrefix(), r.Header.Get("Content-Type"))
+		WriteProblem(w, c, http.StatusUnsupportedMediaType, fmt.Sprintf("Content type must be %s", mergePatchContentType))
+		return
+	}
+
+	patch, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxContactPatchSize))
+	if err != nil {
+		log.Printf("%s Error detected when trying to read patch for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusBadRequest, "Request body could not be read")
+		return
+	}
+
+	current, err := h.Store.GetContact(userId, contactId)
+	if err == ErrContactNotFound || err == ErrUserNotFound {
+		log.Printf("%s Contact not found for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusNotFound, "Contact not found")
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when trying to get contact for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !IsETagMatch(ifMatch, GetContactETag(current), false) {
+		log.Printf("%s If-Match precondition failed for user with id %s and contact with id %s, current etag is %s\n", c.GetLogMessagePrefix(), userId, contactId, GetContactETag(current))
+		WriteProblem(w, c, http.StatusPreconditionFailed, "Contact does not match If-Match")
+		return
+	}
+
+	contact, err := mergePatchContact(current, patch)
+	if err != nil {
+		log.Printf("%s Error detected when trying to apply patch for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusBadRequest, "Request body is not a valid merge patch for a contact")
+		return
+	}
+	if contact.Id != contactId {
+		log.Printf("%s Contact id conflict url is %s patched id is %s\n", c.GetLogMessagePrefix(), contactId, contact.Id)
+		WriteProblem(w, c, http.StatusBadRequest, "Contact id cannot be changed")
+		return
+	}
+	contact.Normalise()
+	if valid, err := contact.IsValidForSaving(); !valid {
+		log.Printf("%s Contact state is not valid for saving for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteValidationProblem(w, c, err)
+		return
+	}
+
+	err = h.Store.SaveContact(userId, contact, current.Version)
+	if err == ErrVersionConflict {
+		log.Printf("%s Version conflict when saving contact for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusPreconditionFailed, "Contact has been changed by another request")
+		return
+	}
+	if err == ErrStoreContention {
+		log.Printf("%s Contention when saving contact for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		writeStoreContentionProblem(w, c)
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when saving user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	// Client cannot know the merged result so we return it
+	w.Header().Set("ETag", GetContactETag(contact))
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(contact); err != nil {
+		log.Printf("%s Error detected when trying to encode contact for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		return
+	}
 }
 
-func (h *ContactsApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
-	ids, err := getIdsFromUrlPath(r.URL.Path, h.PathPrefix)
+// Version is maintained by the store so is not patchable
+func mergePatchContact(current *Contact, patch []byte) (*Contact, error) {
+	currentAsJson, err := json.Marshal(current)
 	if err != nil {
-		log.Printf("%s Error detected when trying to get ids from url : %s\n", c.GetLogMessagePrefix(), err)
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		return false
+		return nil, err
 	}
 
-	userId := ids[0]
-	if userId != c.GetUserName() {
-		log.Printf("%s Forbidden, context user id %s\n", c.GetLogMessagePrefix(), c.GetUserName())
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-		return false
+	patchedAsJson, err := ApplyMergePatch(currentAsJson, patch)
+	if err != nil {
+		return nil, err
 	}
 
-	user, err := h.Store.Get(userId)
+	var contact Contact
+	if err := json.Unmarshal(patchedAsJson, &contact); err != nil {
+		return nil, err
+	}
+
+	contact.Version = current.Version
+	return &contact, nil
+}
+
+// Unconditional writes that kept losing to concurrent changes, nothing was saved and the request can simply be retried
+func writeStoreContentionProblem(w http.ResponseWriter, c *RequestContext) {
+	w.Header().Set("Retry-After", "1")
+	WriteProblem(w, c, http.StatusServiceUnavailable, "Too many concurrent changes, try again")
+}
+
+/*
+Resolves the store's expected version from the request's conditional headers
+
+	No If-Match		Any version, last writer wins
+	If-None-Match: *	Contact must not exist
+	If-Match		Contact must exist with a matching etag, we then expect its current version so a concurrent change is still a conflict
+*/
+func (h *ContactApiHandler) GetExpectedVersion(w http.ResponseWriter, r *http.Request, c *RequestContext) (int64, bool) {
+	userId := c.Data["UserId"].(string)
+	contactId := c.Data["ContactId"].(string)
+
+	if strings.TrimSpace(r.Header.Get("If-None-Match")) == "*" {
+		return NoContactVersion, true
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return AnyContactVersion, true
+	}
+
+	current, err := h.Store.GetContact(userId, contactId)
+	if err == ErrContactNotFound || err == ErrUserNotFound {
+		log.Printf("%s If-Match precondition failed as contact not found for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusPreconditionFailed, "Contact does not match If-Match")
+		return 0, false
+	}
 	if err != nil {
-		log.Printf("%s Error detected when trying to get user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("%s Error detected when trying to get contact for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return 0, false
+	}
+	if !IsETagMatch(ifMatch, GetContactETag(current), false) {
+		log.Printf("%s If-Match precondition failed for user with id %s and contact with id %s, current etag is %s\n", c.GetLogMessagePrefix(), userId, contactId, GetContactETag(current))
+		WriteProblem(w, c, http.StatusPreconditionFailed, "Contact does not match If-Match")
+		return 0, false
+	}
+
+	return current.Version, true
+}
+
+// Contacts api handler
+type ContactsApiHandler struct {
+	Store UserStore
+}
+
+func (h *ContactsApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	userId := c.GetParam("userId")
+	grant, ok := checkContactAccess(h.Store, w, c, userId, "", !isReadMethod(r))
+	if !ok {
 		return false
 	}
 
-	c.Data["User"] = user
+	c.Data["UserId"] = userId
+	c.Data["Grant"] = grant
 	return true
 }
 
 func (h *ContactsApiHandler) GenerateUrl(userId, contactId string) string {
-	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(h.PathPrefix, "/"), userId, contactId)
+	return fmt.Sprintf("/api/v1/contacts/%s/%s", userId, contactId)
 }
 
 func (h *ContactsApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
 	if !h.PreProcess(w, r, c) {
 		return
 	}
-	user := c.Data["User"].(*User)
+	userId := c.Data["UserId"].(string)
+
+	user, err := h.Store.Get(userId)
+	if err != nil {
+		log.Printf("%s Error detected when trying to get user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
 
-	contacts := make([]Contact, 0)
-	if contacts != nil {
-		contacts = user.Contacts
+	query, err := ParseContactQuery(r.URL.Query())
+	if err != nil {
+		log.Printf("%s Error detected when trying to parse contacts query for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	encoder := json.NewEncoder(w)
-	if err := encoder.Encode(contacts); err != nil {
+	contacts, total := query.Apply(c.Data["Grant"].(*Grant).FilterContacts(user.Contacts))
+
+	// Encode first so we can generate an etag from the content
+	content, err := json.Marshal(contacts)
+	if err != nil {
 		log.Printf("%s Error detected when trying to encode contacts for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
 		return
 	}
+
+	etag := GetContentETag(content)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if link := query.GetLinkHeader(r.URL, total); link != "" {
+		w.Header().Set("Link", link)
+	}
+	if IsETagMatch(r.Header.Get("If-None-Match"), etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(append(content, '\n')); err != nil {
+		log.Printf("%s Error detected when trying to write contacts for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+	}
 }
 
 func (h *ContactsApiHandler) Post(w http.ResponseWriter, r *http.Request, c *RequestContext) {
 	if !h.PreProcess(w, r, c) {
 		return
 	}
-	user := c.Data["User"].(*User)
+	userId := c.Data["UserId"].(string)
 
 	var contact Contact
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&contact)
 	if err != nil {
-		log.Printf("%s Error detected when trying to decode contact for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		log.Printf("%s Error detected when trying to decode contact for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusBadRequest, "Request body is not a valid contact")
 		return
 	}
 
 	contact.Id = Uuid()
+	contact.Normalise()
 	if valid, err := (&contact).IsValidForSaving(); !valid {
-		log.Printf("%s Contact state is not valid for saving for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		log.Printf("%s Contact state is not valid for saving for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteValidationProblem(w, c, err)
 		return
 	}
 
-	user.Contacts = append(user.Contacts, contact)
-
-	err = h.Store.Save(user)
+	err = h.Store.SaveContact(userId, &contact, NoContactVersion)
 	if err != nil {
-		log.Printf("%s Error detected when saving user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("%s Error detected when saving user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
 		return
 	}
 
-	contactUrl := h.GenerateUrl(user.Id, contact.Id)
+	contactUrl := h.GenerateUrl(userId, contact.Id)
 
 	w.Header().Set("Location", contactUrl)
+	w.Header().Set("ETag", GetContactETag(&contact))
 	w.WriteHeader(http.StatusCreated)
 }
 
-// LogIn api handler
-type LogInApiHandler struct {
+// vCards api handler - export all contacts or bulk import a multi entry .vcf file
+type VCardsApiHandler struct {
 	Store UserStore
 }
 
-func (h *LogInApiHandler) Delete(w http.ResponseWriter, r *http.Request, c *RequestContext) {
-	if c.Session.UserName == "" {
-		log.Printf("%s User not logged in\n", c.GetLogMessagePrefix())
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+const maxVCardImportSize = 5 * 1024 * 1024
+
+func (h *VCardsApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	userId := c.GetParam("userId")
+	grant, ok := checkContactAccess(h.Store, w, c, userId, "", !isReadMethod(r))
+	if !ok {
+		return false
+	}
+
+	c.Data["UserId"] = userId
+	c.Data["Grant"] = grant
+	return true
+}
+
+func (h *VCardsApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
 		return
 	}
+	userId := c.Data["UserId"].(string)
 
-	c.Session.UserName = ""
+	version := getVCardVersionParameter(r)
+	if !IsSupportedVCardVersion(version) {
+		log.Printf("%s Unsupported vCard version %s\n", c.GetLogMessagePrefix(), version)
+		WriteProblem(w, c, http.StatusBadRequest, fmt.Sprintf("Unsupported vCard version [%s]", version))
+		return
+	}
+
+	user, err := h.Store.Get(userId)
+	if err != nil {
+		log.Printf("%s Error detected when trying to get user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	contacts := c.Data["Grant"].(*Grant).FilterContacts(user.Contacts)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.vcf"`, userId))
+	for index := range contacts {
+		if err := EncodeVCard(w, &contacts[index], version); err != nil {
+			log.Printf("%s Error detected when trying to encode vCards for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+			return
+		}
+	}
 }
 
-func (h *LogInApiHandler) Post(w http.ResponseWriter, r *http.Request, c *RequestContext) {
-	if c.Session.UserName != "" {
-		log.Printf("%s User %s already logged in, must log out first\n", c.GetLogMessagePrefix(), c.Session.UserName)
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+func (h *VCardsApiHandler) Post(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
 		return
 	}
+	userId := c.Data["UserId"].(string)
 
-	var credentials map[string]string
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&credentials)
+	results, err := DecodeVCards(http.MaxBytesReader(w, r.Body, maxVCardImportSize))
 	if err != nil {
-		log.Printf("%s Error detected when trying to decode credentials : %s\n", c.GetLogMessagePrefix(), err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		log.Printf("%s Error detected when trying to decode vCards for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	userId, ok := credentials["UserName"]
-	if !ok {
-		log.Printf("%s User name not suppplied\n", c.GetLogMessagePrefix())
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	saveImportedContacts(h.Store, userId, results, false, w, c)
+}
+
+// vCard api handler - export a single contact
+type VCardApiHandler struct {
+	Store UserStore
+}
+
+func (h *VCardApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	userId, contactId := c.GetParam("userId"), c.GetParam("contactId")
+	if _, ok := checkContactAccess(h.Store, w, c, userId, contactId, false); !ok {
 		return
 	}
 
-	password, ok := credentials["Password"]
-	if !ok {
-		log.Printf("%s Password not suppplied\n", c.GetLogMessagePrefix())
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	version := getVCardVersionParameter(r)
+	if !IsSupportedVCardVersion(version) {
+		log.Printf("%s Unsupported vCard version %s\n", c.GetLogMessagePrefix(), version)
+		WriteProblem(w, c, http.StatusBadRequest, fmt.Sprintf("Unsupported vCard version [%s]", version))
 		return
 	}
 
-	user, err := h.Store.Get(userId)
+	contact, err := h.Store.GetContact(userId, contactId)
+	if err == ErrContactNotFound || err == ErrUserNotFound {
+		log.Printf("%s Contact not found for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusNotFound, "Contact not found")
+		return
+	}
 	if err != nil {
-		log.Printf("%s User record not found for user id %s\n", c.GetLogMessagePrefix(), userId)
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		log.Printf("%s Error detected when trying to get contact for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
 		return
 	}
-	if !user.Authenticate(password) {
-		log.Printf("%s User password is incorrect for user id %s\n", c.GetLogMessagePrefix(), userId)
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.vcf"`, contactId))
+	if err := EncodeVCard(w, contact, version); err != nil {
+		log.Printf("%s Error detected when trying to encode vCard for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
 		return
 	}
+}
 
-	c.Session.UserName = user.Id
+func getVCardVersionParameter(r *http.Request) string {
+	if version := r.URL.Query().Get("version"); version != "" {
+		return version
+	}
+
+	return vCardVersion3
+}
+
+// Contact photo api handler - multipart/form-data upload with a photo part, ?size=thumbnail gets the thumbnail
+type ContactPhotoApiHandler struct {
+	Store UserStore
+	Blobs BlobStore
+}
+
+const maxPhotoRequestSize = maxPhotoSize + 64*1024 // Allows for the multipart headers and boundaries
+
+func (h *ContactPhotoApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	userId, contactId := c.GetParam("userId"), c.GetParam("contactId")
+	if _, ok := checkContactAccess(h.Store, w, c, userId, contactId, !isReadMethod(r)); !ok {
+		return false
+	}
+
+	_, err := h.Store.GetContact(userId, contactId)
+	if err == ErrContactNotFound || err == ErrUserNotFound {
+		log.Printf("%s Contact not found for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusNotFound, "Contact not found")
+		return false
+	}
+	if err != nil {
+		log.Printf("%s Error detected when trying to get contact for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return false
+	}
+
+	c.Data["UserId"] = userId
+	c.Data["ContactId"] = contactId
+	return true
+}
+
+func (h *ContactPhotoApiHandler) Delete(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	userId := c.Data["UserId"].(string)
+	contactId := c.Data["ContactId"].(string)
+
+	_, err := h.Blobs.Get(getContactPhotoKey(userId, contactId, PhotoSizeOriginal))
+	if err == ErrBlobNotFound {
+		log.Printf("%s Photo not found for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusNotFound, "Photo not found")
+		return
+	}
+	if err == nil {
+		err = DeleteContactPhoto(h.Blobs, userId, contactId)
+	}
+	if err != nil {
+		log.Printf("%s Error detected when deleting photo for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+// Photos are private so only the browser may cache them, and must revalidate as a photo can be replaced at the same url
+func (h *ContactPhotoApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	userId := c.Data["UserId"].(string)
+	contactId := c.Data["ContactId"].(string)
+
+	size := r.URL.Query().Get("size")
+	if size != PhotoSizeOriginal && size != PhotoSizeThumbnail {
+		log.Printf("%s Unknown photo size %s for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), size, userId, contactId)
+		WriteProblem(w, c, http.StatusBadRequest, fmt.Sprintf("Unknown photo size [%s], size can only be %s", size, PhotoSizeThumbnail))
+		return
+	}
+
+	blob, err := h.Blobs.Get(getContactPhotoKey(userId, contactId, size))
+	if err == ErrBlobNotFound {
+		log.Printf("%s Photo not found for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusNotFound, "Photo not found")
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when trying to get photo for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	etag := GetContentETag(blob.Data)
+	modifiedAt := blob.ModifiedAt.Truncate(time.Second)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modifiedAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if IsETagMatch(ifNoneMatch, etag, true) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modifiedAt.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", blob.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(blob.Data)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := w.Write(blob.Data); err != nil {
+		log.Printf("%s Error detected when trying to write photo for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+	}
+}
+
+// Adds or replaces the photo
+func (h *ContactPhotoApiHandler) Put(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	userId := c.Data["UserId"].(string)
+	contactId := c.Data["ContactId"].(string)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPhotoRequestSize)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		log.Printf("%s Error detected when trying to read photo upload for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusUnsupportedMediaType, "Content type must be multipart/form-data")
+		return
+	}
+
+	var data []byte
+	for data == nil {
+		part, err := reader.NextPart()
+		if err != nil {
+			log.Printf("%s No photo part in upload for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+			WriteProblem(w, c, http.StatusBadRequest, "Request body must be multipart/form-data with a photo part")
+			return
+		}
+		if part.FormName() != "photo" {
+			continue
+		}
+
+		if partContentType := part.Header.Get("Content-Type"); partContentType != "" && partContentType != "application/octet-stream" && !IsSupportedPhotoContentType(partContentType) {
+			log.Printf("%s Unsupported photo content type %s for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), partContentType, userId, contactId)
+			WriteProblem(w, c, http.StatusUnsupportedMediaType, ErrUnsupportedPhotoType.Error())
+			return
+		}
+
+		if data, err = ioutil.ReadAll(io.LimitReader(part, maxPhotoSize+1)); err != nil && len(data) <= maxPhotoSize {
+			log.Printf("%s Error detected when trying to read photo for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+			WriteProblem(w, c, http.StatusBadRequest, "Request body is not a valid photo upload")
+			return
+		}
+	}
+	if len(data) > maxPhotoSize {
+		log.Printf("%s Photo too large for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Photo exceeds %d bytes", maxPhotoSize))
+		return
+	}
+
+	photo, thumbnail, err := NewContactPhoto(data)
+	if err == ErrUnsupportedPhotoType {
+		log.Printf("%s Unsupported photo for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+		WriteProblem(w, c, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+	if err == ErrInvalidPhoto || err == ErrPhotoDimensions {
+		log.Printf("%s Invalid photo for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when trying to generate thumbnail for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	// Thumbnail first so there is never a photo without a thumbnail
+	err = h.Blobs.Put(getContactPhotoKey(userId, contactId, PhotoSizeThumbnail), thumbnail)
+	if err == nil {
+		err = h.Blobs.Put(getContactPhotoKey(userId, contactId, PhotoSizeOriginal), photo)
+	}
+	if err != nil {
+		log.Printf("%s Error detected when saving photo for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("ETag", GetContentETag(photo.Data))
+}
+
+// Contact duplicates api handler - likely duplicates among the contacts the context user can see, see FindDuplicateContacts
+type ContactDuplicatesApiHandler struct {
+	Store UserStore
+}
+
+func (h *ContactDuplicatesApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	userId := c.GetParam("userId")
+	grant, ok := checkContactAccess(h.Store, w, c, userId, "", false)
+	if !ok {
+		return false
+	}
+
+	c.Data["UserId"] = userId
+	c.Data["Grant"] = grant
+	return true
+}
+
+/*
+Query parameters
+
+	minScore=0.8	Only pairs scoring at least this, greater than 0 and up to 1, default DefaultMinDuplicateScore
+*/
+func (h *ContactDuplicatesApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	userId := c.Data["UserId"].(string)
+
+	minScore := DefaultMinDuplicateScore
+	if value := r.URL.Query().Get("minScore"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed <= 0 || parsed > 1 {
+			log.Printf("%s Invalid minScore %s for user with id %s\n", c.GetLogMessagePrefix(), value, userId)
+			WriteProblem(w, c, http.StatusBadRequest, fmt.Sprintf("Invalid minScore [%s], must be greater than 0 and up to 1", value))
+			return
+		}
+		minScore = parsed
+	}
+
+	user, err := h.Store.Get(userId)
+	if err != nil {
+		log.Printf("%s Error detected when trying to get user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	duplicates := FindDuplicateContacts(c.Data["Grant"].(*Grant).FilterContacts(user.Contacts), minScore)
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(duplicates); err != nil {
+		log.Printf("%s Error detected when trying to encode duplicates for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+// Contact merge api handler - combines contacts into the first, the others are deleted, see CombineContacts
+type ContactMergeApiHandler struct {
+	Store UserStore
+	Blobs BlobStore // Optional, the merged contact takes the first photo if it has none, the other photos are deleted
+}
+
+const maxMergeRequestSize = 64 * 1024
+
+func (h *ContactMergeApiHandler) GenerateUrl(userId, contactId string) string {
+	return fmt.Sprintf("/api/v1/contacts/%s/%s", userId, contactId)
+}
+
+// Merges, i.e. {"ContactIds": ["ted", "ted-toe"]}, responds with the merged contact
+func (h *ContactMergeApiHandler) Post(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	userId := c.GetParam("userId")
+
+	var request struct {
+		ContactIds []string
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMergeRequestSize))
+	if err := decoder.Decode(&request); err != nil {
+		log.Printf("%s Error detected when trying to decode merge for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusBadRequest, "Request body is not a valid merge")
+		return
+	}
+	// Before any store access as each id costs an access check and a read
+	if err := CheckMergeContactIds(request.ContactIds); err != nil {
+		log.Printf("%s Invalid merge for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Every contact is written, the merged contact is replaced and the others deleted
+	if _, ok := checkContactAccess(h.Store, w, c, userId, "", false); !ok {
+		return
+	}
+	for _, contactId := range request.ContactIds {
+		if _, ok := checkContactAccess(h.Store, w, c, userId, contactId, true); !ok {
+			return
+		}
+	}
+
+	contacts := make([]Contact, 0, len(request.ContactIds))
+	expectedVersions := make(map[string]int64)
+	for _, contactId := range request.ContactIds {
+		contact, err := h.Store.GetContact(userId, contactId)
+		if err == ErrContactNotFound || err == ErrUserNotFound {
+			log.Printf("%s Contact not found for user with id %s and contact with id %s\n", c.GetLogMessagePrefix(), userId, contactId)
+			WriteProblem(w, c, http.StatusNotFound, fmt.Sprintf("Contact [%s] not found", contactId))
+			return
+		}
+		if err != nil {
+			log.Printf("%s Error detected when trying to get contact for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, contactId, err)
+			WriteProblem(w, c, http.StatusInternalServerError, "")
+			return
+		}
+		contacts = append(contacts, *contact)
+		expectedVersions[contactId] = contact.Version
+	}
+
+	merged, err := CombineContacts(contacts)
+	if err != nil {
+		log.Printf("%s Invalid merge for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if valid, err := merged.IsValidForSaving(); !valid {
+		log.Printf("%s Merged contact is not valid for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteValidationProblem(w, c, err)
+		return
+	}
+
+	err = h.Store.MergeContacts(userId, merged, expectedVersions)
+	if err == ErrVersionConflict || err == ErrContactNotFound {
+		log.Printf("%s Conflict when merging contacts for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusConflict, "Contacts changed while merging")
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when merging contacts for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	if h.Blobs != nil {
+		if err := MergeContactPhotos(h.Blobs, userId, merged.Id, request.ContactIds[1:]); err != nil {
+			log.Printf("%s Error detected when merging photos for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), userId, merged.Id, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Location", h.GenerateUrl(userId, merged.Id))
+	w.Header().Set("ETag", GetContactETag(merged))
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(merged); err != nil {
+		log.Printf("%s Error detected when trying to encode merged contact for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+	}
+}
+
+// CSV api handler - export all contacts or bulk import with an optional column mapping
+type CsvApiHandler struct {
+	Store UserStore
+}
+
+const maxCsvImportSize = 5 * 1024 * 1024
+
+func (h *CsvApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	userId := c.GetParam("userId")
+	grant, ok := checkContactAccess(h.Store, w, c, userId, "", !isReadMethod(r))
+	if !ok {
+		return false
+	}
+
+	c.Data["UserId"] = userId
+	c.Data["Grant"] = grant
+	return true
+}
+
+func (h *CsvApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	userId := c.Data["UserId"].(string)
+
+	user, err := h.Store.Get(userId)
+	if err != nil {
+		log.Printf("%s Error detected when trying to get user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, userId))
+	if err := EncodeContactsCsv(w, c.Data["Grant"].(*Grant).FilterContacts(user.Contacts)); err != nil {
+		log.Printf("%s Error detected when trying to encode CSV for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		return
+	}
+}
+
+/*
+Query parameters
+
+	map=E-mail:Email1Address	Maps a CSV header to a contact field, repeat for each header, headers that are field names need no mapping
+	dryRun=true			Validate and report only, nothing is saved
+*/
+func (h *CsvApiHandler) Post(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	userId := c.Data["UserId"].(string)
+
+	query := r.URL.Query()
+	mapping, err := ParseCsvColumnMapping(query["map"])
+	if err != nil {
+		log.Printf("%s Invalid CSV column mapping : %s\n", c.GetLogMessagePrefix(), err)
+		WriteProblem(w, c, http.StatusBadRequest, err.Error())
+		return
+	}
+	dryRun, err := strconv.ParseBool(query.Get("dryRun"))
+	if err != nil && query.Get("dryRun") != "" {
+		log.Printf("%s Invalid dryRun %s\n", c.GetLogMessagePrefix(), query.Get("dryRun"))
+		WriteProblem(w, c, http.StatusBadRequest, fmt.Sprintf("Invalid dryRun [%s]", query.Get("dryRun")))
+		return
+	}
+
+	results, err := DecodeContactsCsv(http.MaxBytesReader(w, r.Body, maxCsvImportSize), mapping)
+	if err != nil {
+		log.Printf("%s Error detected when trying to decode CSV for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	saveImportedContacts(h.Store, userId, results, dryRun, w, c)
+}
+
+/*
+Validates decoded contacts, saves the valid ones as a single store update and writes the import report
+Ids that cannot be used as resource ids, or are reserved, are replaced, so re-importing an export updates rather than duplicates
+A contact that already exists keeps its stored values for the fields the import has no values for, so a vCard or CSV
+round trip does not erase them
+*/
+func saveImportedContacts(store UserStore, userId string, results []ContactDecodeResult, dryRun bool, w http.ResponseWriter, c *RequestContext) {
+	user, err := store.Get(userId)
+	if err != nil {
+		log.Printf("%s Error detected when trying to get user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+	stored := make(map[string]*Contact, len(user.Contacts))
+	for index := range user.Contacts {
+		stored[user.Contacts[index].Id] = &user.Contacts[index]
+	}
+
+	report := &ImportReport{DryRun: dryRun}
+	contacts := make([]Contact, 0, len(results))
+	for index, result := range results {
+		contact := result.Contact
+		if result.Err != nil {
+			report.AddError(index+1, contact.Id, result.Err)
+			continue
+		}
+
+		if !resourceIdPattern.MatchString(contact.Id) || IsReservedContactId(contact.Id) {
+			contact.Id = Uuid()
+		}
+		if storedContact, ok := stored[contact.Id]; ok {
+			contact.CopyFields(storedContact, result.Unmapped)
+		}
+		contact.Normalise()
+		if valid, err := (&contact).IsValidForSaving(); !valid {
+			report.AddError(index+1, contact.Id, err)
+			continue
+		}
+
+		contacts = append(contacts, contact)
+	}
+
+	if !dryRun && len(contacts) > 0 {
+		err := store.SaveContacts(userId, contacts)
+		if err == ErrStoreContention {
+			log.Printf("%s Contention when saving imported contacts for user with id %s\n", c.GetLogMessagePrefix(), userId)
+			writeStoreContentionProblem(w, c)
+			return
+		}
+		if err != nil {
+			log.Printf("%s Error detected when saving imported contacts for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+			WriteProblem(w, c, http.StatusInternalServerError, "")
+			return
+		}
+	}
+	report.Imported = len(contacts)
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(report); err != nil {
+		log.Printf("%s Error detected when trying to encode import report for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+// LogIn api handler
+type LogInApiHandler struct {
+	Store    UserStore
+	Throttle *LoginThrottle // Optional, limits password guessing
+}
+
+// Issues the session's CSRF token in the X-CSRF-Token header, needed before logging in
+func (h *LogInApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	SetCsrfTokenHeader(w, c.Session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *LogInApiHandler) Delete(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if c.Session.UserName == "" {
+		log.Printf("%s User not logged in\n", c.GetLogMessagePrefix())
+		WriteProblem(w, c, http.StatusForbidden, "Not logged in")
+		return
+	}
+
+	c.RegenerateSessionId()
+	c.Session.UserName = ""
+	SetCsrfTokenHeader(w, c.Session)
+}
+
+func (h *LogInApiHandler) Post(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if c.Session.UserName != "" {
+		log.Printf("%s User %s already logged in, must log out first\n", c.GetLogMessagePrefix(), c.Session.UserName)
+		WriteProblem(w, c, http.StatusForbidden, "Already logged in, must log out first")
+		return
+	}
+
+	var credentials map[string]string
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&credentials)
+	if err != nil {
+		log.Printf("%s Error detected when trying to decode credentials : %s\n", c.GetLogMessagePrefix(), err)
+		WriteProblem(w, c, http.StatusBadRequest, "Request body is not valid credentials")
+		return
+	}
+
+	userId, ok := credentials["UserName"]
+	if !ok {
+		log.Printf("%s User name not suppplied\n", c.GetLogMessagePrefix())
+		WriteProblem(w, c, http.StatusBadRequest, "User name not supplied")
+		return
+	}
+
+	password, ok := credentials["Password"]
+	if !ok {
+		log.Printf("%s Password not suppplied\n", c.GetLogMessagePrefix())
+		WriteProblem(w, c, http.StatusBadRequest, "Password not supplied")
+		return
+	}
+
+	ip := GetClientIp(r)
+	if h.Throttle != nil {
+		wait, err := h.Throttle.Reserve(userId, ip)
+		if err != nil {
+			log.Printf("%s Error detected when trying to check log in attempts : %s\n", c.GetLogMessagePrefix(), err)
+			WriteProblem(w, c, http.StatusInternalServerError, "")
+			return
+		}
+		if wait > 0 {
+			log.Printf("%s Log in for user id %s from %s is locked out for %s\n", c.GetLogMessagePrefix(), userId, ip, wait)
+			w.Header().Set("Retry-After", strconv.FormatInt(getRetryAfterSeconds(wait), 10))
+			WriteProblem(w, c, http.StatusTooManyRequests, "Too many failed log in attempts, try again later")
+			return
+		}
+	}
+
+	user, err := h.Store.Get(userId)
+	if err != nil {
+		log.Printf("%s User record not found for user id %s\n", c.GetLogMessagePrefix(), userId)
+		VerifyDummyPassword(password)
+		h.recordFailure(c, userId, ip)
+		WriteProblem(w, c, http.StatusUnauthorized, "Invalid user name or password")
+		return
+	}
+	if !user.Authenticate(password) {
+		log.Printf("%s User password is incorrect for user id %s\n", c.GetLogMessagePrefix(), userId)
+		h.recordFailure(c, userId, ip)
+		WriteProblem(w, c, http.StatusUnauthorized, "Invalid user name or password")
+		return
+	}
+	if h.Throttle != nil {
+		if err := h.Throttle.RecordSuccess(c, userId, ip); err != nil {
+			log.Printf("%s Error detected when trying to reset log in attempts : %s\n", c.GetLogMessagePrefix(), err)
+		}
+	}
+
+	if user.PasswordNeedsRehash() {
+		// Failure here should not prevent the log in, we will try again next time
+		if err := user.SetPassword(password); err != nil {
+			log.Printf("%s Error detected when trying to rehash password for user id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		} else if err := h.Store.SavePassword(user.Id, user.Password); err != nil {
+			log.Printf("%s Error detected when saving rehashed password for user id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		}
+	}
+
+	// New id so a session id planted before log in is not logged in too
+	c.RegenerateSessionId()
+	c.Session.UserName = user.Id
+	SetCsrfTokenHeader(w, c.Session)
+}
+
+// A failure to record is only logged, the caller still gets the 401
+func (h *LogInApiHandler) recordFailure(c *RequestContext, userId, ip string) {
+	if h.Throttle == nil {
+		return
+	}
+
+	if err := h.Throttle.RecordFailure(c, userId, ip); err != nil {
+		log.Printf("%s Error detected when trying to record failed log in attempt : %s\n", c.GetLogMessagePrefix(), err)
+	}
+}
+
+// Users api handler - sign up, does not need an authenticated user
+type UsersApiHandler struct {
+	Store UserStore
+}
+
+func (h *UsersApiHandler) GenerateUrl(userId string) string {
+	return fmt.Sprintf("/api/v1/users/%s", userId)
+}
+
+func (h *UsersApiHandler) Post(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if c.GetUserName() != "" {
+		log.Printf("%s User %s already logged in, must log out first\n", c.GetLogMessagePrefix(), c.GetUserName())
+		WriteProblem(w, c, http.StatusForbidden, "Already logged in, must log out first")
+		return
+	}
+
+	var signUp struct {
+		UserProfile
+		Password string
+	}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&signUp)
+	if err != nil {
+		log.Printf("%s Error detected when trying to decode sign up : %s\n", c.GetLogMessagePrefix(), err)
+		WriteProblem(w, c, http.StatusBadRequest, "Request body is not a valid sign up")
+		return
+	}
+	if isEmptyString(signUp.Password) {
+		log.Printf("%s Password not suppplied\n", c.GetLogMessagePrefix())
+		WriteProblem(w, c, http.StatusBadRequest, "Password not supplied")
+		return
+	}
+
+	user := &User{
+		Id:        signUp.Id,
+		FirstName: signUp.FirstName,
+		LastName:  signUp.LastName,
+		Email:     signUp.Email,
+		Contacts:  make([]Contact, 0),
+	}
+	if err := user.SetPassword(signUp.Password); err != nil {
+		log.Printf("%s Error detected when trying to hash password for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+	if valid, err := user.IsValidForSaving(); !valid {
+		log.Printf("%s User state is not valid for saving for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteValidationProblem(w, c, err)
+		return
+	}
+
+	err = h.Store.Create(user)
+	if err == ErrDuplicateUserId || err == ErrDuplicateEmail {
+		log.Printf("%s Conflict when creating user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when creating user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Location", h.GenerateUrl(user.Id))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// User api handler - profile and account for the logged in user, admins can manage any user
+type UserApiHandler struct {
+	Store UserStore
+	Blobs BlobStore // Optional, deleting a user deletes their contacts' photos
+}
+
+func (h *UserApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	return preProcessUserResource(h.Store, w, r, c)
+}
+
+func (h *UserApiHandler) Delete(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+
+	err := h.Store.Delete(user.Id)
+	if err != nil {
+		log.Printf("%s Error detected when deleting user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+	if h.Blobs != nil {
+		for _, contact := range user.Contacts {
+			if err := DeleteContactPhoto(h.Blobs, user.Id, contact.Id); err != nil {
+				log.Printf("%s Error detected when deleting photo for user with id %s and contact with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, contact.Id, err)
+			}
+		}
+	}
+
+	// Account is gone so log out, unless an admin deleted another user
+	if user.Id == c.GetUserName() {
+		c.RegenerateSessionId()
+		c.Session.UserName = ""
+		SetCsrfTokenHeader(w, c.Session)
+	}
+}
+
+func (h *UserApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(user.GetProfile()); err != nil {
+		log.Printf("%s Error detected when trying to encode profile for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+func (h *UserApiHandler) Put(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+
+	var profile UserProfile
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&profile)
+	if err != nil {
+		log.Printf("%s Error detected when trying to decode profile for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusBadRequest, "Request body is not a valid profile")
+		return
+	}
+	if profile.Id != "" && profile.Id != user.Id {
+		log.Printf("%s User id conflict url is %s put body is %s\n", c.GetLogMessagePrefix(), user.Id, profile.Id)
+		WriteProblem(w, c, http.StatusBadRequest, "User id in the body does not match the url")
+		return
+	}
+
+	user.FirstName, user.LastName, user.Email = profile.FirstName, profile.LastName, profile.Email
+	if valid, err := user.IsValidForSaving(); !valid {
+		log.Printf("%s User state is not valid for saving for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteValidationProblem(w, c, err)
+		return
+	}
+
+	err = h.Store.SaveProfile(user)
+	if err == ErrDuplicateEmail {
+		log.Printf("%s Conflict when saving user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when saving user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+// User password api handler
+type UserPasswordApiHandler struct {
+	Store UserStore
+}
+
+func (h *UserPasswordApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	return preProcessUserResource(h.Store, w, r, c)
+}
+
+func (h *UserPasswordApiHandler) Put(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+
+	var passwordChange struct {
+		CurrentPassword string
+		NewPassword     string
+	}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&passwordChange)
+	if err != nil {
+		log.Printf("%s Error detected when trying to decode password change for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusBadRequest, "Request body is not a valid password change")
+		return
+	}
+	if isEmptyString(passwordChange.NewPassword) {
+		log.Printf("%s New password not suppplied for user with id %s\n", c.GetLogMessagePrefix(), user.Id)
+		WriteProblem(w, c, http.StatusBadRequest, "New password not supplied")
+		return
+	}
+	// Admins resetting another user's password do not know the current one
+	if user.Id == c.GetUserName() && !user.Authenticate(passwordChange.CurrentPassword) {
+		log.Printf("%s Current password is incorrect for user id %s\n", c.GetLogMessagePrefix(), user.Id)
+		WriteProblem(w, c, http.StatusForbidden, "Current password is incorrect")
+		return
+	}
+
+	if err := user.SetPassword(passwordChange.NewPassword); err != nil {
+		log.Printf("%s Error detected when trying to hash password for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	err = h.Store.SavePassword(user.Id, user.Password)
+	if err != nil {
+		log.Printf("%s Error detected when saving password for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+// API tokens api handler - list and create the logged in user's API tokens
+type ApiTokensApiHandler struct {
+	Store UserStore
+}
+
+func (h *ApiTokensApiHandler) GenerateUrl(userId, tokenId string) string {
+	return fmt.Sprintf("/api/v1/users/%s/tokens/%s", userId, tokenId)
+}
+
+func (h *ApiTokensApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	return preProcessUserResource(h.Store, w, r, c)
+}
+
+func (h *ApiTokensApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+
+	tokens, err := h.Store.GetApiTokens(user.Id)
+	if err != nil {
+		log.Printf("%s Error detected when trying to get API tokens for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	infos := make([]ApiTokenInfo, len(tokens))
+	for index := range tokens {
+		infos[index] = tokens[index].GetInfo()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(infos); err != nil {
+		log.Printf("%s Error detected when trying to encode API tokens for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+// The token is only in this response, the store only has its hash
+func (h *ApiTokensApiHandler) Post(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+
+	// Otherwise a leaked token could be used to create tokens which outlive its revocation
+	if c.ApiToken != nil {
+		log.Printf("%s API token %s cannot create API tokens\n", c.GetLogMessagePrefix(), c.ApiToken.Id)
+		WriteProblem(w, c, http.StatusForbidden, "API tokens can only be created when logged in")
+		return
+	}
+	// Admins can revoke but not create, a token would let them act as the user
+	if user.Id != c.GetUserName() {
+		log.Printf("%s User %s cannot create API tokens for user with id %s\n", c.GetLogMessagePrefix(), c.GetUserName(), user.Id)
+		WriteProblem(w, c, http.StatusForbidden, "API tokens can only be created by their user")
+		return
+	}
+
+	var request struct {
+		Name string
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		log.Printf("%s Error detected when trying to decode API token request for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusBadRequest, "Request body is not a valid API token request")
+		return
+	}
+
+	var errs ValidationErrors
+	errs.CheckLength("Name", request.Name, "Name", maxApiTokenNameLength)
+	if err := errs.AsError(); err != nil {
+		log.Printf("%s API token request is not valid for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteValidationProblem(w, c, err)
+		return
+	}
+
+	apiToken, token, err := NewApiToken(user.Id, request.Name)
+	if err != nil {
+		log.Printf("%s Error detected when trying to generate API token for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+	if err := h.Store.CreateApiToken(apiToken); err != nil {
+		log.Printf("%s Error detected when creating API token for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	var response struct {
+		ApiTokenInfo
+		Token string
+	}
+	response.ApiTokenInfo = apiToken.GetInfo()
+	response.Token = token
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Location", h.GenerateUrl(user.Id, apiToken.Id))
+	w.WriteHeader(http.StatusCreated)
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(response); err != nil {
+		log.Printf("%s Error detected when trying to encode API token for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+	}
+}
+
+// API token api handler - revocation
+type ApiTokenApiHandler struct {
+	Store UserStore
+}
+
+func (h *ApiTokenApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	return preProcessUserResource(h.Store, w, r, c)
+}
+
+func (h *ApiTokenApiHandler) Delete(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+	tokenId := c.GetParam("tokenId")
+
+	err := h.Store.DeleteApiToken(user.Id, tokenId)
+	if err == ErrApiTokenNotFound {
+		log.Printf("%s API token %s not found for user with id %s\n", c.GetLogMessagePrefix(), tokenId, user.Id)
+		WriteProblem(w, c, http.StatusNotFound, "API token not found")
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when deleting API token %s for user with id %s : %s\n", c.GetLogMessagePrefix(), tokenId, user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+// User roles api handler - only admins can change roles, users can see their roles in their profile
+type UserRolesApiHandler struct {
+	Store UserStore
+}
+
+func (h *UserRolesApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	isAdmin, err := IsAdmin(h.Store, c)
+	if err != nil {
+		log.Printf("%s Error detected when trying to get roles for user with id %s : %s\n", c.GetLogMessagePrefix(), c.GetUserName(), err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return false
+	}
+	if !isAdmin {
+		log.Printf("%s Forbidden, context user id %s is not an admin\n", c.GetLogMessagePrefix(), c.GetUserName())
+		WriteProblem(w, c, http.StatusForbidden, "Only admins can change roles")
+		return false
+	}
+
+	return preProcessUserResource(h.Store, w, r, c)
+}
+
+// Replaces the user's roles, i.e. ["admin"] or [] to remove all roles
+func (h *UserRolesApiHandler) Put(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+
+	var roles []string
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&roles); err != nil {
+		log.Printf("%s Error detected when trying to decode roles for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusBadRequest, "Request body is not a valid list of roles")
+		return
+	}
+
+	var errs ValidationErrors
+	user.Roles = make([]string, 0, len(roles))
+	for index, role := range roles {
+		if !IsValidRole(role) {
+			errs.Add(fmt.Sprintf("[%d]", index), fmt.Sprintf("Unknown role [%s]", role))
+		} else if !user.HasRole(role) {
+			user.Roles = append(user.Roles, role)
+		}
+	}
+	if err := errs.AsError(); err != nil {
+		log.Printf("%s Roles are not valid for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteValidationProblem(w, c, err)
+		return
+	}
+
+	if err := h.Store.SetRoles(user.Id, user.Roles); err != nil {
+		log.Printf("%s Error detected when saving roles for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+	log.Printf("%s Roles for user with id %s set to %v\n", c.GetLogMessagePrefix(), user.Id, user.Roles)
+}
+
+// Grants api handler - lists the grants the user has given
+type GrantsApiHandler struct {
+	Store UserStore
+}
+
+func (h *GrantsApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	return preProcessUserResource(h.Store, w, r, c)
+}
+
+func (h *GrantsApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+
+	grants, err := h.Store.GetGrants(user.Id)
+	if err != nil {
+		log.Printf("%s Error detected when trying to get grants for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	writeGrants(w, c, user.Id, grants)
+}
+
+// Shared grants api handler - lists the grants the user has been given, i.e. the contacts shared with them
+type SharedGrantsApiHandler struct {
+	Store UserStore
+}
+
+func (h *SharedGrantsApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	return preProcessUserResource(h.Store, w, r, c)
+}
+
+func (h *SharedGrantsApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+
+	grants, err := h.Store.GetSharedGrants(user.Id)
+	if err != nil {
+		log.Printf("%s Error detected when trying to get shared grants for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	writeGrants(w, c, user.Id, grants)
+}
+
+func writeGrants(w http.ResponseWriter, c *RequestContext, userId string, grants []Grant) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(grants); err != nil {
+		log.Printf("%s Error detected when trying to encode grants for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+// Grant api handler - the user's grant to another user, the grantee id is in the url
+type GrantApiHandler struct {
+	Store UserStore
+}
+
+func (h *GrantApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	if !preProcessUserResource(h.Store, w, r, c) {
+		return false
+	}
+
+	c.Data["GranteeId"] = c.GetParam("granteeId")
+	return true
+}
+
+func (h *GrantApiHandler) Delete(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+	granteeId := c.Data["GranteeId"].(string)
+
+	err := h.Store.DeleteGrant(user.Id, granteeId)
+	if err == ErrGrantNotFound {
+		log.Printf("%s Grant not found for user with id %s and grantee with id %s\n", c.GetLogMessagePrefix(), user.Id, granteeId)
+		WriteProblem(w, c, http.StatusNotFound, "Grant not found")
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when deleting grant for user with id %s and grantee with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, granteeId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+func (h *GrantApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+	granteeId := c.Data["GranteeId"].(string)
+
+	grant, err := h.Store.GetGrant(user.Id, granteeId)
+	if err == ErrGrantNotFound {
+		log.Printf("%s Grant not found for user with id %s and grantee with id %s\n", c.GetLogMessagePrefix(), user.Id, granteeId)
+		WriteProblem(w, c, http.StatusNotFound, "Grant not found")
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when trying to get grant for user with id %s and grantee with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, granteeId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(grant); err != nil {
+		log.Printf("%s Error detected when trying to encode grant for user with id %s and grantee with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, granteeId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+// Creates or replaces the grant, i.e. {"Access": "read", "ContactIds": ["bbb"]}, no contact ids for all contacts
+func (h *GrantApiHandler) Put(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+	granteeId := c.Data["GranteeId"].(string)
+
+	var request struct {
+		Access     string
+		ContactIds []string
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		log.Printf("%s Error detected when trying to decode grant for user with id %s and grantee with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, granteeId, err)
+		WriteProblem(w, c, http.StatusBadRequest, "Request body is not a valid grant")
+		return
+	}
+
+	grant := &Grant{
+		OwnerId:   user.Id,
+		GranteeId: granteeId,
+		Access:    request.Access,
+		CreatedAt: time.Now().UTC(),
+	}
+	seen := make(map[string]bool)
+	for _, contactId := range request.ContactIds {
+		if !seen[contactId] {
+			seen[contactId] = true
+			grant.ContactIds = append(grant.ContactIds, contactId)
+		}
+	}
+	if valid, err := grant.IsValidForSaving(); !valid {
+		log.Printf("%s Grant is not valid for user with id %s and grantee with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, granteeId, err)
+		WriteValidationProblem(w, c, err)
+		return
+	}
+
+	err := h.Store.SaveGrant(grant)
+	if err == ErrUserNotFound {
+		log.Printf("%s Grantee not found for user with id %s and grantee with id %s\n", c.GetLogMessagePrefix(), user.Id, granteeId)
+		WriteProblem(w, c, http.StatusNotFound, "Grantee not found")
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when saving grant for user with id %s and grantee with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, granteeId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+// Groups api handler - lists and creates the user's contact groups
+type GroupsApiHandler struct {
+	Store UserStore
+}
+
+func (h *GroupsApiHandler) GenerateUrl(userId, groupId string) string {
+	return fmt.Sprintf("/api/v1/users/%s/groups/%s", userId, groupId)
+}
+
+func (h *GroupsApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	return preProcessUserResource(h.Store, w, r, c)
+}
+
+func (h *GroupsApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+
+	groups, err := h.Store.GetGroups(user.Id)
+	if err != nil {
+		log.Printf("%s Error detected when trying to get groups for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(groups); err != nil {
+		log.Printf("%s Error detected when trying to encode groups for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+// Creates a group, i.e. {"Name": "Customers"}
+func (h *GroupsApiHandler) Post(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+
+	group, ok := decodeGroup(w, r, c, user.Id)
+	if !ok {
+		return
+	}
+	group.Id = Uuid()
+
+	err := h.Store.CreateGroup(user.Id, group)
+	if err == ErrDuplicateGroupName {
+		log.Printf("%s Conflict when creating group for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when creating group for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", h.GenerateUrl(user.Id, group.Id))
+	w.WriteHeader(http.StatusCreated)
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(group); err != nil {
+		log.Printf("%s Error detected when trying to encode group for user with id %s : %s\n", c.GetLogMessagePrefix(), user.Id, err)
+	}
+}
+
+// Group api handler - get, rename or delete one of the user's contact groups, deleting a group does not delete its contacts
+type GroupApiHandler struct {
+	Store UserStore
+}
+
+func (h *GroupApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	if !preProcessUserResource(h.Store, w, r, c) {
+		return false
+	}
+
+	c.Data["GroupId"] = c.GetParam("groupId")
+	return true
+}
+
+func (h *GroupApiHandler) Delete(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+	groupId := c.Data["GroupId"].(string)
+
+	err := h.Store.DeleteGroup(user.Id, groupId)
+	if err == ErrGroupNotFound {
+		log.Printf("%s Group %s not found for user with id %s\n", c.GetLogMessagePrefix(), groupId, user.Id)
+		WriteProblem(w, c, http.StatusNotFound, "Group not found")
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when deleting group %s for user with id %s : %s\n", c.GetLogMessagePrefix(), groupId, user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+func (h *GroupApiHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+	groupId := c.Data["GroupId"].(string)
+
+	group, err := h.Store.GetGroup(user.Id, groupId)
+	if err == ErrGroupNotFound {
+		log.Printf("%s Group %s not found for user with id %s\n", c.GetLogMessagePrefix(), groupId, user.Id)
+		WriteProblem(w, c, http.StatusNotFound, "Group not found")
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when trying to get group %s for user with id %s : %s\n", c.GetLogMessagePrefix(), groupId, user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(group); err != nil {
+		log.Printf("%s Error detected when trying to encode group %s for user with id %s : %s\n", c.GetLogMessagePrefix(), groupId, user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+// Renames the group, i.e. {"Name": "Key customers"}
+func (h *GroupApiHandler) Put(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+	groupId := c.Data["GroupId"].(string)
+
+	group, ok := decodeGroup(w, r, c, user.Id)
+	if !ok {
+		return
+	}
+
+	err := h.Store.RenameGroup(user.Id, groupId, group.Name)
+	if err == ErrGroupNotFound {
+		log.Printf("%s Group %s not found for user with id %s\n", c.GetLogMessagePrefix(), groupId, user.Id)
+		WriteProblem(w, c, http.StatusNotFound, "Group not found")
+		return
+	}
+	if err == ErrDuplicateGroupName {
+		log.Printf("%s Conflict when renaming group %s for user with id %s : %s\n", c.GetLogMessagePrefix(), groupId, user.Id, err)
+		WriteProblem(w, c, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("%s Error detected when renaming group %s for user with id %s : %s\n", c.GetLogMessagePrefix(), groupId, user.Id, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+// Decodes and validates a group create or rename request, only the name is used
+func decodeGroup(w http.ResponseWriter, r *http.Request, c *RequestContext, userId string) (*Group, bool) {
+	var request struct {
+		Name string
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		log.Printf("%s Error detected when trying to decode group for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusBadRequest, "Request body is not a valid group")
+		return nil, false
+	}
+
+	group := &Group{Name: strings.TrimSpace(request.Name)}
+	if valid, err := group.IsValidForSaving(); !valid {
+		log.Printf("%s Group is not valid for user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteValidationProblem(w, c, err)
+		return nil, false
+	}
+
+	return group, true
+}
+
+// Group contact api handler - adds or removes one of the user's contacts to or from a group
+type GroupContactApiHandler struct {
+	Store UserStore
+}
+
+func (h *GroupContactApiHandler) PreProcess(w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	if !preProcessUserResource(h.Store, w, r, c) {
+		return false
+	}
+
+	c.Data["GroupId"] = c.GetParam("groupId")
+	c.Data["ContactId"] = c.GetParam("contactId")
+	return true
+}
+
+func (h *GroupContactApiHandler) Delete(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+	groupId, contactId := c.Data["GroupId"].(string), c.Data["ContactId"].(string)
+
+	err := h.Store.RemoveGroupContact(user.Id, groupId, contactId)
+	h.writeError(w, c, user.Id, groupId, contactId, err)
+}
+
+func (h *GroupContactApiHandler) Put(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if !h.PreProcess(w, r, c) {
+		return
+	}
+	user := c.Data["User"].(*User)
+	groupId, contactId := c.Data["GroupId"].(string), c.Data["ContactId"].(string)
+
+	err := h.Store.AddGroupContact(user.Id, groupId, contactId)
+	h.writeError(w, c, user.Id, groupId, contactId, err)
+}
+
+func (h *GroupContactApiHandler) writeError(w http.ResponseWriter, c *RequestContext, userId, groupId, contactId string, err error) {
+	switch err {
+	case nil:
+	case ErrGroupNotFound:
+		log.Printf("%s Group %s not found for user with id %s\n", c.GetLogMessagePrefix(), groupId, userId)
+		WriteProblem(w, c, http.StatusNotFound, "Group not found")
+	case ErrContactNotFound:
+		log.Printf("%s Contact %s not found in group %s for user with id %s\n", c.GetLogMessagePrefix(), contactId, groupId, userId)
+		WriteProblem(w, c, http.StatusNotFound, "Contact not found")
+	default:
+		log.Printf("%s Error detected when changing contact %s in group %s for user with id %s : %s\n", c.GetLogMessagePrefix(), contactId, groupId, userId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+	}
+}
+
+// Shared user resource pre processing - applies the forbidden check, only the user and admins, and loads the user
+func preProcessUserResource(store UserStore, w http.ResponseWriter, r *http.Request, c *RequestContext) bool {
+	userId := c.GetParam("userId")
+	if userId != c.GetUserName() {
+		isAdmin, err := IsAdmin(store, c)
+		if err != nil {
+			log.Printf("%s Error detected when trying to get roles for user with id %s : %s\n", c.GetLogMessagePrefix(), c.GetUserName(), err)
+			WriteProblem(w, c, http.StatusInternalServerError, "")
+			return false
+		}
+		if !isAdmin {
+			log.Printf("%s Forbidden, context user id %s\n", c.GetLogMessagePrefix(), c.GetUserName())
+			WriteProblem(w, c, http.StatusForbidden, "Not permitted to access another user's resources")
+			return false
+		}
+	}
+
+	user, err := store.Get(userId)
+	if err == ErrUserNotFound {
+		log.Printf("%s User not found for user id %s\n", c.GetLogMessagePrefix(), userId)
+		WriteProblem(w, c, http.StatusNotFound, "User not found")
+		return false
+	}
+	if err != nil {
+		log.Printf("%s Error detected when trying to get user with id %s : %s\n", c.GetLogMessagePrefix(), userId, err)
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return false
+	}
+
+	c.Data["User"] = user
+	return true
 }
@@ -2,10 +2,17 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -33,12 +40,13 @@ func TestContactApiHandlerDeleteSuccess(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &ContactApiHandler{PathPrefix: "/api/v1/contacts/", Store: store}
+	handler := &ContactApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
 	request, _ := http.NewRequest("DELETE", "/api/v1/contacts/pmcgrath/pmcgrath/", nil)
 	response := httptest.NewRecorder()
 
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}/{contactId}", request)
 	handler.Delete(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
@@ -52,12 +60,13 @@ func TestContactApiHandlerDeleteResourceDoesNotExist(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &ContactApiHandler{PathPrefix: "/api/v1/contacts/", Store: store}
+	handler := &ContactApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
 	request, _ := http.NewRequest("DELETE", "/api/v1/contacts/pmcgrath/DOESNOTEXIST", nil)
 	response := httptest.NewRecorder()
 
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}/{contactId}", request)
 	handler.Delete(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusNotFound, "Unexpected status code %d", response.Code)
@@ -70,12 +79,13 @@ func TestContactApiHandlerGetSuccess(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &ContactApiHandler{PathPrefix: "/api/v1/contacts/", Store: store}
+	handler := &ContactApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
 	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath/ted", nil)
 	response := httptest.NewRecorder()
 
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}/{contactId}", request)
 	handler.Get(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
@@ -91,12 +101,13 @@ func TestContactApiHandlerGetNotFound(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &ContactApiHandler{PathPrefix: "/api/v1/contacts/", Store: store}
+	handler := &ContactApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
 	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath/DOESNOTEXIST", nil)
 	response := httptest.NewRecorder()
 
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}/{contactId}", request)
 	handler.Get(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusNotFound, "Unexpected status code %d", response.Code)
@@ -106,29 +117,206 @@ func TestContactApiHandlerPutSuccess(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &ContactApiHandler{PathPrefix: "/api/v1/contacts/", Store: store}
+	handler := &ContactApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
 	postData := []byte(`{"FirstName": "Ted", "LastName": "Toad"}`)
 	request, _ := http.NewRequest("PUT", "/api/v1/contacts/pmcgrath/ted", bytes.NewReader(postData))
 	response := httptest.NewRecorder()
 
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}/{contactId}", request)
 	handler.Put(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
 }
 
+func TestContactApiHandlerPutNewContact(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &ContactApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	postData := []byte(`{"FirstName": "Tom", "LastName": "Toad"}`)
+	request, _ := http.NewRequest("PUT", "/api/v1/contacts/pmcgrath/tomtoad", bytes.NewReader(postData))
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}/{contactId}", request)
+	handler.Put(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	user, _ := store.Get("pmcgrath")
+	spec.Assert(len(user.Contacts) == 3, "Unexpected contact count %d", len(user.Contacts))
+	spec.Assert(user.Contacts[2].Id == "tomtoad", "Unexpected contact id %s", user.Contacts[2].Id)
+}
+
+func TestContactApiHandlerGetReturnsETag(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &ContactApiHandler{Store: store}
+
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath/ted", nil)
+	response := httptest.NewRecorder()
+
+	handler.Get(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/{contactId}", request))
+
+	etag := response.HeaderMap.Get("ETag")
+	spec.Assert(etag == `"1"`, "Unexpected etag %s", etag)
+
+	request, _ = http.NewRequest("GET", "/api/v1/contacts/pmcgrath/ted", nil)
+	request.Header.Set("If-None-Match", etag)
+	response = httptest.NewRecorder()
+
+	handler.Get(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/{contactId}", request))
+
+	spec.Assert(response.Code == http.StatusNotModified, "Unexpected status code %d", response.Code)
+}
+
+func TestContactApiHandlerPutWithIfMatch(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &ContactApiHandler{Store: store}
+
+	testCases := []struct {
+		ifMatch        string // Input
+		expectedStatus int    // Expected result
+	}{
+		{`"2"`, http.StatusPreconditionFailed}, // Stale etag
+		{`"1"`, http.StatusOK},
+		{`"1"`, http.StatusPreconditionFailed}, // Now stale as previous put incremented the version
+		{`*`, http.StatusOK},
+	}
+
+	for _, testCase := range testCases {
+		postData := []byte(`{"FirstName": "Ted", "LastName": "Toad"}`)
+		request, _ := http.NewRequest("PUT", "/api/v1/contacts/pmcgrath/ted", bytes.NewReader(postData))
+		request.Header.Set("If-Match", testCase.ifMatch)
+		response := httptest.NewRecorder()
+
+		handler.Put(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/{contactId}", request))
+
+		spec.Assert(response.Code == testCase.expectedStatus, "Unexpected status code %d for If-Match [%s]", response.Code, testCase.ifMatch)
+	}
+
+	contact, _ := store.GetContact("pmcgrath", "ted")
+	spec.Assert(contact.Version == 3, "Unexpected version %d", contact.Version)
+}
+
+// Stands in for a store that keeps losing WATCH races to other writers
+type contentionUserStore struct {
+	UserStore
+}
+
+func (store *contentionUserStore) SaveContact(userId string, contact *Contact, expectedVersion int64) error {
+	return ErrStoreContention
+}
+
+func (store *contentionUserStore) DeleteContact(userId, contactId string, expectedVersion int64) error {
+	return ErrStoreContention
+}
+
+func TestContactApiHandlerStoreContentionIsRetryable(t *testing.T) {
+	spec := &Spec{t}
+
+	handler := &ContactApiHandler{Store: &contentionUserStore{GetInitialisedUserStore()}}
+
+	request, _ := http.NewRequest("PUT", "/api/v1/contacts/pmcgrath/ted", strings.NewReader(`{"FirstName": "Ted", "LastName": "Toad"}`))
+	response := httptest.NewRecorder()
+	handler.Put(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/{contactId}", request))
+
+	spec.Assert(response.Code == http.StatusServiceUnavailable, "Unexpected status code %d for a put", response.Code)
+	spec.Assert(response.Header().Get("Retry-After") == "1", "Unexpected Retry-After [%s]", response.Header().Get("Retry-After"))
+
+	request, _ = http.NewRequest("DELETE", "/api/v1/contacts/pmcgrath/ted", nil)
+	response = httptest.NewRecorder()
+	handler.Delete(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/{contactId}", request))
+
+	spec.Assert(response.Code == http.StatusServiceUnavailable, "Unexpected status code %d for a delete", response.Code)
+
+	request, _ = http.NewRequest("PATCH", "/api/v1/contacts/pmcgrath/ted", strings.NewReader(`{"LastName": "Toad"}`))
+	request.Header.Set("Content-Type", "application/merge-patch+json")
+	response = httptest.NewRecorder()
+	handler.Patch(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/{contactId}", request))
+
+	spec.Assert(response.Code == http.StatusServiceUnavailable, "Unexpected status code %d for a patch", response.Code)
+}
+
+func TestContactApiHandlerETagChangesWhenContactIsCreatedAgain(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &ContactApiHandler{Store: store}
+
+	putTomToad := func() string {
+		request, _ := http.NewRequest("PUT", "/api/v1/contacts/pmcgrath/tomtoad", strings.NewReader(`{"FirstName": "Tom", "LastName": "Toad"}`))
+		response := httptest.NewRecorder()
+		handler.Put(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/{contactId}", request))
+		spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+		return response.Header().Get("ETag")
+	}
+
+	etag := putTomToad()
+	store.DeleteContact("pmcgrath", "tomtoad", AnyContactVersion)
+	recreatedETag := putTomToad()
+	spec.Assert(recreatedETag != etag, "Expected a new etag for the new contact [%s]", etag)
+
+	// The old contact's etag must not match the new contact
+	request, _ := http.NewRequest("PUT", "/api/v1/contacts/pmcgrath/tomtoad", strings.NewReader(`{"FirstName": "Tom", "LastName": "Toe"}`))
+	request.Header.Set("If-Match", etag)
+	response := httptest.NewRecorder()
+	handler.Put(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/{contactId}", request))
+	spec.Assert(response.Code == http.StatusPreconditionFailed, "Unexpected status code %d for the old etag", response.Code)
+}
+
+func TestContactApiHandlerPutWithIfNoneMatchForExistingContact(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &ContactApiHandler{Store: store}
+
+	postData := []byte(`{"FirstName": "Ted", "LastName": "Toad"}`)
+	request, _ := http.NewRequest("PUT", "/api/v1/contacts/pmcgrath/ted", bytes.NewReader(postData))
+	request.Header.Set("If-None-Match", "*")
+	response := httptest.NewRecorder()
+
+	handler.Put(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/{contactId}", request))
+
+	spec.Assert(response.Code == http.StatusPreconditionFailed, "Unexpected status code %d", response.Code)
+}
+
+func TestContactApiHandlerDeleteWithStaleIfMatch(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &ContactApiHandler{Store: store}
+
+	request, _ := http.NewRequest("DELETE", "/api/v1/contacts/pmcgrath/ted", nil)
+	request.Header.Set("If-Match", `"7"`)
+	response := httptest.NewRecorder()
+
+	handler.Delete(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/{contactId}", request))
+
+	spec.Assert(response.Code == http.StatusPreconditionFailed, "Unexpected status code %d", response.Code)
+
+	user, _ := store.Get("pmcgrath")
+	spec.Assert(len(user.Contacts) == 2, "Unexpected contact count %d", len(user.Contacts))
+}
+
 func TestContactApiHandlerPutUrlAndBodyIdConflict(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &ContactApiHandler{PathPrefix: "/api/v1/contacts/", Store: store}
+	handler := &ContactApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
 	postData := []byte(`{"Id": "..", "FirstName": "Ted", "LastName": "Toad"}`)
 	request, _ := http.NewRequest("PUT", "/api/v1/contacts/pmcgrath/ted", bytes.NewReader(postData))
 	response := httptest.NewRecorder()
 
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}/{contactId}", request)
 	handler.Put(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusBadRequest, "Unexpected status code %d", response.Code)
@@ -138,28 +326,103 @@ func TestContactApiHandlerPutFailureDueToIncompleteData(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &ContactApiHandler{PathPrefix: "/api/v1/contacts/", Store: store}
+	handler := &ContactApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
 	postData := []byte(`{"LastName": "Toad"}`) // No first name
 	request, _ := http.NewRequest("PUT", "/api/v1/contacts/pmcgrath/ted", bytes.NewReader(postData))
 	response := httptest.NewRecorder()
 
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}/{contactId}", request)
 	handler.Put(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusBadRequest, "Unexpected status code %d", response.Code)
 }
 
+func TestContactApiHandlerPatchSuccess(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &ContactApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	patchData := []byte(`{"LastName": "Toad", "Twitter": "@ttoad", "Phones": null, "Version": 99}`)
+	request, _ := http.NewRequest("PATCH", "/api/v1/contacts/pmcgrath/ted", bytes.NewReader(patchData))
+	request.Header.Set("Content-Type", "application/merge-patch+json")
+	request.Header.Set("If-Match", `"1"`)
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}/{contactId}", request)
+	handler.Patch(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	etag := response.HeaderMap.Get("ETag")
+	spec.Assert(etag == `"2"`, "Unexpected etag %s", etag)
+
+	contact, _ := store.GetContact("pmcgrath", "ted")
+	spec.Assert(contact.FirstName == "Ted" && contact.LastName == "Toad" && contact.Twitter == "@ttoad", "Unexpected contact %#v", contact)
+	spec.Assert(contact.Phones == nil, "Phones were not removed %#v", contact.Phones)
+
+	body := response.Body.String()
+	spec.Assert(strings.Contains(body, `"LastName":"Toad"`), "Response body did not contain expected content, body is %s", body)
+}
+
+func TestContactApiHandlerPatchFailures(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Url         string
+		ContentType string
+		IfMatch     string
+		Patch       string
+		// Expected result
+		ExpectedStatusCode int
+	}{
+		{"/api/v1/contacts/pmcgrath/ted", "application/json", "", `{"LastName": "Toad"}`, http.StatusUnsupportedMediaType},
+		{"/api/v1/contacts/pmcgrath/ted", "application/merge-patch+json", `"7"`, `{"LastName": "Toad"}`, http.StatusPreconditionFailed},
+		{"/api/v1/contacts/pmcgrath/nosuchcontact", "application/merge-patch+json", "", `{"LastName": "Toad"}`, http.StatusNotFound},
+		{"/api/v1/contacts/someoneelse/ted", "application/merge-patch+json", "", `{"LastName": "Toad"}`, http.StatusForbidden},
+		{"/api/v1/contacts/pmcgrath/ted", "application/merge-patch+json", "", `{"LastName": `, http.StatusBadRequest},
+		{"/api/v1/contacts/pmcgrath/ted", "application/merge-patch+json", "", `["LastName"]`, http.StatusBadRequest},
+		{"/api/v1/contacts/pmcgrath/ted", "application/merge-patch+json", "", `{"Id": "other"}`, http.StatusBadRequest},
+		{"/api/v1/contacts/pmcgrath/ted", "application/merge-patch+json", "", `{"LastName": null}`, http.StatusBadRequest},
+	}
+
+	for _, testCase := range testCases {
+		store := GetInitialisedUserStore()
+		handler := &ContactApiHandler{Store: store}
+
+		requestContext := GetLoggedInRequestContext()
+		request, _ := http.NewRequest("PATCH", testCase.Url, strings.NewReader(testCase.Patch))
+		request.Header.Set("Content-Type", testCase.ContentType)
+		if testCase.IfMatch != "" {
+			request.Header.Set("If-Match", testCase.IfMatch)
+		}
+		response := httptest.NewRecorder()
+
+		SetPathParams(requestContext, "/api/v1/contacts/{userId}/{contactId}", request)
+		handler.Patch(response, request, requestContext)
+
+		spec.Assert(response.Code == testCase.ExpectedStatusCode, "Unexpected status code %d for patch %s", response.Code, testCase.Patch)
+
+		contact, _ := store.GetContact("pmcgrath", "ted")
+		spec.Assert(contact.LastName == "Toe", "Contact was changed by patch %s", testCase.Patch)
+	}
+}
+
 func TestContactsApiHandlerGetSuccess(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &ContactsApiHandler{PathPrefix: "/api/v1/contacts/", Store: store}
+	handler := &ContactsApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
 	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath", nil)
 	response := httptest.NewRecorder()
 
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}", request)
 	handler.Get(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
@@ -168,17 +431,118 @@ func TestContactsApiHandlerGetSuccess(t *testing.T) {
 	spec.Assert(strings.Contains(body, `"Id":"ted",`), "Response body did not contain expected content, body is %s", body)
 }
 
+func TestContactsApiHandlerGetWithIfNoneMatch(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &ContactsApiHandler{Store: store}
+
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath", nil)
+	response := httptest.NewRecorder()
+
+	handler.Get(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}", request))
+
+	etag := response.HeaderMap.Get("ETag")
+	spec.Assert(etag != "", "Missing etag")
+
+	request, _ = http.NewRequest("GET", "/api/v1/contacts/pmcgrath", nil)
+	request.Header.Set("If-None-Match", etag)
+	response = httptest.NewRecorder()
+
+	handler.Get(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}", request))
+
+	spec.Assert(response.Code == http.StatusNotModified, "Unexpected status code %d", response.Code)
+	spec.Assert(response.Body.Len() == 0, "Unexpected body %s", response.Body.String())
+
+	// Change invalidates the etag
+	store.SaveContact("pmcgrath", &Contact{Id: "tom", FirstName: "Tom", LastName: "Toe"}, NoContactVersion)
+
+	request, _ = http.NewRequest("GET", "/api/v1/contacts/pmcgrath", nil)
+	request.Header.Set("If-None-Match", etag)
+	response = httptest.NewRecorder()
+
+	handler.Get(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}", request))
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+}
+
+func TestContactsApiHandlerGetWithQuery(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &ContactsApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath?sort=firstName&limit=1", nil)
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}", request)
+	handler.Get(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	totalCountHeader := response.HeaderMap.Get("X-Total-Count")
+	spec.Assert(totalCountHeader == "2", "Unexpected total count header %s", totalCountHeader)
+
+	linkHeader := response.HeaderMap.Get("Link")
+	spec.Assert(strings.Contains(linkHeader, `rel="next"`), "Unexpected link header %s", linkHeader)
+
+	body := response.Body.String()
+	spec.Assert(strings.Contains(body, `"Id":"pmcgrath",`), "Response body did not contain expected content, body is %s", body)
+	spec.Assert(!strings.Contains(body, `"Id":"ted",`), "Response body contained unexpected content, body is %s", body)
+}
+
+func TestContactsApiHandlerGetWithTag(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	contact, _ := store.GetContact("pmcgrath", "ted")
+	contact.Tags = []string{"Customers", "On-call"}
+	store.SaveContact("pmcgrath", contact, AnyContactVersion)
+	handler := &ContactsApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath?tag=on-call", nil)
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}", request)
+	handler.Get(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	body := response.Body.String()
+	spec.Assert(strings.Contains(body, `"Id":"ted",`) && strings.Contains(body, `"Tags":["Customers","On-call"]`), "Response body did not contain expected content, body is %s", body)
+	spec.Assert(!strings.Contains(body, `"Id":"pmcgrath",`), "Response body contained unexpected content, body is %s", body)
+}
+
+func TestContactsApiHandlerGetWithInvalidQuery(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &ContactsApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath?sort=password", nil)
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}", request)
+	handler.Get(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusBadRequest, "Unexpected status code %d", response.Code)
+}
+
 func TestContactsApiHandlerPostSuccess(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &ContactsApiHandler{PathPrefix: "/api/v1/contacts/", Store: store}
+	handler := &ContactsApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
 	postData := []byte(`{"FirstName": "Ted", "LastName": "Toad", "Email": "tt@gmail.com"}`)
 	request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath", bytes.NewReader(postData))
 	response := httptest.NewRecorder()
 
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}", request)
 	handler.Post(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusCreated, "Unexpected status code %d", response.Code)
@@ -191,98 +555,689 @@ func TestContactsApiHandlerPostFailureDueToInCompleteData(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &ContactsApiHandler{PathPrefix: "/api/v1/contacts/", Store: store}
+	handler := &ContactsApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
 	postData := []byte(`{"FirstName": "Ted", "Email": "tt@gmail.com"}`) // Missing lastname
 	request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath", bytes.NewReader(postData))
 	response := httptest.NewRecorder()
 
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}", request)
 	handler.Post(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusBadRequest, "Unexpected status code %d", response.Code)
 }
 
-func TestLogInApiHandlerDeleteSuccess(t *testing.T) {
+func TestContactsApiHandlerPostReturnsValidationProblem(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &LogInApiHandler{Store: store}
+	handler := &ContactsApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
+	postData := []byte(`{"FirstName": "Ted", "LastName": "Toad", "Emails": [{"Address": "tt@"}], "Phones": [{"Number": "066 7132310"}]}`)
+	request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath", bytes.NewReader(postData))
+	response := httptest.NewRecorder()
 
-	request, _ := http.NewRequest("DELETE", "/api/v1/login", nil)
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}", request)
+	handler.Post(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusBadRequest, "Unexpected status code %d", response.Code)
+
+	contentTypeHeader := response.HeaderMap.Get("Content-Type")
+	spec.Assert(contentTypeHeader == "application/problem+json", "Unexpected content type header %s", contentTypeHeader)
+
+	body := response.Body.String()
+	spec.Assert(strings.Contains(body, `"field":"Emails[0].Address"`), "Response body did not contain expected content, body is %s", body)
+	spec.Assert(strings.Contains(body, `"field":"Phones[0].Number","message":"Phone number must include a country code [066 7132310]"`), "Response body did not contain expected content, body is %s", body)
+}
+
+func TestContactsApiHandlerPostNormalisesPhoneNumbers(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &ContactsApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	postData := []byte(`{"FirstName": "Ted", "LastName": "Toad", "Phones": [{"Number": "00353 (66) 713-2310"}]}`)
+	request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath", bytes.NewReader(postData))
 	response := httptest.NewRecorder()
 
-	handler.Delete(response, request, requestContext)
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}", request)
+	handler.Post(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusCreated, "Unexpected status code %d", response.Code)
+
+	locationHeader := response.HeaderMap.Get("Location")
+	contact, _ := store.GetContact("pmcgrath", locationHeader[strings.LastIndex(locationHeader, "/")+1:])
+	spec.Assert(contact.Phones[0].Number == "+353667132310", "Unexpected phone number %s", contact.Phones[0].Number)
+}
+
+func TestVCardsApiHandlerGetSuccess(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &VCardsApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath.vcf", nil)
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}.vcf", request)
+	handler.Get(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
 
-	spec.Assert(requestContext.Session.UserName == "", "Unexpected session user name %s", requestContext.Session.UserName)
+	contentTypeHeader := response.HeaderMap.Get("Content-Type")
+	spec.Assert(contentTypeHeader == "text/vcard; charset=utf-8", "Unexpected content type header %s", contentTypeHeader)
+
+	body := response.Body.String()
+	spec.Assert(strings.Count(body, "BEGIN:VCARD") == 2, "Unexpected card count, body is %s", body)
+	spec.Assert(strings.Contains(body, "TEL;TYPE=Home:353 066 7132310"), "Response body did not contain expected content, body is %s", body)
 }
 
-func TestLogInApiHandlerPostSuccess(t *testing.T) {
+func TestVCardsApiHandlerGetForbidden(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &LogInApiHandler{Store: store}
+	handler := &VCardsApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
-	requestContext.Session.UserName = ""
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/someoneelse.vcf", nil)
+	response := httptest.NewRecorder()
 
-	postData := []byte(`{"UserName": "pmcgrath", "Password": "pass"}`)
-	request, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewReader(postData))
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}.vcf", request)
+	handler.Get(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusForbidden, "Unexpected status code %d", response.Code)
+}
+
+func TestVCardsApiHandlerPostReportsPerCardErrors(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &VCardsApiHandler{Store: store}
+
+	vcf := "BEGIN:VCARD\r\nVERSION:3.0\r\nN:Toe;Tom;;;\r\nEMAIL:tom@example.com\r\nEND:VCARD\r\n" +
+		"BEGIN:VCARD\r\nVERSION:3.0\r\nN:;Anne;;;\r\nEND:VCARD\r\n" +
+		"BEGIN:VCARD\r\nVERSION:3.0\r\nUID:pmcgrath\r\nN:Toad;Peter;;;\r\nEND:VCARD\r\n"
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath.vcf", strings.NewReader(vcf))
 	response := httptest.NewRecorder()
 
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}.vcf", request)
 	handler.Post(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
 
-	spec.Assert(requestContext.Session.UserName == "pmcgrath", "Unexpected session user name %s", requestContext.Session.UserName)
+	body := response.Body.String()
+	spec.Assert(strings.Contains(body, `"Imported":2,"Failed":1`), "Unexpected report, body is %s", body)
+	spec.Assert(strings.Contains(body, `"Index":2`) && strings.Contains(body, "Missing last name"), "Unexpected report, body is %s", body)
+
+	user, _ := store.Get("pmcgrath")
+	spec.Assert(len(user.Contacts) == 3, "Unexpected contact count %d", len(user.Contacts))
+
+	contact, _ := store.GetContact("pmcgrath", "pmcgrath")
+	spec.Assert(contact.LastName == "Toad", "Existing contact was not updated, last name is %s", contact.LastName)
 }
 
-func TestLogInApiHandlerPostWhereAlreadyLoggedInFailure(t *testing.T) {
+func TestVCardsApiHandlerPostNoCards(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &LogInApiHandler{Store: store}
+	handler := &VCardsApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
-
-	postData := []byte(`{"UserName": "pmcgrath", "Password": "pass"}`)
-	request, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewReader(postData))
+	request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath.vcf", strings.NewReader("Hello"))
 	response := httptest.NewRecorder()
 
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}.vcf", request)
 	handler.Post(response, request, requestContext)
 
-	spec.Assert(response.Code == http.StatusForbidden, "Unexpected status code %d", response.Code)
+	spec.Assert(response.Code == http.StatusBadRequest, "Unexpected status code %d", response.Code)
 }
 
-func TestLogInApiHandlerPostIncorrectPassword(t *testing.T) {
+func TestVCardApiHandlerGetSuccess(t *testing.T) {
 	spec := &Spec{t}
 
 	store := GetInitialisedUserStore()
-	handler := &LogInApiHandler{Store: store}
+	handler := &VCardApiHandler{Store: store}
 
 	requestContext := GetLoggedInRequestContext()
-	requestContext.Session.UserName = ""
-
-	postData := []byte(`{"UserName": "pmcgrath", "Password": "BADPASS"}`)
-	request, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewReader(postData))
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath/ted.vcf?version=4.0", nil)
 	response := httptest.NewRecorder()
 
-	handler.Post(response, request, requestContext)
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}/{contactId}.vcf", request)
+	handler.Get(response, request, requestContext)
 
-	spec.Assert(response.Code == http.StatusUnauthorized, "Unexpected status code %d", response.Code)
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
 
-	spec.Assert(requestContext.Session.UserName == "", "Unexpected session user name %s", requestContext.Session.UserName)
+	body := response.Body.String()
+	spec.Assert(strings.Contains(body, "VERSION:4.0\r\nUID:ted\r\nN:Toe;Ted;;;"), "Response body did not contain expected content, body is %s", body)
 }
 
-func GetInitialisedUserStore() UserStore {
-	store := NewInMemoryUserStore()
-	store.Save(
-		&User{
-			Id:        "pmcgrath",
+func TestVCardApiHandlerGetNotFound(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &VCardApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath/DOESNOTEXIST.vcf", nil)
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}/{contactId}.vcf", request)
+	handler.Get(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusNotFound, "Unexpected status code %d", response.Code)
+}
+
+func TestLogInApiHandlerGetIssuesCsrfToken(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &LogInApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	requestContext.Session.UserName = ""
+
+	request, _ := http.NewRequest("GET", "/api/v1/login", nil)
+	response := httptest.NewRecorder()
+
+	handler.Get(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusNoContent, "Unexpected status code %d", response.Code)
+	token := response.Header().Get("X-CSRF-Token")
+	spec.Assert(token != "" && token == GetExistingCsrfToken(requestContext.Session), "Expected the session's new CSRF token, got [%s]", token)
+}
+
+func TestLogInApiHandlerDeleteSuccess(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &LogInApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+
+	request, _ := http.NewRequest("DELETE", "/api/v1/login", nil)
+	response := httptest.NewRecorder()
+
+	originalSessionId := requestContext.GetSessionId()
+	handler.Delete(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	spec.Assert(requestContext.Session.UserName == "", "Unexpected session user name %s", requestContext.Session.UserName)
+	spec.Assert(requestContext.GetSessionId() != originalSessionId, "Session id was not regenerated")
+	spec.Assert(response.Header().Get("X-CSRF-Token") == GetCsrfToken(requestContext.Session), "Expected the new session's CSRF token")
+}
+
+func TestLogInApiHandlerPostSuccess(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &LogInApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	requestContext.Session.UserName = ""
+	originalSessionId := requestContext.GetSessionId()
+	originalCsrfToken := GetCsrfToken(requestContext.Session)
+
+	postData := []byte(`{"UserName": "pmcgrath", "Password": "pass"}`)
+	request, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewReader(postData))
+	response := httptest.NewRecorder()
+
+	handler.Post(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	spec.Assert(requestContext.Session.UserName == "pmcgrath", "Unexpected session user name %s", requestContext.Session.UserName)
+	spec.Assert(requestContext.GetSessionId() != originalSessionId, "Session id was not regenerated")
+	newCsrfToken := response.Header().Get("X-CSRF-Token")
+	spec.Assert(newCsrfToken == GetCsrfToken(requestContext.Session) && newCsrfToken != originalCsrfToken, "Expected a new CSRF token")
+}
+
+func TestLogInApiHandlerPostRehashesPlaintextPassword(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &LogInApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	requestContext.Session.UserName = ""
+
+	postData := []byte(`{"UserName": "pmcgrath", "Password": "pass"}`)
+	request, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewReader(postData))
+	response := httptest.NewRecorder()
+
+	handler.Post(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	user, _ := store.Get("pmcgrath")
+	spec.Assert(IsPasswordHashed(user.Password), "Password was not rehashed %s", user.Password)
+	spec.Assert(user.Authenticate("pass"), "Rehashed password should authenticate")
+}
+
+func TestLogInApiHandlerPostWhereAlreadyLoggedInFailure(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &LogInApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+
+	postData := []byte(`{"UserName": "pmcgrath", "Password": "pass"}`)
+	request, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewReader(postData))
+	response := httptest.NewRecorder()
+
+	handler.Post(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusForbidden, "Unexpected status code %d", response.Code)
+}
+
+func TestLogInApiHandlerPostIncorrectPassword(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &LogInApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	requestContext.Session.UserName = ""
+
+	postData := []byte(`{"UserName": "pmcgrath", "Password": "BADPASS"}`)
+	request, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewReader(postData))
+	response := httptest.NewRecorder()
+
+	handler.Post(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusUnauthorized, "Unexpected status code %d", response.Code)
+
+	// Same detail as for an unknown user so user names cannot be discovered
+	body := response.Body.String()
+	spec.Assert(strings.Contains(body, `"detail":"Invalid user name or password"`), "Response body did not contain expected content, body is %s", body)
+
+	spec.Assert(requestContext.Session.UserName == "", "Unexpected session user name %s", requestContext.Session.UserName)
+}
+
+func TestLogInApiHandlerPostLockedOut(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	throttle, attemptStore, _ := newTestLoginThrottle()
+	defer attemptStore.Close()
+	handler := &LogInApiHandler{Store: store, Throttle: throttle}
+
+	testCases := []struct {
+		// Input
+		Password string
+		// Expected result
+		StatusCode int
+	}{
+		{"BADPASS", http.StatusUnauthorized},
+		{"BADPASS", http.StatusUnauthorized},
+		{"pass", http.StatusTooManyRequests}, // Even the right password is rejected while locked out
+	}
+
+	for index, testCase := range testCases {
+		requestContext := GetLoggedInRequestContext()
+		requestContext.Session.UserName = ""
+
+		postData := []byte(`{"UserName": "pmcgrath", "Password": "` + testCase.Password + `"}`)
+		request, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewReader(postData))
+		request.RemoteAddr = "10.0.0.1:5000"
+		response := httptest.NewRecorder()
+
+		handler.Post(response, request, requestContext)
+
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code %d for test case %d", response.Code, index)
+		if testCase.StatusCode == http.StatusTooManyRequests {
+			spec.Assert(response.Header().Get("Retry-After") == "1", "Unexpected Retry-After [%s]", response.Header().Get("Retry-After"))
+			spec.Assert(requestContext.Session.UserName == "", "Should not be logged in while locked out")
+		}
+	}
+}
+
+func TestLogInApiHandlerPostCountsUnknownUsers(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	throttle, attemptStore, _ := newTestLoginThrottle()
+	defer attemptStore.Close()
+	handler := &LogInApiHandler{Store: store, Throttle: throttle}
+
+	requestContext := GetLoggedInRequestContext()
+	requestContext.Session.UserName = ""
+
+	postData := []byte(`{"UserName": "nobody", "Password": "pass"}`)
+	request, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewReader(postData))
+	request.RemoteAddr = "10.0.0.1:5000"
+	response := httptest.NewRecorder()
+
+	handler.Post(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusUnauthorized, "Unexpected status code %d", response.Code)
+	attempts, _ := attemptStore.GetLoginAttempts(getLoginUserNameKey("nobody"))
+	spec.Assert(attempts.Failures == 1, "Expected the failure to be counted, got %d", attempts.Failures)
+}
+
+func TestUsersApiHandlerPostSuccess(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &UsersApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	requestContext.Session.UserName = ""
+
+	postData := []byte(`{"Id": "tedtoe", "FirstName": "Ted", "LastName": "Toe", "Email": "ted@example.com", "Password": "pass"}`)
+	request, _ := http.NewRequest("POST", "/api/v1/users", bytes.NewReader(postData))
+	response := httptest.NewRecorder()
+
+	handler.Post(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusCreated, "Unexpected status code %d", response.Code)
+
+	locationHeader := response.HeaderMap["Location"][0]
+	spec.Assert(locationHeader == "/api/v1/users/tedtoe", "Unexpected location header %s", locationHeader)
+
+	user, err := store.Get("tedtoe")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(IsPasswordHashed(user.Password), "Password was not hashed %s", user.Password)
+	spec.Assert(user.Authenticate("pass"), "Password should authenticate")
+}
+
+func TestUsersApiHandlerPostDuplicates(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	store.Create(&User{Id: "annother", FirstName: "Anne", LastName: "Other", Password: "pass"})
+	store.Delete("annother")
+	handler := &UsersApiHandler{Store: store}
+
+	testCases := []string{
+		`{"Id": "pmcgrath", "FirstName": "Ted", "LastName": "Toe", "Password": "pass"}`,
+		`{"Id": "tedtoe", "FirstName": "Ted", "LastName": "Toe", "Email": "PMcGrath@gmail.com", "Password": "pass"}`,
+		`{"Id": "annother", "FirstName": "Anne", "LastName": "Other", "Password": "pass"}`, // Deleted, old sessions may still hold the id
+	}
+
+	for _, testCase := range testCases {
+		requestContext := GetLoggedInRequestContext()
+		requestContext.Session.UserName = ""
+
+		request, _ := http.NewRequest("POST", "/api/v1/users", strings.NewReader(testCase))
+		response := httptest.NewRecorder()
+
+		handler.Post(response, request, requestContext)
+
+		spec.Assert(response.Code == http.StatusConflict, "Unexpected status code %d for input [%s]", response.Code, testCase)
+	}
+}
+
+func TestUsersApiHandlerPostFailureDueToIncompleteData(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &UsersApiHandler{Store: store}
+
+	testCases := []string{
+		`{"Id": "tedtoe", "FirstName": "Ted", "LastName": "Toe"}`,                      // No password
+		`{"Id": "ted", "FirstName": "Ted", "LastName": "Toe", "Password": "pass"}`,     // Id too short
+		`{"Id": "ted toe", "FirstName": "Ted", "LastName": "Toe", "Password": "pass"}`, // Id has a space
+		`{"Id": "tedtoe", "FirstName": "Ted", "Password": "pass"}`,                     // No last name
+	}
+
+	for _, testCase := range testCases {
+		requestContext := GetLoggedInRequestContext()
+		requestContext.Session.UserName = ""
+
+		request, _ := http.NewRequest("POST", "/api/v1/users", strings.NewReader(testCase))
+		response := httptest.NewRecorder()
+
+		handler.Post(response, request, requestContext)
+
+		spec.Assert(response.Code == http.StatusBadRequest, "Unexpected status code %d for input [%s]", response.Code, testCase)
+	}
+}
+
+func TestUsersApiHandlerPostWhereAlreadyLoggedInFailure(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &UsersApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+
+	postData := []byte(`{"Id": "tedtoe", "FirstName": "Ted", "LastName": "Toe", "Password": "pass"}`)
+	request, _ := http.NewRequest("POST", "/api/v1/users", bytes.NewReader(postData))
+	response := httptest.NewRecorder()
+
+	handler.Post(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusForbidden, "Unexpected status code %d", response.Code)
+}
+
+func TestUserApiHandlerGetSuccess(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &UserApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("GET", "/api/v1/users/pmcgrath", nil)
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/users/{userId}", request)
+	handler.Get(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	body := response.Body.String()
+	spec.Assert(strings.Contains(body, `"Email":"pmcgrath@gmail.com"`), "Response body did not contain expected content, body is %s", body)
+	spec.Assert(!strings.Contains(body, "Password"), "Response body should not contain the password, body is %s", body)
+	spec.Assert(!strings.Contains(body, "Contacts"), "Response body should not contain the contacts, body is %s", body)
+}
+
+func TestUserApiHandlerGetForbidden(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &UserApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("GET", "/api/v1/users/someoneelse", nil)
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/users/{userId}", request)
+	handler.Get(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusForbidden, "Unexpected status code %d", response.Code)
+}
+
+func TestUserApiHandlerPutSuccess(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &UserApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	postData := []byte(`{"FirstName": "Patrick", "LastName": "Mc Grath", "Email": "pat@example.com"}`)
+	request, _ := http.NewRequest("PUT", "/api/v1/users/pmcgrath", bytes.NewReader(postData))
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/users/{userId}", request)
+	handler.Put(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	user, _ := store.Get("pmcgrath")
+	spec.Assert(user.FirstName == "Patrick", "Unexpected first name %s", user.FirstName)
+	spec.Assert(user.Email == "pat@example.com", "Unexpected email %s", user.Email)
+	spec.Assert(len(user.Contacts) == 2, "Unexpected contact count %d", len(user.Contacts))
+}
+
+func TestUserApiHandlerPutDuplicateEmail(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	store.Create(&User{Id: "tedtoe", FirstName: "Ted", LastName: "Toe", Email: "ted@example.com", Password: "pass"})
+	handler := &UserApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	postData := []byte(`{"FirstName": "Pat", "LastName": "Mc Grath", "Email": "ted@example.com"}`)
+	request, _ := http.NewRequest("PUT", "/api/v1/users/pmcgrath", bytes.NewReader(postData))
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/users/{userId}", request)
+	handler.Put(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusConflict, "Unexpected status code %d", response.Code)
+}
+
+func TestUserApiHandlerDeleteSuccess(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &UserApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("DELETE", "/api/v1/users/pmcgrath", nil)
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/users/{userId}", request)
+	handler.Delete(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+	spec.Assert(requestContext.Session.UserName == "", "Unexpected session user name %s", requestContext.Session.UserName)
+
+	_, err := store.Get("pmcgrath")
+	spec.Assert(err != nil, "Expected user to be deleted")
+}
+
+func TestUserPasswordApiHandlerPutSuccess(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &UserPasswordApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	postData := []byte(`{"CurrentPassword": "pass", "NewPassword": "newpass"}`)
+	request, _ := http.NewRequest("PUT", "/api/v1/users/pmcgrath/password", bytes.NewReader(postData))
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/users/{userId}/password", request)
+	handler.Put(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	user, _ := store.Get("pmcgrath")
+	spec.Assert(user.Authenticate("newpass"), "New password should authenticate")
+	spec.Assert(!user.Authenticate("pass"), "Old password should not authenticate")
+}
+
+func TestUserPasswordApiHandlerPutIncorrectCurrentPassword(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &UserPasswordApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	postData := []byte(`{"CurrentPassword": "BADPASS", "NewPassword": "newpass"}`)
+	request, _ := http.NewRequest("PUT", "/api/v1/users/pmcgrath/password", bytes.NewReader(postData))
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/users/{userId}/password", request)
+	handler.Put(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusForbidden, "Unexpected status code %d", response.Code)
+
+	user, _ := store.Get("pmcgrath")
+	spec.Assert(user.Authenticate("pass"), "Password should not have changed")
+}
+
+func TestApiTokensApiHandlerPostGetAndDelete(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	tokensHandler := &ApiTokensApiHandler{Store: store}
+	tokenHandler := &ApiTokenApiHandler{Store: store}
+
+	request, _ := http.NewRequest("POST", "/api/v1/users/pmcgrath/tokens", strings.NewReader(`{"Name": "ci"}`))
+	response := httptest.NewRecorder()
+	tokensHandler.Post(response, request, GetLoggedInRequestContextForPath("/api/v1/users/{userId}/tokens", request))
+
+	spec.Assert(response.Code == http.StatusCreated, "Unexpected status code %d", response.Code)
+	spec.Assert(response.Header().Get("Cache-Control") == "no-store", "Token response must not be cached")
+	var created struct {
+		Id    string
+		Name  string
+		Token string
+	}
+	json.Unmarshal(response.Body.Bytes(), &created)
+	spec.Assert(created.Name == "ci" && created.Token != "", "Unexpected response %s", response.Body.String())
+	spec.Assert(response.Header().Get("Location") == "/api/v1/users/pmcgrath/tokens/"+created.Id, "Unexpected location %s", response.Header().Get("Location"))
+
+	apiToken, err := store.GetApiToken(HashApiToken(created.Token))
+	spec.Assert(err == nil && apiToken.Id == created.Id, "Created token not found by its hash")
+
+	request, _ = http.NewRequest("GET", "/api/v1/users/pmcgrath/tokens", nil)
+	response = httptest.NewRecorder()
+	tokensHandler.Get(response, request, GetLoggedInRequestContextForPath("/api/v1/users/{userId}/tokens", request))
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+	spec.Assert(strings.Contains(response.Body.String(), created.Id), "Token not listed, body is %s", response.Body.String())
+	spec.Assert(!strings.Contains(response.Body.String(), created.Token) && !strings.Contains(response.Body.String(), apiToken.Hash), "List includes the token or its hash, body is %s", response.Body.String())
+
+	for _, expectedStatusCode := range []int{http.StatusOK, http.StatusNotFound} {
+		request, _ = http.NewRequest("DELETE", "/api/v1/users/pmcgrath/tokens/"+created.Id, nil)
+		response = httptest.NewRecorder()
+		tokenHandler.Delete(response, request, GetLoggedInRequestContextForPath("/api/v1/users/{userId}/tokens/{tokenId}", request))
+
+		spec.Assert(response.Code == expectedStatusCode, "Unexpected status code %d, expected %d", response.Code, expectedStatusCode)
+	}
+}
+
+func TestApiTokensApiHandlerPostFailures(t *testing.T) {
+	spec := &Spec{t}
+	testCases := []struct {
+		// Input
+		Url        string
+		Body       string
+		ByApiToken bool
+		// Expected result
+		StatusCode int
+	}{
+		{"/api/v1/users/tedtoe/tokens", `{"Name": "ci"}`, false, http.StatusForbidden},
+		{"/api/v1/users/pmcgrath/tokens", `{"Name": "ci"}`, true, http.StatusForbidden},
+		{"/api/v1/users/pmcgrath/tokens", `{"Name": "` + strings.Repeat("x", 101) + `"}`, false, http.StatusBadRequest},
+		{"/api/v1/users/pmcgrath/tokens", `not json`, false, http.StatusBadRequest},
+	}
+
+	for _, testCase := range testCases {
+		store := GetInitialisedUserStore()
+		handler := &ApiTokensApiHandler{Store: store}
+
+		request, _ := http.NewRequest("POST", testCase.Url, strings.NewReader(testCase.Body))
+		requestContext := GetLoggedInRequestContextForPath("/api/v1/users/{userId}/tokens", request)
+		if testCase.ByApiToken {
+			requestContext.ApiToken, _, _ = NewApiToken("pmcgrath", "")
+		}
+		response := httptest.NewRecorder()
+
+		handler.Post(response, request, requestContext)
+
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code %d for %s", response.Code, testCase.Body)
+		tokens, _ := store.GetApiTokens("pmcgrath")
+		spec.Assert(len(tokens) == 0, "Unexpected token created for %s", testCase.Body)
+	}
+}
+
+func GetInitialisedUserStore() UserStore {
+	store := NewInMemoryUserStore()
+	store.Save(
+		&User{
+			Id:        "pmcgrath",
 			FirstName: "Pat",
 			LastName:  "Mc Grath",
 			Email:     "pmcgrath@gmail.com",
@@ -303,6 +1258,7 @@ func GetInitialisedUserStore() UserStore {
 					Id:        "ted",
 					FirstName: "Ted",
 					LastName:  "Toe",
+					Version:   1,
 					Phones: []Phone{
 						Phone{
 							Description: "Home",
@@ -316,16 +1272,1031 @@ func GetInitialisedUserStore() UserStore {
 	return store
 }
 
-func GetLoggedInRequestContext() *RequestContext {
-	return &RequestContext{
-		Id:        Uuid(),
-		StartTime: time.Now(),
-		Session: &Session{
-			Id:         Uuid(),
-			UserName:   "pmcgrath",
-			Data:       make(map[string]interface{}),
-			LastAccess: time.Now(),
-		},
-		Data: make(map[string]interface{}),
+// Sets the path parameters as the router would for the template
+func SetPathParams(c *RequestContext, template string, r *http.Request) {
+	segments, _ := parsePathTemplate(template)
+	c.Params, _ = (&compiledRoute{segments: segments}).match(splitPath(r.URL.Path))
+}
+
+func GetLoggedInRequestContextForPath(template string, r *http.Request) *RequestContext {
+	c := GetLoggedInRequestContext()
+	SetPathParams(c, template, r)
+	return c
+}
+
+func GetLoggedInRequestContext() *RequestContext {
+	return &RequestContext{
+		Id:        Uuid(),
+		StartTime: time.Now(),
+		Session: &Session{
+			Id:         Uuid(),
+			UserName:   "pmcgrath",
+			Data:       make(map[string]interface{}),
+			LastAccess: time.Now(),
+		},
+		Data: make(map[string]interface{}),
+	}
+}
+
+func TestCsvApiHandlerGetSuccess(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &CsvApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath.csv", nil)
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}.csv", request)
+	handler.Get(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	contentTypeHeader := response.HeaderMap.Get("Content-Type")
+	spec.Assert(contentTypeHeader == "text/csv; charset=utf-8", "Unexpected content type header %s", contentTypeHeader)
+
+	body := response.Body.String()
+	spec.Assert(strings.HasPrefix(body, "Id,FirstName,LastName,"), "Unexpected header row, body is %s", body)
+	spec.Assert(strings.Count(body, "\n") == 3, "Unexpected row count, body is %s", body)
+}
+
+func TestCsvApiHandlerGetForbidden(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &CsvApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/someoneelse.csv", nil)
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}.csv", request)
+	handler.Get(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusForbidden, "Unexpected status code %d", response.Code)
+}
+
+func TestCsvApiHandlerPostWithMapping(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &CsvApiHandler{Store: store}
+
+	data := "Given Name,Family Name,E-mail\nTom,Toe,tom@example.com\nAnne,,\nPeter,Toad,\n"
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath.csv?map=Given+Name:FirstName&map=Family+Name:LastName&map=E-mail:Email1Address", strings.NewReader(data))
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}.csv", request)
+	handler.Post(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	body := response.Body.String()
+	spec.Assert(strings.Contains(body, `"Imported":2,"Failed":1`), "Unexpected report, body is %s", body)
+	spec.Assert(strings.Contains(body, `"Index":2`) && strings.Contains(body, "Missing last name"), "Unexpected report, body is %s", body)
+
+	user, _ := store.Get("pmcgrath")
+	spec.Assert(len(user.Contacts) == 4, "Unexpected contact count %d", len(user.Contacts))
+}
+
+func TestCsvApiHandlerPostDryRun(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &CsvApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath.csv?dryRun=true", strings.NewReader("FirstName,LastName\nTom,Toe\n"))
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}.csv", request)
+	handler.Post(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	body := response.Body.String()
+	spec.Assert(strings.Contains(body, `"DryRun":true,"Imported":1,"Failed":0`), "Unexpected report, body is %s", body)
+
+	user, _ := store.Get("pmcgrath")
+	spec.Assert(len(user.Contacts) == 2, "Unexpected contact count %d", len(user.Contacts))
+}
+
+func TestContactExportReimportKeepsFieldsTheFormatDoesNotCarry(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Path       string
+		NewHandler func(store UserStore) (get, post contextualHandlerFunc)
+	}{
+		{"/api/v1/contacts/{userId}.vcf", func(store UserStore) (get, post contextualHandlerFunc) {
+			handler := &VCardsApiHandler{Store: store}
+			return handler.Get, handler.Post
+		}},
+		{"/api/v1/contacts/{userId}.csv", func(store UserStore) (get, post contextualHandlerFunc) {
+			handler := &CsvApiHandler{Store: store}
+			return handler.Get, handler.Post
+		}},
+	}
+
+	for _, testCase := range testCases {
+		store := GetInitialisedUserStore()
+		original := &Contact{
+			Id:           "tedtoe",
+			FirstName:    "Ted",
+			LastName:     "Toe",
+			Emails:       []Email{Email{Description: "Work", Address: "ted@example.com"}},
+			Addresses:    []Address{Address{Description: "Home", Street: "1 Main St", Country: "Ireland"}},
+			Websites:     []Website{Website{Description: "Blog", Url: "https://example.com/ted"}},
+			CustomFields: []CustomField{CustomField{Name: "Account", Value: "123"}},
+			Tags:         []string{"customers", "on-call"},
+		}
+		store.SaveContact("pmcgrath", original, AnyContactVersion)
+
+		path := strings.Replace(testCase.Path, "{userId}", "pmcgrath", 1)
+		get, post := testCase.NewHandler(store)
+		export, report := serveExportReimport(get, post, testCase.Path, path)
+		spec.Assert(export.Code == http.StatusOK, "Unexpected export status code %d for %s", export.Code, path)
+		spec.Assert(strings.Contains(report.Body.String(), `"Imported":3`), "Unexpected report for %s, body is %s", path, report.Body.String())
+
+		contact, _ := store.GetContact("pmcgrath", "tedtoe")
+		spec.Assert(contact.Version == original.Version+1, "Existing contact was not updated for %s", path)
+		contact.Version, contact.Incarnation = 0, ""
+		original.Version, original.Incarnation = 0, ""
+		spec.Assert(reflect.DeepEqual(contact, original), "Expected [%v] but got [%v] for %s", original, contact, path)
+	}
+
+	// Columns missing from a CSV are kept too, i.e. a file from before tags were exported
+	store := GetInitialisedUserStore()
+	store.SaveContact("pmcgrath", &Contact{Id: "tedtoe", FirstName: "Ted", LastName: "Toe", Emails: []Email{Email{Address: "ted@example.com"}}, Tags: []string{"customers"}}, AnyContactVersion)
+	handler := &CsvApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath.csv", strings.NewReader("Id,FirstName,LastName\ntedtoe,Teddy,Toe\n"))
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}.csv", request)
+	response := httptest.NewRecorder()
+	handler.Post(response, request, requestContext)
+	spec.Assert(strings.Contains(response.Body.String(), `"Imported":1`), "Unexpected report, body is %s", response.Body.String())
+
+	contact, _ := store.GetContact("pmcgrath", "tedtoe")
+	spec.Assert(contact.FirstName == "Teddy", "Existing contact was not updated, first name is %s", contact.FirstName)
+	spec.Assert(reflect.DeepEqual(contact.Tags, []string{"customers"}), "Unexpected tags %v", contact.Tags)
+	spec.Assert(len(contact.Emails) == 1 && contact.Emails[0].Address == "ted@example.com", "Unexpected emails %v", contact.Emails)
+}
+
+type contextualHandlerFunc func(w http.ResponseWriter, r *http.Request, c *RequestContext)
+
+// Exports with get then imports the export with post
+func serveExportReimport(get, post contextualHandlerFunc, template, path string) (*httptest.ResponseRecorder, *httptest.ResponseRecorder) {
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("GET", path, nil)
+	export := httptest.NewRecorder()
+	SetPathParams(requestContext, template, request)
+	get(export, request, requestContext)
+
+	requestContext = GetLoggedInRequestContext()
+	request, _ = http.NewRequest("POST", path, bytes.NewReader(export.Body.Bytes()))
+	report := httptest.NewRecorder()
+	SetPathParams(requestContext, template, request)
+	post(report, request, requestContext)
+
+	return export, report
+}
+
+func TestCsvApiHandlerPostReplacesReservedIds(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	handler := &CsvApiHandler{Store: store}
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath.csv", strings.NewReader("Id,FirstName,LastName\nduplicates,Tom,Toe\nmerge,Anne,Other\n"))
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}.csv", request)
+	handler.Post(response, request, requestContext)
+
+	body := response.Body.String()
+	spec.Assert(strings.Contains(body, `"Imported":2,"Failed":0`), "Unexpected report, body is %s", body)
+
+	user, _ := store.Get("pmcgrath")
+	spec.Assert(len(user.Contacts) == 4, "Unexpected contact count %d", len(user.Contacts))
+	for _, contact := range user.Contacts {
+		spec.Assert(!IsReservedContactId(contact.Id), "Contact saved with reserved id %s", contact.Id)
+	}
+}
+
+func TestCsvApiHandlerPostBadRequest(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Url  string
+		Data string
+	}{
+		{"/api/v1/contacts/pmcgrath.csv?map=Name", "FirstName,LastName\nTom,Toe\n"},
+		{"/api/v1/contacts/pmcgrath.csv?map=Name:Surname", "FirstName,LastName\nTom,Toe\n"},
+		{"/api/v1/contacts/pmcgrath.csv?dryRun=maybe", "FirstName,LastName\nTom,Toe\n"},
+		{"/api/v1/contacts/pmcgrath.csv", "Unknown\nTom\n"},
+		{"/api/v1/contacts/pmcgrath.csv", ""},
+	}
+
+	for _, testCase := range testCases {
+		store := GetInitialisedUserStore()
+		handler := &CsvApiHandler{Store: store}
+
+		requestContext := GetLoggedInRequestContext()
+		request, _ := http.NewRequest("POST", testCase.Url, strings.NewReader(testCase.Data))
+		response := httptest.NewRecorder()
+
+		SetPathParams(requestContext, "/api/v1/contacts/{userId}.csv", request)
+		handler.Post(response, request, requestContext)
+
+		spec.Assert(response.Code == http.StatusBadRequest, "Unexpected status code %d for %s", response.Code, testCase.Url)
+	}
+}
+
+func TestContactsApiHandlerGetSharedContactsAreFiltered(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetSharingUserStore()
+	handler := &ContactsApiHandler{Store: store}
+
+	requestContext := GetRequestContextForUser("picker")
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath", nil)
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/contacts/{userId}", request)
+	handler.Get(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+
+	var contacts []Contact
+	json.Unmarshal(response.Body.Bytes(), &contacts)
+	spec.Assert(len(contacts) == 1 && contacts[0].Id == "ted", "Expected only the granted contact but got %v", contacts)
+	spec.Assert(response.Header().Get("X-Total-Count") == "1", "Unexpected total count %s", response.Header().Get("X-Total-Count"))
+}
+
+func TestContactApiHandlerSharedAccess(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		UserName string
+		Method   string
+		// Expected result
+		StatusCode int
+	}{
+		{"reader", "GET", http.StatusOK},
+		{"reader", "PUT", http.StatusForbidden},
+		{"writer", "PUT", http.StatusOK},
+		{"stranger", "GET", http.StatusForbidden},
+		{"theadmin", "PUT", http.StatusOK},
+	}
+
+	for index, testCase := range testCases {
+		store := GetSharingUserStore()
+		handler := &ContactApiHandler{Store: store}
+
+		requestContext := GetRequestContextForUser(testCase.UserName)
+		body := bytes.NewReader([]byte(`{"FirstName": "Ted", "LastName": "Toe"}`))
+		request, _ := http.NewRequest(testCase.Method, "/api/v1/contacts/pmcgrath/ted", body)
+		response := httptest.NewRecorder()
+
+		SetPathParams(requestContext, "/api/v1/contacts/{userId}/{contactId}", request)
+		if testCase.Method == "GET" {
+			handler.Get(response, request, requestContext)
+		} else {
+			handler.Put(response, request, requestContext)
+		}
+
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code %d for test case %d", response.Code, index)
+	}
+}
+
+func TestUserApiHandlerAdminAccess(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetSharingUserStore()
+	handler := &UserApiHandler{Store: store}
+
+	testCases := []struct {
+		// Input
+		Method string
+		UserId string
+		// Expected result
+		StatusCode int
+	}{
+		{"GET", "pmcgrath", http.StatusOK},
+		{"GET", "nobodyhere", http.StatusNotFound},
+		{"DELETE", "stranger", http.StatusOK},
+	}
+
+	for index, testCase := range testCases {
+		requestContext := GetRequestContextForUser("theadmin")
+		originalSessionId := requestContext.GetSessionId()
+		request, _ := http.NewRequest(testCase.Method, "/api/v1/users/"+testCase.UserId, nil)
+		response := httptest.NewRecorder()
+
+		SetPathParams(requestContext, "/api/v1/users/{userId}", request)
+		if testCase.Method == "GET" {
+			handler.Get(response, request, requestContext)
+		} else {
+			handler.Delete(response, request, requestContext)
+		}
+
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code %d for test case %d", response.Code, index)
+		spec.Assert(requestContext.GetSessionId() == originalSessionId && requestContext.GetUserName() == "theadmin", "Admin should still be logged in for test case %d", index)
+	}
+
+	_, err := store.Get("stranger")
+	spec.Assert(err == ErrUserNotFound, "Expected the user to be deleted but got %v", err)
+}
+
+func TestUserPasswordApiHandlerPutAsAdmin(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetSharingUserStore()
+	handler := &UserPasswordApiHandler{Store: store}
+
+	requestContext := GetRequestContextForUser("theadmin")
+	putData := []byte(`{"NewPassword": "reset"}`)
+	request, _ := http.NewRequest("PUT", "/api/v1/users/pmcgrath/password", bytes.NewReader(putData))
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/users/{userId}/password", request)
+	handler.Put(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+	user, _ := store.Get("pmcgrath")
+	spec.Assert(user.Authenticate("reset"), "Password was not reset")
+}
+
+func TestApiTokensApiHandlerPostAsAdminForbidden(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetSharingUserStore()
+	handler := &ApiTokensApiHandler{Store: store}
+
+	requestContext := GetRequestContextForUser("theadmin")
+	request, _ := http.NewRequest("POST", "/api/v1/users/pmcgrath/tokens", bytes.NewReader([]byte(`{"Name": "ci"}`)))
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/users/{userId}/tokens", request)
+	handler.Post(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusForbidden, "Unexpected status code %d", response.Code)
+}
+
+func TestUserRolesApiHandlerPut(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		UserName string
+		Body     string
+		// Expected result
+		StatusCode int
+		Roles      []string
+	}{
+		{"theadmin", `["admin", "admin"]`, http.StatusOK, []string{AdminRole}},
+		{"theadmin", `[]`, http.StatusOK, []string{}},
+		{"theadmin", `["superuser"]`, http.StatusBadRequest, nil},
+		{"theadmin", `{"Roles": []}`, http.StatusBadRequest, nil},
+		{"pmcgrath", `["admin"]`, http.StatusForbidden, nil},
+	}
+
+	for index, testCase := range testCases {
+		store := GetSharingUserStore()
+		handler := &UserRolesApiHandler{Store: store}
+
+		requestContext := GetRequestContextForUser(testCase.UserName)
+		request, _ := http.NewRequest("PUT", "/api/v1/users/pmcgrath/roles", bytes.NewReader([]byte(testCase.Body)))
+		response := httptest.NewRecorder()
+
+		SetPathParams(requestContext, "/api/v1/users/{userId}/roles", request)
+		handler.Put(response, request, requestContext)
+
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code %d for test case %d", response.Code, index)
+		user, _ := store.Get("pmcgrath")
+		if testCase.Roles != nil {
+			spec.Assert(len(user.Roles) == len(testCase.Roles) && (len(user.Roles) == 0 || user.Roles[0] == testCase.Roles[0]), "Unexpected roles %v for test case %d", user.Roles, index)
+		} else {
+			spec.Assert(len(user.Roles) == 0, "Roles should not have changed for test case %d, got %v", index, user.Roles)
+		}
+	}
+}
+
+func TestGrantApiHandler(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetSharingUserStore()
+	handler := &GrantApiHandler{Store: store}
+
+	testCases := []struct {
+		// Input
+		Method    string
+		GranteeId string
+		Body      string
+		// Expected result
+		StatusCode int
+	}{
+		{"PUT", "stranger", `{"Access": "read", "ContactIds": ["pmcgrath", "pmcgrath"]}`, http.StatusOK},
+		{"GET", "stranger", "", http.StatusOK},
+		{"PUT", "stranger", `{"Access": "owner"}`, http.StatusBadRequest},
+		{"PUT", "pmcgrath", `{"Access": "read"}`, http.StatusBadRequest},
+		{"PUT", "nobodyhere", `{"Access": "read"}`, http.StatusNotFound},
+		{"DELETE", "stranger", "", http.StatusOK},
+		{"DELETE", "stranger", "", http.StatusNotFound},
+		{"GET", "stranger", "", http.StatusNotFound},
+	}
+
+	for index, testCase := range testCases {
+		requestContext := GetLoggedInRequestContext()
+		request, _ := http.NewRequest(testCase.Method, "/api/v1/users/pmcgrath/grants/"+testCase.GranteeId, strings.NewReader(testCase.Body))
+		response := httptest.NewRecorder()
+
+		SetPathParams(requestContext, "/api/v1/users/{userId}/grants/{granteeId}", request)
+		switch testCase.Method {
+		case "GET":
+			handler.Get(response, request, requestContext)
+		case "PUT":
+			handler.Put(response, request, requestContext)
+		case "DELETE":
+			handler.Delete(response, request, requestContext)
+		}
+
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code %d for test case %d, body is %s", response.Code, index, response.Body.String())
+		if testCase.Method == "GET" && testCase.StatusCode == http.StatusOK {
+			var grant Grant
+			json.Unmarshal(response.Body.Bytes(), &grant)
+			spec.Assert(grant.Access == ReadAccess && len(grant.ContactIds) == 1, "Unexpected grant %v", grant)
+		}
+	}
+}
+
+func TestGrantApiHandlerPutForbidden(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetSharingUserStore()
+	handler := &GrantApiHandler{Store: store}
+
+	// A read-write grantee cannot share the owner's contacts on
+	requestContext := GetRequestContextForUser("writer")
+	request, _ := http.NewRequest("PUT", "/api/v1/users/pmcgrath/grants/stranger", strings.NewReader(`{"Access": "read"}`))
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/users/{userId}/grants/{granteeId}", request)
+	handler.Put(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusForbidden, "Unexpected status code %d", response.Code)
+}
+
+func TestGrantsApiHandlers(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetSharingUserStore()
+
+	testCases := []struct {
+		// Input
+		Handler  interface{}
+		UserName string
+		Path     string
+		// Expected result
+		UserIds []string
+	}{
+		{&GrantsApiHandler{Store: store}, "pmcgrath", "/api/v1/users/pmcgrath/grants", []string{"picker", "reader", "writer"}},
+		{&SharedGrantsApiHandler{Store: store}, "reader", "/api/v1/users/reader/shared", []string{"pmcgrath"}},
+		{&SharedGrantsApiHandler{Store: store}, "stranger", "/api/v1/users/stranger/shared", []string{}},
+	}
+
+	for index, testCase := range testCases {
+		requestContext := GetRequestContextForUser(testCase.UserName)
+		request, _ := http.NewRequest("GET", testCase.Path, nil)
+		response := httptest.NewRecorder()
+
+		SetPathParams(requestContext, "/api/v1/users/{userId}/"+testCase.Path[strings.LastIndex(testCase.Path, "/")+1:], request)
+		switch handler := testCase.Handler.(type) {
+		case *GrantsApiHandler:
+			handler.Get(response, request, requestContext)
+		case *SharedGrantsApiHandler:
+			handler.Get(response, request, requestContext)
+		}
+
+		spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d for test case %d", response.Code, index)
+		var grants []Grant
+		json.Unmarshal(response.Body.Bytes(), &grants)
+		userIds := make([]string, 0)
+		for _, grant := range grants {
+			if grant.OwnerId == testCase.UserName {
+				userIds = append(userIds, grant.GranteeId)
+			} else {
+				userIds = append(userIds, grant.OwnerId)
+			}
+		}
+		spec.Assert(reflect.DeepEqual(userIds, testCase.UserIds), "Expected %v but got %v for test case %d", testCase.UserIds, userIds, index)
+	}
+}
+
+func TestGroupsApiHandlers(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetSharingUserStore()
+	groupsHandler := &GroupsApiHandler{Store: store}
+	groupHandler := &GroupApiHandler{Store: store}
+	groupContactHandler := &GroupContactApiHandler{Store: store}
+
+	// Create
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("POST", "/api/v1/users/pmcgrath/groups", strings.NewReader(`{"Name": " Customers "}`))
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/users/{userId}/groups", request)
+	groupsHandler.Post(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusCreated, "Unexpected status code %d, body is %s", response.Code, response.Body.String())
+	var created Group
+	json.Unmarshal(response.Body.Bytes(), &created)
+	spec.Assert(created.Name == "Customers" && created.Id != "", "Unexpected group %v", created)
+	location := response.HeaderMap.Get("Location")
+	spec.Assert(location == "/api/v1/users/pmcgrath/groups/"+created.Id, "Unexpected location header %s", location)
+	groupUrl := location
+
+	testCases := []struct {
+		// Input
+		Handler interface{}
+		Method  string
+		Path    string
+		Body    string
+		// Expected result
+		StatusCode int
+	}{
+		{groupsHandler, "POST", "/api/v1/users/pmcgrath/groups", `{"Name": "customers"}`, http.StatusConflict},
+		{groupsHandler, "POST", "/api/v1/users/pmcgrath/groups", `{"Name": ""}`, http.StatusBadRequest},
+		{groupsHandler, "POST", "/api/v1/users/pmcgrath/groups", `{"Name": "Suppliers"}`, http.StatusCreated},
+		{groupContactHandler, "PUT", groupUrl + "/contacts/pmcgrath", "", http.StatusOK},
+		{groupContactHandler, "PUT", groupUrl + "/contacts/nobodyhere", "", http.StatusNotFound},
+		{groupContactHandler, "PUT", "/api/v1/users/pmcgrath/groups/nogroup/contacts/pmcgrath", "", http.StatusNotFound},
+		{groupHandler, "PUT", groupUrl, `{"Name": "Suppliers"}`, http.StatusConflict},
+		{groupHandler, "PUT", groupUrl, `{"Name": "Key customers"}`, http.StatusOK},
+		{groupHandler, "PUT", "/api/v1/users/pmcgrath/groups/nogroup", `{"Name": "Other"}`, http.StatusNotFound},
+		{groupHandler, "GET", groupUrl, "", http.StatusOK},
+		{groupContactHandler, "DELETE", groupUrl + "/contacts/pmcgrath", "", http.StatusOK},
+		{groupContactHandler, "DELETE", groupUrl + "/contacts/pmcgrath", "", http.StatusNotFound},
+		{groupHandler, "DELETE", groupUrl, "", http.StatusOK},
+		{groupHandler, "GET", groupUrl, "", http.StatusNotFound},
+	}
+
+	for index, testCase := range testCases {
+		requestContext := GetLoggedInRequestContext()
+		request, _ := http.NewRequest(testCase.Method, testCase.Path, strings.NewReader(testCase.Body))
+		response := httptest.NewRecorder()
+
+		switch handler := testCase.Handler.(type) {
+		case *GroupsApiHandler:
+			SetPathParams(requestContext, "/api/v1/users/{userId}/groups", request)
+			handler.Post(response, request, requestContext)
+		case *GroupApiHandler:
+			SetPathParams(requestContext, "/api/v1/users/{userId}/groups/{groupId}", request)
+			switch testCase.Method {
+			case "GET":
+				handler.Get(response, request, requestContext)
+			case "PUT":
+				handler.Put(response, request, requestContext)
+			case "DELETE":
+				handler.Delete(response, request, requestContext)
+			}
+		case *GroupContactApiHandler:
+			SetPathParams(requestContext, "/api/v1/users/{userId}/groups/{groupId}/contacts/{contactId}", request)
+			switch testCase.Method {
+			case "PUT":
+				handler.Put(response, request, requestContext)
+			case "DELETE":
+				handler.Delete(response, request, requestContext)
+			}
+		}
+
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code %d for test case %d, body is %s", response.Code, index, response.Body.String())
+		if testCase.Method == "GET" && testCase.StatusCode == http.StatusOK {
+			var group Group
+			json.Unmarshal(response.Body.Bytes(), &group)
+			spec.Assert(group.Name == "Key customers" && reflect.DeepEqual(group.ContactIds, []string{"pmcgrath"}), "Unexpected group %v", group)
+		}
+	}
+
+	// List
+	requestContext = GetLoggedInRequestContext()
+	request, _ = http.NewRequest("GET", "/api/v1/users/pmcgrath/groups", nil)
+	response = httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/users/{userId}/groups", request)
+	groupsHandler.Get(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+	var groups []Group
+	json.Unmarshal(response.Body.Bytes(), &groups)
+	spec.Assert(len(groups) == 1 && groups[0].Name == "Suppliers", "Unexpected groups %v", groups)
+}
+
+func TestGroupsApiHandlerForbidden(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetSharingUserStore()
+	handler := &GroupsApiHandler{Store: store}
+
+	// Even a read-write grantee cannot see the owner's groups
+	requestContext := GetRequestContextForUser("writer")
+	request, _ := http.NewRequest("GET", "/api/v1/users/pmcgrath/groups", nil)
+	response := httptest.NewRecorder()
+
+	SetPathParams(requestContext, "/api/v1/users/{userId}/groups", request)
+	handler.Get(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusForbidden, "Unexpected status code %d", response.Code)
+}
+
+func TestContactPhotoApiHandler(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	blobs := GetTemporaryBlobStore(t)
+	defer os.RemoveAll(blobs.directory)
+	handler := &ContactPhotoApiHandler{Store: store, Blobs: blobs}
+	template := "/api/v1/contacts/{userId}/{contactId}/photo"
+
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath/ted/photo", nil)
+	response := httptest.NewRecorder()
+	handler.Get(response, request, GetLoggedInRequestContextForPath(template, request))
+	spec.Assert(response.Code == http.StatusNotFound, "Unexpected status code before upload %d", response.Code)
+
+	photo := EncodeTestPhoto("png", 400, 200)
+	request = NewPhotoUploadRequest("/api/v1/contacts/pmcgrath/ted/photo", "photo", "image/png", photo)
+	response = httptest.NewRecorder()
+	handler.Put(response, request, GetLoggedInRequestContextForPath(template, request))
+	spec.Assert(response.Code == http.StatusOK, "Unexpected put status code %d", response.Code)
+	etag := response.Header().Get("ETag")
+	spec.Assert(etag != "", "Expected an ETag")
+
+	request, _ = http.NewRequest("GET", "/api/v1/contacts/pmcgrath/ted/photo", nil)
+	response = httptest.NewRecorder()
+	handler.Get(response, request, GetLoggedInRequestContextForPath(template, request))
+	spec.Assert(response.Code == http.StatusOK, "Unexpected get status code %d", response.Code)
+	spec.Assert(response.Header().Get("Content-Type") == "image/png", "Unexpected content type %s", response.Header().Get("Content-Type"))
+	spec.Assert(response.Header().Get("ETag") == etag, "Unexpected ETag %s", response.Header().Get("ETag"))
+	spec.Assert(response.Header().Get("Last-Modified") != "", "Expected a Last-Modified header")
+	spec.Assert(bytes.Equal(response.Body.Bytes(), photo), "Unexpected photo content")
+	lastModified := response.Header().Get("Last-Modified")
+
+	request, _ = http.NewRequest("GET", "/api/v1/contacts/pmcgrath/ted/photo", nil)
+	request.Header.Set("If-None-Match", etag)
+	response = httptest.NewRecorder()
+	handler.Get(response, request, GetLoggedInRequestContextForPath(template, request))
+	spec.Assert(response.Code == http.StatusNotModified, "Unexpected If-None-Match status code %d", response.Code)
+
+	request, _ = http.NewRequest("GET", "/api/v1/contacts/pmcgrath/ted/photo", nil)
+	request.Header.Set("If-Modified-Since", lastModified)
+	response = httptest.NewRecorder()
+	handler.Get(response, request, GetLoggedInRequestContextForPath(template, request))
+	spec.Assert(response.Code == http.StatusNotModified, "Unexpected If-Modified-Since status code %d", response.Code)
+
+	request, _ = http.NewRequest("GET", "/api/v1/contacts/pmcgrath/ted/photo?size=thumbnail", nil)
+	response = httptest.NewRecorder()
+	handler.Get(response, request, GetLoggedInRequestContextForPath(template, request))
+	spec.Assert(response.Code == http.StatusOK, "Unexpected thumbnail status code %d", response.Code)
+	config, _, err := image.DecodeConfig(response.Body)
+	spec.Assert(err == nil, "Thumbnail does not decode : %s", err)
+	spec.Assert(config.Width == 128 && config.Height == 64, "Unexpected thumbnail dimensions %dx%d", config.Width, config.Height)
+
+	request, _ = http.NewRequest("GET", "/api/v1/contacts/pmcgrath/ted/photo?size=huge", nil)
+	response = httptest.NewRecorder()
+	handler.Get(response, request, GetLoggedInRequestContextForPath(template, request))
+	spec.Assert(response.Code == http.StatusBadRequest, "Unexpected unknown size status code %d", response.Code)
+
+	request, _ = http.NewRequest("DELETE", "/api/v1/contacts/pmcgrath/ted/photo", nil)
+	response = httptest.NewRecorder()
+	handler.Delete(response, request, GetLoggedInRequestContextForPath(template, request))
+	spec.Assert(response.Code == http.StatusOK, "Unexpected delete status code %d", response.Code)
+
+	_, err = blobs.Get(getContactPhotoKey("pmcgrath", "ted", PhotoSizeThumbnail))
+	spec.Assert(err == ErrBlobNotFound, "Expected thumbnail to be deleted %v", err)
+
+	request, _ = http.NewRequest("DELETE", "/api/v1/contacts/pmcgrath/ted/photo", nil)
+	response = httptest.NewRecorder()
+	handler.Delete(response, request, GetLoggedInRequestContextForPath(template, request))
+	spec.Assert(response.Code == http.StatusNotFound, "Unexpected second delete status code %d", response.Code)
+}
+
+func TestContactPhotoApiHandlerPutFailures(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	blobs := GetTemporaryBlobStore(t)
+	defer os.RemoveAll(blobs.directory)
+	handler := &ContactPhotoApiHandler{Store: store, Blobs: blobs}
+	template := "/api/v1/contacts/{userId}/{contactId}/photo"
+
+	oversized := make([]byte, maxPhotoSize+1)
+	copy(oversized, EncodeTestPhoto("png", 1, 1))
+
+	testCases := []struct {
+		// Input
+		Path        string
+		FieldName   string
+		ContentType string
+		Data        []byte
+		// Expected result
+		StatusCode int
+	}{
+		{"/api/v1/contacts/pmcgrath/DOESNOTEXIST/photo", "photo", "image/png", EncodeTestPhoto("png", 10, 10), http.StatusNotFound},
+		{"/api/v1/contacts/pmcgrath/ted/photo", "other", "image/png", EncodeTestPhoto("png", 10, 10), http.StatusBadRequest},
+		{"/api/v1/contacts/pmcgrath/ted/photo", "photo", "text/plain", []byte("not a photo"), http.StatusUnsupportedMediaType},
+		{"/api/v1/contacts/pmcgrath/ted/photo", "photo", "image/png", []byte("not a photo"), http.StatusUnsupportedMediaType},
+		{"/api/v1/contacts/pmcgrath/ted/photo", "photo", "", []byte("GIF89a truncated"), http.StatusBadRequest},
+		{"/api/v1/contacts/pmcgrath/ted/photo", "photo", "image/png", oversized, http.StatusRequestEntityTooLarge},
+	}
+
+	for index, testCase := range testCases {
+		request := NewPhotoUploadRequest(testCase.Path, testCase.FieldName, testCase.ContentType, testCase.Data)
+		response := httptest.NewRecorder()
+		handler.Put(response, request, GetLoggedInRequestContextForPath(template, request))
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code for case %d %d", index, response.Code)
+	}
+
+	request, _ := http.NewRequest("PUT", "/api/v1/contacts/pmcgrath/ted/photo", bytes.NewReader(EncodeTestPhoto("png", 10, 10)))
+	request.Header.Set("Content-Type", "image/png")
+	response := httptest.NewRecorder()
+	handler.Put(response, request, GetLoggedInRequestContextForPath(template, request))
+	spec.Assert(response.Code == http.StatusUnsupportedMediaType, "Unexpected non multipart status code %d", response.Code)
+
+	_, err := blobs.Get(getContactPhotoKey("pmcgrath", "ted", PhotoSizeOriginal))
+	spec.Assert(err == ErrBlobNotFound, "Expected no photo to be stored %v", err)
+}
+
+func TestContactApiHandlerDeleteRemovesPhoto(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	blobs := GetTemporaryBlobStore(t)
+	defer os.RemoveAll(blobs.directory)
+	photo, thumbnail, _ := NewContactPhoto(EncodeTestPhoto("png", 10, 10))
+	blobs.Put(getContactPhotoKey("pmcgrath", "ted", PhotoSizeOriginal), photo)
+	blobs.Put(getContactPhotoKey("pmcgrath", "ted", PhotoSizeThumbnail), thumbnail)
+	handler := &ContactApiHandler{Store: store, Blobs: blobs}
+
+	request, _ := http.NewRequest("DELETE", "/api/v1/contacts/pmcgrath/ted", nil)
+	response := httptest.NewRecorder()
+	handler.Delete(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/{contactId}", request))
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+	_, err := blobs.Get(getContactPhotoKey("pmcgrath", "ted", PhotoSizeOriginal))
+	spec.Assert(err == ErrBlobNotFound, "Expected photo to be deleted %v", err)
+	_, err = blobs.Get(getContactPhotoKey("pmcgrath", "ted", PhotoSizeThumbnail))
+	spec.Assert(err == ErrBlobNotFound, "Expected thumbnail to be deleted %v", err)
+}
+
+func GetTemporaryBlobStore(t *testing.T) *FileBlobStore {
+	directory, err := ioutil.TempDir("", "handlers-test-")
+	if err != nil {
+		t.Fatalf("TempDir failed : %s", err)
+	}
+	store, err := NewFileBlobStore(directory)
+	if err != nil {
+		t.Fatalf("NewFileBlobStore failed : %s", err)
+	}
+	return store
+}
+
+func NewPhotoUploadRequest(path, fieldName, contentType string, data []byte) *http.Request {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="photo"`, fieldName))
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	part, _ := writer.CreatePart(header)
+	part.Write(data)
+	writer.Close()
+
+	request, _ := http.NewRequest("PUT", path, body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	return request
+}
+
+func TestContactDuplicatesApiHandlerGet(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetSharingUserStore()
+	store.SaveContact("pmcgrath", &Contact{Id: "ted-toe", FirstName: "Toe", LastName: "Ted", Phones: []Phone{Phone{Number: "+3530667132310"}}}, NoContactVersion)
+	handler := &ContactDuplicatesApiHandler{Store: store}
+	template := "/api/v1/contacts/{userId}/duplicates"
+
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath/duplicates", nil)
+	response := httptest.NewRecorder()
+	handler.Get(response, request, GetLoggedInRequestContextForPath(template, request))
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+	var duplicates []DuplicateContacts
+	err := json.NewDecoder(response.Body).Decode(&duplicates)
+	spec.Assert(err == nil, "Response is not a duplicates list : %s", err)
+	expected := []DuplicateContacts{DuplicateContacts{ContactIds: []string{"ted", "ted-toe"}, Score: 0.91, Reasons: []string{"phone", "name"}}}
+	spec.Assert(reflect.DeepEqual(duplicates, expected), "Expected [%v] but got [%v]", expected, duplicates)
+
+	testCases := []struct {
+		// Input
+		UserName string
+		Path     string
+		// Expected result
+		StatusCode int
+		Count      int
+	}{
+		{"pmcgrath", "/api/v1/contacts/pmcgrath/duplicates?minScore=0.95", http.StatusOK, 0},
+		{"pmcgrath", "/api/v1/contacts/pmcgrath/duplicates?minScore=abc", http.StatusBadRequest, 0},
+		{"pmcgrath", "/api/v1/contacts/pmcgrath/duplicates?minScore=0", http.StatusBadRequest, 0},
+		{"reader", "/api/v1/contacts/pmcgrath/duplicates", http.StatusOK, 1},
+		{"picker", "/api/v1/contacts/pmcgrath/duplicates", http.StatusOK, 0}, // Only sees ted
+		{"stranger", "/api/v1/contacts/pmcgrath/duplicates", http.StatusForbidden, 0},
+	}
+
+	for index, testCase := range testCases {
+		request, _ := http.NewRequest("GET", testCase.Path, nil)
+		response := httptest.NewRecorder()
+		requestContext := GetRequestContextForUser(testCase.UserName)
+		SetPathParams(requestContext, template, request)
+		handler.Get(response, request, requestContext)
+
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code for case %d %d", index, response.Code)
+		if response.Code == http.StatusOK {
+			var duplicates []DuplicateContacts
+			json.NewDecoder(response.Body).Decode(&duplicates)
+			spec.Assert(len(duplicates) == testCase.Count, "Unexpected duplicate count for case %d %d", index, len(duplicates))
+		}
+	}
+}
+
+func TestContactMergeApiHandlerPost(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	store.SaveContact("pmcgrath", &Contact{Id: "ted-toe", FirstName: "Toe", LastName: "Ted", Emails: []Email{Email{Address: "ted@example.com"}}, Phones: []Phone{Phone{Number: "+3530667132310"}}}, NoContactVersion)
+	blobs := GetTemporaryBlobStore(t)
+	defer os.RemoveAll(blobs.directory)
+	photo, thumbnail, _ := NewContactPhoto(EncodeTestPhoto("png", 10, 10))
+	blobs.Put(getContactPhotoKey("pmcgrath", "ted-toe", PhotoSizeThumbnail), thumbnail)
+	blobs.Put(getContactPhotoKey("pmcgrath", "ted-toe", PhotoSizeOriginal), photo)
+	handler := &ContactMergeApiHandler{Store: store, Blobs: blobs}
+
+	request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath/merge", strings.NewReader(`{"ContactIds": ["ted", "ted-toe"]}`))
+	response := httptest.NewRecorder()
+	handler.Post(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/merge", request))
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+	spec.Assert(response.Header().Get("Content-Location") == "/api/v1/contacts/pmcgrath/ted", "Unexpected Content-Location %s", response.Header().Get("Content-Location"))
+	var merged Contact
+	err := json.NewDecoder(response.Body).Decode(&merged)
+	spec.Assert(err == nil, "Response is not a contact : %s", err)
+	spec.Assert(merged.Id == "ted" && merged.FirstName == "Ted", "Unexpected merged contact %+v", merged)
+	spec.Assert(len(merged.Phones) == 1 && merged.Phones[0].Number == "+3530667132310", "Unexpected phones %v", merged.Phones)
+	spec.Assert(len(merged.Emails) == 1 && merged.Emails[0].Address == "ted@example.com", "Unexpected emails %v", merged.Emails)
+	spec.Assert(reflect.DeepEqual(merged.MergedIds, []string{"ted-toe"}), "Unexpected merged ids %v", merged.MergedIds)
+	spec.Assert(response.Header().Get("ETag") == GetContactETag(&merged), "Unexpected ETag %s", response.Header().Get("ETag"))
+
+	user, _ := store.Get("pmcgrath")
+	spec.Assert(len(user.Contacts) == 2, "Unexpected contact count %d", len(user.Contacts))
+	_, err = store.GetContact("pmcgrath", "ted-toe")
+	spec.Assert(err == ErrContactNotFound, "Expected merged contact to be deleted %v", err)
+
+	// The merged contact had no photo so takes ted-toe's
+	stored, err := blobs.Get(getContactPhotoKey("pmcgrath", "ted", PhotoSizeOriginal))
+	spec.Assert(err == nil && bytes.Equal(stored.Data, photo.Data), "Expected photo to be moved %v", err)
+	_, err = blobs.Get(getContactPhotoKey("pmcgrath", "ted-toe", PhotoSizeOriginal))
+	spec.Assert(err == ErrBlobNotFound, "Expected merged contact photo to be deleted %v", err)
+}
+
+func TestContactApiHandlerPutKeepsMergedIds(t *testing.T) {
+	spec := &Spec{t}
+
+	store := GetInitialisedUserStore()
+	store.SaveContact("pmcgrath", &Contact{Id: "ted-toe", FirstName: "Toe", LastName: "Ted"}, NoContactVersion)
+	mergeHandler := &ContactMergeApiHandler{Store: store}
+	request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath/merge", strings.NewReader(`{"ContactIds": ["ted", "ted-toe"]}`))
+	response := httptest.NewRecorder()
+	mergeHandler.Post(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/merge", request))
+	spec.Assert(response.Code == http.StatusOK, "Unexpected merge status code %d", response.Code)
+
+	handler := &ContactApiHandler{Store: store}
+	for _, body := range []string{
+		`{"Id": "ted", "FirstName": "Ted", "LastName": "Toe"}`,
+		`{"Id": "ted", "FirstName": "Ted", "LastName": "Toe", "MergedIds": ["forged"]}`,
+	} {
+		request, _ := http.NewRequest("PUT", "/api/v1/contacts/pmcgrath/ted", strings.NewReader(body))
+		response := httptest.NewRecorder()
+		handler.Put(response, request, GetLoggedInRequestContextForPath("/api/v1/contacts/{userId}/{contactId}", request))
+		spec.Assert(response.Code == http.StatusOK, "Unexpected put status code %d", response.Code)
+
+		contact, _ := store.GetContact("pmcgrath", "ted")
+		spec.Assert(reflect.DeepEqual(contact.MergedIds, []string{"ted-toe"}), "Unexpected merged ids after put %v", contact.MergedIds)
+	}
+}
+
+func TestContactMergeApiHandlerPostFailures(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		UserName string
+		Body     string
+		// Expected result
+		StatusCode int
+	}{
+		{"pmcgrath", `{"ContactIds": ["ted", "pmcgrath"`, http.StatusBadRequest},
+		{"pmcgrath", `{"ContactIds": ["ted"]}`, http.StatusBadRequest},
+		{"pmcgrath", `{"ContactIds": ["ted", "ted"]}`, http.StatusBadRequest},
+		{"pmcgrath", `{"ContactIds": ["ted", "DOESNOTEXIST"]}`, http.StatusNotFound},
+		{"reader", `{"ContactIds": ["ted", "pmcgrath"]}`, http.StatusForbidden},
+		{"picker", `{"ContactIds": ["ted", "pmcgrath"]}`, http.StatusForbidden},
+		{"stranger", `{"ContactIds": ["ted", "pmcgrath"]}`, http.StatusForbidden},
+		{"stranger", `{"ContactIds": []}`, http.StatusBadRequest},
+		{"writer", `{"ContactIds": ["ted", "pmcgrath"]}`, http.StatusOK},
+	}
+
+	for index, testCase := range testCases {
+		store := GetSharingUserStore()
+		handler := &ContactMergeApiHandler{Store: store}
+
+		request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath/merge", strings.NewReader(testCase.Body))
+		response := httptest.NewRecorder()
+		requestContext := GetRequestContextForUser(testCase.UserName)
+		SetPathParams(requestContext, "/api/v1/contacts/{userId}/merge", request)
+		handler.Post(response, request, requestContext)
+
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code for case %d %d", index, response.Code)
+		if response.Code != http.StatusOK {
+			user, _ := store.Get("pmcgrath")
+			spec.Assert(len(user.Contacts) == 2, "Unexpected contact count for case %d %d", index, len(user.Contacts))
+		}
+	}
+}
+
+// Counts reads so tests can check requests are rejected before the store is used
+type countingUserStore struct {
+	UserStore
+	Reads int
+}
+
+func (store *countingUserStore) Get(id string) (*User, error) {
+	store.Reads++
+	return store.UserStore.Get(id)
+}
+
+func (store *countingUserStore) GetContact(userId, contactId string) (*Contact, error) {
+	store.Reads++
+	return store.UserStore.GetContact(userId, contactId)
+}
+
+func (store *countingUserStore) GetGrant(ownerId, granteeId string) (*Grant, error) {
+	store.Reads++
+	return store.UserStore.GetGrant(ownerId, granteeId)
+}
+
+func TestContactMergeApiHandlerPostRejectsBeforeStoreAccess(t *testing.T) {
+	spec := &Spec{t}
+
+	tooMany := make([]string, maxMergeContacts+1)
+	for index := range tooMany {
+		tooMany[index] = fmt.Sprintf("contact%d", index)
+	}
+	tooManyBody, _ := json.Marshal(map[string][]string{"ContactIds": tooMany})
+	oversizedBody := `{"ContactIds": ["` + strings.Repeat("a", maxMergeRequestSize) + `"]}`
+
+	testCases := []struct {
+		// Input
+		UserName string
+		Body     string
+		// Expected result
+		StatusCode int
+	}{
+		{"pmcgrath", string(tooManyBody), http.StatusBadRequest},
+		{"picker", string(tooManyBody), http.StatusBadRequest},
+		{"picker", `{"ContactIds": ["ted", "pmcgrath", "ted"]}`, http.StatusBadRequest},
+		{"stranger", `{"ContactIds": ["ted"]}`, http.StatusBadRequest},
+		{"pmcgrath", oversizedBody, http.StatusBadRequest},
+	}
+
+	for index, testCase := range testCases {
+		store := &countingUserStore{UserStore: GetSharingUserStore()}
+		handler := &ContactMergeApiHandler{Store: store}
+
+		request, _ := http.NewRequest("POST", "/api/v1/contacts/pmcgrath/merge", strings.NewReader(testCase.Body))
+		response := httptest.NewRecorder()
+		requestContext := GetRequestContextForUser(testCase.UserName)
+		SetPathParams(requestContext, "/api/v1/contacts/{userId}/merge", request)
+		handler.Post(response, request, requestContext)
+
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code for case %d %d", index, response.Code)
+		spec.Assert(store.Reads == 0, "Unexpected store reads for case %d %d", index, store.Reads)
 	}
 }
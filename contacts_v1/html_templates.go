@@ -4,6 +4,7 @@ const rootHtmlTemplate = `
 <html>
   <head>
     <title>Contacts</title>
+    <meta name="csrf-token" content="{{.GetCsrfToken}}">
     <script src="/assets/js/main.js"></script>    
   </head>
   <body>
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"net/http"
+	"reflect"
 	"time"
 )
 
@@ -26,6 +28,8 @@ type RequestContext struct {
 	Id        string
 	StartTime time.Time
 	Session   *Session
+	Params    map[string]string // Path template parameters, set by the router
+	ApiToken  *ApiToken         // Set if authenticated by an API token rather than a session cookie
 	Data      map[string]interface{}
 }
 
@@ -45,6 +49,40 @@ func (c *RequestContext) GetUserName() string {
 	return ""
 }
 
+func (c *RequestContext) GetParam(name string) string {
+	return c.Params[name]
+}
+
+// For the root page template, empty if there is no session or the session has no token yet
+func (c *RequestContext) GetCsrfToken() string {
+	if c.Session != nil {
+		return GetExistingCsrfToken(c.Session)
+	}
+
+	return ""
+}
+
+/*
+Session fixation defence - moves the session to a new id, the session middleware deletes the old id and sends the new
+cookie, must be called before the response is written
+The CSRF token is dropped so a token seen under the old id is useless
+*/
+func (c *RequestContext) RegenerateSessionId() {
+	data := make(map[string]interface{}, len(c.Session.Data))
+	for key, value := range c.Session.Data {
+		if key != csrfTokenSessionKey {
+			data[key] = value
+		}
+	}
+
+	c.Session = &Session{
+		Id:         Uuid(),
+		UserName:   c.Session.UserName,
+		Data:       data,
+		LastAccess: c.Session.LastAccess,
+	}
+}
+
 func (c *RequestContext) IsLoggedIn() bool {
 	return c.GetUserName() != ""
 }
@@ -109,52 +147,283 @@ func NewLoggingHandler(next ContextualHandler) ContextualHandler {
 
 /*
 Session middleware
+Sessions are only saved when modified or when over half their age has passed since the last save, so the store's expiry
+slides, the cookie is only written when the session is saved so both expire together
+New sessions are only saved when modified, so anonymous requests which do not use the session do not fill the store
+The session is saved before the response headers are written, the client can then rely on it for its next request
+Save errors are logged, and with BufferResponses set the response is held until the session is saved so a failure
+becomes a 500, otherwise the response is already on its way
 */
 type SessionHandler struct {
-	Store SessionStore
-	Next  ContextualHandler
+	Store           SessionStore
+	Next            ContextualHandler
+	BufferResponses bool
 }
 
 func (h *SessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	isNew := false
 	var s *Session
-	cookie, err := r.Cookie("SessionId")
-	if err != nil {
+	if cookie, err := r.Cookie("SessionId"); err == nil {
+		s, _ = h.Store.Get(cookie.Value)
+	}
+	if s == nil {
+		// Never adopt the client's id, a new id is only used if the session gets saved
+		isNew = true
 		s = &Session{
 			Id: Uuid(),
 		}
-	} else {
-		s, _ = h.Store.Get(cookie.Value)
-		if s == nil {
-			s = &Session{
-				Id: Uuid(),
-			}
-		}
 	}
 	c.Session = s
 
-	// *** Need to write cookie before we pass to the next handler as we will not succed in writing the cookie after the next handler has completed, if it has written some contentto the repsonse body
-	// Rewrite session cookie
-	cookie = &http.Cookie{
+	tracker := &sessionTracker{store: h.Store, c: c, isNew: isNew, savedState: getSessionState(s)}
+	if h.BufferResponses {
+		h.serveBuffered(w, r, c, tracker)
+		return
+	}
+
+	sessionWriter := &sessionResponseWriter{ResponseWriter: w, beforeHeaders: func(w http.ResponseWriter) {
+		h.saveSession(w, r, c, tracker)
+	}}
+	h.Next.ServeHTTP(sessionWriter, r, c)
+	sessionWriter.writingHeaders() // Next handler may not have written anything
+
+	// Changed after the headers were written, too late for the cookie so only useful for existing sessions
+	if tracker.needsSave() {
+		if _, ok := h.Store.(SessionCookieEncoder); ok {
+			// The change only exists in the cookie we can no longer send, saving would only revoke a rotated session's old id
+			log.Printf("%s Session changed after the response was written, change dropped as the session is held in the cookie, see WEBAPP_SESSION_BUFFER_RESPONSES\n", c.GetLogMessagePrefix())
+			return
+		}
+		if err := tracker.save(); err != nil {
+			log.Printf("%s Error detected when trying to save session after the response was written : %s\n", c.GetLogMessagePrefix(), err)
+		}
+	}
+}
+
+func (h *SessionHandler) serveBuffered(w http.ResponseWriter, r *http.Request, c *RequestContext, tracker *sessionTracker) {
+	buffer := newBufferedResponseWriter()
+	h.Next.ServeHTTP(buffer, r, c)
+
+	if !h.saveSession(w, r, c, tracker) {
+		WriteProblem(w, c, http.StatusInternalServerError, "")
+		return
+	}
+
+	buffer.writeTo(w)
+}
+
+// Saves if needed, writing the cookie on success, false if the save failed
+func (h *SessionHandler) saveSession(w http.ResponseWriter, r *http.Request, c *RequestContext, tracker *sessionTracker) bool {
+	if !tracker.needsSave() {
+		return true
+	}
+
+	if err := tracker.save(); err != nil {
+		log.Printf("%s Error detected when trying to save session : %s\n", c.GetLogMessagePrefix(), err)
+		return false
+	}
+
+	// Stateless stores hold the whole session in the cookie
+	value := c.Session.Id
+	if encoder, ok := h.Store.(SessionCookieEncoder); ok {
+		var err error
+		if value, err = encoder.EncodeSession(c.Session); err != nil {
+			log.Printf("%s Error detected when trying to encode session cookie : %s\n", c.GetLogMessagePrefix(), err)
+			return false
+		}
+	}
+
+	// Only get to write one cookie, so this will overwrite any existing cookies
+	http.SetCookie(w, &http.Cookie{
 		Name:     "SessionId",
-		Value:    c.Session.Id,
+		Value:    value,
 		Path:     "/",
 		Domain:   "", // Chrome will not include if value is "localhost" the Cookie header in requests, seems to need 2 dots see http://stackoverflow.com/questions/21865681/sessions-variables-in-golang-not-saved-while-using-gorilla-sessions
 		MaxAge:   int(h.Store.GetAge()),
-		Secure:   false, // Requires TLS to make true
+		Secure:   r.TLS != nil, // Browsers will then only send over https
 		HttpOnly: true,
-	}
-	// Only get to write one cookie, so this will overwrite any existing cookies
-	http.SetCookie(w, cookie)
-
-	h.Next.ServeHTTP(w, r, c)
+		SameSite: http.SameSiteLaxMode, // Not sent on cross site sub requests, still sent when following a link to us
+	})
 
-	h.Store.Save(s)
+	return true
 }
 
 func NewSessionHandler(store SessionStore, next ContextualHandler) ContextualHandler {
 	return &SessionHandler{Store: store, Next: next}
 }
 
+func NewBufferedSessionHandler(store SessionStore, next ContextualHandler) ContextualHandler {
+	return &SessionHandler{Store: store, Next: next, BufferResponses: true}
+}
+
+// The parts of a session we compare to detect changes, data values are expected to be simple values
+type sessionState struct {
+	id       string
+	userName string
+	data     map[string]interface{}
+}
+
+func getSessionState(s *Session) sessionState {
+	data := make(map[string]interface{}, len(s.Data))
+	for key, value := range s.Data {
+		data[key] = value
+	}
+
+	return sessionState{id: s.Id, userName: s.UserName, data: data}
+}
+
+func (state sessionState) matches(s *Session) bool {
+	if state.id != s.Id || state.userName != s.UserName || len(state.data) != len(s.Data) {
+		return false
+	}
+	for key, value := range s.Data {
+		if savedValue, ok := state.data[key]; !ok || !reflect.DeepEqual(savedValue, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type sessionTracker struct {
+	store      SessionStore
+	c          *RequestContext // Session is read from here as handlers may replace it, see RegenerateSessionId
+	isNew      bool            // Not in the store yet
+	savedState sessionState    // As loaded or last saved, the id is deleted from the store if the session is rotated
+}
+
+func (tracker *sessionTracker) needsSave() bool {
+	if !tracker.savedState.matches(tracker.c.Session) {
+		return true
+	}
+
+	halfAge := time.Duration(tracker.store.GetAge()) * time.Second / 2
+	return !tracker.isNew && time.Since(tracker.c.Session.LastAccess) > halfAge
+}
+
+func (tracker *sessionTracker) save() error {
+	s := tracker.c.Session
+	if err := tracker.store.Save(s); err != nil {
+		return err
+	}
+
+	if !tracker.isNew && s.Id != tracker.savedState.id {
+		if err := tracker.store.Delete(tracker.savedState.id); err != nil {
+			log.Printf("%s Error detected when trying to delete rotated session %s : %s\n", tracker.c.GetLogMessagePrefix(), tracker.savedState.id, err)
+		}
+	}
+	tracker.isNew = false
+	tracker.savedState = getSessionState(s)
+
+	return nil
+}
+
+// Runs a function just before the headers are written
+type sessionResponseWriter struct {
+	http.ResponseWriter
+	beforeHeaders func(http.ResponseWriter)
+	wroteHeaders  bool
+}
+
+func (w *sessionResponseWriter) writingHeaders() {
+	if !w.wroteHeaders {
+		w.wroteHeaders = true
+		w.beforeHeaders(w.ResponseWriter)
+	}
+}
+
+func (w *sessionResponseWriter) WriteHeader(code int) {
+	w.writingHeaders()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *sessionResponseWriter) Write(content []byte) (int, error) {
+	w.writingHeaders()
+	return w.ResponseWriter.Write(content)
+}
+
+// Holds the whole response until writeTo
+type bufferedResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       *bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{header: make(http.Header), body: new(bytes.Buffer)}
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	if w.statusCode == 0 {
+		w.statusCode = code
+	}
+}
+
+func (w *bufferedResponseWriter) Write(content []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(content)
+}
+
+func (w *bufferedResponseWriter) writeTo(target http.ResponseWriter) {
+	for key, values := range w.header {
+		target.Header()[key] = values
+	}
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	target.WriteHeader(w.statusCode)
+	target.Write(w.body.Bytes())
+}
+
+/*
+Bearer token middleware - requests with an "Authorization: Bearer <token>" header are authenticated by API token
+The context gets a session that is never saved so later middleware and handlers work as they would for a logged in session
+Other requests go to the session chain, bearer requests skip it as they do not need a session cookie or CSRF checks
+*/
+type BearerTokenHandler struct {
+	Store        UserStore
+	Next         ContextualHandler // For bearer requests
+	SessionChain ContextualHandler // For all other requests
+}
+
+func (h *BearerTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	token, ok := ParseBearerToken(r.Header.Get("Authorization"))
+	if !ok {
+		h.SessionChain.ServeHTTP(w, r, c)
+		return
+	}
+
+	apiToken, err := h.Store.GetApiToken(HashApiToken(token))
+	if err != nil {
+		if err != ErrApiTokenNotFound {
+			log.Printf("%s Error detected when trying to get API token : %s\n", c.GetLogMessagePrefix(), err)
+			WriteProblem(w, c, http.StatusInternalServerError, "")
+			return
+		}
+		log.Printf("%s Unknown or revoked API token\n", c.GetLogMessagePrefix())
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		WriteProblem(w, c, http.StatusUnauthorized, "Invalid API token")
+		return
+	}
+
+	c.ApiToken = apiToken
+	c.Session = &Session{
+		Id:       "apitoken:" + apiToken.Id, // Only used in log messages
+		UserName: apiToken.UserId,
+		Data:     make(map[string]interface{}),
+	}
+
+	h.Next.ServeHTTP(w, r, c)
+}
+
+func NewBearerTokenHandler(store UserStore, next, sessionChain ContextualHandler) ContextualHandler {
+	return &BearerTokenHandler{Store: store, Next: next, SessionChain: sessionChain}
+}
+
 /*
 Authorisation middleware
 */
@@ -164,7 +433,7 @@ type AuthorisationHandler struct {
 
 func (h *AuthorisationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, c *RequestContext) {
 	if !c.IsLoggedIn() {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		WriteProblem(w, c, http.StatusUnauthorized, "Must be logged in")
 		return
 	}
 
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -40,3 +45,283 @@ func TestRequestContextiGetLogMessagePrefix(t *testing.T) {
 
 	spec.Assert(c.GetLogMessagePrefix() == "TheId SID [Ted]", "Unexpected message")
 }
+
+func TestAuthorisationHandlerNotLoggedIn(t *testing.T) {
+	spec := &Spec{t}
+
+	handler := NewAuthorisationHandler(NewRouter())
+
+	requestContext := &RequestContext{Id: "r1", Data: make(map[string]interface{})}
+	request, _ := http.NewRequest("GET", "/api/v1/contacts/pmcgrath", nil)
+	response := httptest.NewRecorder()
+
+	handler.ServeHTTP(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusUnauthorized, "Unexpected status code %d", response.Code)
+
+	contentTypeHeader := response.HeaderMap.Get("Content-Type")
+	spec.Assert(contentTypeHeader == "application/problem+json", "Unexpected content type header %s", contentTypeHeader)
+	spec.Assert(strings.Contains(response.Body.String(), `"detail":"Must be logged in","instance":"r1"`), "Response body did not contain expected content, body is %s", response.Body.String())
+}
+
+type SessionTestHandler struct {
+	Rotate      bool
+	UserName    string
+	WriteBody   bool
+	Store       SessionStore
+	SavedBefore bool // Was the session in the store when the body was written
+}
+
+func (h *SessionTestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	if h.Rotate {
+		c.RegenerateSessionId()
+	}
+	if h.UserName != "" {
+		c.Session.UserName = h.UserName
+	}
+	if h.WriteBody {
+		w.Write([]byte("body"))
+		if h.Store != nil {
+			_, err := h.Store.Get(c.Session.Id)
+			h.SavedBefore = err == nil
+		}
+	}
+}
+
+type FailingSessionStore struct {
+	*InMemorySessionStore
+}
+
+func (store *FailingSessionStore) Save(s *Session) error {
+	return errors.New("Save failed")
+}
+
+func serveSessionRequest(handler ContextualHandler, sessionId string) (*httptest.ResponseRecorder, *RequestContext) {
+	requestContext := &RequestContext{Id: "r1", Data: make(map[string]interface{})}
+	request, _ := http.NewRequest("POST", "/api/v1/login", nil)
+	if sessionId != "" {
+		request.AddCookie(&http.Cookie{Name: "SessionId", Value: sessionId})
+	}
+	response := httptest.NewRecorder()
+
+	handler.ServeHTTP(response, request, requestContext)
+
+	return response, requestContext
+}
+
+func TestSessionHandlerCookieOverPlainHttp(t *testing.T) {
+	spec := &Spec{t}
+
+	handler := NewSessionHandler(NewInMemorySessionStore(60, 60), &SessionTestHandler{UserName: "ted"})
+
+	response, _ := serveSessionRequest(handler, "")
+
+	cookie := response.Result().Cookies()[0]
+	spec.Assert(cookie.Name == "SessionId", "Unexpected cookie %s", cookie.Name)
+	spec.Assert(cookie.HttpOnly, "Session cookie is not HttpOnly")
+	spec.Assert(!cookie.Secure, "Session cookie is secure over plain http")
+	spec.Assert(cookie.SameSite == http.SameSiteLaxMode, "Unexpected session cookie SameSite %d", cookie.SameSite)
+}
+
+func TestSessionHandlerRotatesSessionId(t *testing.T) {
+	spec := &Spec{t}
+
+	for _, writeBody := range []bool{false, true} {
+		store := NewInMemorySessionStore(60, 60)
+		original := &Session{Id: "original", Data: map[string]interface{}{"Other": "kept"}}
+		GetCsrfToken(original)
+		store.Save(original)
+
+		handler := NewSessionHandler(store, &SessionTestHandler{Rotate: true, UserName: "ted", WriteBody: writeBody})
+
+		response, requestContext := serveSessionRequest(handler, "original")
+
+		newId := requestContext.GetSessionId()
+		spec.Assert(newId != "original", "Session id was not regenerated")
+
+		cookies := response.Result().Cookies()
+		spec.Assert(len(cookies) == 1 && cookies[0].Value == newId, "Expected a single cookie with the new session id, body written is %t", writeBody)
+
+		_, err := store.Get("original")
+		spec.Assert(err != nil, "Original session was not deleted")
+
+		rotated, err := store.Get(newId)
+		spec.Assert(err == nil, "Rotated session was not saved")
+		spec.Assert(rotated.UserName == "ted", "Unexpected user name %s", rotated.UserName)
+		spec.Assert(rotated.Data["Other"] == "kept", "Session data was not carried over")
+		spec.Assert(rotated.Data["CsrfToken"] == nil, "CSRF token was carried over")
+	}
+}
+
+func TestSessionHandlerDoesNotAdoptUnknownSessionId(t *testing.T) {
+	spec := &Spec{t}
+
+	store := NewInMemorySessionStore(60, 60)
+	handler := NewSessionHandler(store, &SessionTestHandler{UserName: "ted"})
+
+	response, requestContext := serveSessionRequest(handler, "planted")
+
+	spec.Assert(requestContext.GetSessionId() != "planted", "Unknown session id was adopted")
+	spec.Assert(response.Result().Cookies()[0].Value == requestContext.GetSessionId(), "Unexpected cookie value")
+	_, err := store.Get("planted")
+	spec.Assert(err != nil, "Unknown session id was saved")
+}
+
+func TestSessionHandlerDoesNotSaveUnmodifiedAnonymousSession(t *testing.T) {
+	spec := &Spec{t}
+
+	store := NewInMemorySessionStore(60, 60)
+	handler := NewSessionHandler(store, &SessionTestHandler{WriteBody: true})
+
+	response, _ := serveSessionRequest(handler, "")
+
+	spec.Assert(len(response.Result().Cookies()) == 0, "Unexpected cookie for an unmodified anonymous session")
+	spec.Assert(len(store.data) == 0, "Unmodified anonymous session was saved")
+}
+
+func TestSessionHandlerSlidingExpiry(t *testing.T) {
+	spec := &Spec{t}
+	testCases := []struct {
+		// Input
+		SinceLastSave time.Duration
+		// Expected result
+		Saved bool
+	}{
+		{0, false},
+		{29 * time.Second, false},
+		{31 * time.Second, true}, // Over half the 60 second age
+	}
+
+	for _, testCase := range testCases {
+		store := NewInMemorySessionStore(60, 60)
+		store.Save(&Session{Id: "s1", UserName: "ted"})
+		lastAccess := time.Now().Add(-testCase.SinceLastSave)
+		store.data["s1"].LastAccess = lastAccess
+
+		handler := NewSessionHandler(store, &SessionTestHandler{WriteBody: true})
+		response, _ := serveSessionRequest(handler, "s1")
+
+		saved := !store.data["s1"].LastAccess.Equal(lastAccess)
+		spec.Assert(saved == testCase.Saved, "Unexpected save %t for %s since the last save", saved, testCase.SinceLastSave)
+		spec.Assert((len(response.Result().Cookies()) == 1) == testCase.Saved, "Cookie should only be written when saved, %s since the last save", testCase.SinceLastSave)
+	}
+}
+
+func TestSessionHandlerSavesBeforeResponseIsWritten(t *testing.T) {
+	spec := &Spec{t}
+
+	store := NewInMemorySessionStore(60, 60)
+	next := &SessionTestHandler{UserName: "ted", WriteBody: true, Store: store}
+
+	serveSessionRequest(NewSessionHandler(store, next), "")
+
+	spec.Assert(next.SavedBefore, "Session was not saved before the response was written")
+}
+
+func TestSessionHandlerSaveFailure(t *testing.T) {
+	spec := &Spec{t}
+	testCases := []struct {
+		// Input
+		Buffered bool
+		// Expected result
+		StatusCode int
+		Body       string
+	}{
+		{false, http.StatusOK, "body"}, // Too late to change the response
+		{true, http.StatusInternalServerError, `"status":500`},
+	}
+
+	for _, testCase := range testCases {
+		store := &FailingSessionStore{NewInMemorySessionStore(60, 60)}
+		next := &SessionTestHandler{UserName: "ted", WriteBody: true}
+		handler := NewSessionHandler(store, next)
+		if testCase.Buffered {
+			handler = NewBufferedSessionHandler(store, next)
+		}
+
+		response, _ := serveSessionRequest(handler, "")
+
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code %d, buffered is %t", response.Code, testCase.Buffered)
+		spec.Assert(strings.Contains(response.Body.String(), testCase.Body), "Unexpected body %s, buffered is %t", response.Body.String(), testCase.Buffered)
+		spec.Assert(len(response.Result().Cookies()) == 0, "Unexpected cookie for a session that was not saved, buffered is %t", testCase.Buffered)
+	}
+}
+
+func TestBufferedSessionHandlerWritesResponse(t *testing.T) {
+	spec := &Spec{t}
+
+	store := NewInMemorySessionStore(60, 60)
+	handler := NewBufferedSessionHandler(store, &AcceptedTestHandler{})
+
+	response, requestContext := serveSessionRequest(handler, "")
+
+	spec.Assert(response.Code == http.StatusAccepted, "Unexpected status code %d", response.Code)
+	spec.Assert(response.Body.String() == "accepted", "Unexpected body %s", response.Body.String())
+	spec.Assert(response.Header().Get("X-Test") == "value", "Buffered header was not written")
+	spec.Assert(response.Result().Cookies()[0].Value == requestContext.GetSessionId(), "Unexpected cookie")
+}
+
+type AcceptedTestHandler struct{}
+
+func (h *AcceptedTestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	c.Session.UserName = "ted"
+	w.Header().Set("X-Test", "value")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("accepted"))
+}
+
+type ContextCaptureTestHandler struct {
+	Context *RequestContext
+}
+
+func (h *ContextCaptureTestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	h.Context = c
+}
+
+func TestBearerTokenHandler(t *testing.T) {
+	spec := &Spec{t}
+
+	store := NewInMemoryUserStore()
+	store.Save(&User{Id: "pmcgrath", FirstName: "Pat", LastName: "Mc Grath", Password: "pass"})
+	apiToken, token, _ := NewApiToken("pmcgrath", "ci")
+	store.CreateApiToken(apiToken)
+
+	testCases := []struct {
+		// Input
+		Authorization string
+		// Expected result
+		StatusCode       int
+		UsedTokenChain   bool
+		UsedSessionChain bool
+	}{
+		{"Bearer " + token, http.StatusOK, true, false},
+		{"Bearer ct_unknown", http.StatusUnauthorized, false, false},
+		{"", http.StatusOK, false, true},
+		{"Basic dXNlcjpwYXNz", http.StatusOK, false, true},
+	}
+
+	for _, testCase := range testCases {
+		next, sessionChain := &ContextCaptureTestHandler{}, &ContextCaptureTestHandler{}
+		handler := NewBearerTokenHandler(store, next, sessionChain)
+
+		requestContext := &RequestContext{Id: "r1", Data: make(map[string]interface{})}
+		request, _ := http.NewRequest("DELETE", "/api/v1/contacts/pmcgrath/c1", nil)
+		if testCase.Authorization != "" {
+			request.Header.Set("Authorization", testCase.Authorization)
+		}
+		response := httptest.NewRecorder()
+
+		handler.ServeHTTP(response, request, requestContext)
+
+		spec.Assert(response.Code == testCase.StatusCode, "Unexpected status code %d for [%s]", response.Code, testCase.Authorization)
+		spec.Assert((next.Context != nil) == testCase.UsedTokenChain, "Unexpected token chain use for [%s]", testCase.Authorization)
+		spec.Assert((sessionChain.Context != nil) == testCase.UsedSessionChain, "Unexpected session chain use for [%s]", testCase.Authorization)
+		if testCase.UsedTokenChain {
+			spec.Assert(next.Context.IsLoggedIn() && next.Context.GetUserName() == "pmcgrath", "Token request is not logged in as the token's user")
+			spec.Assert(next.Context.ApiToken.Id == apiToken.Id, "Context does not have the API token")
+		}
+		if testCase.StatusCode == http.StatusUnauthorized {
+			spec.Assert(response.Header().Get("WWW-Authenticate") == `Bearer error="invalid_token"`, "Unexpected WWW-Authenticate header %s", response.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+/*
+JSON Merge Patch, see https://tools.ietf.org/html/rfc7396
+Objects are merged recursively, null removes a member, anything else including arrays replaces the target value
+*/
+const mergePatchContentType = "application/merge-patch+json"
+
+func ApplyMergePatch(target, patch []byte) ([]byte, error) {
+	var targetValue, patchValue interface{}
+	if len(target) > 0 {
+		if err := json.Unmarshal(target, &targetValue); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(patch, &patchValue); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(mergePatchValue(targetValue, patchValue))
+}
+
+func mergePatchValue(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = mergePatchValue(targetObject[name], value)
+	}
+
+	return targetObject
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+// Test cases from https://tools.ietf.org/html/rfc7396#appendix-A
+func TestApplyMergePatch(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Target string
+		Patch  string
+		// Expected result
+		Expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, testCase := range testCases {
+		actual, err := ApplyMergePatch([]byte(testCase.Target), []byte(testCase.Patch))
+		spec.Assert(err == nil, "Unexpected error for patch %s : %s", testCase.Patch, err)
+
+		var actualValue, expectedValue interface{}
+		json.Unmarshal(actual, &actualValue)
+		json.Unmarshal([]byte(testCase.Expected), &expectedValue)
+		spec.Assert(reflect.DeepEqual(actualValue, expectedValue), "Unexpected result %s for target %s and patch %s", actual, testCase.Target, testCase.Patch)
+	}
+}
+
+func TestApplyMergePatchInvalidJson(t *testing.T) {
+	spec := &Spec{t}
+
+	_, err := ApplyMergePatch([]byte(`{"a":"b"}`), []byte(`{"a":`))
+
+	spec.Assert(err != nil, "Expected error")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+Password hashes are stored as "algorithm:hash" so we can rotate the algorithm or its parameters later
+Anything without a known algorithm tag and a well formed hash is presumed to be a legacy plaintext password
+so a plaintext password that happens to start with "bcrypt:" still verifies
+*/
+const (
+	passwordAlgorithmBcrypt = "bcrypt"
+	passwordTagSeparator    = ":"
+)
+
+var passwordBcryptCost = bcrypt.DefaultCost // Variable so tests can lower it
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordBcryptCost)
+	if err != nil {
+		return "", err
+	}
+
+	return passwordAlgorithmBcrypt + passwordTagSeparator + string(hash), nil
+}
+
+func VerifyPassword(storedPassword, password string) bool {
+	algorithm, hash := splitPasswordHash(storedPassword)
+	switch algorithm {
+	case passwordAlgorithmBcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	// Legacy plaintext
+	return subtle.ConstantTimeCompare([]byte(storedPassword), []byte(password)) == 1
+}
+
+var (
+	dummyPasswordHash     string
+	dummyPasswordHashOnce sync.Once
+)
+
+// Hashed on first use so it has the same cost as real hashes
+func getDummyPasswordHash() string {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, _ = HashPassword("dummy")
+	})
+
+	return dummyPasswordHash
+}
+
+// Takes as long as verifying a real hash so a log in for an unknown user cannot be told apart by its timing
+func VerifyDummyPassword(password string) {
+	VerifyPassword(getDummyPasswordHash(), password)
+}
+
+func PasswordNeedsRehash(storedPassword string) bool {
+	algorithm, hash := splitPasswordHash(storedPassword)
+	switch algorithm {
+	case passwordAlgorithmBcrypt:
+		cost, _ := bcrypt.Cost([]byte(hash))
+		return cost != passwordBcryptCost
+	}
+
+	// Legacy plaintext
+	return true
+}
+
+func IsPasswordHashed(storedPassword string) bool {
+	algorithm, _ := splitPasswordHash(storedPassword)
+	return algorithm != ""
+}
+
+func splitPasswordHash(storedPassword string) (algorithm, hash string) {
+	parts := strings.SplitN(storedPassword, passwordTagSeparator, 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+
+	switch parts[0] {
+	case passwordAlgorithmBcrypt:
+		if _, err := bcrypt.Cost([]byte(parts[1])); err == nil {
+			return parts[0], parts[1]
+		}
+	}
+
+	return "", ""
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+	passwordBcryptCost = bcrypt.MinCost // Keep tests fast
+}
+
+func TestHashPassword(t *testing.T) {
+	spec := &Spec{t}
+
+	hash, err := HashPassword("pass")
+
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(strings.HasPrefix(hash, "bcrypt:"), "Unexpected hash %s", hash)
+	spec.Assert(!strings.Contains(hash, "pass"), "Hash contains plaintext %s", hash)
+	spec.Assert(IsPasswordHashed(hash), "Hash not recognised as hashed %s", hash)
+}
+
+func TestHashPasswordIsSalted(t *testing.T) {
+	spec := &Spec{t}
+
+	hash1, _ := HashPassword("pass")
+	hash2, _ := HashPassword("pass")
+
+	spec.Assert(hash1 != hash2, "Expected different hashes for the same password")
+}
+
+func TestVerifyPassword(t *testing.T) {
+	spec := &Spec{t}
+
+	hash, _ := HashPassword("pass")
+
+	testCases := []struct {
+		stored   string // Stored password
+		password string // Supplied password
+		expected bool   // Expected result
+	}{
+		{hash, "pass", true},
+		{hash, "bad", false},
+		{hash, hash, false},
+		{"pass", "pass", true}, // Legacy plaintext
+		{"pass", "bad", false},
+		{"bcrypt:notahash", "bcrypt:notahash", true}, // Legacy plaintext with what looks like a tag
+		{"bcrypt:notahash", "notahash", false},
+	}
+
+	for _, testCase := range testCases {
+		actual := VerifyPassword(testCase.stored, testCase.password)
+		spec.Assert(actual == testCase.expected, "Unexpected result %t for input [%s, %s]", actual, testCase.stored, testCase.password)
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	spec := &Spec{t}
+
+	hash, _ := HashPassword("pass")
+	higherCostHash, _ := bcrypt.GenerateFromPassword([]byte("pass"), passwordBcryptCost+1)
+
+	spec.Assert(!PasswordNeedsRehash(hash), "Current hash should not need a rehash")
+	spec.Assert(PasswordNeedsRehash("pass"), "Plaintext should need a rehash")
+	spec.Assert(PasswordNeedsRehash("bcrypt:"+string(higherCostHash)), "Hash with different cost should need a rehash")
+	spec.Assert(PasswordNeedsRehash("bcrypt:notahash"), "Plaintext that looks tagged should need a rehash")
+	spec.Assert(!IsPasswordHashed("bcrypt:notahash"), "Plaintext that looks tagged was recognised as hashed")
+}
+
+func TestDummyPasswordHash(t *testing.T) {
+	spec := &Spec{t}
+
+	hash := getDummyPasswordHash()
+
+	spec.Assert(IsPasswordHashed(hash), "Dummy hash not recognised as hashed %s", hash)
+	spec.Assert(!PasswordNeedsRehash(hash), "Dummy hash should have the current cost %s", hash)
+	spec.Assert(getDummyPasswordHash() == hash, "Dummy hash changed")
+}
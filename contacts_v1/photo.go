@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+/*
+Contact photos - the uploaded image is kept as is, after checking it decodes, along with a thumbnail that fits in a
+photoThumbnailSize square, both are kept in the blob store
+*/
+const (
+	maxPhotoSize          = 5 * 1024 * 1024
+	maxPhotoPixels        = 4096 * 4096 // Decoded size guard, a small file can declare huge dimensions, 64MB as RGBA
+	photoThumbnailSize    = 128
+	photoThumbnailQuality = 85
+	photoThumbnailSamples = 4 // Per axis, bounds the work per thumbnail pixel however large the photo
+)
+
+// Sniffed, see http.DetectContentType, the uploaded content type is not trusted
+var photoContentTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+var (
+	ErrUnsupportedPhotoType = errors.New("Photo must be a JPEG, PNG or GIF image")
+	ErrInvalidPhoto         = errors.New("Photo is not a valid image")
+	ErrPhotoDimensions      = errors.New("Photo dimensions are too large")
+)
+
+// Photo sizes for the size query parameter, "" is the uploaded photo
+const (
+	PhotoSizeOriginal  = ""
+	PhotoSizeThumbnail = "thumbnail"
+)
+
+func getContactPhotoKey(userId, contactId, size string) string {
+	if size == PhotoSizeThumbnail {
+		return "photos/" + userId + "/" + contactId + ".thumbnail"
+	}
+	return "photos/" + userId + "/" + contactId + ".photo"
+}
+
+func IsSupportedPhotoContentType(contentType string) bool {
+	for _, supported := range photoContentTypes {
+		if contentType == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// Validates the image and generates its thumbnail, JPEGs get a JPEG thumbnail, others a PNG so transparency is kept
+func NewContactPhoto(data []byte) (photo, thumbnail *Blob, err error) {
+	contentType := http.DetectContentType(data)
+	if !IsSupportedPhotoContentType(contentType) {
+		return nil, nil, ErrUnsupportedPhotoType
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, ErrInvalidPhoto
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxPhotoPixels {
+		return nil, nil, ErrPhotoDimensions
+	}
+
+	var source image.Image
+	switch contentType {
+	case "image/jpeg":
+		source, err = jpeg.Decode(bytes.NewReader(data))
+	case "image/png":
+		source, err = png.Decode(bytes.NewReader(data))
+	case "image/gif":
+		source, err = gif.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, nil, ErrInvalidPhoto
+	}
+
+	buf := new(bytes.Buffer)
+	thumbnailContentType := "image/png"
+	if contentType == "image/jpeg" {
+		thumbnailContentType = "image/jpeg"
+		err = jpeg.Encode(buf, ThumbnailImage(source, photoThumbnailSize), &jpeg.Options{Quality: photoThumbnailQuality})
+	} else {
+		err = png.Encode(buf, ThumbnailImage(source, photoThumbnailSize))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &Blob{ContentType: contentType, Data: data}, &Blob{ContentType: thumbnailContentType, Data: buf.Bytes()}, nil
+}
+
+/*
+Scales the image down to fit in a size by size square keeping the aspect ratio, smaller images are not scaled up
+Each thumbnail pixel averages a grid of up to photoThumbnailSamples by photoThumbnailSamples source pixels spread over
+the area it covers, read straight from the decoded image so no full size copy is made
+*/
+func ThumbnailImage(source image.Image, size int) *image.RGBA {
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	thumbnailWidth, thumbnailHeight := width, height
+	if width > size || height > size {
+		if width >= height {
+			thumbnailWidth, thumbnailHeight = size, maxInt(1, height*size/width)
+		} else {
+			thumbnailWidth, thumbnailHeight = maxInt(1, width*size/height), size
+		}
+	}
+
+	thumbnail := image.NewRGBA(image.Rect(0, 0, thumbnailWidth, thumbnailHeight))
+	for y := 0; y < thumbnailHeight; y++ {
+		y0, y1 := y*height/thumbnailHeight, maxInt((y+1)*height/thumbnailHeight, y*height/thumbnailHeight+1)
+		samplesY := minInt(y1-y0, photoThumbnailSamples)
+		for x := 0; x < thumbnailWidth; x++ {
+			x0, x1 := x*width/thumbnailWidth, maxInt((x+1)*width/thumbnailWidth, x*width/thumbnailWidth+1)
+			samplesX := minInt(x1-x0, photoThumbnailSamples)
+
+			var sum [4]uint32
+			for sampleY := 0; sampleY < samplesY; sampleY++ {
+				sourceY := bounds.Min.Y + y0 + (2*sampleY+1)*(y1-y0)/(2*samplesY)
+				for sampleX := 0; sampleX < samplesX; sampleX++ {
+					sourceX := bounds.Min.X + x0 + (2*sampleX+1)*(x1-x0)/(2*samplesX)
+					r, g, b, a := source.At(sourceX, sourceY).RGBA()
+					sum[0] += r >> 8
+					sum[1] += g >> 8
+					sum[2] += b >> 8
+					sum[3] += a >> 8
+				}
+			}
+
+			count := uint32(samplesX * samplesY)
+			offset := thumbnail.PixOffset(x, y)
+			for channel := 0; channel < 4; channel++ {
+				thumbnail.Pix[offset+channel] = uint8(sum[channel] / count)
+			}
+		}
+	}
+
+	return thumbnail
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Removes the photo and its thumbnail, not an error if there is no photo
+func DeleteContactPhoto(blobs BlobStore, userId, contactId string) error {
+	return firstError(
+		blobs.Delete(getContactPhotoKey(userId, contactId, PhotoSizeThumbnail)),
+		blobs.Delete(getContactPhotoKey(userId, contactId, PhotoSizeOriginal)))
+}
+
+// Keeps the contact's photo, or takes the first merged contact's photo if it has none, the merged contacts' photos are deleted
+func MergeContactPhotos(blobs BlobStore, userId, contactId string, mergedIds []string) error {
+	_, err := blobs.Get(getContactPhotoKey(userId, contactId, PhotoSizeOriginal))
+	if err != nil && err != ErrBlobNotFound {
+		return err
+	}
+	hasPhoto := err == nil
+
+	for _, mergedId := range mergedIds {
+		if !hasPhoto {
+			photo, err := blobs.Get(getContactPhotoKey(userId, mergedId, PhotoSizeOriginal))
+			if err != nil && err != ErrBlobNotFound {
+				return err
+			}
+			if err == nil {
+				thumbnail, err := blobs.Get(getContactPhotoKey(userId, mergedId, PhotoSizeThumbnail))
+				if err == nil {
+					err = blobs.Put(getContactPhotoKey(userId, contactId, PhotoSizeThumbnail), thumbnail)
+				}
+				if err == nil {
+					err = blobs.Put(getContactPhotoKey(userId, contactId, PhotoSizeOriginal), photo)
+				}
+				if err != nil {
+					return err
+				}
+				hasPhoto = true
+			}
+		}
+
+		if err := DeleteContactPhoto(blobs, userId, mergedId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestNewContactPhoto(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Data []byte
+		// Expected result
+		ContentType          string
+		ThumbnailContentType string
+		ThumbnailWidth       int
+		ThumbnailHeight      int
+	}{
+		{EncodeTestPhoto("png", 512, 256), "image/png", "image/png", 128, 64},
+		{EncodeTestPhoto("jpeg", 300, 600), "image/jpeg", "image/jpeg", 64, 128},
+		{EncodeTestPhoto("gif", 200, 200), "image/gif", "image/png", 128, 128},
+		{EncodeTestPhoto("png", 40, 20), "image/png", "image/png", 40, 20},
+	}
+
+	for index, testCase := range testCases {
+		photo, thumbnail, err := NewContactPhoto(testCase.Data)
+		spec.Assert(err == nil, "Unexpected error for case %d : %s", index, err)
+
+		spec.Assert(photo.ContentType == testCase.ContentType, "Unexpected content type for case %d %s", index, photo.ContentType)
+		spec.Assert(bytes.Equal(photo.Data, testCase.Data), "Photo data was changed for case %d", index)
+		spec.Assert(thumbnail.ContentType == testCase.ThumbnailContentType, "Unexpected thumbnail content type for case %d %s", index, thumbnail.ContentType)
+
+		config, format, err := image.DecodeConfig(bytes.NewReader(thumbnail.Data))
+		spec.Assert(err == nil, "Thumbnail for case %d does not decode : %s", index, err)
+		spec.Assert("image/"+format == testCase.ThumbnailContentType, "Unexpected thumbnail format for case %d %s", index, format)
+		spec.Assert(config.Width == testCase.ThumbnailWidth && config.Height == testCase.ThumbnailHeight, "Unexpected thumbnail dimensions for case %d %dx%d", index, config.Width, config.Height)
+	}
+}
+
+func TestNewContactPhotoFailures(t *testing.T) {
+	spec := &Spec{t}
+
+	truncated := EncodeTestPhoto("png", 64, 64)
+	truncated = truncated[:len(truncated)/2]
+
+	testCases := []struct {
+		// Input
+		Data []byte
+		// Expected result
+		Err error
+	}{
+		{[]byte("not a photo"), ErrUnsupportedPhotoType},
+		{[]byte("<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"), ErrUnsupportedPhotoType},
+		{[]byte{}, ErrUnsupportedPhotoType},
+		{truncated, ErrInvalidPhoto},
+		{EncodeTestPhotoHeader(20000, 20000), ErrPhotoDimensions},
+		{EncodeTestPhotoHeader(7000, 7000), ErrPhotoDimensions},
+		{EncodeTestPhotoHeader(4097, 4096), ErrPhotoDimensions},
+	}
+
+	for index, testCase := range testCases {
+		_, _, err := NewContactPhoto(testCase.Data)
+		spec.Assert(err == testCase.Err, "Unexpected error for case %d : %v", index, err)
+	}
+}
+
+func TestThumbnailImageAveragesPixels(t *testing.T) {
+	spec := &Spec{t}
+
+	// Alternating black and white columns should average to grey
+	source := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			if x%2 == 0 {
+				source.Set(x, y, color.White)
+			} else {
+				source.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	thumbnail := ThumbnailImage(source, 128)
+	spec.Assert(thumbnail.Bounds().Dx() == 128 && thumbnail.Bounds().Dy() == 128, "Unexpected thumbnail bounds %s", thumbnail.Bounds())
+
+	pixel := thumbnail.RGBAAt(10, 10)
+	spec.Assert(pixel.R == 127 && pixel.G == 127 && pixel.B == 127 && pixel.A == 255, "Unexpected thumbnail pixel %v", pixel)
+}
+
+func TestNewContactPhotoAllocationIsBounded(t *testing.T) {
+	spec := &Spec{t}
+
+	// Opaque so it decodes to an RGBA, 4 bytes per pixel, the full size copy we no longer make would double this
+	width, height := 2048, 2048
+	data := EncodeTestPhoto("png", width, height)
+	decodedSize := uint64(width * height * 4)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	_, _, err := NewContactPhoto(data)
+	runtime.ReadMemStats(&after)
+
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	allocated := after.TotalAlloc - before.TotalAlloc
+	spec.Assert(allocated < decodedSize*3/2, "Allocated %d bytes for a %d byte decoded photo", allocated, decodedSize)
+}
+
+func TestMergeContactPhotosKeepsExistingPhoto(t *testing.T) {
+	spec := &Spec{t}
+
+	blobs := GetTemporaryBlobStore(t)
+	defer os.RemoveAll(blobs.directory)
+	for _, contactId := range []string{"ted", "ted2", "ted3"} {
+		blobs.Put(getContactPhotoKey("pmcgrath", contactId, PhotoSizeThumbnail), &Blob{ContentType: "image/png", Data: []byte(contactId)})
+		blobs.Put(getContactPhotoKey("pmcgrath", contactId, PhotoSizeOriginal), &Blob{ContentType: "image/png", Data: []byte(contactId)})
+	}
+
+	err := MergeContactPhotos(blobs, "pmcgrath", "ted", []string{"ted2", "ted3", "nophoto"})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	photo, err := blobs.Get(getContactPhotoKey("pmcgrath", "ted", PhotoSizeOriginal))
+	spec.Assert(err == nil && string(photo.Data) == "ted", "Expected the contact's own photo to be kept %v", err)
+	for _, contactId := range []string{"ted2", "ted3"} {
+		for _, size := range []string{PhotoSizeOriginal, PhotoSizeThumbnail} {
+			_, err := blobs.Get(getContactPhotoKey("pmcgrath", contactId, size))
+			spec.Assert(err == ErrBlobNotFound, "Expected %s %s photo to be deleted %v", contactId, size, err)
+		}
+	}
+}
+
+func EncodeTestPhoto(format string, width, height int) []byte {
+	source := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			source.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	switch format {
+	case "jpeg":
+		jpeg.Encode(buf, source, nil)
+	case "gif":
+		gif.Encode(buf, source, nil)
+	default:
+		png.Encode(buf, source)
+	}
+	return buf.Bytes()
+}
+
+// Only the PNG signature and header chunk with its checksum, enough for DecodeConfig to report the dimensions
+func EncodeTestPhotoHeader(width, height int) []byte {
+	full := EncodeTestPhoto("png", 1, 1)
+	header := append([]byte{}, full[:33]...)
+	header[16], header[17], header[18], header[19] = byte(width>>24), byte(width>>16), byte(width>>8), byte(width)
+	header[20], header[21], header[22], header[23] = byte(height>>24), byte(height>>16), byte(height>>8), byte(height)
+	crc := crc32.ChecksumIEEE(header[12:29])
+	header[29], header[30], header[31], header[32] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+	return header
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+/*
+Problem details response bodies, see https://tools.ietf.org/html/rfc7807
+All error responses go through here so clients always get the same shape, the request id is the instance so a
+client report can be matched to our logs
+Detail must be safe to show to the client, internal errors should only be logged
+*/
+const (
+	problemContentType      = "application/problem+json"
+	defaultProblemType      = "about:blank" // Title is then the status text
+	validationProblemType   = "/problems/validation"
+	validationProblemTitle  = "Validation failed"
+	validationProblemDetail = "One or more fields are invalid"
+)
+
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+func WriteProblem(w http.ResponseWriter, c *RequestContext, status int, detail string) {
+	writeProblem(w, c, &Problem{
+		Type:     defaultProblemType,
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: c.Id,
+	})
+}
+
+// 400 with the per field errors if err is ValidationErrors, otherwise the error text is the detail
+func WriteValidationProblem(w http.ResponseWriter, c *RequestContext, err error) {
+	problem := &Problem{
+		Type:     validationProblemType,
+		Title:    validationProblemTitle,
+		Status:   http.StatusBadRequest,
+		Detail:   validationProblemDetail,
+		Instance: c.Id,
+	}
+	if errs, ok := err.(ValidationErrors); ok {
+		problem.Errors = errs
+	} else if err != nil {
+		problem.Detail = err.Error()
+	}
+
+	writeProblem(w, c, problem)
+}
+
+func writeProblem(w http.ResponseWriter, c *RequestContext, problem *Problem) {
+	content, err := json.Marshal(problem)
+	if err != nil {
+		log.Printf("%s Error detected when trying to encode problem : %s\n", c.GetLogMessagePrefix(), err)
+		http.Error(w, http.StatusText(problem.Status), problem.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	w.Write(append(content, '\n'))
+}
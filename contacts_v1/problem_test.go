@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestWriteProblem(t *testing.T) {
+	spec := &Spec{t}
+
+	requestContext := &RequestContext{Id: "r1"}
+	response := httptest.NewRecorder()
+
+	WriteProblem(response, requestContext, http.StatusNotFound, "Contact not found")
+
+	spec.Assert(response.Code == http.StatusNotFound, "Unexpected status code %d", response.Code)
+
+	contentTypeHeader := response.HeaderMap.Get("Content-Type")
+	spec.Assert(contentTypeHeader == "application/problem+json", "Unexpected content type header %s", contentTypeHeader)
+
+	expected := `{"type":"about:blank","title":"Not Found","status":404,"detail":"Contact not found","instance":"r1"}` + "\n"
+	spec.Assert(response.Body.String() == expected, "Unexpected body %s", response.Body.String())
+}
+
+func TestWriteValidationProblemWithFieldErrors(t *testing.T) {
+	spec := &Spec{t}
+
+	requestContext := &RequestContext{Id: "r1"}
+	response := httptest.NewRecorder()
+
+	WriteValidationProblem(response, requestContext, ValidationErrors{FieldError{Field: "FirstName", Message: "Missing first name"}})
+
+	spec.Assert(response.Code == http.StatusBadRequest, "Unexpected status code %d", response.Code)
+
+	contentTypeHeader := response.HeaderMap.Get("Content-Type")
+	spec.Assert(contentTypeHeader == "application/problem+json", "Unexpected content type header %s", contentTypeHeader)
+
+	var problem Problem
+	err := json.Unmarshal(response.Body.Bytes(), &problem)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(problem.Status == http.StatusBadRequest && problem.Instance == "r1", "Unexpected problem %#v", problem)
+	spec.Assert(len(problem.Errors) == 1 && problem.Errors[0].Field == "FirstName", "Unexpected field errors %#v", problem.Errors)
+}
+
+func TestWriteValidationProblemWithOtherError(t *testing.T) {
+	spec := &Spec{t}
+
+	response := httptest.NewRecorder()
+
+	WriteValidationProblem(response, &RequestContext{}, errors.New("Bad things"))
+
+	var problem Problem
+	json.Unmarshal(response.Body.Bytes(), &problem)
+	spec.Assert(problem.Detail == "Bad things" && problem.Errors == nil, "Unexpected problem %#v", problem)
+}
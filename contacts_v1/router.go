@@ -1,82 +1,173 @@
 package main
 
 import (
-	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 )
 
+/*
+Router - path templates with named parameters
+
+	/api/v1/contacts				Static segments
+	/api/v1/contacts/{userId}			Parameter, matches any non empty segment
+	/api/v1/contacts/{userId:[\w-]{5,36}}		Parameter with a regex constraint
+	/api/v1/contacts/{userId}.vcf			Parameter with literal text around it, one parameter per segment
+	/assets/*path					Wildcard, matches the remaining segments, must be last, name is optional
+
+A trailing slash on the request path is ignored
+Where more than one template matches, the first segment that differs decides - static beats parameter beats wildcard,
+a parameter with literal text or a constraint beats a bare parameter, otherwise the template added first wins
+Matched parameters are available from the request context, see RequestContext.GetParam
+Handler methods are found by name, HEAD is served from GET and OPTIONS is answered with an Allow header if the handler
+does not have its own
+OPTIONS is served before authentication so CORS preflights work, see CorsHandler, handler Options methods must not
+expose anything that needs a logged in user
+*/
 type router struct {
-	config map[*regexp.Regexp]*pathEntry
+	routes []*compiledRoute
 }
 
+// Handler methods we look for, in Allow header order, i.e. Get for GET
+var routerMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+var contextualHandlerFuncType = reflect.TypeOf(func(http.ResponseWriter, *http.Request, *RequestContext) {})
+
 func NewRouter() *router {
 	return &router{
-		config: make(map[*regexp.Regexp]*pathEntry),
+		routes: make([]*compiledRoute, 0),
+	}
+}
+
+/*
+Route registration - a route for each template, errors for all routes are reported together so one start up attempt
+shows every problem
+*/
+type Route struct {
+	Template string
+	Handler  interface{}
+}
+
+func (router *router) AddRoutes(routes ...Route) error {
+	problems := make([]string, 0)
+	for _, route := range routes {
+		if err := router.Add(route.Template, route.Handler); err != nil {
+			problems = append(problems, err.Error())
+		}
 	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Route registration failed\n\t%s", strings.Join(problems, "\n\t"))
+	}
+
+	return nil
 }
 
-func (router *router) Add(pattern string, pathHandler interface{}) error {
+/*
+Handler methods must be ContextualHandlerFuncs, every method with a matching name but the wrong signature is reported
+*/
+func (router *router) Add(template string, pathHandler interface{}) error {
 	// See http://stackoverflow.com/questions/20714939/how-to-properly-use-call-in-reflect-package-golang
-	key := regexp.MustCompile(pattern)
+	segments, err := parsePathTemplate(template)
+	if err != nil {
+		return err
+	}
+	for _, existing := range router.routes {
+		if existing.entry.pattern == template {
+			return fmt.Errorf("Route [%s] : duplicate route", template)
+		}
+	}
 
-	pathEntry := &pathEntry{pattern: pattern, supportedMethods: make(map[string]ContextualHandlerFunc)}
+	pathEntry := &pathEntry{pattern: template, supportedMethods: make(map[string]ContextualHandlerFunc)}
 
 	interfaceValue := reflect.ValueOf(pathHandler)
+	if !interfaceValue.IsValid() {
+		return fmt.Errorf("Route [%s] : nil handler", template)
+	}
 
-	methodFound := false
-	for _, method := range []string{"GET", "POST", "PUT", "DELETE"} {
+	problems := make([]string, 0)
+	for _, method := range routerMethods {
 		capitalisedMethod := strings.Title(strings.ToLower(method))
 
 		methodValue := interfaceValue.MethodByName(capitalisedMethod)
 		if !methodValue.IsValid() {
 			continue
 		}
+		if methodValue.Type() != contextualHandlerFuncType {
+			problems = append(problems, fmt.Sprintf("%T.%s is %s, expected %s", pathHandler, capitalisedMethod, methodValue.Type(), contextualHandlerFuncType))
+			continue
+		}
 
-		methodInterface := methodValue.Interface()
-		methodHandle := methodInterface.(func(http.ResponseWriter, *http.Request, *RequestContext)) // Assuming func signature matches
-		pathEntry.supportedMethods[method] = methodHandle                                           // Taking care of func(.. to HandlerFunc conversion
+		methodHandle := methodValue.Interface().(func(http.ResponseWriter, *http.Request, *RequestContext)) // Signature checked above
+		pathEntry.supportedMethods[method] = methodHandle                                                   // Taking care of func(.. to HandlerFunc conversion
+	}
 
-		methodFound = true
+	if len(problems) > 0 {
+		return fmt.Errorf("Route [%s] : %s", template, strings.Join(problems, ", "))
+	}
+	if len(pathEntry.supportedMethods) == 0 {
+		return fmt.Errorf("Route [%s] : no method found on %T", template, pathHandler)
 	}
 
-	if methodFound != true {
-		return errors.New("No method found")
+	// HEAD and OPTIONS are answered for the handler unless it has its own
+	if get, ok := pathEntry.supportedMethods["GET"]; ok && pathEntry.supportedMethods["HEAD"] == nil {
+		pathEntry.supportedMethods["HEAD"] = createHeadHandlerFunc(get)
+	}
+	if pathEntry.supportedMethods["OPTIONS"] == nil {
+		pathEntry.supportedMethods["OPTIONS"] = pathEntry.serveOptions
 	}
 
-	router.config[key] = pathEntry
+	// Kept in priority order so the first match is the best match, stable so equal templates keep the order added
+	router.routes = append(router.routes, &compiledRoute{segments: segments, entry: pathEntry, handlerName: fmt.Sprintf("%T", pathHandler)})
+	sort.SliceStable(router.routes, func(i, j int) bool {
+		return compareRoutes(router.routes[i], router.routes[j]) > 0
+	})
 	return nil
 }
 
-func (router *router) Get(path string) *pathEntry {
-	for key, value := range router.config {
-		if key.MatchString(path) {
-			return value
+// Route table in priority order, a line per route with the template, handler and allowed methods
+func (router *router) GetRouteTable() []string {
+	table := make([]string, len(router.routes))
+	for index, route := range router.routes {
+		table[index] = fmt.Sprintf("%-70s %-30s %s", route.entry.pattern, route.handlerName, route.entry.GetAllowHeader())
+	}
+
+	return table
+}
+
+func (router *router) Get(path string) (*pathEntry, map[string]string) {
+	pathSegments := splitPath(path)
+	for _, route := range router.routes {
+		if params, ok := route.match(pathSegments); ok {
+			return route.entry, params
 		}
 	}
 
-	return nil
+	return nil, nil
 }
 
 func (router *router) ServeHTTP(w http.ResponseWriter, r *http.Request, c *RequestContext) {
 	log.Printf("%s %s %s Servicing\n", c.GetLogMessagePrefix(), r.URL.Path, r.Method)
 
 	isPathSupported, isMethodSupported := false, false
-	pathEntry := router.Get(r.URL.Path)
+	pathEntry, params := router.Get(r.URL.Path)
 	if pathEntry != nil {
 		isPathSupported = true
 		methodHandler := pathEntry.Get(r.Method)
 		if methodHandler != nil {
 			isMethodSupported = true
+			c.Params = params
 			methodHandler(w, r, c)
 		} else {
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			w.Header().Set("Allow", pathEntry.GetAllowHeader())
+			WriteProblem(w, c, http.StatusMethodNotAllowed, fmt.Sprintf("Method [%s] is not supported for [%s]", r.Method, r.URL.Path))
 		}
 	} else {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		WriteProblem(w, c, http.StatusNotFound, fmt.Sprintf("No resource found for [%s]", r.URL.Path))
 	}
 
 	log.Printf("%s %s %s Serviced: Path supported = %t, method supported = %t\n", c.GetLogMessagePrefix(), r.URL.Path, r.Method, isPathSupported, isMethodSupported)
@@ -91,3 +182,218 @@ type pathEntry struct {
 func (entry *pathEntry) Get(method string) ContextualHandlerFunc {
 	return entry.supportedMethods[method]
 }
+
+// Allow header value, methods are in routerMethods order so the value is stable
+func (entry *pathEntry) GetAllowHeader() string {
+	methods := make([]string, 0, len(entry.supportedMethods))
+	for _, method := range routerMethods {
+		if _, ok := entry.supportedMethods[method]; ok {
+			methods = append(methods, method)
+		}
+	}
+
+	return strings.Join(methods, ", ")
+}
+
+func (entry *pathEntry) serveOptions(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	w.Header().Set("Allow", entry.GetAllowHeader())
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+HEAD from GET - the GET handler runs as normal so headers such as ETag and Content-Type are the same, the body is discarded
+*/
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *headResponseWriter) Write(content []byte) (int, error) {
+	return len(content), nil
+}
+
+func createHeadHandlerFunc(get ContextualHandlerFunc) ContextualHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+		get(&headResponseWriter{ResponseWriter: w}, r, c)
+	}
+}
+
+/*
+Route - a parsed path template
+*/
+type segmentKind int
+
+// In priority order, lowest first
+const (
+	wildcardSegment segmentKind = iota
+	paramSegment
+	staticSegment
+)
+
+type segment struct {
+	kind    segmentKind
+	value   string // Static text, or the parameter\wildcard name
+	prefix  string // Literal text before a parameter
+	suffix  string // Literal text after a parameter
+	pattern *regexp.Regexp
+}
+
+// A Route parsed for matching, see Add
+type compiledRoute struct {
+	segments    []segment
+	entry       *pathEntry
+	handlerName string
+}
+
+func parsePathTemplate(template string) ([]segment, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("Path template [%s] must start with /", template)
+	}
+
+	segments := make([]segment, 0)
+	names := make(map[string]bool)
+	templateSegments := splitPath(template)
+	for index, value := range templateSegments {
+		seg, err := parsePathTemplateSegment(value)
+		if err != nil {
+			return nil, fmt.Errorf("Path template [%s] : %s", template, err)
+		}
+		if seg.kind == wildcardSegment && index != len(templateSegments)-1 {
+			return nil, fmt.Errorf("Path template [%s] : wildcard must be the last segment", template)
+		}
+		if seg.kind != staticSegment && seg.value != "" {
+			if names[seg.value] {
+				return nil, fmt.Errorf("Path template [%s] : duplicate parameter [%s]", template, seg.value)
+			}
+			names[seg.value] = true
+		}
+
+		segments = append(segments, seg)
+	}
+
+	return segments, nil
+}
+
+func parsePathTemplateSegment(value string) (segment, error) {
+	if strings.HasPrefix(value, "*") {
+		return segment{kind: wildcardSegment, value: value[1:]}, nil
+	}
+
+	start := strings.Index(value, "{")
+	if start == -1 {
+		if strings.Contains(value, "}") {
+			return segment{}, fmt.Errorf("unbalanced braces in [%s]", value)
+		}
+		return segment{kind: staticSegment, value: value}, nil
+	}
+
+	// Find the matching brace, constraints may contain braces themselves, i.e. {id:[\w-]{5,36}}
+	end, depth := -1, 0
+	for index := start; index < len(value) && end == -1; index++ {
+		switch value[index] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				end = index
+			}
+		}
+	}
+	if end == -1 {
+		return segment{}, fmt.Errorf("unbalanced braces in [%s]", value)
+	}
+
+	seg := segment{kind: paramSegment, prefix: value[:start], suffix: value[end+1:]}
+	if strings.ContainsAny(seg.suffix, "{}") {
+		return segment{}, fmt.Errorf("only one parameter is allowed per segment in [%s]", value)
+	}
+
+	seg.value = value[start+1 : end]
+	if index := strings.Index(seg.value, ":"); index != -1 {
+		pattern, err := regexp.Compile(`^(?:` + seg.value[index+1:] + `)$`)
+		if err != nil {
+			return segment{}, err
+		}
+		seg.value, seg.pattern = seg.value[:index], pattern
+	}
+	if seg.value == "" {
+		return segment{}, fmt.Errorf("missing parameter name in [%s]", value)
+	}
+
+	return seg, nil
+}
+
+func (route *compiledRoute) match(pathSegments []string) (map[string]string, bool) {
+	params := make(map[string]string)
+	for index, seg := range route.segments {
+		if seg.kind == wildcardSegment {
+			if seg.value != "" {
+				params[seg.value] = strings.Join(pathSegments[index:], "/")
+			}
+			return params, true
+		}
+		if index >= len(pathSegments) {
+			return nil, false
+		}
+
+		value := pathSegments[index]
+		if seg.kind == staticSegment {
+			if value != seg.value {
+				return nil, false
+			}
+			continue
+		}
+
+		if len(value) <= len(seg.prefix)+len(seg.suffix) || !strings.HasPrefix(value, seg.prefix) || !strings.HasSuffix(value, seg.suffix) {
+			return nil, false
+		}
+		value = value[len(seg.prefix) : len(value)-len(seg.suffix)]
+		if seg.pattern != nil && !seg.pattern.MatchString(value) {
+			return nil, false
+		}
+		params[seg.value] = value
+	}
+
+	return params, len(pathSegments) == len(route.segments)
+}
+
+// Positive if a has priority over b, see the router comment
+func compareRoutes(a, b *compiledRoute) int {
+	for index := 0; index < len(a.segments) && index < len(b.segments); index++ {
+		if result := compareSegments(&a.segments[index], &b.segments[index]); result != 0 {
+			return result
+		}
+	}
+
+	return 0
+}
+
+func compareSegments(a, b *segment) int {
+	if a.kind != b.kind {
+		return int(a.kind) - int(b.kind)
+	}
+	if a.kind != paramSegment {
+		return 0
+	}
+	if literalLength, otherLiteralLength := len(a.prefix)+len(a.suffix), len(b.prefix)+len(b.suffix); literalLength != otherLiteralLength {
+		return literalLength - otherLiteralLength
+	}
+	if (a.pattern != nil) != (b.pattern != nil) {
+		if a.pattern != nil {
+			return 1
+		}
+		return -1
+	}
+
+	return 0
+}
+
+// Ignores leading and trailing slashes, so the root path has no segments
+func splitPath(path string) []string {
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/")
+	if path == "" {
+		return []string{}
+	}
+
+	return strings.Split(path, "/")
+}
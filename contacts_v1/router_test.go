@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -27,10 +28,10 @@ func TestRouterAddSuccess(t *testing.T) {
 
 	handler := &TestHandler{}
 	router := NewRouter()
-	err := router.Add(`^/p1/?$`, handler)
+	err := router.Add(`/p1`, handler)
 
 	spec.Assert(err == nil, "Unexpected error : %s", err)
-	spec.Assert(len(router.config) == 1, "Not added")
+	spec.Assert(len(router.routes) == 1, "Not added")
 }
 
 func TestRouterAddMultipleSuccess(t *testing.T) {
@@ -39,13 +40,13 @@ func TestRouterAddMultipleSuccess(t *testing.T) {
 	handler := &TestHandler{}
 	router := NewRouter()
 
-	err := router.Add(`^/p1/?$`, handler)
+	err := router.Add(`/p1`, handler)
 	spec.Assert(err == nil, "Unexpected error : %s", err)
-	spec.Assert(len(router.config) == 1, "Not added")
+	spec.Assert(len(router.routes) == 1, "Not added")
 
-	err = router.Add(`^/p2/\w+/?$`, handler)
+	err = router.Add(`/p2/{id}`, handler)
 	spec.Assert(err == nil, "Unexpected error : %s", err)
-	spec.Assert(len(router.config) == 2, "Not added")
+	spec.Assert(len(router.routes) == 2, "Not added")
 }
 
 func TestRouterAddFailureNoMethods(t *testing.T) {
@@ -53,7 +54,7 @@ func TestRouterAddFailureNoMethods(t *testing.T) {
 
 	handler := 1
 	router := NewRouter()
-	err := router.Add(`^/p1/?$`, handler)
+	err := router.Add(`/p1`, handler)
 
 	spec.Assert(err != nil, "Expected error")
 }
@@ -63,7 +64,7 @@ func TestRouterServeHTTPMatchFound(t *testing.T) {
 
 	handler := &TestHandler{}
 	router := NewRouter()
-	router.Add(`^/p1/?$`, handler)
+	router.Add(`/p1`, handler)
 
 	requestContext := GetLoggedInRequestContext()
 	request, _ := http.NewRequest("GET", "/p1/", nil)
@@ -80,7 +81,7 @@ func TestRouterServeHTTPPathMatchNotFound(t *testing.T) {
 
 	handler := &TestHandler{}
 	router := NewRouter()
-	router.Add(`^/p1/?$`, handler)
+	router.Add(`/p1`, handler)
 
 	requestContext := GetLoggedInRequestContext()
 	request, _ := http.NewRequest("GET", "/p1/aaa", nil)
@@ -89,6 +90,10 @@ func TestRouterServeHTTPPathMatchNotFound(t *testing.T) {
 	router.ServeHTTP(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusNotFound, "Unexpected status code %d", response.Code)
+
+	contentTypeHeader := response.HeaderMap.Get("Content-Type")
+	spec.Assert(contentTypeHeader == "application/problem+json", "Unexpected content type header %s", contentTypeHeader)
+	spec.Assert(strings.Contains(response.Body.String(), `"instance":"`+requestContext.Id+`"`), "Response body did not contain expected content, body is %s", response.Body.String())
 }
 
 func TestRouterServeHTTPMethodNotSupported(t *testing.T) {
@@ -96,7 +101,7 @@ func TestRouterServeHTTPMethodNotSupported(t *testing.T) {
 
 	handler := &TestHandler{}
 	router := NewRouter()
-	router.Add(`^/p1/?$`, handler)
+	router.Add(`/p1`, handler)
 
 	requestContext := GetLoggedInRequestContext()
 	postData := []byte("{\"Name\": \"Ted\"}")
@@ -106,4 +111,233 @@ func TestRouterServeHTTPMethodNotSupported(t *testing.T) {
 	router.ServeHTTP(response, request, requestContext)
 
 	spec.Assert(response.Code == http.StatusMethodNotAllowed, "Unexpected status code %d", response.Code)
+	spec.Assert(strings.Contains(response.Body.String(), `"status":405`), "Response body did not contain expected content, body is %s", response.Body.String())
+
+	allowHeader := response.HeaderMap.Get("Allow")
+	spec.Assert(allowHeader == "GET, HEAD, OPTIONS", "Unexpected allow header %s", allowHeader)
+}
+
+type TestPatchHandler struct {
+}
+
+func (h *TestPatchHandler) Get(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	w.Header().Set("ETag", `"1"`)
+	fmt.Fprintln(w, "Success")
+}
+
+func (h *TestPatchHandler) Patch(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+	fmt.Fprintln(w, "Patched")
+}
+
+func (h *TestPatchHandler) Delete(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+}
+
+func TestRouterServeHTTPMethods(t *testing.T) {
+	spec := &Spec{t}
+
+	router := NewRouter()
+	router.Add(`/p1`, &TestPatchHandler{})
+
+	testCases := []struct {
+		// Input
+		Method string
+		// Expected result
+		ExpectedStatusCode int
+		ExpectedBody       string
+		ExpectedAllow      string
+	}{
+		{"GET", http.StatusOK, "Success\n", ""},
+		{"PATCH", http.StatusOK, "Patched\n", ""},
+		{"HEAD", http.StatusOK, "", ""},
+		{"OPTIONS", http.StatusNoContent, "", "GET, HEAD, PATCH, DELETE, OPTIONS"},
+		{"PUT", http.StatusMethodNotAllowed, "", "GET, HEAD, PATCH, DELETE, OPTIONS"},
+	}
+
+	for _, testCase := range testCases {
+		requestContext := GetLoggedInRequestContext()
+		request, _ := http.NewRequest(testCase.Method, "/p1", nil)
+		response := httptest.NewRecorder()
+
+		router.ServeHTTP(response, request, requestContext)
+
+		spec.Assert(response.Code == testCase.ExpectedStatusCode, "Unexpected status code %d for %s", response.Code, testCase.Method)
+		if testCase.ExpectedStatusCode != http.StatusMethodNotAllowed {
+			spec.Assert(response.Body.String() == testCase.ExpectedBody, "Unexpected body %q for %s", response.Body.String(), testCase.Method)
+		}
+		allowHeader := response.HeaderMap.Get("Allow")
+		spec.Assert(allowHeader == testCase.ExpectedAllow, "Unexpected allow header %s for %s", allowHeader, testCase.Method)
+	}
+
+	// HEAD has the same headers as GET
+	request, _ := http.NewRequest("HEAD", "/p1", nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request, GetLoggedInRequestContext())
+	spec.Assert(response.HeaderMap.Get("ETag") == `"1"`, "Unexpected etag %s", response.HeaderMap.Get("ETag"))
+}
+
+func TestRouterAddFailureInvalidTemplate(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []string{
+		"p1",
+		"/p1/*/p2",
+		"/p1/{id",
+		"/p1/{}",
+		"/p1/{id}-{other}",
+		"/p1/{id}/{id}",
+		"/p1/{id:[}",
+	}
+
+	for _, testCase := range testCases {
+		err := NewRouter().Add(testCase, &TestHandler{})
+		spec.Assert(err != nil, "Expected error for %s", testCase)
+	}
+}
+
+func TestRouterGetParamsAndPriority(t *testing.T) {
+	spec := &Spec{t}
+
+	added := NewRouter()
+	for _, template := range []string{
+		"/",
+		"/assets/*path",
+		"/assets/js/{name}",
+		"/contacts/{userId}",
+		"/contacts/{userId}/{contactId:[a-z]+}",
+		"/contacts/{userId}/{contactId}",
+		"/contacts/{userId}.vcf",
+		"/contacts/{userId}/new",
+	} {
+		err := added.Add(template, &TestHandler{})
+		spec.Assert(err == nil, "Unexpected error for %s : %s", template, err)
+	}
+
+	testCases := []struct {
+		// Input
+		Path string
+		// Expected result
+		Template string
+		Params   map[string]string
+	}{
+		{"/", "/", map[string]string{}},
+		{"/assets/", "/assets/*path", map[string]string{"path": ""}},
+		{"/assets/css/a/b.css", "/assets/*path", map[string]string{"path": "css/a/b.css"}},
+		{"/assets/js/app.js", "/assets/js/{name}", map[string]string{"name": "app.js"}},
+		{"/contacts/ted", "/contacts/{userId}", map[string]string{"userId": "ted"}},
+		{"/contacts/ted/", "/contacts/{userId}", map[string]string{"userId": "ted"}},
+		{"/contacts/ted.vcf", "/contacts/{userId}.vcf", map[string]string{"userId": "ted"}},
+		{"/contacts/ted/new", "/contacts/{userId}/new", map[string]string{"userId": "ted"}},
+		{"/contacts/ted/toe", "/contacts/{userId}/{contactId:[a-z]+}", map[string]string{"userId": "ted", "contactId": "toe"}},
+		{"/contacts/ted/t0e", "/contacts/{userId}/{contactId}", map[string]string{"userId": "ted", "contactId": "t0e"}},
+		{"/contacts/ted/toe/more", "", nil},
+		{"/contacts", "", nil},
+		{"/other", "", nil},
+	}
+
+	// Priority must not depend on the order templates were added in
+	reversed := NewRouter()
+	for index := len(added.routes) - 1; index >= 0; index-- {
+		reversed.Add(added.routes[index].entry.pattern, &TestHandler{})
+	}
+
+	for _, candidate := range []*router{added, reversed} {
+		for _, testCase := range testCases {
+			entry, params := candidate.Get(testCase.Path)
+
+			template := ""
+			if entry != nil {
+				template = entry.pattern
+			}
+			spec.Assert(template == testCase.Template, "Unexpected template [%s] for %s", template, testCase.Path)
+			spec.Assert(reflect.DeepEqual(params, testCase.Params), "Unexpected params %v for %s", params, testCase.Path)
+		}
+	}
+}
+
+func TestRouterServeHTTPSetsParams(t *testing.T) {
+	spec := &Spec{t}
+
+	router := NewRouter()
+	router.Add(`/contacts/{userId}/{contactId}`, &TestHandler{})
+
+	requestContext := GetLoggedInRequestContext()
+	request, _ := http.NewRequest("GET", "/contacts/ted/toe", nil)
+	response := httptest.NewRecorder()
+
+	router.ServeHTTP(response, request, requestContext)
+
+	spec.Assert(response.Code == http.StatusOK, "Unexpected status code %d", response.Code)
+	spec.Assert(requestContext.GetParam("userId") == "ted", "Unexpected userId param %s", requestContext.GetParam("userId"))
+	spec.Assert(requestContext.GetParam("contactId") == "toe", "Unexpected contactId param %s", requestContext.GetParam("contactId"))
+}
+
+type TestBadSignatureHandler struct {
+}
+
+func (h *TestBadSignatureHandler) Get(w http.ResponseWriter, r *http.Request) {
+}
+
+func (h *TestBadSignatureHandler) Post(w http.ResponseWriter, r *http.Request, c *RequestContext) {
+}
+
+func (h *TestBadSignatureHandler) Delete() error {
+	return nil
+}
+
+func TestRouterAddFailureReportsEveryBadSignature(t *testing.T) {
+	spec := &Spec{t}
+
+	router := NewRouter()
+	err := router.Add(`/p1`, &TestBadSignatureHandler{})
+
+	spec.Assert(err != nil, "Expected error")
+	spec.Assert(strings.HasPrefix(err.Error(), "Route [/p1] : "), "Error does not include the route %s", err)
+	spec.Assert(strings.Contains(err.Error(), "*main.TestBadSignatureHandler.Get is func(http.ResponseWriter, *http.Request)"), "Error does not include Get %s", err)
+	spec.Assert(strings.Contains(err.Error(), "*main.TestBadSignatureHandler.Delete is func() error"), "Error does not include Delete %s", err)
+	spec.Assert(!strings.Contains(err.Error(), "Post"), "Error includes Post %s", err)
+	spec.Assert(len(router.routes) == 0, "Route was added")
+}
+
+func TestRouterAddFailureDuplicateRoute(t *testing.T) {
+	spec := &Spec{t}
+
+	router := NewRouter()
+	router.Add(`/p1`, &TestHandler{})
+	err := router.Add(`/p1`, &TestHandler{})
+
+	spec.Assert(err != nil, "Expected error")
+}
+
+func TestRouterAddRoutesReportsEveryRoute(t *testing.T) {
+	spec := &Spec{t}
+
+	router := NewRouter()
+	err := router.AddRoutes(
+		Route{`/p1`, &TestHandler{}},
+		Route{`/p2`, &TestBadSignatureHandler{}},
+		Route{`/p3`, 1},
+		Route{`/p4/{id`, &TestHandler{}},
+	)
+
+	spec.Assert(err != nil, "Expected error")
+	for _, template := range []string{"/p2", "/p3", "/p4/{id"} {
+		spec.Assert(strings.Contains(err.Error(), "["+template+"]"), "Error does not include %s : %s", template, err)
+	}
+	spec.Assert(!strings.Contains(err.Error(), "[/p1]"), "Error includes /p1 : %s", err)
+}
+
+func TestRouterGetRouteTable(t *testing.T) {
+	spec := &Spec{t}
+
+	router := NewRouter()
+	router.AddRoutes(
+		Route{`/p1/{id}`, &TestHandler{}},
+		Route{`/p1/new`, &TestPatchHandler{}},
+	)
+
+	table := router.GetRouteTable()
+
+	spec.Assert(len(table) == 2, "Unexpected route count %d", len(table))
+	spec.Assert(strings.HasPrefix(table[0], "/p1/new ") && strings.Contains(table[0], "*main.TestPatchHandler") && strings.HasSuffix(table[0], "GET, HEAD, PATCH, DELETE, OPTIONS"), "Unexpected route %s", table[0])
+	spec.Assert(strings.HasPrefix(table[1], "/p1/{id} ") && strings.HasSuffix(table[1], "GET, HEAD, OPTIONS"), "Unexpected route %s", table[1])
 }
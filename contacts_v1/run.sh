@@ -28,7 +28,7 @@ if $use_redis; then
     [ ! -d /tmp/contacts ] && mkdir /tmp/contacts
     redis-server --dir /tmp/contacts --dbfilename contacts.rdp &
     
-    # Ensure we have one user's data - no contacts
+    # Ensure we have one user's data - legacy single ContactsAsJson layout, the app migrates this to per contact keys on start up
     sleep 2
     redis-cli hmset user:pmcgrath FirstName Pat LastName McGrath Password pass ContactsAsJson '[{"Id": "pmcgrath", "FirstName": "Ted", "LastName": "Toe"}]'
   fi
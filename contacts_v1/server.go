@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+Server - explicit timeouts and graceful shutdown, values are seconds
+
+	WEBAPP_READ_TIMEOUT_IN_SECONDS		Reading the whole request including the body, default 15
+	WEBAPP_WRITE_TIMEOUT_IN_SECONDS		Writing the response, default 30
+	WEBAPP_IDLE_TIMEOUT_IN_SECONDS		Keep alive connections waiting for the next request, default 120
+	WEBAPP_SHUTDOWN_TIMEOUT_IN_SECONDS	Waiting for in flight requests on shutdown, default 30
+*/
+func NewServer(address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: getEnvSeconds("WEBAPP_READ_TIMEOUT_IN_SECONDS", 15),
+		ReadTimeout:       getEnvSeconds("WEBAPP_READ_TIMEOUT_IN_SECONDS", 15),
+		WriteTimeout:      getEnvSeconds("WEBAPP_WRITE_TIMEOUT_IN_SECONDS", 30),
+		IdleTimeout:       getEnvSeconds("WEBAPP_IDLE_TIMEOUT_IN_SECONDS", 120),
+	}
+}
+
+func GetShutdownTimeout() time.Duration {
+	return getEnvSeconds("WEBAPP_SHUTDOWN_TIMEOUT_IN_SECONDS", 30)
+}
+
+// A server and the listener it serves, the listener is already wrapped for TLS if needed
+type ServerListener struct {
+	Server   *http.Server
+	Listener net.Listener
+}
+
+/*
+Serves until a signal is received or a server fails, on either we stop accepting connections on all servers and wait
+for in flight requests to complete, up to the shutdown timeout
+Only returns an error if a server failed or in flight requests did not complete in time
+*/
+func ServeUntilSignalled(shutdownTimeout time.Duration, signals <-chan os.Signal, servers ...ServerListener) error {
+	serveErrors := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server ServerListener) {
+			serveErrors <- server.Server.Serve(server.Listener)
+		}(server)
+	}
+
+	var result error
+	running := len(servers)
+	select {
+	case result = <-serveErrors:
+		running--
+		log.Printf("Server failed, shutting down, waiting up to %s for in flight requests : %s\n", shutdownTimeout, result)
+	case sig := <-signals:
+		log.Printf("Received %s signal, shutting down, waiting up to %s for in flight requests\n", sig, shutdownTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Server.Shutdown(ctx); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	// Serve returns ErrServerClosed as soon as Shutdown starts, which is expected
+	for ; running > 0; running-- {
+		if err := <-serveErrors; err != http.ErrServerClosed && result == nil {
+			result = err
+		}
+	}
+	if result != nil {
+		return result
+	}
+
+	log.Println("Server shut down, all in flight requests completed")
+	return nil
+}
+
+func getEnvSeconds(key string, defaultValue int) time.Duration {
+	return time.Duration(getEnvInt(key, defaultValue)) * time.Second
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(GetOrDefaultEnv(key, strconv.Itoa(defaultValue)))
+	if err != nil || value < 0 {
+		log.Printf("Invalid %s, using default of %d\n", key, defaultValue)
+		value = defaultValue
+	}
+
+	return value
+}
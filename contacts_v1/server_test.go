@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeUntilSignalledDrainsInFlightRequests(t *testing.T) {
+	spec := &Spec{t}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	spec.Assert(err == nil, "Listen failed : %s", err)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	server := NewServer(listener.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		fmt.Fprint(w, "done")
+	}))
+
+	signals := make(chan os.Signal, 1)
+	serveErrors := make(chan error, 1)
+	go func() {
+		serveErrors <- ServeUntilSignalled(5*time.Second, signals, ServerListener{server, listener})
+	}()
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		res, err := http.Get(fmt.Sprintf("http://%s/", listener.Addr()))
+		if err != nil {
+			responses <- nil
+			return
+		}
+		res.Body.Close()
+		responses <- res
+	}()
+
+	<-started
+	signals <- syscall.SIGTERM
+
+	// Shutdown must wait for the in flight request
+	select {
+	case err := <-serveErrors:
+		t.Fatalf("Returned before the in flight request completed : %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	res := <-responses
+	spec.Assert(res != nil, "In flight request failed")
+	spec.Assert(res.StatusCode == http.StatusOK, "Unexpected status code %d", res.StatusCode)
+	spec.Assert(<-serveErrors == nil, "Expected a clean shutdown")
+
+	_, err = net.DialTimeout("tcp", listener.Addr().String(), time.Second)
+	spec.Assert(err != nil, "Still accepting connections after shutdown")
+}
+
+func TestServeUntilSignalledShutdownTimeout(t *testing.T) {
+	spec := &Spec{t}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	spec.Assert(err == nil, "Listen failed : %s", err)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	server := NewServer(listener.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	signals := make(chan os.Signal, 1)
+	serveErrors := make(chan error, 1)
+	go func() {
+		serveErrors <- ServeUntilSignalled(50*time.Millisecond, signals, ServerListener{server, listener})
+	}()
+	go http.Get(fmt.Sprintf("http://%s/", listener.Addr()))
+
+	<-started
+	signals <- os.Interrupt
+
+	select {
+	case err := <-serveErrors:
+		spec.Assert(err != nil, "Expected an error as the in flight request did not complete in time")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown timeout was not honoured")
+	}
+}
+
+func TestServeUntilSignalledServeFailure(t *testing.T) {
+	spec := &Spec{t}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	spec.Assert(err == nil, "Listen failed : %s", err)
+	listener.Close()
+
+	err = ServeUntilSignalled(time.Second, make(chan os.Signal), ServerListener{NewServer("", http.NotFoundHandler()), listener})
+	spec.Assert(err != nil, "Expected an error for a closed listener")
+}
+
+func TestServeUntilSignalledServeFailureShutsDownOtherServers(t *testing.T) {
+	spec := &Spec{t}
+
+	failing, err := net.Listen("tcp", "127.0.0.1:0")
+	spec.Assert(err == nil, "Listen failed : %s", err)
+	failing.Close()
+	healthy, err := net.Listen("tcp", "127.0.0.1:0")
+	spec.Assert(err == nil, "Listen failed : %s", err)
+
+	err = ServeUntilSignalled(
+		time.Second,
+		make(chan os.Signal),
+		ServerListener{NewServer("", http.NotFoundHandler()), healthy},
+		ServerListener{NewServer("", http.NotFoundHandler()), failing})
+	spec.Assert(err != nil, "Expected an error for a closed listener")
+
+	_, err = net.DialTimeout("tcp", healthy.Addr().String(), time.Second)
+	spec.Assert(err != nil, "Healthy server still accepting connections")
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	spec := &Spec{t}
+
+	os.Setenv("WEBAPP_WRITE_TIMEOUT_IN_SECONDS", "7")
+	os.Setenv("WEBAPP_IDLE_TIMEOUT_IN_SECONDS", "invalid")
+	defer os.Unsetenv("WEBAPP_WRITE_TIMEOUT_IN_SECONDS")
+	defer os.Unsetenv("WEBAPP_IDLE_TIMEOUT_IN_SECONDS")
+
+	server := NewServer(":8080", nil)
+	spec.Assert(server.ReadTimeout == 15*time.Second, "Unexpected read timeout %s", server.ReadTimeout)
+	spec.Assert(server.ReadHeaderTimeout == 15*time.Second, "Unexpected read header timeout %s", server.ReadHeaderTimeout)
+	spec.Assert(server.WriteTimeout == 7*time.Second, "Unexpected write timeout %s", server.WriteTimeout)
+	spec.Assert(server.IdleTimeout == 120*time.Second, "Invalid value should use the default, got %s", server.IdleTimeout)
+	spec.Assert(GetShutdownTimeout() == 30*time.Second, "Unexpected shutdown timeout %s", GetShutdownTimeout())
+}
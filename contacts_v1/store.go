@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,26 +22,128 @@ Store interfaces
 type SessionStore interface {
 	Get(string) (*Session, error)
 	Save(*Session) error
+	Delete(id string) error // Not an error if the session does not exist
 	GetAge() uint
 }
 
 type UserStore interface {
 	Get(id string) (*User, error)
-	Save(user *User) error
+	Save(user *User) error // Whole user including contacts
+	Create(user *User) error
+	Delete(id string) error
+	SaveProfile(user *User) error                 // Names and email only, password, roles and contacts are untouched
+	SavePassword(userId, password string) error   // Password hash only, see User.SetPassword
+	SetRoles(userId string, roles []string) error // Replaces the user's roles only
+	GetContact(userId, contactId string) (*Contact, error)
+	SaveContact(userId string, contact *Contact, expectedVersion int64) error // Sets the contact's new version, incarnation and stored MergedIds on success
+	SaveContacts(userId string, contacts []Contact) error                     // Bulk add or replace as a single update, sets each contact's new version, incarnation and stored MergedIds
+	DeleteContact(userId, contactId string, expectedVersion int64) error
+	MergeContacts(userId string, contact *Contact, expectedVersions map[string]int64) error // See MergeContacts on the in memory store
+	CreateApiToken(token *ApiToken) error
+	GetApiToken(hash string) (*ApiToken, error)     // By the token's hash, see HashApiToken
+	GetApiTokens(userId string) ([]ApiToken, error) // Oldest first
+	DeleteApiToken(userId, tokenId string) error    // Revokes the token
+	SaveGrant(grant *Grant) error                   // Replaces any grant from the owner to the grantee
+	GetGrant(ownerId, granteeId string) (*Grant, error)
+	GetGrants(ownerId string) ([]Grant, error)         // Given by the owner, ordered by grantee id
+	GetSharedGrants(granteeId string) ([]Grant, error) // Received by the grantee, ordered by owner id
+	DeleteGrant(ownerId, granteeId string) error
+	CreateGroup(userId string, group *Group) error // Group names are unique per user ignoring case
+	GetGroup(userId, groupId string) (*Group, error)
+	GetGroups(userId string) ([]Group, error) // Ordered by name ignoring case
+	RenameGroup(userId, groupId, name string) error
+	DeleteGroup(userId, groupId string) error
+	AddGroupContact(userId, groupId, contactId string) error    // Not an error if the contact is already in the group
+	RemoveGroupContact(userId, groupId, contactId string) error // ErrContactNotFound if the contact is not in the group
+}
+
+type LoginAttemptStore interface {
+	GetLoginAttempts(key string) (*LoginAttempts, error) // Zero value if there have been no recent failures
+	// Atomic, if no limit needs a wait each key's failures are incremented and forgotten ResetAfter later, otherwise the longest wait is returned and nothing changes
+	ReserveLoginAttempt(limits []LoginAttemptLimit, backoff LoginBackoff) (time.Duration, error)
+	ReleaseLoginAttempt(key string) error // Gives back one reserved attempt
+	ResetLoginAttempts(key string) error
+}
+
+/*
+Expected contact versions for compare and swap, otherwise the contact's current version
+*/
+const (
+	AnyContactVersion int64 = -1 // No version check
+	NoContactVersion  int64 = -2 // Contact must not exist
+)
+
+func isExpectedContactVersion(current *Contact, expectedVersion int64) bool {
+	switch expectedVersion {
+	case AnyContactVersion:
+		return true
+	case NoContactVersion:
+		return current == nil
+	}
+
+	return current != nil && current.Version == expectedVersion
+}
+
+// MergedIds is maintained by the store, like Version, so the current contact's value is kept whatever the caller sent
+func getStoredMergedIds(current *Contact) []string {
+	if current == nil {
+		return nil
+	}
+
+	return current.MergedIds
+}
+
+// New for each contact created, so a contact deleted and created again does not repeat the earlier etags, see GetContactETag
+func getContactIncarnation(current *Contact) string {
+	if current == nil {
+		return Uuid()
+	}
+
+	return current.Incarnation
+}
+
+func getNextContactVersion(current *Contact) int64 {
+	if current == nil {
+		return 1
+	}
+
+	return current.Version + 1
+}
+
+/*
+User store errors - callers need to distinguish these from other store failures
+*/
+var (
+	ErrDuplicateUserId    = errors.New("Duplicate user id")
+	ErrDuplicateEmail     = errors.New("Duplicate email")
+	ErrUserNotFound       = errors.New("User not found")
+	ErrContactNotFound    = errors.New("Contact not found")
+	ErrVersionConflict    = errors.New("Version conflict")
+	ErrStoreContention    = errors.New("Too many concurrent changes") // Unconditional write that kept losing to concurrent changes, can be retried
+	ErrApiTokenNotFound   = errors.New("API token not found")
+	ErrGrantNotFound      = errors.New("Grant not found")
+	ErrGroupNotFound      = errors.New("Group not found")
+	ErrDuplicateGroupName = errors.New("Duplicate group name")
+)
+
+func normaliseEmailForIndex(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
 }
 
 /*
 In memory session store
 */
 type InMemorySessionStore struct {
-	mutex *sync.RWMutex
-	age   uint
-	data  map[string]*Session
+	mutex     *sync.RWMutex
+	age       uint
+	data      map[string]*Session
+	stopPurge chan struct{}
+	closeOnce sync.Once
 }
 
 func (store *InMemorySessionStore) Get(id string) (*Session, error) {
-	store.mutex.Lock()
-	defer store.mutex.Unlock()
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
 
 	s, ok := store.data[id]
 	if !ok {
@@ -48,8 +154,8 @@ func (store *InMemorySessionStore) Get(id string) (*Session, error) {
 }
 
 func (store *InMemorySessionStore) Save(s *Session) error {
-	store.mutex.RLock()
-	defer store.mutex.RUnlock()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 
 	s.LastAccess = time.Now()
 	store.data[s.Id] = s
@@ -57,6 +163,15 @@ func (store *InMemorySessionStore) Save(s *Session) error {
 	return nil
 }
 
+func (store *InMemorySessionStore) Delete(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.data, id)
+
+	return nil
+}
+
 func (store *InMemorySessionStore) Purge() {
 	log.Println("Purging session store")
 	store.mutex.Lock()
@@ -79,18 +194,36 @@ func (store *InMemorySessionStore) GetAge() uint {
 
 func NewInMemorySessionStore(age, purgeInterval uint) *InMemorySessionStore {
 	store := &InMemorySessionStore{
-		mutex: new(sync.RWMutex),
-		age:   age,
-		data:  make(map[string]*Session, 0),
+		mutex:     new(sync.RWMutex),
+		age:       age,
+		data:      make(map[string]*Session, 0),
+		stopPurge: make(chan struct{}),
 	}
-	go func() {
-		for {
-			time.Sleep(time.Duration(purgeInterval) * time.Second)
+	go store.purgePeriodically(time.Duration(purgeInterval) * time.Second)
+
+	return store
+}
+
+func (store *InMemorySessionStore) purgePeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
 			store.Purge()
+		case <-store.stopPurge:
+			log.Println("Session store purging stopped")
+			return
 		}
-	}()
+	}
+}
 
-	return store
+// Stops purging, safe to call more than once
+func (store *InMemorySessionStore) Close() {
+	store.closeOnce.Do(func() {
+		close(store.stopPurge)
+	})
 }
 
 /*
@@ -125,6 +258,7 @@ func (store *RedisSessionStore) Save(session *Session) error {
 	conn := store.pool.Get()
 	defer conn.Close()
 
+	session.LastAccess = time.Now()
 	sessionDataBuffer := new(bytes.Buffer)
 	encoder := gob.NewEncoder(sessionDataBuffer)
 	if err := encoder.Encode(session); err != nil {
@@ -140,6 +274,16 @@ func (store *RedisSessionStore) Save(session *Session) error {
 	return nil
 }
 
+func (store *RedisSessionStore) Delete(id string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	redisKey := "session:" + id
+	_, err := conn.Do("DEL", redisKey)
+
+	return err
+}
+
 func (store *RedisSessionStore) GetAge() uint {
 	return store.age
 }
@@ -152,113 +296,2564 @@ func NewRedisSessionStore(pool *redis.Pool, age uint) *RedisSessionStore {
 }
 
 /*
-In memory user store
+In memory session revocation store - only seen by this process, so other replicas still accept a revoked cookie
 */
-type InMemoryUserStore struct {
-	mutex *sync.RWMutex
-	data  map[string]*User
+type InMemorySessionRevocationStore struct {
+	mutex     *sync.Mutex
+	data      map[string]time.Time // Id to when the revocation can be forgotten
+	stopPurge chan struct{}
+	closeOnce sync.Once
 }
 
-func (store *InMemoryUserStore) Get(id string) (*User, error) {
+func (store *InMemorySessionRevocationStore) Revoke(id string, age uint) error {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	user, ok := store.data[id]
-	if !ok {
-		return nil, fmt.Errorf("Record not found for [%s]", id)
-	}
+	store.data[id] = time.Now().Add(time.Duration(age) * time.Second)
 
-	return user, nil
+	return nil
 }
 
-func (store *InMemoryUserStore) Save(user *User) error {
-	store.mutex.RLock()
-	defer store.mutex.RUnlock()
+func (store *InMemorySessionRevocationStore) IsRevoked(id string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 
-	store.data[user.Id] = user
-	return nil
+	expires, ok := store.data[id]
+	return ok && time.Now().Before(expires), nil
 }
 
-func NewInMemoryUserStore() *InMemoryUserStore {
-	return &InMemoryUserStore{
-		mutex: new(sync.RWMutex),
-		data:  make(map[string]*User),
+func (store *InMemorySessionRevocationStore) Purge() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	for id, expires := range store.data {
+		if !now.Before(expires) {
+			delete(store.data, id)
+		}
+	}
+}
+
+func NewInMemorySessionRevocationStore(purgeInterval uint) *InMemorySessionRevocationStore {
+	store := &InMemorySessionRevocationStore{
+		mutex:     new(sync.Mutex),
+		data:      make(map[string]time.Time),
+		stopPurge: make(chan struct{}),
+	}
+	go store.purgePeriodically(time.Duration(purgeInterval) * time.Second)
+
+	return store
+}
+
+func (store *InMemorySessionRevocationStore) purgePeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			store.Purge()
+		case <-store.stopPurge:
+			return
+		}
 	}
 }
 
+// Stops purging, safe to call more than once
+func (store *InMemorySessionRevocationStore) Close() {
+	store.closeOnce.Do(func() {
+		close(store.stopPurge)
+	})
+}
+
 /*
-Redis user store
+Redis session revocation store - a revokedsession:<id> key per revoked id which expires with the cookie
 */
-type RedisUserStore struct {
+type RedisSessionRevocationStore struct {
 	pool *redis.Pool
 }
 
-func (store *RedisUserStore) Get(id string) (*User, error) {
+func (store *RedisSessionRevocationStore) Revoke(id string, age uint) error {
 	conn := store.pool.Get()
 	defer conn.Close()
 
-	redisKey := "user:" + id
-	values, err := redis.Values(conn.Do("HGETALL", redisKey))
-	if err != nil {
-		return nil, err
-	}
+	_, err := conn.Do("SETEX", "revokedsession:"+id, age, "1")
 
-	var data struct {
-		FirstName, LastName, Email, Password, ContactsAsJson string
+	return err
+}
+
+func (store *RedisSessionRevocationStore) IsRevoked(id string) (bool, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("EXISTS", "revokedsession:"+id))
+}
+
+func NewRedisSessionRevocationStore(pool *redis.Pool) *RedisSessionRevocationStore {
+	return &RedisSessionRevocationStore{pool: pool}
+}
+
+/*
+In memory user store - hands out copies so callers cannot change stored state without going through Save
+*/
+type InMemoryUserStore struct {
+	mutex     *sync.RWMutex
+	data      map[string]*User
+	emails    map[string]string            // Normalised email to user id index
+	apiTokens map[string]*ApiToken         // By token hash
+	grants    map[string]map[string]*Grant // By owner id then grantee id
+	groups    map[string]map[string]*Group // By user id then group id
+	deleted   map[string]bool              // Ids of deleted users, never reused so their old sessions cannot act as a new user
+}
+
+func (store *InMemoryUserStore) Get(id string) (*User, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	user, ok := store.data[id]
+	if !ok {
+		return nil, ErrUserNotFound
 	}
-	if err = redis.ScanStruct(values, &data); err != nil {
-		return nil, err
+
+	return copyUser(user), nil
+}
+
+func (store *InMemoryUserStore) Save(user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.save(user)
+}
+
+func (store *InMemoryUserStore) Create(user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.data[user.Id]; ok || store.deleted[user.Id] {
+		return ErrDuplicateUserId
 	}
 
-	if (data.FirstName + data.LastName + data.Email + data.Password + data.ContactsAsJson) == "" {
-		// No data, so we presume no user
-		return nil, fmt.Errorf("Record not found for [%s]", redisKey)
+	return store.save(user)
+}
+
+func (store *InMemoryUserStore) Delete(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	existing, ok := store.data[id]
+	if !ok {
+		return ErrUserNotFound
 	}
 
-	var contacts []Contact
-	if data.ContactsAsJson != "" {
-		if err = json.Unmarshal([]byte(data.ContactsAsJson), &contacts); err != nil {
-			return nil, err
+	delete(store.emails, normaliseEmailForIndex(existing.Email))
+	delete(store.data, id)
+	store.deleted[id] = true
+	for hash, token := range store.apiTokens {
+		if token.UserId == id {
+			delete(store.apiTokens, hash)
 		}
 	}
+	delete(store.grants, id)
+	for _, grants := range store.grants {
+		delete(grants, id)
+	}
+	delete(store.groups, id)
+	return nil
+}
 
-	user := &User{
-		Id:        id,
-		FirstName: data.FirstName,
-		LastName:  data.LastName,
-		Email:     data.Email,
-		Password:  data.Password,
-		Contacts:  contacts,
+func (store *InMemoryUserStore) SaveProfile(user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	existing, ok := store.data[user.Id]
+	if !ok {
+		return ErrUserNotFound
 	}
 
-	return user, nil
+	// Starts from the stored user so a concurrent password or roles change is not lost
+	userCopy := *existing
+	userCopy.FirstName, userCopy.LastName, userCopy.Email = user.FirstName, user.LastName, user.Email
+	return store.save(&userCopy)
 }
 
-func (store *RedisUserStore) Save(user *User) error {
-	conn := store.pool.Get()
-	defer conn.Close()
+func (store *InMemoryUserStore) SavePassword(userId, password string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 
-	contactsAsJson, err := json.Marshal(user.Contacts)
-	if err != nil {
-		return err
+	existing, ok := store.data[userId]
+	if !ok {
+		return ErrUserNotFound
 	}
 
-	redisKey := "user:" + user.Id
-	_, err = conn.Do("HMSET", redisKey,
-		"FirstName", user.FirstName,
-		"LastName", user.LastName,
-		"Email", user.Email,
-		"Password", user.Password,
-		"ContactsAsJson", contactsAsJson)
-	if err != nil {
-		return err
+	existing.Password = password
+	return nil
+}
+
+func (store *InMemoryUserStore) SetRoles(userId string, roles []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	existing, ok := store.data[userId]
+	if !ok {
+		return ErrUserNotFound
 	}
 
+	existing.Roles = make([]string, len(roles))
+	copy(existing.Roles, roles)
 	return nil
 }
 
-func NewRedisUserStore(pool *redis.Pool) *RedisUserStore {
-	return &RedisUserStore{pool: pool}
+func (store *InMemoryUserStore) GetContact(userId, contactId string) (*Contact, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	user, ok := store.data[userId]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	index, ok := user.GetContactIndex(contactId)
+	if !ok {
+		return nil, ErrContactNotFound
+	}
+
+	contact := user.Contacts[index]
+	return &contact, nil
+}
+
+func (store *InMemoryUserStore) SaveContact(userId string, contact *Contact, expectedVersion int64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user, ok := store.data[userId]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	var current *Contact
+	index, ok := user.GetContactIndex(contact.Id)
+	if ok {
+		current = &user.Contacts[index]
+	}
+	if !isExpectedContactVersion(current, expectedVersion) {
+		return ErrVersionConflict
+	}
+
+	contact.Version = getNextContactVersion(current)
+	contact.Incarnation = getContactIncarnation(current)
+	contact.MergedIds = getStoredMergedIds(current)
+
+	// Stored user is replaced rather than mutated so copies already handed out are not affected
+	userCopy := copyUser(user)
+	if ok {
+		userCopy.Contacts[index] = *contact
+	} else {
+		userCopy.Contacts = append(userCopy.Contacts, *contact)
+	}
+
+	store.data[userId] = userCopy
+	return nil
+}
+
+func (store *InMemoryUserStore) SaveContacts(userId string, contacts []Contact) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user, ok := store.data[userId]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	userCopy := copyUser(user)
+	for contactIndex := range contacts {
+		var current *Contact
+		index, ok := userCopy.GetContactIndex(contacts[contactIndex].Id)
+		if ok {
+			current = &userCopy.Contacts[index]
+		}
+
+		contacts[contactIndex].Version = getNextContactVersion(current)
+		contacts[contactIndex].Incarnation = getContactIncarnation(current)
+		contacts[contactIndex].MergedIds = getStoredMergedIds(current)
+		if ok {
+			userCopy.Contacts[index] = contacts[contactIndex]
+		} else {
+			userCopy.Contacts = append(userCopy.Contacts, contacts[contactIndex])
+		}
+	}
+
+	store.data[userId] = userCopy
+	return nil
+}
+
+func (store *InMemoryUserStore) DeleteContact(userId, contactId string, expectedVersion int64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user, ok := store.data[userId]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	index, ok := user.GetContactIndex(contactId)
+	if !ok {
+		return ErrContactNotFound
+	}
+	if !isExpectedContactVersion(&user.Contacts[index], expectedVersion) {
+		return ErrVersionConflict
+	}
+
+	userCopy := copyUser(user)
+	userCopy.Contacts = append(userCopy.Contacts[:index], userCopy.Contacts[index+1:]...)
+
+	store.data[userId] = userCopy
+	store.removeGroupContacts(userCopy)
+	return nil
+}
+
+/*
+Saves the merged contact and deletes the other contacts in expectedVersions as a single update
+expectedVersions has the expected version of every contact being merged, including the merged contact itself, a missing
+contact is ErrContactNotFound and a changed one ErrVersionConflict
+The merged contact keeps its place in the contact order and is added to the groups of the deleted contacts
+*/
+func (store *InMemoryUserStore) MergeContacts(userId string, contact *Contact, expectedVersions map[string]int64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user, ok := store.data[userId]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	for contactId, expectedVersion := range expectedVersions {
+		index, ok := user.GetContactIndex(contactId)
+		if !ok {
+			return ErrContactNotFound
+		}
+		if !isExpectedContactVersion(&user.Contacts[index], expectedVersion) {
+			return ErrVersionConflict
+		}
+	}
+	index, ok := user.GetContactIndex(contact.Id)
+	if !ok {
+		return ErrContactNotFound
+	}
+
+	contact.Version = getNextContactVersion(&user.Contacts[index])
+	contact.Incarnation = getContactIncarnation(&user.Contacts[index])
+
+	userCopy := copyUser(user)
+	contacts := make([]Contact, 0, len(userCopy.Contacts))
+	for _, existing := range userCopy.Contacts {
+		if existing.Id == contact.Id {
+			contacts = append(contacts, *contact)
+			continue
+		}
+		if _, merged := expectedVersions[existing.Id]; !merged {
+			contacts = append(contacts, existing)
+		}
+	}
+	userCopy.Contacts = contacts
+
+	for _, group := range store.groups[userId] {
+		inGroup, mergedInGroup := false, false
+		for _, contactId := range group.ContactIds {
+			if contactId == contact.Id {
+				inGroup = true
+			} else if _, merged := expectedVersions[contactId]; merged {
+				mergedInGroup = true
+			}
+		}
+		if mergedInGroup && !inGroup {
+			group.ContactIds = append(group.ContactIds, contact.Id)
+			sort.Strings(group.ContactIds)
+		}
+	}
+
+	store.data[userId] = userCopy
+	store.removeGroupContacts(userCopy)
+	return nil
+}
+
+func (store *InMemoryUserStore) CreateApiToken(token *ApiToken) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.data[token.UserId]; !ok {
+		return ErrUserNotFound
+	}
+
+	tokenCopy := *token
+	store.apiTokens[token.Hash] = &tokenCopy
+	return nil
+}
+
+func (store *InMemoryUserStore) GetApiToken(hash string) (*ApiToken, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	token, ok := store.apiTokens[hash]
+	if !ok {
+		return nil, ErrApiTokenNotFound
+	}
+
+	tokenCopy := *token
+	return &tokenCopy, nil
+}
+
+func (store *InMemoryUserStore) GetApiTokens(userId string) ([]ApiToken, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if _, ok := store.data[userId]; !ok {
+		return nil, ErrUserNotFound
+	}
+
+	tokens := make([]ApiToken, 0)
+	for _, token := range store.apiTokens {
+		if token.UserId == userId {
+			tokens = append(tokens, *token)
+		}
+	}
+	sortApiTokens(tokens)
+
+	return tokens, nil
+}
+
+func (store *InMemoryUserStore) DeleteApiToken(userId, tokenId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for hash, token := range store.apiTokens {
+		if token.UserId == userId && token.Id == tokenId {
+			delete(store.apiTokens, hash)
+			return nil
+		}
+	}
+
+	return ErrApiTokenNotFound
+}
+
+func sortApiTokens(tokens []ApiToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+		}
+		return tokens[i].Id < tokens[j].Id
+	})
+}
+
+func (store *InMemoryUserStore) SaveGrant(grant *Grant) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.data[grant.OwnerId]; !ok {
+		return ErrUserNotFound
+	}
+	if _, ok := store.data[grant.GranteeId]; !ok {
+		return ErrUserNotFound
+	}
+
+	grants, ok := store.grants[grant.OwnerId]
+	if !ok {
+		grants = make(map[string]*Grant)
+		store.grants[grant.OwnerId] = grants
+	}
+	grants[grant.GranteeId] = copyGrant(grant)
+
+	return nil
+}
+
+func (store *InMemoryUserStore) GetGrant(ownerId, granteeId string) (*Grant, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	grant, ok := store.grants[ownerId][granteeId]
+	if !ok {
+		return nil, ErrGrantNotFound
+	}
+
+	return copyGrant(grant), nil
+}
+
+func (store *InMemoryUserStore) GetGrants(ownerId string) ([]Grant, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if _, ok := store.data[ownerId]; !ok {
+		return nil, ErrUserNotFound
+	}
+
+	grants := make([]Grant, 0)
+	for _, grant := range store.grants[ownerId] {
+		grants = append(grants, *copyGrant(grant))
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].GranteeId < grants[j].GranteeId })
+
+	return grants, nil
+}
+
+func (store *InMemoryUserStore) GetSharedGrants(granteeId string) ([]Grant, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if _, ok := store.data[granteeId]; !ok {
+		return nil, ErrUserNotFound
+	}
+
+	grants := make([]Grant, 0)
+	for _, ownerGrants := range store.grants {
+		if grant, ok := ownerGrants[granteeId]; ok {
+			grants = append(grants, *copyGrant(grant))
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].OwnerId < grants[j].OwnerId })
+
+	return grants, nil
+}
+
+func (store *InMemoryUserStore) DeleteGrant(ownerId, granteeId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.grants[ownerId][granteeId]; !ok {
+		return ErrGrantNotFound
+	}
+	delete(store.grants[ownerId], granteeId)
+
+	return nil
+}
+
+func copyGrant(grant *Grant) *Grant {
+	grantCopy := *grant
+	if grant.ContactIds != nil {
+		grantCopy.ContactIds = make([]string, len(grant.ContactIds))
+		copy(grantCopy.ContactIds, grant.ContactIds)
+	}
+
+	return &grantCopy
+}
+
+func (store *InMemoryUserStore) CreateGroup(userId string, group *Group) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.data[userId]; !ok {
+		return ErrUserNotFound
+	}
+	if store.isDuplicateGroupName(userId, group.Id, group.Name) {
+		return ErrDuplicateGroupName
+	}
+
+	groups, ok := store.groups[userId]
+	if !ok {
+		groups = make(map[string]*Group)
+		store.groups[userId] = groups
+	}
+	groups[group.Id] = &Group{Id: group.Id, Name: group.Name}
+
+	return nil
+}
+
+func (store *InMemoryUserStore) GetGroup(userId, groupId string) (*Group, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	group, ok := store.groups[userId][groupId]
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+
+	return copyGroup(group), nil
+}
+
+func (store *InMemoryUserStore) GetGroups(userId string) ([]Group, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if _, ok := store.data[userId]; !ok {
+		return nil, ErrUserNotFound
+	}
+
+	groups := make([]Group, 0)
+	for _, group := range store.groups[userId] {
+		groups = append(groups, *copyGroup(group))
+	}
+	sortGroups(groups)
+
+	return groups, nil
+}
+
+func (store *InMemoryUserStore) RenameGroup(userId, groupId, name string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	group, ok := store.groups[userId][groupId]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	if store.isDuplicateGroupName(userId, groupId, name) {
+		return ErrDuplicateGroupName
+	}
+
+	group.Name = name
+	return nil
+}
+
+func (store *InMemoryUserStore) DeleteGroup(userId, groupId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.groups[userId][groupId]; !ok {
+		return ErrGroupNotFound
+	}
+	delete(store.groups[userId], groupId)
+
+	return nil
+}
+
+func (store *InMemoryUserStore) AddGroupContact(userId, groupId, contactId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	group, ok := store.groups[userId][groupId]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	if _, ok := store.data[userId].GetContactIndex(contactId); !ok {
+		return ErrContactNotFound
+	}
+
+	for _, existingContactId := range group.ContactIds {
+		if existingContactId == contactId {
+			return nil
+		}
+	}
+	group.ContactIds = append(group.ContactIds, contactId)
+	sort.Strings(group.ContactIds)
+
+	return nil
+}
+
+func (store *InMemoryUserStore) RemoveGroupContact(userId, groupId, contactId string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	group, ok := store.groups[userId][groupId]
+	if !ok {
+		return ErrGroupNotFound
+	}
+
+	for index, existingContactId := range group.ContactIds {
+		if existingContactId == contactId {
+			group.ContactIds = append(group.ContactIds[:index], group.ContactIds[index+1:]...)
+			return nil
+		}
+	}
+
+	return ErrContactNotFound
+}
+
+// Caller must hold the lock
+func (store *InMemoryUserStore) isDuplicateGroupName(userId, groupId, name string) bool {
+	for _, group := range store.groups[userId] {
+		if group.Id != groupId && strings.EqualFold(group.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyGroup(group *Group) *Group {
+	groupCopy := *group
+	if len(group.ContactIds) > 0 {
+		groupCopy.ContactIds = make([]string, len(group.ContactIds))
+		copy(groupCopy.ContactIds, group.ContactIds)
+	} else {
+		groupCopy.ContactIds = nil
+	}
+
+	return &groupCopy
+}
+
+func sortGroups(groups []Group) {
+	sort.Slice(groups, func(i, j int) bool {
+		a, b := strings.ToLower(groups[i].Name), strings.ToLower(groups[j].Name)
+		if a != b {
+			return a < b
+		}
+		return groups[i].Id < groups[j].Id
+	})
+}
+
+// Caller must hold the write lock
+func (store *InMemoryUserStore) save(user *User) error {
+	email := normaliseEmailForIndex(user.Email)
+	if ownerId, ok := store.emails[email]; ok && email != "" && ownerId != user.Id {
+		return ErrDuplicateEmail
+	}
+
+	if existing, ok := store.data[user.Id]; ok {
+		delete(store.emails, normaliseEmailForIndex(existing.Email))
+	}
+	if email != "" {
+		store.emails[email] = user.Id
+	}
+
+	store.data[user.Id] = copyUser(user)
+	store.removeGroupContacts(user)
+	return nil
+}
+
+// Removes contacts the user no longer has from their groups, caller must hold the write lock
+func (store *InMemoryUserStore) removeGroupContacts(user *User) {
+	for _, group := range store.groups[user.Id] {
+		contactIds := group.ContactIds[:0]
+		for _, contactId := range group.ContactIds {
+			if _, ok := user.GetContactIndex(contactId); ok {
+				contactIds = append(contactIds, contactId)
+			}
+		}
+		group.ContactIds = contactIds
+	}
+}
+
+func copyUser(user *User) *User {
+	userCopy := *user
+	if user.Roles != nil {
+		userCopy.Roles = make([]string, len(user.Roles))
+		copy(userCopy.Roles, user.Roles)
+	}
+	if user.Contacts != nil {
+		userCopy.Contacts = make([]Contact, len(user.Contacts))
+		copy(userCopy.Contacts, user.Contacts)
+	}
+
+	return &userCopy
+}
+
+func NewInMemoryUserStore() *InMemoryUserStore {
+	return &InMemoryUserStore{
+		mutex:     new(sync.RWMutex),
+		data:      make(map[string]*User),
+		emails:    make(map[string]string),
+		apiTokens: make(map[string]*ApiToken),
+		grants:    make(map[string]map[string]*Grant),
+		groups:    make(map[string]map[string]*Group),
+		deleted:   make(map[string]bool),
+	}
+}
+
+const maxRedisTransactionAttempts = 5
+
+// Sources of all scripts, scripts must only use keys passed in KEYS, see TestRedisScriptsOnlyUseKeysPassedIn
+var redisScriptSources []string
+
+func newRedisScript(keyCount int, src string) *redis.Script {
+	redisScriptSources = append(redisScriptSources, src)
+	return redis.NewScript(keyCount, src)
+}
+
+/*
+Runs a script in MULTI\EXEC after the caller has WATCHed the keys it read to work out the script's KEYS, so the keys
+passed in are still the right ones when the script runs
+ok is false if a watched key changed or the script had to be loaded, the caller should then re-read and try again
+*/
+func doRedisWatchedScript(conn redis.Conn, script *redis.Script, keysAndArgs ...interface{}) (reply interface{}, ok bool, err error) {
+	conn.Send("MULTI")
+	if err := script.SendHash(conn, keysAndArgs...); err != nil {
+		conn.Do("DISCARD")
+		return nil, false, err
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if redisErr, isErr := replies[0].(redis.Error); isErr {
+		if strings.HasPrefix(string(redisErr), "NOSCRIPT") {
+			return nil, false, script.Load(conn)
+		}
+		return nil, false, redisErr
+	}
+	return replies[0], true, nil
+}
+
+/*
+Redis user store
+Key layout
+
+	user:<id>			Hash of the user fields, EmailKey records the useremail:<email> index key we own
+	user:<id>:contacts		Sorted set of contact ids, score gives the contact order
+	user:<id>:contact:<contactId>	Contact json
+	useremail:<email>		User id for the normalised email
+	user:<id>:apitokens		Hash of API token id to token hash
+	apitoken:<hash>			API token json, keyed by hash so bearer requests need a single lookup
+	user:<id>:grants		Hash of grantee id to grant json
+	user:<id>:shared		Set of the ids of owners who have granted the user access
+	user:<id>:groups		Hash of group id to group json, without the contact ids
+	user:<id>:groupnames		Hash of lower case group name to group id, keeps names unique
+	user:<id>:group:<groupId>	Set of the group's contact ids
+	deleteduser:<id>		Set when a user is deleted, the id cannot be used again so old sessions cannot act as a new user
+
+Legacy user hashes hold all contacts in a ContactsAsJson field, these are migrated on start up (Migrate) and on read (Get)
+*/
+type RedisUserStore struct {
+	pool *redis.Pool
+}
+
+func getRedisUserKey(id string) string {
+	return "user:" + id
+}
+
+func getRedisDeletedUserKey(id string) string {
+	return "deleteduser:" + id
+}
+
+func getRedisContactsKey(userId string) string {
+	return "user:" + userId + ":contacts"
+}
+
+func getRedisContactKey(userId, contactId string) string {
+	return "user:" + userId + ":contact:" + contactId
+}
+
+func getRedisApiTokensKey(userId string) string {
+	return "user:" + userId + ":apitokens"
+}
+
+func getRedisApiTokenKey(hash string) string {
+	return "apitoken:" + hash
+}
+
+func getRedisGrantsKey(ownerId string) string {
+	return "user:" + ownerId + ":grants"
+}
+
+func getRedisSharedKey(granteeId string) string {
+	return "user:" + granteeId + ":shared"
+}
+
+func getRedisGroupsKey(userId string) string {
+	return "user:" + userId + ":groups"
+}
+
+func getRedisGroupNamesKey(userId string) string {
+	return "user:" + userId + ":groupnames"
+}
+
+func getRedisGroupKey(userId, groupId string) string {
+	return "user:" + userId + ":group:" + groupId
+}
+
+/*
+Redis user save script - checks and maintains the useremail:<email> index atomically with the user hash write
+The index key is recorded in the user hash (EmailKey) so we always remove exactly what we added
+Run by save after reading the old email key, contact ids and group ids under WATCH, so all keys are passed in KEYS
+KEYS[1] user key, KEYS[2] email index key or "" for no email, KEYS[3] contacts key, KEYS[4] old email index key or ""
+KEYS[5...] old contact keys, then group keys, then a key for each new contact
+ARGV[1] "create", "save" or "profile", ARGV[2] user id, ARGV[3] hash field value pair count, ARGV[4] old contact key
+count, ARGV[5] group key count, ARGV[6...] hash field value pairs followed by contact id and json pairs
+Contacts are only replaced for "create" and "save", "profile" only sends the names and email, the password and roles
+fields are left as they are
+Replacing contacts removes contacts the user no longer has from their groups
+*/
+var redisSaveUserScript = newRedisScript(-1, `
+local exists = redis.call("EXISTS", KEYS[1]) == 1
+if ARGV[1] == "create" and exists then
+  return redis.error_reply("DUPLICATEID")
+end
+if ARGV[1] == "profile" and not exists then
+  return redis.error_reply("NOTFOUND")
+end
+if KEYS[2] ~= "" then
+  local ownerId = redis.call("GET", KEYS[2])
+  if ownerId and ownerId ~= ARGV[2] then
+    return redis.error_reply("DUPLICATEEMAIL")
+  end
+end
+if KEYS[4] ~= "" and KEYS[4] ~= KEYS[2] and redis.call("GET", KEYS[4]) == ARGV[2] then
+  redis.call("DEL", KEYS[4])
+end
+if KEYS[2] ~= "" then
+  redis.call("SET", KEYS[2], ARGV[2])
+end
+local fieldsEnd = 5 + tonumber(ARGV[3])
+redis.call("HMSET", KEYS[1], "EmailKey", KEYS[2], unpack(ARGV, 6, fieldsEnd))
+if ARGV[1] ~= "profile" then
+  local oldContactsEnd = 4 + tonumber(ARGV[4])
+  local groupsEnd = oldContactsEnd + tonumber(ARGV[5])
+  redis.call("HDEL", KEYS[1], "ContactsAsJson")
+  for index = 5, oldContactsEnd do
+    redis.call("DEL", KEYS[index])
+  end
+  redis.call("DEL", KEYS[3])
+  local score = 0
+  for index = fieldsEnd + 1, #ARGV, 2 do
+    score = score + 1
+    redis.call("ZADD", KEYS[3], score, ARGV[index])
+    redis.call("SET", KEYS[groupsEnd + score], ARGV[index + 1])
+  end
+  for index = oldContactsEnd + 1, groupsEnd do
+    for _, contactId in ipairs(redis.call("SMEMBERS", KEYS[index])) do
+      if not redis.call("ZSCORE", KEYS[3], contactId) then
+        redis.call("SREM", KEYS[index], contactId)
+      end
+    end
+  end
+end
+return "OK"
+`)
+
+/*
+Redis user field script - sets a single user hash field, so other fields changed concurrently are kept
+KEYS[1] user key, ARGV[1] field, ARGV[2] value
+*/
+var redisSetUserFieldScript = newRedisScript(1, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+  return redis.error_reply("NOTFOUND")
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return "OK"
+`)
+
+/*
+Redis grant save script - the grantee's shared set indexes the grants they have received
+KEYS[1] owner key, KEYS[2] grantee key, KEYS[3] owner's grants key, KEYS[4] grantee's shared key
+ARGV[1] owner id, ARGV[2] grantee id, ARGV[3] grant json
+*/
+var redisSaveGrantScript = newRedisScript(4, `
+if redis.call("EXISTS", KEYS[1]) == 0 or redis.call("EXISTS", KEYS[2]) == 0 then
+  return redis.error_reply("NOTFOUND")
+end
+redis.call("HSET", KEYS[3], ARGV[2], ARGV[3])
+redis.call("SADD", KEYS[4], ARGV[1])
+return "OK"
+`)
+
+/*
+Redis grant delete script
+KEYS[1] owner's grants key, KEYS[2] grantee's shared key, ARGV[1] owner id, ARGV[2] grantee id
+*/
+var redisDeleteGrantScript = newRedisScript(2, `
+if redis.call("HDEL", KEYS[1], ARGV[2]) == 0 then
+  return redis.error_reply("GRANTNOTFOUND")
+end
+redis.call("SREM", KEYS[2], ARGV[1])
+return "OK"
+`)
+
+/*
+Redis group create script - the group names hash keeps names unique
+KEYS[1] user key, KEYS[2] groups key, KEYS[3] group names key, ARGV[1] group id, ARGV[2] lower case name, ARGV[3] group json
+*/
+var redisCreateGroupScript = newRedisScript(3, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+  return redis.error_reply("NOTFOUND")
+end
+if redis.call("HEXISTS", KEYS[3], ARGV[2]) == 1 then
+  return redis.error_reply("DUPLICATEGROUPNAME")
+end
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[3])
+redis.call("HSET", KEYS[3], ARGV[2], ARGV[1])
+return "OK"
+`)
+
+/*
+Redis group rename script - replaces the group's entry in the group names hash
+KEYS[1] groups key, KEYS[2] group names key, ARGV[1] group id, ARGV[2] lower case name, ARGV[3] group json
+*/
+var redisRenameGroupScript = newRedisScript(2, `
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+  return redis.error_reply("GROUPNOTFOUND")
+end
+local groupId = redis.call("HGET", KEYS[2], ARGV[2])
+if groupId and groupId ~= ARGV[1] then
+  return redis.error_reply("DUPLICATEGROUPNAME")
+end
+local names = redis.call("HGETALL", KEYS[2])
+for index = 1, #names, 2 do
+  if names[index + 1] == ARGV[1] then
+    redis.call("HDEL", KEYS[2], names[index])
+  end
+end
+redis.call("HSET", KEYS[2], ARGV[2], ARGV[1])
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+return "OK"
+`)
+
+/*
+Redis group delete script
+KEYS[1] groups key, KEYS[2] group names key, KEYS[3] group key, ARGV[1] group id
+*/
+var redisDeleteGroupScript = newRedisScript(3, `
+if redis.call("HDEL", KEYS[1], ARGV[1]) == 0 then
+  return redis.error_reply("GROUPNOTFOUND")
+end
+local names = redis.call("HGETALL", KEYS[2])
+for index = 1, #names, 2 do
+  if names[index + 1] == ARGV[1] then
+    redis.call("HDEL", KEYS[2], names[index])
+  end
+end
+redis.call("DEL", KEYS[3])
+return "OK"
+`)
+
+/*
+Redis group contact add script - the contact must be one of the user's
+KEYS[1] groups key, KEYS[2] contacts key, KEYS[3] group key, ARGV[1] group id, ARGV[2] contact id
+*/
+var redisAddGroupContactScript = newRedisScript(3, `
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+  return redis.error_reply("GROUPNOTFOUND")
+end
+if not redis.call("ZSCORE", KEYS[2], ARGV[2]) then
+  return redis.error_reply("CONTACTNOTFOUND")
+end
+redis.call("SADD", KEYS[3], ARGV[2])
+return "OK"
+`)
+
+/*
+Redis group contact remove script
+KEYS[1] groups key, KEYS[2] group key, ARGV[1] group id, ARGV[2] contact id
+*/
+var redisRemoveGroupContactScript = newRedisScript(2, `
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+  return redis.error_reply("GROUPNOTFOUND")
+end
+if redis.call("SREM", KEYS[2], ARGV[2]) == 0 then
+  return redis.error_reply("CONTACTNOTFOUND")
+end
+return "OK"
+`)
+
+/*
+Redis API token create script
+KEYS[1] user key, KEYS[2] user's API tokens key, KEYS[3] API token key, ARGV[1] token id, ARGV[2] token hash, ARGV[3] token json
+*/
+var redisCreateApiTokenScript = newRedisScript(3, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+  return redis.error_reply("NOTFOUND")
+end
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[2])
+redis.call("SET", KEYS[3], ARGV[3])
+return "OK"
+`)
+
+func (store *RedisUserStore) Get(id string) (*User, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	redisKey := getRedisUserKey(id)
+	values, contactsAsJson, err := getRedisUser(conn, redisKey, getRedisContactsKey(id), id)
+	if err != nil {
+		return nil, err
+	}
+
+	var data struct {
+		FirstName, LastName, Email, Password, Roles, ContactsAsJson string
+	}
+	if err = redis.ScanStruct(values, &data); err != nil {
+		return nil, err
+	}
+
+	if (data.FirstName + data.LastName + data.Email + data.Password + data.ContactsAsJson) == "" {
+		// No data, so we presume no user
+		return nil, ErrUserNotFound
+	}
+
+	if data.ContactsAsJson != "" {
+		// Legacy layout, migrate and re-read
+		if err = store.migrateUser(conn, id); err != nil {
+			return nil, err
+		}
+		return store.Get(id)
+	}
+
+	contacts := make([]Contact, 0, len(contactsAsJson))
+	for _, contactAsJson := range contactsAsJson {
+		var contact Contact
+		if err = json.Unmarshal([]byte(contactAsJson), &contact); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, contact)
+	}
+
+	user := &User{
+		Id:        id,
+		FirstName: data.FirstName,
+		LastName:  data.LastName,
+		Email:     data.Email,
+		Password:  data.Password,
+		Contacts:  contacts,
+	}
+	if data.Roles != "" {
+		user.Roles = strings.Split(data.Roles, ",")
+	}
+
+	return user, nil
+}
+
+// User hash and all contacts read in one MULTI\EXEC, the contacts index is watched so the contact ids we read stay current
+func getRedisUser(conn redis.Conn, redisKey, contactsKey, id string) ([]interface{}, []string, error) {
+	for attempt := 0; attempt < maxRedisTransactionAttempts; attempt++ {
+		if _, err := conn.Do("WATCH", contactsKey); err != nil {
+			return nil, nil, err
+		}
+		contactIds, err := redis.Strings(conn.Do("ZRANGE", contactsKey, 0, -1))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, nil, err
+		}
+
+		conn.Send("MULTI")
+		conn.Send("HGETALL", redisKey)
+		for _, contactId := range contactIds {
+			conn.Send("GET", getRedisContactKey(id, contactId))
+		}
+		replies, err := redis.Values(conn.Do("EXEC"))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		values, err := redis.Values(replies[0], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		contactsAsJson := make([]string, 0, len(contactIds))
+		for _, reply := range replies[1:] {
+			if reply == nil {
+				continue
+			}
+			contactAsJson, err := redis.String(reply, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			contactsAsJson = append(contactsAsJson, contactAsJson)
+		}
+		return values, contactsAsJson, nil
+	}
+
+	return nil, nil, ErrStoreContention
+}
+
+func (store *RedisUserStore) Save(user *User) error {
+	return store.save(user, "save")
+}
+
+func (store *RedisUserStore) Create(user *User) error {
+	return store.save(user, "create")
+}
+
+func (store *RedisUserStore) SaveProfile(user *User) error {
+	return store.save(user, "profile")
+}
+
+func (store *RedisUserStore) SavePassword(userId, password string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	_, err := redisSetUserFieldScript.Do(conn, getRedisUserKey(userId), "Password", password)
+	return mapRedisUserStoreError(err)
+}
+
+func (store *RedisUserStore) SetRoles(userId string, roles []string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	_, err := redisSetUserFieldScript.Do(conn, getRedisUserKey(userId), "Roles", strings.Join(roles, ","))
+	return mapRedisUserStoreError(err)
+}
+
+func (store *RedisUserStore) Delete(id string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	redisKey, contactsKey, apiTokensKey := getRedisUserKey(id), getRedisContactsKey(id), getRedisApiTokensKey(id)
+	grantsKey, sharedKey, groupsKey := getRedisGrantsKey(id), getRedisSharedKey(id), getRedisGroupsKey(id)
+	for attempt := 0; attempt < maxRedisTransactionAttempts; attempt++ {
+		// Everything we read to find the keys to delete is watched, so a concurrent change retries
+		if _, err := conn.Do("WATCH", redisKey, contactsKey, apiTokensKey, grantsKey, sharedKey, groupsKey); err != nil {
+			return err
+		}
+		keys, err := getRedisUserDeleteKeys(conn, id)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		conn.Send("MULTI")
+		if keys.EmailKey != "" {
+			conn.Send("DEL", keys.EmailKey)
+		}
+		for _, key := range keys.Keys {
+			conn.Send("DEL", key)
+		}
+		for _, granteeId := range keys.GranteeIds {
+			conn.Send("SREM", getRedisSharedKey(granteeId), id)
+		}
+		for _, ownerId := range keys.OwnerIds {
+			conn.Send("HDEL", getRedisGrantsKey(ownerId), id)
+		}
+		conn.Send("DEL", redisKey, contactsKey, apiTokensKey, grantsKey, sharedKey, groupsKey, getRedisGroupNamesKey(id))
+		conn.Send("SET", getRedisDeletedUserKey(id), 1)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			return nil
+		}
+	}
+
+	return ErrStoreContention
+}
+
+// Keys that reference the user, read by Delete under WATCH
+type redisUserDeleteKeys struct {
+	EmailKey   string   // Only if the index still points at the user
+	Keys       []string // Contact, API token and group keys
+	GranteeIds []string // Users the user has granted access to
+	OwnerIds   []string // Users who have granted the user access
+}
+
+func getRedisUserDeleteKeys(conn redis.Conn, id string) (*redisUserDeleteKeys, error) {
+	exists, err := redis.Bool(conn.Do("EXISTS", getRedisUserKey(id)))
+	if err != nil || !exists {
+		return nil, firstError(err, ErrUserNotFound)
+	}
+
+	keys := &redisUserDeleteKeys{}
+	emailKey, err := redis.String(conn.Do("HGET", getRedisUserKey(id), "EmailKey"))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	if emailKey != "" {
+		if _, err := conn.Do("WATCH", emailKey); err != nil {
+			return nil, err
+		}
+		ownerId, err := redis.String(conn.Do("GET", emailKey))
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		if ownerId == id {
+			keys.EmailKey = emailKey
+		}
+	}
+
+	contactIds, err := redis.Strings(conn.Do("ZRANGE", getRedisContactsKey(id), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	for _, contactId := range contactIds {
+		keys.Keys = append(keys.Keys, getRedisContactKey(id, contactId))
+	}
+	hashes, err := redis.Strings(conn.Do("HVALS", getRedisApiTokensKey(id)))
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range hashes {
+		keys.Keys = append(keys.Keys, getRedisApiTokenKey(hash))
+	}
+	groupIds, err := redis.Strings(conn.Do("HKEYS", getRedisGroupsKey(id)))
+	if err != nil {
+		return nil, err
+	}
+	for _, groupId := range groupIds {
+		keys.Keys = append(keys.Keys, getRedisGroupKey(id, groupId))
+	}
+
+	if keys.GranteeIds, err = redis.Strings(conn.Do("HKEYS", getRedisGrantsKey(id))); err != nil {
+		return nil, err
+	}
+	if keys.OwnerIds, err = redis.Strings(conn.Do("SMEMBERS", getRedisSharedKey(id))); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (store *RedisUserStore) GetContact(userId, contactId string) (*Contact, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	return getRedisContact(conn, getRedisContactKey(userId, contactId))
+}
+
+func (store *RedisUserStore) CreateApiToken(token *ApiToken) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	tokenAsJson, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	_, err = redisCreateApiTokenScript.Do(conn, getRedisUserKey(token.UserId), getRedisApiTokensKey(token.UserId), getRedisApiTokenKey(token.Hash), token.Id, token.Hash, tokenAsJson)
+	return mapRedisUserStoreError(err)
+}
+
+func (store *RedisUserStore) GetApiToken(hash string) (*ApiToken, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	tokenAsJson, err := redis.Bytes(conn.Do("GET", getRedisApiTokenKey(hash)))
+	if err == redis.ErrNil {
+		return nil, ErrApiTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var token ApiToken
+	if err = json.Unmarshal(tokenAsJson, &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (store *RedisUserStore) GetApiTokens(userId string) ([]ApiToken, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	if exists, err := redis.Bool(conn.Do("EXISTS", getRedisUserKey(userId))); err != nil || !exists {
+		return nil, firstError(err, ErrUserNotFound)
+	}
+
+	hashes, err := redis.Strings(conn.Do("HVALS", getRedisApiTokensKey(userId)))
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]ApiToken, 0, len(hashes))
+	if len(hashes) == 0 {
+		return tokens, nil
+	}
+
+	tokenKeys := make([]interface{}, len(hashes))
+	for index, hash := range hashes {
+		tokenKeys[index] = getRedisApiTokenKey(hash)
+	}
+	values, err := redis.ByteSlices(conn.Do("MGET", tokenKeys...))
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		var token ApiToken
+		if err = json.Unmarshal(value, &token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	sortApiTokens(tokens)
+
+	return tokens, nil
+}
+
+func (store *RedisUserStore) DeleteApiToken(userId, tokenId string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	apiTokensKey := getRedisApiTokensKey(userId)
+	for attempt := 0; attempt < maxRedisTransactionAttempts; attempt++ {
+		if _, err := conn.Do("WATCH", apiTokensKey); err != nil {
+			return err
+		}
+		hash, err := redis.String(conn.Do("HGET", apiTokensKey, tokenId))
+		if err != nil {
+			conn.Do("UNWATCH")
+			if err == redis.ErrNil {
+				return ErrApiTokenNotFound
+			}
+			return err
+		}
+
+		conn.Send("MULTI")
+		conn.Send("DEL", getRedisApiTokenKey(hash))
+		conn.Send("HDEL", apiTokensKey, tokenId)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			return nil
+		}
+	}
+
+	return ErrStoreContention
+}
+
+/*
+Contact saves and deletes are compare and swap using WATCH\MULTI, new contacts are added after the current last contact
+Only the contact's key is watched, and the contacts index when adding, so changes to the user or other contacts do not
+cause retries, if a watched key changes before EXEC we re-read and re-check, so a concurrent change to the same contact
+becomes a version conflict, or ErrStoreContention for writes without an expected version once we run out of attempts
+*/
+func (store *RedisUserStore) SaveContact(userId string, contact *Contact, expectedVersion int64) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	redisKey, contactsKey, contactKey := getRedisUserKey(userId), getRedisContactsKey(userId), getRedisContactKey(userId, contact.Id)
+	for attempt := 0; attempt < maxRedisTransactionAttempts; attempt++ {
+		if _, err := conn.Do("WATCH", contactKey); err != nil {
+			return err
+		}
+
+		exists, err := redis.Bool(conn.Do("EXISTS", redisKey))
+		if err != nil || !exists {
+			conn.Do("UNWATCH")
+			return firstError(err, ErrUserNotFound)
+		}
+
+		current, err := getRedisContact(conn, contactKey)
+		if err != nil && err != ErrContactNotFound {
+			conn.Do("UNWATCH")
+			return err
+		}
+		if !isExpectedContactVersion(current, expectedVersion) {
+			conn.Do("UNWATCH")
+			return ErrVersionConflict
+		}
+
+		score := float64(0)
+		if current == nil {
+			// Watched before reading the last score so a concurrent add cannot take the same score
+			if _, err := conn.Do("WATCH", contactsKey); err != nil {
+				return err
+			}
+			last, err := redis.Strings(conn.Do("ZREVRANGE", contactsKey, 0, 0, "WITHSCORES"))
+			if err != nil {
+				conn.Do("UNWATCH")
+				return err
+			}
+			score = 1
+			if len(last) == 2 {
+				lastScore, err := strconv.ParseFloat(last[1], 64)
+				if err != nil {
+					conn.Do("UNWATCH")
+					return err
+				}
+				score = lastScore + 1
+			}
+		}
+
+		contactCopy := *contact
+		contactCopy.Version = getNextContactVersion(current)
+		contactCopy.Incarnation = getContactIncarnation(current)
+		contactCopy.MergedIds = getStoredMergedIds(current)
+		contactAsJson, err := json.Marshal(&contactCopy)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		conn.Send("MULTI")
+		if score > 0 {
+			conn.Send("ZADD", contactsKey, score, contact.Id)
+		}
+		conn.Send("SET", contactKey, contactAsJson)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			contact.Version = contactCopy.Version
+			contact.Incarnation = contactCopy.Incarnation
+			contact.MergedIds = contactCopy.MergedIds
+			return nil
+		}
+	}
+
+	return getRedisRetriesExhaustedError(expectedVersion)
+}
+
+// Running out of attempts is only a version conflict if the caller expected a version, otherwise the write can be retried
+func getRedisRetriesExhaustedError(expectedVersion int64) error {
+	if expectedVersion == AnyContactVersion {
+		return ErrStoreContention
+	}
+
+	return ErrVersionConflict
+}
+
+/*
+Bulk save in a single MULTI\EXEC, existing contacts are replaced and new contacts added after the current last contact
+The contacts index and contact keys are watched so a concurrent change to any of them causes a retry with fresh versions
+*/
+func (store *RedisUserStore) SaveContacts(userId string, contacts []Contact) error {
+	if len(contacts) == 0 {
+		return nil
+	}
+
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	redisKey, contactsKey := getRedisUserKey(userId), getRedisContactsKey(userId)
+	contactKeys := make([]interface{}, len(contacts))
+	for index := range contacts {
+		contactKeys[index] = getRedisContactKey(userId, contacts[index].Id)
+	}
+
+	for attempt := 0; attempt < maxRedisTransactionAttempts; attempt++ {
+		if _, err := conn.Do("WATCH", append([]interface{}{contactsKey}, contactKeys...)...); err != nil {
+			return err
+		}
+
+		currentContacts, lastScore, err := getRedisCurrentContacts(conn, contactsKey, contactKeys)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		if exists, err := redis.Bool(conn.Do("EXISTS", redisKey)); err != nil || !exists {
+			conn.Do("UNWATCH")
+			return firstError(err, ErrUserNotFound)
+		}
+
+		// Current contacts are tracked by id as the same contact may appear more than once, last one wins
+		savedContacts := make([]Contact, len(contacts))
+		conn.Send("MULTI")
+		for index := range contacts {
+			current := currentContacts[contacts[index].Id]
+			contactCopy := contacts[index]
+			contactCopy.Version = getNextContactVersion(current)
+			contactCopy.Incarnation = getContactIncarnation(current)
+			contactCopy.MergedIds = getStoredMergedIds(current)
+			savedContacts[index] = contactCopy
+			currentContacts[contactCopy.Id] = &savedContacts[index]
+
+			contactAsJson, err := json.Marshal(&contactCopy)
+			if err != nil {
+				conn.Do("DISCARD")
+				return err
+			}
+			if current == nil {
+				lastScore++
+				conn.Send("ZADD", contactsKey, lastScore, contactCopy.Id)
+			}
+			conn.Send("SET", contactKeys[index], contactAsJson)
+		}
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			for index := range contacts {
+				contacts[index].Version = savedContacts[index].Version
+				contacts[index].Incarnation = savedContacts[index].Incarnation
+				contacts[index].MergedIds = savedContacts[index].MergedIds
+			}
+			return nil
+		}
+	}
+
+	return ErrStoreContention
+}
+
+// Current contacts by id for the contacts that exist and the last contact's score
+func getRedisCurrentContacts(conn redis.Conn, contactsKey string, contactKeys []interface{}) (map[string]*Contact, float64, error) {
+	values, err := redis.ByteSlices(conn.Do("MGET", contactKeys...))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	contacts := make(map[string]*Contact)
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		var contact Contact
+		if err = json.Unmarshal(value, &contact); err != nil {
+			return nil, 0, err
+		}
+		contacts[contact.Id] = &contact
+	}
+
+	last, err := redis.Strings(conn.Do("ZREVRANGE", contactsKey, 0, 0, "WITHSCORES"))
+	if err != nil {
+		return nil, 0, err
+	}
+	lastScore := float64(0)
+	if len(last) == 2 {
+		if lastScore, err = strconv.ParseFloat(last[1], 64); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return contacts, lastScore, nil
+}
+
+func (store *RedisUserStore) DeleteContact(userId, contactId string, expectedVersion int64) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	contactsKey, contactKey, groupsKey := getRedisContactsKey(userId), getRedisContactKey(userId, contactId), getRedisGroupsKey(userId)
+	for attempt := 0; attempt < maxRedisTransactionAttempts; attempt++ {
+		if _, err := conn.Do("WATCH", contactKey, groupsKey); err != nil {
+			return err
+		}
+
+		current, err := getRedisContact(conn, contactKey)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		if !isExpectedContactVersion(current, expectedVersion) {
+			conn.Do("UNWATCH")
+			return ErrVersionConflict
+		}
+		groupIds, err := redis.Strings(conn.Do("HKEYS", groupsKey))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		conn.Send("MULTI")
+		conn.Send("ZREM", contactsKey, contactId)
+		conn.Send("DEL", contactKey)
+		for _, groupId := range groupIds {
+			conn.Send("SREM", getRedisGroupKey(userId, groupId), contactId)
+		}
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			return nil
+		}
+	}
+
+	return getRedisRetriesExhaustedError(expectedVersion)
+}
+
+// See MergeContacts on the in memory store, the contact keys and group sets are watched so a concurrent change retries
+func (store *RedisUserStore) MergeContacts(userId string, contact *Contact, expectedVersions map[string]int64) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	contactsKey, groupsKey := getRedisContactsKey(userId), getRedisGroupsKey(userId)
+	watchKeys := []interface{}{contactsKey, groupsKey, getRedisContactKey(userId, contact.Id)}
+	for contactId := range expectedVersions {
+		watchKeys = append(watchKeys, getRedisContactKey(userId, contactId))
+	}
+
+	for attempt := 0; attempt < maxRedisTransactionAttempts; attempt++ {
+		if _, err := conn.Do("WATCH", watchKeys...); err != nil {
+			return err
+		}
+
+		var current *Contact
+		for contactId, expectedVersion := range expectedVersions {
+			existing, err := getRedisContact(conn, getRedisContactKey(userId, contactId))
+			if err != nil {
+				conn.Do("UNWATCH")
+				return err
+			}
+			if !isExpectedContactVersion(existing, expectedVersion) {
+				conn.Do("UNWATCH")
+				return ErrVersionConflict
+			}
+			if contactId == contact.Id {
+				current = existing
+			}
+		}
+		if current == nil {
+			var err error
+			if current, err = getRedisContact(conn, getRedisContactKey(userId, contact.Id)); err != nil {
+				conn.Do("UNWATCH")
+				return err
+			}
+		}
+
+		groupIds, err := redis.Strings(conn.Do("HKEYS", groupsKey))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		mergedGroupKeys := make([]string, 0)
+		for _, groupId := range groupIds {
+			groupKey := getRedisGroupKey(userId, groupId)
+			if _, err := conn.Do("WATCH", groupKey); err != nil {
+				return err
+			}
+			contactIds, err := redis.Strings(conn.Do("SMEMBERS", groupKey))
+			if err != nil {
+				conn.Do("UNWATCH")
+				return err
+			}
+			for _, contactId := range contactIds {
+				if _, merged := expectedVersions[contactId]; merged && contactId != contact.Id {
+					mergedGroupKeys = append(mergedGroupKeys, groupKey)
+					break
+				}
+			}
+		}
+
+		contactCopy := *contact
+		contactCopy.Version = getNextContactVersion(current)
+		contactCopy.Incarnation = getContactIncarnation(current)
+		contactAsJson, err := json.Marshal(&contactCopy)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		conn.Send("MULTI")
+		conn.Send("SET", getRedisContactKey(userId, contact.Id), contactAsJson)
+		for contactId := range expectedVersions {
+			if contactId == contact.Id {
+				continue
+			}
+			conn.Send("ZREM", contactsKey, contactId)
+			conn.Send("DEL", getRedisContactKey(userId, contactId))
+			for _, groupId := range groupIds {
+				conn.Send("SREM", getRedisGroupKey(userId, groupId), contactId)
+			}
+		}
+		for _, groupKey := range mergedGroupKeys {
+			conn.Send("SADD", groupKey, contact.Id)
+		}
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			contact.Version = contactCopy.Version
+			contact.Incarnation = contactCopy.Incarnation
+			return nil
+		}
+	}
+
+	return ErrVersionConflict
+}
+
+func getRedisContact(conn redis.Conn, contactKey string) (*Contact, error) {
+	contactAsJson, err := redis.Bytes(conn.Do("GET", contactKey))
+	if err == redis.ErrNil {
+		return nil, ErrContactNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var contact Contact
+	if err = json.Unmarshal(contactAsJson, &contact); err != nil {
+		return nil, err
+	}
+
+	return &contact, nil
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Migrates all legacy user hashes, returns the number of users migrated
+func (store *RedisUserStore) Migrate() (int, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	migrated, cursor := 0, 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "user:*", "COUNT", 100))
+		if err != nil {
+			return migrated, err
+		}
+		if cursor, err = redis.Int(reply[0], nil); err != nil {
+			return migrated, err
+		}
+		keys, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return migrated, err
+		}
+
+		for _, key := range keys {
+			id := strings.TrimPrefix(key, "user:")
+			if strings.Contains(id, ":") {
+				// Contacts index or contact key
+				continue
+			}
+
+			isLegacy, err := redis.Bool(conn.Do("HEXISTS", key, "ContactsAsJson"))
+			if err != nil {
+				return migrated, err
+			}
+			// Users saved before the email index have no EmailKey
+			isIndexed, err := redis.Bool(conn.Do("HEXISTS", key, "EmailKey"))
+			if err != nil {
+				return migrated, err
+			}
+			if !isLegacy && isIndexed {
+				continue
+			}
+
+			if isLegacy {
+				if err = store.migrateUser(conn, id); err != nil {
+					return migrated, err
+				}
+			}
+			if !isIndexed {
+				if err = store.migrateUserEmail(conn, id); err != nil {
+					return migrated, err
+				}
+			}
+			migrated++
+		}
+
+		if cursor == 0 {
+			return migrated, nil
+		}
+	}
+}
+
+// Moves the legacy ContactsAsJson field into per contact keys, uses WATCH so a concurrent migration or write is not lost
+func (store *RedisUserStore) migrateUser(conn redis.Conn, id string) error {
+	redisKey, contactsKey := getRedisUserKey(id), getRedisContactsKey(id)
+
+	for attempt := 0; attempt < maxRedisTransactionAttempts; attempt++ {
+		if _, err := conn.Do("WATCH", redisKey, contactsKey); err != nil {
+			return err
+		}
+
+		contactsAsJson, err := redis.Bytes(conn.Do("HGET", redisKey, "ContactsAsJson"))
+		if err == redis.ErrNil {
+			// Already migrated
+			_, err = conn.Do("UNWATCH")
+			return err
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		var contacts []Contact
+		if len(contactsAsJson) > 0 {
+			if err = json.Unmarshal(contactsAsJson, &contacts); err != nil {
+				conn.Do("UNWATCH")
+				return fmt.Errorf("Unable to migrate contacts for [%s] : %s", redisKey, err)
+			}
+		}
+
+		conn.Send("MULTI")
+		for index := range contacts {
+			contactAsJson, err := json.Marshal(&contacts[index])
+			if err != nil {
+				conn.Do("DISCARD")
+				return err
+			}
+			conn.Send("ZADD", contactsKey, "NX", index+1, contacts[index].Id)
+			conn.Send("SET", getRedisContactKey(id, contacts[index].Id), contactAsJson)
+		}
+		conn.Send("HDEL", redisKey, "ContactsAsJson")
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			log.Printf("Migrated %d contact(s) for [%s]\n", len(contacts), redisKey)
+			return nil
+		}
+		// Watched keys changed, try again
+	}
+
+	return fmt.Errorf("Unable to migrate contacts for [%s], too many concurrent changes", redisKey)
+}
+
+/*
+Adds the user's useremail:<email> index entry and records it in EmailKey, as save does, so the duplicate email checks
+see users saved before the index existed
+If another user already owns the email the entry is left to them, this user keeps an empty EmailKey and a warning is
+logged, saving this user's profile then needs a different email
+*/
+func (store *RedisUserStore) migrateUserEmail(conn redis.Conn, id string) error {
+	redisKey := getRedisUserKey(id)
+
+	for attempt := 0; attempt < maxRedisTransactionAttempts; attempt++ {
+		if _, err := conn.Do("WATCH", redisKey); err != nil {
+			return err
+		}
+
+		values, err := redis.Values(conn.Do("HMGET", redisKey, "Email", "EmailKey"))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		if values[1] != nil {
+			// Already indexed
+			_, err = conn.Do("UNWATCH")
+			return err
+		}
+		email, _ := redis.String(values[0], nil)
+
+		emailKey := ""
+		if email = normaliseEmailForIndex(email); email != "" {
+			emailKey = "useremail:" + email
+			if _, err := conn.Do("WATCH", emailKey); err != nil {
+				return err
+			}
+			ownerId, err := redis.String(conn.Do("GET", emailKey))
+			if err != nil && err != redis.ErrNil {
+				conn.Do("UNWATCH")
+				return err
+			}
+			if ownerId != "" && ownerId != id {
+				log.Printf("Warning: email for [%s] is already used by [%s], not indexed\n", redisKey, ownerId)
+				emailKey = ""
+			}
+		}
+
+		conn.Send("MULTI")
+		if emailKey != "" {
+			conn.Send("SET", emailKey, id)
+		}
+		conn.Send("HSET", redisKey, "EmailKey", emailKey)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			return nil
+		}
+		// Watched keys changed, try again
+	}
+
+	return fmt.Errorf("Unable to index email for [%s], too many concurrent changes", redisKey)
+}
+
+func (store *RedisUserStore) SaveGrant(grant *Grant) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	grantAsJson, err := json.Marshal(grant)
+	if err != nil {
+		return err
+	}
+
+	_, err = redisSaveGrantScript.Do(conn, getRedisUserKey(grant.OwnerId), getRedisUserKey(grant.GranteeId), getRedisGrantsKey(grant.OwnerId), getRedisSharedKey(grant.GranteeId), grant.OwnerId, grant.GranteeId, grantAsJson)
+	return mapRedisUserStoreError(err)
+}
+
+func (store *RedisUserStore) GetGrant(ownerId, granteeId string) (*Grant, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	grantAsJson, err := redis.Bytes(conn.Do("HGET", getRedisGrantsKey(ownerId), granteeId))
+	if err == redis.ErrNil {
+		return nil, ErrGrantNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var grant Grant
+	if err = json.Unmarshal(grantAsJson, &grant); err != nil {
+		return nil, err
+	}
+
+	return &grant, nil
+}
+
+func (store *RedisUserStore) GetGrants(ownerId string) ([]Grant, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	if exists, err := redis.Bool(conn.Do("EXISTS", getRedisUserKey(ownerId))); err != nil || !exists {
+		return nil, firstError(err, ErrUserNotFound)
+	}
+
+	values, err := redis.ByteSlices(conn.Do("HVALS", getRedisGrantsKey(ownerId)))
+	if err != nil {
+		return nil, err
+	}
+
+	grants, err := unmarshalRedisGrants(values)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].GranteeId < grants[j].GranteeId })
+
+	return grants, nil
+}
+
+func (store *RedisUserStore) GetSharedGrants(granteeId string) ([]Grant, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	if exists, err := redis.Bool(conn.Do("EXISTS", getRedisUserKey(granteeId))); err != nil || !exists {
+		return nil, firstError(err, ErrUserNotFound)
+	}
+
+	ownerIds, err := redis.Strings(conn.Do("SMEMBERS", getRedisSharedKey(granteeId)))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, 0, len(ownerIds))
+	for _, ownerId := range ownerIds {
+		value, err := redis.Bytes(conn.Do("HGET", getRedisGrantsKey(ownerId), granteeId))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	grants, err := unmarshalRedisGrants(values)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].OwnerId < grants[j].OwnerId })
+
+	return grants, nil
+}
+
+func (store *RedisUserStore) DeleteGrant(ownerId, granteeId string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	_, err := redisDeleteGrantScript.Do(conn, getRedisGrantsKey(ownerId), getRedisSharedKey(granteeId), ownerId, granteeId)
+	return mapRedisUserStoreError(err)
+}
+
+func unmarshalRedisGrants(values [][]byte) ([]Grant, error) {
+	grants := make([]Grant, 0, len(values))
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		var grant Grant
+		if err := json.Unmarshal(value, &grant); err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+
+	return grants, nil
+}
+
+func (store *RedisUserStore) CreateGroup(userId string, group *Group) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	groupAsJson, err := json.Marshal(&Group{Id: group.Id, Name: group.Name})
+	if err != nil {
+		return err
+	}
+
+	_, err = redisCreateGroupScript.Do(conn, getRedisUserKey(userId), getRedisGroupsKey(userId), getRedisGroupNamesKey(userId), group.Id, strings.ToLower(group.Name), groupAsJson)
+	return mapRedisUserStoreError(err)
+}
+
+func (store *RedisUserStore) GetGroup(userId, groupId string) (*Group, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	groupAsJson, err := redis.Bytes(conn.Do("HGET", getRedisGroupsKey(userId), groupId))
+	if err == redis.ErrNil {
+		return nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return getRedisGroup(conn, userId, groupAsJson)
+}
+
+func (store *RedisUserStore) GetGroups(userId string) ([]Group, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	if exists, err := redis.Bool(conn.Do("EXISTS", getRedisUserKey(userId))); err != nil || !exists {
+		return nil, firstError(err, ErrUserNotFound)
+	}
+
+	values, err := redis.ByteSlices(conn.Do("HVALS", getRedisGroupsKey(userId)))
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]Group, 0, len(values))
+	for _, value := range values {
+		group, err := getRedisGroup(conn, userId, value)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, *group)
+	}
+	sortGroups(groups)
+
+	return groups, nil
+}
+
+func (store *RedisUserStore) RenameGroup(userId, groupId, name string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	groupAsJson, err := json.Marshal(&Group{Id: groupId, Name: name})
+	if err != nil {
+		return err
+	}
+
+	_, err = redisRenameGroupScript.Do(conn, getRedisGroupsKey(userId), getRedisGroupNamesKey(userId), groupId, strings.ToLower(name), groupAsJson)
+	return mapRedisUserStoreError(err)
+}
+
+func (store *RedisUserStore) DeleteGroup(userId, groupId string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	_, err := redisDeleteGroupScript.Do(conn, getRedisGroupsKey(userId), getRedisGroupNamesKey(userId), getRedisGroupKey(userId, groupId), groupId)
+	return mapRedisUserStoreError(err)
+}
+
+func (store *RedisUserStore) AddGroupContact(userId, groupId, contactId string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	_, err := redisAddGroupContactScript.Do(conn, getRedisGroupsKey(userId), getRedisContactsKey(userId), getRedisGroupKey(userId, groupId), groupId, contactId)
+	return mapRedisUserStoreError(err)
+}
+
+func (store *RedisUserStore) RemoveGroupContact(userId, groupId, contactId string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	_, err := redisRemoveGroupContactScript.Do(conn, getRedisGroupsKey(userId), getRedisGroupKey(userId, groupId), groupId, contactId)
+	return mapRedisUserStoreError(err)
+}
+
+// Decodes the group json and adds the group's contact ids
+func getRedisGroup(conn redis.Conn, userId string, groupAsJson []byte) (*Group, error) {
+	var group Group
+	if err := json.Unmarshal(groupAsJson, &group); err != nil {
+		return nil, err
+	}
+
+	contactIds, err := redis.Strings(conn.Do("SMEMBERS", getRedisGroupKey(userId, group.Id)))
+	if err != nil {
+		return nil, err
+	}
+	if len(contactIds) > 0 {
+		sort.Strings(contactIds)
+		group.ContactIds = contactIds
+	}
+
+	return &group, nil
+}
+
+func (store *RedisUserStore) save(user *User, mode string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	emailKey := ""
+	if email := normaliseEmailForIndex(user.Email); email != "" {
+		emailKey = "useremail:" + email
+	}
+
+	fields := []interface{}{
+		"FirstName", user.FirstName,
+		"LastName", user.LastName,
+		"Email", user.Email,
+	}
+	// Profile saves leave the password and roles as they are, see SavePassword and SetRoles
+	if mode != "profile" {
+		fields = append(fields, "Password", user.Password, "Roles", strings.Join(user.Roles, ","))
+	}
+
+	contactsAndJson := make([]interface{}, 0, 2*len(user.Contacts))
+	if mode != "profile" {
+		for index := range user.Contacts {
+			contactAsJson, err := json.Marshal(&user.Contacts[index])
+			if err != nil {
+				return err
+			}
+			contactsAndJson = append(contactsAndJson, user.Contacts[index].Id, contactAsJson)
+		}
+	}
+
+	redisKey, contactsKey, groupsKey := getRedisUserKey(user.Id), getRedisContactsKey(user.Id), getRedisGroupsKey(user.Id)
+	for attempt := 0; attempt < maxRedisTransactionAttempts; attempt++ {
+		// The old email key, contact ids and group ids give the script's other keys, see redisSaveUserScript
+		if _, err := conn.Do("WATCH", redisKey, contactsKey, groupsKey); err != nil {
+			return err
+		}
+		if mode == "create" {
+			if err := checkRedisUserIdNotDeleted(conn, user.Id); err != nil {
+				conn.Do("UNWATCH")
+				return err
+			}
+		}
+		oldEmailKey, err := redis.String(conn.Do("HGET", redisKey, "EmailKey"))
+		if err != nil && err != redis.ErrNil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		var oldContactKeys, groupKeys []interface{}
+		if mode != "profile" {
+			if oldContactKeys, groupKeys, err = getRedisUserSaveKeys(conn, user.Id); err != nil {
+				conn.Do("UNWATCH")
+				return err
+			}
+		}
+
+		keys := []interface{}{redisKey, emailKey, contactsKey, oldEmailKey}
+		keys = append(keys, oldContactKeys...)
+		keys = append(keys, groupKeys...)
+		for index := 0; index < len(contactsAndJson); index += 2 {
+			keys = append(keys, getRedisContactKey(user.Id, contactsAndJson[index].(string)))
+		}
+		args := append([]interface{}{len(keys)}, keys...)
+		args = append(args, mode, user.Id, len(fields), len(oldContactKeys), len(groupKeys))
+		args = append(args, fields...)
+		args = append(args, contactsAndJson...)
+
+		_, ok, err := doRedisWatchedScript(conn, redisSaveUserScript, args...)
+		if err != nil || ok {
+			return mapRedisUserStoreError(err)
+		}
+	}
+
+	return ErrStoreContention
+}
+
+// Watched so a delete that completes first is seen
+func checkRedisUserIdNotDeleted(conn redis.Conn, id string) error {
+	deletedKey := getRedisDeletedUserKey(id)
+	if _, err := conn.Do("WATCH", deletedKey); err != nil {
+		return err
+	}
+	deleted, err := redis.Bool(conn.Do("EXISTS", deletedKey))
+	if err != nil || deleted {
+		return firstError(err, ErrDuplicateUserId)
+	}
+
+	return nil
+}
+
+func getRedisUserSaveKeys(conn redis.Conn, userId string) (oldContactKeys, groupKeys []interface{}, err error) {
+	contactIds, err := redis.Strings(conn.Do("ZRANGE", getRedisContactsKey(userId), 0, -1))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, contactId := range contactIds {
+		oldContactKeys = append(oldContactKeys, getRedisContactKey(userId, contactId))
+	}
+
+	groupIds, err := redis.Strings(conn.Do("HKEYS", getRedisGroupsKey(userId)))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, groupId := range groupIds {
+		groupKeys = append(groupKeys, getRedisGroupKey(userId, groupId))
+	}
+
+	return oldContactKeys, groupKeys, nil
+}
+
+func mapRedisUserStoreError(err error) error {
+	if redisErr, ok := err.(redis.Error); ok {
+		switch string(redisErr) {
+		case "DUPLICATEID":
+			return ErrDuplicateUserId
+		case "DUPLICATEEMAIL":
+			return ErrDuplicateEmail
+		case "NOTFOUND":
+			return ErrUserNotFound
+		case "TOKENNOTFOUND":
+			return ErrApiTokenNotFound
+		case "GRANTNOTFOUND":
+			return ErrGrantNotFound
+		case "GROUPNOTFOUND":
+			return ErrGroupNotFound
+		case "DUPLICATEGROUPNAME":
+			return ErrDuplicateGroupName
+		case "CONTACTNOTFOUND":
+			return ErrContactNotFound
+		}
+	}
+
+	return err
+}
+
+func NewRedisUserStore(pool *redis.Pool) *RedisUserStore {
+	return &RedisUserStore{pool: pool}
+}
+
+/*
+In memory login attempt store
+*/
+type InMemoryLoginAttemptStore struct {
+	mutex     *sync.Mutex
+	data      map[string]*inMemoryLoginAttempts
+	stopPurge chan struct{}
+	closeOnce sync.Once
+}
+
+type inMemoryLoginAttempts struct {
+	LoginAttempts
+	expires time.Time
+}
+
+func (store *InMemoryLoginAttemptStore) GetLoginAttempts(key string) (*LoginAttempts, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	attempts, ok := store.data[key]
+	if !ok || !attempts.expires.After(time.Now()) {
+		return &LoginAttempts{}, nil
+	}
+
+	result := attempts.LoginAttempts
+	return &result, nil
+}
+
+func (store *InMemoryLoginAttemptStore) ReserveLoginAttempt(limits []LoginAttemptLimit, backoff LoginBackoff) (time.Duration, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	wait := time.Duration(0)
+	for _, limit := range limits {
+		if attempts, ok := store.data[limit.Key]; ok && attempts.expires.After(now) {
+			if limitWait := getLoginAttemptWait(&attempts.LoginAttempts, limit.FreeAttempts, backoff, now); limitWait > wait {
+				wait = limitWait
+			}
+		}
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+
+	for _, limit := range limits {
+		attempts, ok := store.data[limit.Key]
+		if !ok || !attempts.expires.After(now) {
+			attempts = &inMemoryLoginAttempts{}
+			store.data[limit.Key] = attempts
+		}
+		attempts.Failures++
+		attempts.LastFailure = now
+		attempts.expires = now.Add(backoff.ResetAfter)
+	}
+
+	return 0, nil
+}
+
+func (store *InMemoryLoginAttemptStore) ReleaseLoginAttempt(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	attempts, ok := store.data[key]
+	if !ok {
+		return nil
+	}
+	if attempts.Failures <= 1 {
+		delete(store.data, key)
+		return nil
+	}
+	attempts.Failures--
+
+	return nil
+}
+
+func (store *InMemoryLoginAttemptStore) ResetLoginAttempts(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.data, key)
+
+	return nil
+}
+
+func (store *InMemoryLoginAttemptStore) Purge() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	for key, attempts := range store.data {
+		if !attempts.expires.After(now) {
+			delete(store.data, key)
+		}
+	}
+}
+
+func NewInMemoryLoginAttemptStore(purgeInterval uint) *InMemoryLoginAttemptStore {
+	store := &InMemoryLoginAttemptStore{
+		mutex:     new(sync.Mutex),
+		data:      make(map[string]*inMemoryLoginAttempts),
+		stopPurge: make(chan struct{}),
+	}
+	go store.purgePeriodically(time.Duration(purgeInterval) * time.Second)
+
+	return store
+}
+
+func (store *InMemoryLoginAttemptStore) purgePeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			store.Purge()
+		case <-store.stopPurge:
+			return
+		}
+	}
+}
+
+// Stops purging, safe to call more than once
+func (store *InMemoryLoginAttemptStore) Close() {
+	store.closeOnce.Do(func() {
+		close(store.stopPurge)
+	})
+}
+
+/*
+Redis login attempt store - a hash per key with the failure count and the last failure time in unix nanoseconds
+*/
+type RedisLoginAttemptStore struct {
+	pool *redis.Pool
+}
+
+/*
+Redis login attempt reserve script - the wait is worked out as LoginBackoff.GetDelay does, in milliseconds
+KEYS login attempts keys, ARGV[1] attempt time in unix nanoseconds, ARGV[2] base delay, ARGV[3] max delay and ARGV[4]
+ttl in milliseconds, ARGV[5...] free attempts for each key
+Returns 0 when the attempt is reserved, otherwise the wait in milliseconds
+*/
+var redisReserveLoginAttemptScript = newRedisScript(-1, `
+local now, baseDelay, maxDelay = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local wait = 0
+for index = 1, #KEYS do
+  local attempts = redis.call("HMGET", KEYS[index], "Failures", "LastFailure")
+  local failures, freeAttempts = tonumber(attempts[1]) or 0, tonumber(ARGV[4 + index])
+  if failures >= freeAttempts then
+    local delay = baseDelay
+    for doublings = failures - freeAttempts, 1, -1 do
+      if delay >= maxDelay then
+        break
+      end
+      delay = delay * 2
+    end
+    delay = math.min(delay, maxDelay)
+    wait = math.max(wait, delay - (now - tonumber(attempts[2])) / 1000000)
+  end
+end
+if wait > 0 then
+  return math.ceil(wait)
+end
+for index = 1, #KEYS do
+  redis.call("HINCRBY", KEYS[index], "Failures", 1)
+  redis.call("HSET", KEYS[index], "LastFailure", ARGV[1])
+  redis.call("PEXPIRE", KEYS[index], ARGV[4])
+end
+return 0
+`)
+
+/*
+Redis login attempt release script
+KEYS[1] login attempts key
+*/
+var redisReleaseLoginAttemptScript = newRedisScript(1, `
+local failures = tonumber(redis.call("HGET", KEYS[1], "Failures") or "0")
+if failures <= 1 then
+  redis.call("DEL", KEYS[1])
+else
+  redis.call("HINCRBY", KEYS[1], "Failures", -1)
+end
+return "OK"
+`)
+
+func (store *RedisLoginAttemptStore) GetLoginAttempts(key string) (*LoginAttempts, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.Strings(conn.Do("HMGET", getRedisLoginAttemptsKey(key), "Failures", "LastFailure"))
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := &LoginAttempts{}
+	if reply[0] == "" {
+		return attempts, nil
+	}
+	if attempts.Failures, err = strconv.Atoi(reply[0]); err != nil {
+		return nil, err
+	}
+	lastFailure, err := strconv.ParseInt(reply[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	attempts.LastFailure = time.Unix(0, lastFailure)
+
+	return attempts, nil
+}
+
+func (store *RedisLoginAttemptStore) ReserveLoginAttempt(limits []LoginAttemptLimit, backoff LoginBackoff) (time.Duration, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	args := []interface{}{len(limits)}
+	for _, limit := range limits {
+		args = append(args, getRedisLoginAttemptsKey(limit.Key))
+	}
+	args = append(args, time.Now().UnixNano(), int64(backoff.BaseDelay/time.Millisecond), int64(backoff.MaxDelay/time.Millisecond), int64(backoff.ResetAfter/time.Millisecond))
+	for _, limit := range limits {
+		args = append(args, limit.FreeAttempts)
+	}
+
+	waitInMilliseconds, err := redis.Int64(redisReserveLoginAttemptScript.Do(conn, args...))
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(waitInMilliseconds) * time.Millisecond, nil
+}
+
+func (store *RedisLoginAttemptStore) ReleaseLoginAttempt(key string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	_, err := redisReleaseLoginAttemptScript.Do(conn, getRedisLoginAttemptsKey(key))
+
+	return err
+}
+
+func (store *RedisLoginAttemptStore) ResetLoginAttempts(key string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", getRedisLoginAttemptsKey(key))
+
+	return err
+}
+
+func getRedisLoginAttemptsKey(key string) string {
+	return "loginattempts:" + key
+}
+
+func NewRedisLoginAttemptStore(pool *redis.Pool) *RedisLoginAttemptStore {
+	return &RedisLoginAttemptStore{pool: pool}
 }
 
 /*
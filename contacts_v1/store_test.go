@@ -1,11 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"reflect"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 func init() {
@@ -16,6 +21,22 @@ func isRedisRunning() bool {
 	return IsProcessRunning("redis-server")
 }
 
+// Deleted user ids cannot be created again, tests reuse ids so clear them first
+func clearRedisDeletedUserIds(t *testing.T, pool *redis.Pool) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("KEYS", getRedisDeletedUserKey("*")))
+	for _, key := range keys {
+		if err == nil {
+			_, err = conn.Do("DEL", key)
+		}
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error clearing deleted user ids : %s", err)
+	}
+}
+
 func TestRoundTripInMemorySessionStore(t *testing.T) {
 	age, purgeInterval := uint(1), uint(1)
 	store := NewInMemorySessionStore(age, purgeInterval)
@@ -30,6 +51,30 @@ func TestInMemorySessionStoreRecordNotFound(t *testing.T) {
 	RunSessionStoreRecordNotFoundTest(t, store)
 }
 
+func TestInMemorySessionStoreCloseStopsPurging(t *testing.T) {
+	spec := &Spec{t}
+	age, purgeInterval := uint(1), uint(1)
+	store := NewInMemorySessionStore(age, purgeInterval)
+
+	err := store.Save(&Session{Id: "expires", UserName: "ted"})
+	spec.Assert(err == nil, "Save failed : %s", err)
+
+	store.Close()
+	store.Close() // Must be safe to call more than once
+
+	// Would have been purged by now if purging was still running
+	time.Sleep(time.Duration(age+purgeInterval)*time.Second + 500*time.Millisecond)
+	_, err = store.Get("expires")
+	spec.Assert(err == nil, "Session was purged after Close")
+}
+
+func TestInMemorySessionStoreDelete(t *testing.T) {
+	age, purgeInterval := uint(1), uint(1)
+	store := NewInMemorySessionStore(age, purgeInterval)
+
+	RunSessionStoreDeleteTest(t, store)
+}
+
 func TestRoundTripRedisSessionStore(t *testing.T) {
 	if !isRedisRunning() {
 		t.Skip("No redis instance running")
@@ -60,6 +105,21 @@ func TestRedisSessionStoreRecordNotFound(t *testing.T) {
 	RunSessionStoreRecordNotFoundTest(t, store)
 }
 
+func TestRedisSessionStoreDelete(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+
+	age := uint(15)
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	store := NewRedisSessionStore(pool, age)
+
+	RunSessionStoreDeleteTest(t, store)
+}
+
 func TestRoundTripInMemoryUserStore(t *testing.T) {
 	store := NewInMemoryUserStore()
 
@@ -72,6 +132,59 @@ func TestInMemoryUserStoreRecordNotFound(t *testing.T) {
 	RunUserStoreRecordNotFoundTest(t, store)
 }
 
+func RunSessionRevocationStoreTest(t *testing.T, store SessionRevocationStore) {
+	spec := &Spec{t}
+
+	id := Uuid()
+	revoked, err := store.IsRevoked(id)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(!revoked, "Session %s should not be revoked", id)
+
+	err = store.Revoke(id, 60)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	revoked, err = store.IsRevoked(id)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(revoked, "Session %s should be revoked", id)
+}
+
+func TestInMemorySessionRevocationStore(t *testing.T) {
+	store := NewInMemorySessionRevocationStore(60)
+	defer store.Close()
+
+	RunSessionRevocationStoreTest(t, store)
+
+	// Forgotten once the cookie would have expired
+	store.Revoke("s1", 0)
+	revoked, _ := store.IsRevoked("s1")
+	(&Spec{t}).Assert(!revoked, "Revocation should have expired")
+}
+
+func TestRedisSessionRevocationStore(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	RunSessionRevocationStoreTest(t, NewRedisSessionRevocationStore(pool))
+}
+
+// Redis only guarantees atomicity, and cluster routing, for keys passed in KEYS, so scripts must not build key names
+func TestRedisScriptsOnlyUseKeysPassedIn(t *testing.T) {
+	spec := &Spec{t}
+
+	callPattern := regexp.MustCompile(`redis\.call\("(\w+)",\s*([^,)]+)`)
+	spec.Assert(len(redisScriptSources) > 0, "Expected scripts to be registered")
+	for _, src := range redisScriptSources {
+		spec.Assert(!strings.Contains(src, ".."), "Script builds a key name [%s]", src)
+		calls := callPattern.FindAllStringSubmatch(src, -1)
+		spec.Assert(len(calls) > 0, "Expected redis calls in script [%s]", src)
+		for _, call := range calls {
+			spec.Assert(strings.HasPrefix(call[2], "KEYS["), "%s called with key [%s] not from KEYS in script [%s]", call[1], call[2], src)
+		}
+	}
+}
+
 func TestRoundtripRedisUserStore(t *testing.T) {
 	if !isRedisRunning() {
 		t.Skip("No redis instance running")
@@ -97,6 +210,299 @@ func TestRedisUserStoreRecordNotFound(t *testing.T) {
 	RunUserStoreRecordNotFoundTest(t, store)
 }
 
+func TestInMemoryUserStoreCreateAndDelete(t *testing.T) {
+	store := NewInMemoryUserStore()
+
+	RunUserStoreCreateAndDeleteTest(t, store)
+}
+
+func TestInMemoryUserStoreConcurrentCreate(t *testing.T) {
+	spec := &Spec{t}
+
+	store := NewInMemoryUserStore()
+
+	results := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		go func(i int) {
+			results <- store.Create(&User{Id: fmt.Sprintf("user%d", i), Email: "same@example.com"})
+		}(i)
+	}
+
+	successCount := 0
+	for i := 0; i < 20; i++ {
+		err := <-results
+		if err == nil {
+			successCount++
+			continue
+		}
+		spec.Assert(err == ErrDuplicateEmail, "Unexpected error : %s", err)
+	}
+
+	spec.Assert(successCount == 1, "Unexpected success count %d", successCount)
+}
+
+func TestInMemoryUserStoreGetReturnsCopy(t *testing.T) {
+	spec := &Spec{t}
+
+	store := NewInMemoryUserStore()
+	store.Save(&User{Id: "pmcgrath", FirstName: "Pat", Contacts: []Contact{Contact{Id: "c1"}}})
+
+	user, _ := store.Get("pmcgrath")
+	user.FirstName = "Changed"
+	user.Contacts[0].Id = "Changed"
+
+	retrieved, _ := store.Get("pmcgrath")
+	spec.Assert(retrieved.FirstName == "Pat", "Unexpected first name %s", retrieved.FirstName)
+	spec.Assert(retrieved.Contacts[0].Id == "c1", "Unexpected contact id %s", retrieved.Contacts[0].Id)
+}
+
+func TestRedisUserStoreCreateAndDelete(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	clearRedisDeletedUserIds(t, pool)
+	store := NewRedisUserStore(pool)
+	RunUserStoreCreateAndDeleteTest(t, store)
+}
+
+func TestInMemoryUserStoreContacts(t *testing.T) {
+	store := NewInMemoryUserStore()
+
+	RunUserStoreContactsTest(t, store)
+}
+
+func TestRedisUserStoreContacts(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	store := NewRedisUserStore(pool)
+	RunUserStoreContactsTest(t, store)
+}
+
+func TestInMemoryUserStoreProfileFields(t *testing.T) {
+	store := NewInMemoryUserStore()
+
+	RunUserStoreProfileFieldsTest(t, store)
+}
+
+func TestRedisUserStoreProfileFields(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	clearRedisDeletedUserIds(t, pool)
+	store := NewRedisUserStore(pool)
+	RunUserStoreProfileFieldsTest(t, store)
+}
+
+func TestInMemoryUserStoreContactVersions(t *testing.T) {
+	store := NewInMemoryUserStore()
+
+	RunUserStoreContactVersionsTest(t, store)
+}
+
+func TestRedisUserStoreContactVersions(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	store := NewRedisUserStore(pool)
+	RunUserStoreContactVersionsTest(t, store)
+}
+
+func TestInMemoryUserStoreBulkContacts(t *testing.T) {
+	store := NewInMemoryUserStore()
+
+	RunUserStoreBulkContactsTest(t, store)
+}
+
+func TestRedisUserStoreBulkContacts(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	store := NewRedisUserStore(pool)
+	RunUserStoreBulkContactsTest(t, store)
+}
+
+func TestInMemoryUserStoreApiTokens(t *testing.T) {
+	store := NewInMemoryUserStore()
+
+	RunUserStoreApiTokensTest(t, store)
+}
+
+func TestRedisUserStoreApiTokens(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	store := NewRedisUserStore(pool)
+	RunUserStoreApiTokensTest(t, store)
+}
+
+func TestInMemoryUserStoreGrants(t *testing.T) {
+	store := NewInMemoryUserStore()
+
+	RunUserStoreGrantsTest(t, store)
+}
+
+func TestRedisUserStoreGrants(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	store := NewRedisUserStore(pool)
+	RunUserStoreGrantsTest(t, store)
+}
+
+func TestInMemoryUserStoreGroups(t *testing.T) {
+	store := NewInMemoryUserStore()
+
+	RunUserStoreGroupsTest(t, store)
+}
+
+func TestRedisUserStoreGroups(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	store := NewRedisUserStore(pool)
+	RunUserStoreGroupsTest(t, store)
+}
+
+func TestInMemoryUserStoreMergeContacts(t *testing.T) {
+	store := NewInMemoryUserStore()
+
+	RunUserStoreMergeContactsTest(t, store)
+}
+
+func TestRedisUserStoreMergeContacts(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	store := NewRedisUserStore(pool)
+	RunUserStoreMergeContactsTest(t, store)
+}
+
+func TestInMemoryLoginAttemptStore(t *testing.T) {
+	store := NewInMemoryLoginAttemptStore(60)
+	defer store.Close()
+
+	RunLoginAttemptStoreTest(t, store)
+}
+
+func TestInMemoryLoginAttemptStorePurge(t *testing.T) {
+	spec := &Spec{t}
+
+	store := NewInMemoryLoginAttemptStore(60)
+	defer store.Close()
+
+	store.ReserveLoginAttempt([]LoginAttemptLimit{{Key: "expired", FreeAttempts: 5}}, LoginBackoff{BaseDelay: time.Second, MaxDelay: time.Minute, ResetAfter: time.Nanosecond})
+	store.ReserveLoginAttempt([]LoginAttemptLimit{{Key: "current", FreeAttempts: 5}}, LoginBackoff{BaseDelay: time.Second, MaxDelay: time.Minute, ResetAfter: time.Minute})
+	time.Sleep(time.Millisecond)
+	store.Purge()
+
+	spec.Assert(len(store.data) == 1 && store.data["current"] != nil, "Unexpected attempts after purge %v", store.data)
+}
+
+func TestRedisLoginAttemptStore(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	store := NewRedisLoginAttemptStore(pool)
+	RunLoginAttemptStoreTest(t, store)
+}
+
+func TestRedisUserStoreMigration(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+	spec := &Spec{t}
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	store := NewRedisUserStore(pool)
+	store.Delete("migrationtest")
+	store.Delete("migrationtest2")
+	clearRedisDeletedUserIds(t, pool)
+
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", "useremail:migrationtest@example.com")
+	_, err := conn.Do("HMSET", "user:migrationtest", "FirstName", "Pat", "LastName", "Mc Grath", "Email", " MigrationTest@Example.com", "Password", "pass", "ContactsAsJson", `[{"Id":"c1","FirstName":"Ted","LastName":"Toe"},{"Id":"c2","FirstName":"Tom","LastName":"Toe"}]`)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	migrated, err := store.Migrate()
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(migrated >= 1, "Unexpected migrated count %d", migrated)
+
+	user, err := store.Get("migrationtest")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(len(user.Contacts) == 2 && user.Contacts[0].Id == "c1" && user.Contacts[1].Id == "c2", "Unexpected contacts %v", user.Contacts)
+
+	contact, err := store.GetContact("migrationtest", "c2")
+	spec.Assert(err == nil && contact.FirstName == "Tom", "Unexpected contact %v, error %v", contact, err)
+
+	// Migrated contacts take the extended fields
+	contact.Organisation = "Acme"
+	contact.Addresses = []Address{Address{Locality: "Tralee", Country: "Ireland"}}
+	contact.CustomFields = []CustomField{CustomField{Name: "Account", Value: "123"}}
+	err = store.SaveContact("migrationtest", contact, AnyContactVersion)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	saved, _ := store.GetContact("migrationtest", "c2")
+	spec.Assert(reflect.DeepEqual(saved, contact), "Expected [%v] but got [%v]", contact, saved)
+
+	// The email index covers legacy users, so is checked on sign up and removed with the user
+	ownerId, err := redis.String(conn.Do("GET", "useremail:migrationtest@example.com"))
+	spec.Assert(err == nil && ownerId == "migrationtest", "Unexpected email index owner %s, error %v", ownerId, err)
+	err = store.Create(&User{Id: "migrationtest2", FirstName: "Pat", LastName: "Other", Email: "migrationtest@example.com"})
+	spec.Assert(err == ErrDuplicateEmail, "Expected duplicate email error but got %v", err)
+
+	_, err = store.Migrate()
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	isIndexed, _ := redis.Bool(conn.Do("HEXISTS", "user:migrationtest", "EmailKey"))
+	spec.Assert(isIndexed, "Expected the email key to be recorded")
+
+	store.Delete("migrationtest")
+	exists, _ := redis.Bool(conn.Do("EXISTS", "useremail:migrationtest@example.com"))
+	spec.Assert(!exists, "Email index was not removed with the user")
+}
+
 /*
 Helper functions
 */
@@ -128,6 +534,23 @@ func RunSessionStoreRecordNotFoundTest(t *testing.T, store SessionStore) {
 	spec.Assert(retrieved == nil, "Expected session to be nil")
 }
 
+func RunSessionStoreDeleteTest(t *testing.T, store SessionStore) {
+	spec := &Spec{t}
+
+	err := store.Save(&Session{Id: "s200", UserName: "Ted"})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	err = store.Delete("s200")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	retrieved, err := store.Get("s200")
+	spec.Assert(err != nil, "Expected error")
+	spec.Assert(retrieved == nil, "Expected session to be nil")
+
+	err = store.Delete("DOESNOTEXIST")
+	spec.Assert(err == nil, "Unexpected error deleting a session that does not exist : %s", err)
+}
+
 func RunRoundtripUserStoreTest(t *testing.T, store UserStore) {
 	spec := &Spec{t}
 
@@ -169,3 +592,540 @@ func RunUserStoreRecordNotFoundTest(t *testing.T, store UserStore) {
 	spec.Assert(err != nil, "Expected error")
 	spec.Assert(retrieved == nil, "Expected user to be nil")
 }
+
+func RunUserStoreCreateAndDeleteTest(t *testing.T, store UserStore) {
+	spec := &Spec{t}
+
+	store.Delete("createtest1")
+	store.Delete("createtest2")
+
+	err := store.Create(&User{Id: "createtest1", FirstName: "Ted", LastName: "Toe", Email: "Ted@Example.com", Password: "pass"})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	err = store.Create(&User{Id: "createtest1", FirstName: "Ted", LastName: "Toe", Password: "pass"})
+	spec.Assert(err == ErrDuplicateUserId, "Expected duplicate id error but got : %v", err)
+
+	err = store.Create(&User{Id: "createtest2", FirstName: "Tom", LastName: "Toe", Email: "ted@example.com ", Password: "pass"})
+	spec.Assert(err == ErrDuplicateEmail, "Expected duplicate email error but got : %v", err)
+
+	// Changing email releases the old one
+	user, _ := store.Get("createtest1")
+	user.Email = "ted.toe@example.com"
+	err = store.Save(user)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	err = store.Create(&User{Id: "createtest2", FirstName: "Tom", LastName: "Toe", Email: "ted@example.com", Password: "pass"})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	user.Email = "ted@example.com"
+	err = store.Save(user)
+	spec.Assert(err == ErrDuplicateEmail, "Expected duplicate email error but got : %v", err)
+
+	err = store.Delete("createtest1")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	retrieved, err := store.Get("createtest1")
+	spec.Assert(err != nil && retrieved == nil, "Expected user to be deleted")
+
+	err = store.Delete("createtest1")
+	spec.Assert(err == ErrUserNotFound, "Expected not found error but got : %v", err)
+
+	// Deleted ids are not reused, sessions still holding the id must not act as a new user
+	err = store.Create(&User{Id: "createtest1", FirstName: "Ted", LastName: "Toe", Password: "pass"})
+	spec.Assert(err == ErrDuplicateUserId, "Expected duplicate id error for a deleted id but got : %v", err)
+
+	err = store.Create(&User{Id: "createtest3", FirstName: "Ted", LastName: "Toe", Email: "ted.toe@example.com", Password: "pass"})
+	spec.Assert(err == nil, "Deleted users email should be released : %v", err)
+
+	store.Delete("createtest2")
+	store.Delete("createtest3")
+}
+
+func RunUserStoreContactsTest(t *testing.T, store UserStore) {
+	spec := &Spec{t}
+
+	store.Delete("contactstest")
+	err := store.Save(&User{Id: "contactstest", FirstName: "Pat", LastName: "Mc Grath", Password: "pass", Contacts: []Contact{Contact{Id: "c1", FirstName: "Ted", LastName: "Toe"}}})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	err = store.SaveContact("contactstest", &Contact{Id: "c2", FirstName: "Tom", LastName: "Toe"}, NoContactVersion)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	err = store.SaveContact("contactstest", &Contact{Id: "c1", FirstName: "Ted", LastName: "Toad"}, AnyContactVersion)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	contact, err := store.GetContact("contactstest", "c1")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(contact.LastName == "Toad", "Unexpected last name %s", contact.LastName)
+
+	_, err = store.GetContact("contactstest", "DOESNOTEXIST")
+	spec.Assert(err == ErrContactNotFound, "Expected contact not found error but got : %v", err)
+
+	// Profile saves must not touch contacts
+	err = store.SaveProfile(&User{Id: "contactstest", FirstName: "Patrick", LastName: "Mc Grath", Password: "pass"})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	user, _ := store.Get("contactstest")
+	spec.Assert(user.FirstName == "Patrick", "Unexpected first name %s", user.FirstName)
+	spec.Assert(len(user.Contacts) == 2 && user.Contacts[0].Id == "c1" && user.Contacts[1].Id == "c2", "Unexpected contacts %v", user.Contacts)
+
+	err = store.DeleteContact("contactstest", "c1", AnyContactVersion)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	err = store.DeleteContact("contactstest", "c1", AnyContactVersion)
+	spec.Assert(err == ErrContactNotFound, "Expected contact not found error but got : %v", err)
+
+	user, _ = store.Get("contactstest")
+	spec.Assert(len(user.Contacts) == 1 && user.Contacts[0].Id == "c2", "Unexpected contacts %v", user.Contacts)
+
+	err = store.SaveContact("DOESNOTEXIST", &Contact{Id: "c1"}, AnyContactVersion)
+	spec.Assert(err == ErrUserNotFound, "Expected user not found error but got : %v", err)
+
+	err = store.SaveProfile(&User{Id: "DOESNOTEXIST"})
+	spec.Assert(err == ErrUserNotFound, "Expected user not found error but got : %v", err)
+
+	store.Delete("contactstest")
+}
+
+// Profile, password and roles are saved separately so a change to one cannot undo a concurrent change to another
+func RunUserStoreProfileFieldsTest(t *testing.T, store UserStore) {
+	spec := &Spec{t}
+
+	store.Delete("profiletest")
+	err := store.Create(&User{Id: "profiletest", FirstName: "Pat", LastName: "Mc Grath", Email: "pat@example.com", Password: "pass1"})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	// Stale copies, as handlers would have read before the other changes
+	profileCopy, _ := store.Get("profiletest")
+	rolesCopy, _ := store.Get("profiletest")
+
+	err = store.SavePassword("profiletest", "pass2")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	err = store.SetRoles("profiletest", append(rolesCopy.Roles, AdminRole))
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	profileCopy.FirstName, profileCopy.Email = "Patrick", "patrick@example.com"
+	err = store.SaveProfile(profileCopy)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	user, _ := store.Get("profiletest")
+	spec.Assert(user.FirstName == "Patrick" && user.LastName == "Mc Grath" && user.Email == "patrick@example.com", "Unexpected profile %+v", user)
+	spec.Assert(user.Password == "pass2", "Profile save changed the password [%s]", user.Password)
+	spec.Assert(len(user.Roles) == 1 && user.Roles[0] == AdminRole, "Profile save changed the roles %v", user.Roles)
+
+	err = store.SetRoles("profiletest", []string{})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	user, _ = store.Get("profiletest")
+	spec.Assert(len(user.Roles) == 0 && user.Password == "pass2" && user.FirstName == "Patrick", "Unexpected user after removing roles %+v", user)
+
+	err = store.SavePassword("DOESNOTEXIST", "pass")
+	spec.Assert(err == ErrUserNotFound, "Expected user not found error but got : %v", err)
+
+	err = store.SetRoles("DOESNOTEXIST", []string{AdminRole})
+	spec.Assert(err == ErrUserNotFound, "Expected user not found error but got : %v", err)
+
+	_, err = store.Get("DOESNOTEXIST")
+	spec.Assert(err == ErrUserNotFound, "Set for an unknown user should not create it : %v", err)
+
+	store.Delete("profiletest")
+}
+
+func RunUserStoreContactVersionsTest(t *testing.T, store UserStore) {
+	spec := &Spec{t}
+
+	store.Delete("versionstest")
+	store.Save(&User{Id: "versionstest", FirstName: "Pat", LastName: "Mc Grath", Password: "pass"})
+
+	contact := &Contact{Id: "c1", FirstName: "Ted", LastName: "Toe"}
+	err := store.SaveContact("versionstest", contact, NoContactVersion)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(contact.Version == 1, "Unexpected version %d", contact.Version)
+
+	err = store.SaveContact("versionstest", &Contact{Id: "c1"}, NoContactVersion)
+	spec.Assert(err == ErrVersionConflict, "Expected version conflict error but got : %v", err)
+
+	err = store.SaveContact("versionstest", contact, 1)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(contact.Version == 2, "Unexpected version %d", contact.Version)
+
+	// Stale version
+	err = store.SaveContact("versionstest", contact, 1)
+	spec.Assert(err == ErrVersionConflict, "Expected version conflict error but got : %v", err)
+
+	retrieved, _ := store.GetContact("versionstest", "c1")
+	spec.Assert(retrieved.Version == 2, "Unexpected version %d", retrieved.Version)
+
+	err = store.DeleteContact("versionstest", "c1", 1)
+	spec.Assert(err == ErrVersionConflict, "Expected version conflict error but got : %v", err)
+
+	spec.Assert(contact.Incarnation != "" && retrieved.Incarnation == contact.Incarnation, "Incarnation changed by an update [%s] [%s]", contact.Incarnation, retrieved.Incarnation)
+	etag := GetContactETag(retrieved)
+
+	err = store.DeleteContact("versionstest", "c1", 1)
+	spec.Assert(err == ErrVersionConflict, "Expected version conflict error but got : %v", err)
+
+	err = store.DeleteContact("versionstest", "c1", 2)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	// Created again the version restarts, the incarnation keeps the etags of the old and new contact apart
+	recreated := &Contact{Id: "c1", FirstName: "Ted", LastName: "Toe", Incarnation: contact.Incarnation}
+	store.SaveContact("versionstest", recreated, NoContactVersion)
+	store.SaveContact("versionstest", recreated, 1)
+	spec.Assert(recreated.Version == 2, "Unexpected version %d", recreated.Version)
+	spec.Assert(recreated.Incarnation != contact.Incarnation, "Expected a new incarnation [%s]", recreated.Incarnation)
+	spec.Assert(GetContactETag(recreated) != etag, "Expected a new etag [%s]", etag)
+
+	bulk := []Contact{Contact{Id: "c1", FirstName: "Ted"}, Contact{Id: "c2", FirstName: "Tom"}}
+	store.SaveContacts("versionstest", bulk)
+	spec.Assert(bulk[0].Version == 3 && bulk[0].Incarnation == recreated.Incarnation, "Unexpected bulk update %+v", bulk[0])
+	spec.Assert(bulk[1].Version == 1 && bulk[1].Incarnation != "" && bulk[1].Incarnation != recreated.Incarnation, "Unexpected bulk add %+v", bulk[1])
+
+	store.Delete("versionstest")
+}
+
+func RunUserStoreBulkContactsTest(t *testing.T, store UserStore) {
+	spec := &Spec{t}
+
+	store.Delete("bulktest")
+	store.Save(&User{Id: "bulktest", FirstName: "Pat", LastName: "Mc Grath", Password: "pass", Contacts: []Contact{Contact{Id: "c1", FirstName: "Ted", LastName: "Toe", Version: 3}}})
+
+	contacts := []Contact{
+		Contact{Id: "c2", FirstName: "Anne", LastName: "Other"},
+		Contact{Id: "c1", FirstName: "Ted", LastName: "Toad"},
+		Contact{Id: "c3", FirstName: "Peter", LastName: "Toad"},
+		Contact{Id: "c2", FirstName: "Anne", LastName: "Again"},
+	}
+	err := store.SaveContacts("bulktest", contacts)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	versions := []int64{contacts[0].Version, contacts[1].Version, contacts[2].Version, contacts[3].Version}
+	spec.Assert(reflect.DeepEqual(versions, []int64{1, 4, 1, 2}), "Unexpected versions %v", versions)
+
+	user, _ := store.Get("bulktest")
+	ids := make([]string, 0)
+	for _, contact := range user.Contacts {
+		ids = append(ids, contact.Id+" "+contact.LastName)
+	}
+	spec.Assert(reflect.DeepEqual(ids, []string{"c1 Toad", "c2 Again", "c3 Toad"}), "Unexpected contacts %v", ids)
+
+	err = store.SaveContacts("nosuchuser", contacts)
+	spec.Assert(err == ErrUserNotFound, "Expected user not found error but got : %v", err)
+
+	store.Delete("bulktest")
+}
+
+func RunUserStoreApiTokensTest(t *testing.T, store UserStore) {
+	spec := &Spec{t}
+
+	store.Delete("tokentest")
+	store.Save(&User{Id: "tokentest", FirstName: "Pat", LastName: "Mc Grath", Password: "pass"})
+
+	first, _, _ := NewApiToken("tokentest", "first")
+	second, _, _ := NewApiToken("tokentest", "second")
+	second.CreatedAt = first.CreatedAt.Add(time.Second)
+	for _, token := range []*ApiToken{second, first} {
+		err := store.CreateApiToken(token)
+		spec.Assert(err == nil, "Unexpected error : %s", err)
+	}
+
+	retrieved, err := store.GetApiToken(first.Hash)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(retrieved.Id == first.Id && retrieved.UserId == "tokentest" && retrieved.Name == "first", "Unexpected token %v", retrieved)
+	spec.Assert(retrieved.CreatedAt.Equal(first.CreatedAt), "Unexpected created at %s", retrieved.CreatedAt)
+
+	tokens, err := store.GetApiTokens("tokentest")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(len(tokens) == 2 && tokens[0].Id == first.Id && tokens[1].Id == second.Id, "Unexpected tokens %v", tokens)
+
+	err = store.DeleteApiToken("tokentest", first.Id)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	_, err = store.GetApiToken(first.Hash)
+	spec.Assert(err == ErrApiTokenNotFound, "Expected revoked token to be not found, got %v", err)
+	err = store.DeleteApiToken("tokentest", first.Id)
+	spec.Assert(err == ErrApiTokenNotFound, "Expected not found for a revoked token, got %v", err)
+	err = store.DeleteApiToken("someoneelse", second.Id)
+	spec.Assert(err == ErrApiTokenNotFound, "Expected not found for another user's token, got %v", err)
+
+	other, _, _ := NewApiToken("nosuchuser", "")
+	err = store.CreateApiToken(other)
+	spec.Assert(err == ErrUserNotFound, "Expected user not found, got %v", err)
+	_, err = store.GetApiTokens("nosuchuser")
+	spec.Assert(err == ErrUserNotFound, "Expected user not found, got %v", err)
+
+	// Deleting the user revokes all its tokens
+	store.Delete("tokentest")
+	_, err = store.GetApiToken(second.Hash)
+	spec.Assert(err == ErrApiTokenNotFound, "Expected token to be deleted with its user, got %v", err)
+}
+
+func RunLoginAttemptStoreTest(t *testing.T, store LoginAttemptStore) {
+	spec := &Spec{t}
+
+	store.ResetLoginAttempts("user:ted")
+	store.ResetLoginAttempts("ip:10.0.0.1")
+	store.ResetLoginAttempts("ip:10.0.0.2")
+
+	attempts, err := store.GetLoginAttempts("user:ted")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(attempts.Failures == 0 && attempts.LastFailure.IsZero(), "Expected no attempts but got %v", attempts)
+
+	backoff := LoginBackoff{BaseDelay: time.Minute, MaxDelay: time.Hour, ResetAfter: time.Hour}
+	limits := []LoginAttemptLimit{{Key: "user:ted", FreeAttempts: 3}, {Key: "ip:10.0.0.1", FreeAttempts: 10}}
+	before := time.Now()
+	for index := 1; index <= 3; index++ {
+		wait, err := store.ReserveLoginAttempt(limits, backoff)
+		spec.Assert(err == nil && wait == 0, "Attempt %d should be reserved, wait %s, error %v", index, wait, err)
+	}
+
+	attempts, err = store.GetLoginAttempts("user:ted")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(attempts.Failures == 3, "Expected 3 failures but got %d", attempts.Failures)
+	spec.Assert(!attempts.LastFailure.Before(before.Truncate(time.Millisecond)), "Unexpected last failure %s", attempts.LastFailure)
+
+	// Free attempts used so the next must wait, and nothing is counted for it, including the other limit
+	wait, err := store.ReserveLoginAttempt(limits, backoff)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(wait > 59*time.Second && wait <= time.Minute, "Expected a wait of about a minute but got %s", wait)
+	attempts, _ = store.GetLoginAttempts("ip:10.0.0.1")
+	spec.Assert(attempts.Failures == 3, "Expected 3 IP failures but got %d", attempts.Failures)
+
+	other, _ := store.GetLoginAttempts("ip:10.0.0.2")
+	spec.Assert(other.Failures == 0, "Keys should be independent, got %d failures", other.Failures)
+
+	err = store.ReleaseLoginAttempt("ip:10.0.0.1")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	attempts, _ = store.GetLoginAttempts("ip:10.0.0.1")
+	spec.Assert(attempts.Failures == 2, "Expected 2 IP failures after a release but got %d", attempts.Failures)
+
+	err = store.ReleaseLoginAttempt("ip:10.0.0.2")
+	spec.Assert(err == nil, "Unexpected error releasing an unknown key : %s", err)
+
+	err = store.ResetLoginAttempts("user:ted")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	attempts, _ = store.GetLoginAttempts("user:ted")
+	spec.Assert(attempts.Failures == 0, "Expected no failures after reset but got %d", attempts.Failures)
+
+	store.ResetLoginAttempts("ip:10.0.0.1")
+}
+
+func RunUserStoreGrantsTest(t *testing.T, store UserStore) {
+	spec := &Spec{t}
+
+	for _, userId := range []string{"grantowner", "granteeone", "granteetwo"} {
+		store.Delete(userId)
+		store.Save(&User{Id: userId, FirstName: "Pat", LastName: "Mc Grath", Password: "pass", Roles: []string{AdminRole}})
+	}
+
+	user, err := store.Get("grantowner")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(reflect.DeepEqual(user.Roles, []string{AdminRole}), "Unexpected roles %v", user.Roles)
+
+	createdAt := time.Now().UTC().Truncate(time.Second)
+	readGrant := &Grant{OwnerId: "grantowner", GranteeId: "granteeone", Access: ReadAccess, ContactIds: []string{"contact1"}, CreatedAt: createdAt}
+	writeGrant := &Grant{OwnerId: "grantowner", GranteeId: "granteetwo", Access: ReadWriteAccess, CreatedAt: createdAt}
+	sharedGrant := &Grant{OwnerId: "granteetwo", GranteeId: "granteeone", Access: ReadAccess, CreatedAt: createdAt}
+	for _, grant := range []*Grant{writeGrant, readGrant, sharedGrant} {
+		err := store.SaveGrant(grant)
+		spec.Assert(err == nil, "Unexpected error : %s", err)
+	}
+
+	err = store.SaveGrant(&Grant{OwnerId: "grantowner", GranteeId: "DOESNOTEXIST", Access: ReadAccess})
+	spec.Assert(err == ErrUserNotFound, "Expected user not found for an unknown grantee but got %v", err)
+
+	retrieved, err := store.GetGrant("grantowner", "granteeone")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(reflect.DeepEqual(retrieved, readGrant), "Expected [%v] but got [%v]", readGrant, retrieved)
+
+	_, err = store.GetGrant("granteeone", "grantowner")
+	spec.Assert(err == ErrGrantNotFound, "Expected grant not found but got %v", err)
+
+	given, err := store.GetGrants("grantowner")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(len(given) == 2 && given[0].GranteeId == "granteeone" && given[1].GranteeId == "granteetwo", "Unexpected grants %v", given)
+
+	received, err := store.GetSharedGrants("granteeone")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(len(received) == 2 && received[0].OwnerId == "granteetwo" && received[1].OwnerId == "grantowner", "Unexpected shared grants %v", received)
+
+	// Replacing keeps one grant per owner and grantee
+	readGrant.Access = ReadWriteAccess
+	store.SaveGrant(readGrant)
+	given, _ = store.GetGrants("grantowner")
+	spec.Assert(len(given) == 2 && given[0].Access == ReadWriteAccess, "Unexpected grants after replacing %v", given)
+
+	err = store.DeleteGrant("grantowner", "granteetwo")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	err = store.DeleteGrant("grantowner", "granteetwo")
+	spec.Assert(err == ErrGrantNotFound, "Expected grant not found but got %v", err)
+
+	// Deleting a user removes the grants they gave and received
+	err = store.Delete("granteeone")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	given, _ = store.GetGrants("grantowner")
+	spec.Assert(len(given) == 0, "Expected no grants after deleting the grantee but got %v", given)
+	received, _ = store.GetSharedGrants("granteetwo")
+	spec.Assert(len(received) == 0, "Unexpected shared grants %v", received)
+	_, err = store.GetGrants("granteeone")
+	spec.Assert(err == ErrUserNotFound, "Expected user not found but got %v", err)
+}
+
+func RunUserStoreGroupsTest(t *testing.T, store UserStore) {
+	spec := &Spec{t}
+
+	store.Delete("groupowner")
+	err := store.Save(&User{Id: "groupowner", FirstName: "Pat", LastName: "Mc Grath", Password: "pass", Contacts: []Contact{
+		Contact{Id: "contact1", FirstName: "Ted", LastName: "Toe", Tags: []string{"customers"}},
+		Contact{Id: "contact2", FirstName: "Tom", LastName: "Toe"},
+		Contact{Id: "contact3", FirstName: "Ann", LastName: "Bee"},
+	}})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	user, _ := store.Get("groupowner")
+	spec.Assert(reflect.DeepEqual(user.Contacts[0].Tags, []string{"customers"}), "Unexpected tags %v", user.Contacts[0].Tags)
+
+	for _, group := range []*Group{&Group{Id: "group1", Name: "Suppliers"}, &Group{Id: "group2", Name: "customers"}} {
+		err := store.CreateGroup("groupowner", group)
+		spec.Assert(err == nil, "Unexpected error : %s", err)
+	}
+
+	err = store.CreateGroup("groupowner", &Group{Id: "group3", Name: "SUPPLIERS"})
+	spec.Assert(err == ErrDuplicateGroupName, "Expected duplicate group name but got %v", err)
+	err = store.CreateGroup("DOESNOTEXIST", &Group{Id: "group3", Name: "Suppliers"})
+	spec.Assert(err == ErrUserNotFound, "Expected user not found but got %v", err)
+
+	for _, contactId := range []string{"contact2", "contact1", "contact1"} {
+		err := store.AddGroupContact("groupowner", "group1", contactId)
+		spec.Assert(err == nil, "Unexpected error : %s", err)
+	}
+	err = store.AddGroupContact("groupowner", "group1", "DOESNOTEXIST")
+	spec.Assert(err == ErrContactNotFound, "Expected contact not found but got %v", err)
+	err = store.AddGroupContact("groupowner", "DOESNOTEXIST", "contact1")
+	spec.Assert(err == ErrGroupNotFound, "Expected group not found but got %v", err)
+
+	group, err := store.GetGroup("groupowner", "group1")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	expected := &Group{Id: "group1", Name: "Suppliers", ContactIds: []string{"contact1", "contact2"}}
+	spec.Assert(reflect.DeepEqual(group, expected), "Expected [%v] but got [%v]", expected, group)
+
+	_, err = store.GetGroup("groupowner", "DOESNOTEXIST")
+	spec.Assert(err == ErrGroupNotFound, "Expected group not found but got %v", err)
+
+	groups, err := store.GetGroups("groupowner")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(len(groups) == 2 && groups[0].Id == "group2" && groups[1].Id == "group1", "Unexpected groups %v", groups)
+
+	// Renaming frees the old name and keeps the contacts, a group can change the case of its own name
+	err = store.RenameGroup("groupowner", "group1", "customers")
+	spec.Assert(err == ErrDuplicateGroupName, "Expected duplicate group name but got %v", err)
+	err = store.RenameGroup("groupowner", "group1", "On-call")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	err = store.RenameGroup("groupowner", "group1", "On-Call")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	err = store.CreateGroup("groupowner", &Group{Id: "group3", Name: "Suppliers"})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	err = store.RenameGroup("groupowner", "DOESNOTEXIST", "Other")
+	spec.Assert(err == ErrGroupNotFound, "Expected group not found but got %v", err)
+	group, _ = store.GetGroup("groupowner", "group1")
+	spec.Assert(group.Name == "On-Call" && len(group.ContactIds) == 2, "Unexpected group after renaming %v", group)
+
+	err = store.RemoveGroupContact("groupowner", "group1", "contact2")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	err = store.RemoveGroupContact("groupowner", "group1", "contact2")
+	spec.Assert(err == ErrContactNotFound, "Expected contact not found but got %v", err)
+
+	// Deleting or replacing contacts removes them from groups
+	store.AddGroupContact("groupowner", "group2", "contact3")
+	store.AddGroupContact("groupowner", "group3", "contact3")
+	err = store.DeleteContact("groupowner", "contact1", AnyContactVersion)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	group, _ = store.GetGroup("groupowner", "group1")
+	spec.Assert(len(group.ContactIds) == 0, "Expected no contacts after deleting the contact but got %v", group.ContactIds)
+
+	user, _ = store.Get("groupowner")
+	user.Contacts = user.Contacts[:1]
+	store.Save(user)
+	group, _ = store.GetGroup("groupowner", "group2")
+	spec.Assert(len(group.ContactIds) == 0, "Expected no contacts after replacing the contacts but got %v", group.ContactIds)
+
+	err = store.DeleteGroup("groupowner", "group3")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	err = store.DeleteGroup("groupowner", "group3")
+	spec.Assert(err == ErrGroupNotFound, "Expected group not found but got %v", err)
+	err = store.CreateGroup("groupowner", &Group{Id: "group4", Name: "suppliers"})
+	spec.Assert(err == nil, "Deleting a group should free its name : %v", err)
+
+	err = store.Delete("groupowner")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	store.Save(&User{Id: "groupowner", FirstName: "Pat", LastName: "Mc Grath", Password: "pass"})
+	groups, _ = store.GetGroups("groupowner")
+	spec.Assert(len(groups) == 0, "Expected no groups after deleting the user but got %v", groups)
+	store.Delete("groupowner")
+}
+
+func RunUserStoreMergeContactsTest(t *testing.T, store UserStore) {
+	spec := &Spec{t}
+
+	store.Delete("mergeowner")
+	err := store.Save(&User{Id: "mergeowner", FirstName: "Pat", LastName: "Mc Grath", Password: "pass", Contacts: []Contact{
+		Contact{Id: "contact1", FirstName: "Ted", LastName: "Toe"},
+		Contact{Id: "contact2", FirstName: "Ann", LastName: "Bee"},
+		Contact{Id: "contact3", FirstName: "Ted", LastName: "Toe"},
+		Contact{Id: "contact4", FirstName: "Tom", LastName: "Toe"},
+	}})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	store.CreateGroup("mergeowner", &Group{Id: "group1", Name: "Customers"})
+	store.AddGroupContact("mergeowner", "group1", "contact3")
+	store.CreateGroup("mergeowner", &Group{Id: "group2", Name: "Suppliers"})
+	store.AddGroupContact("mergeowner", "group2", "contact4")
+
+	user, _ := store.Get("mergeowner")
+	versions := make(map[string]int64)
+	for _, contact := range user.Contacts {
+		versions[contact.Id] = contact.Version
+	}
+
+	merged := &Contact{Id: "contact3", FirstName: "Ted", LastName: "Toe", MergedIds: []string{"contact1"}}
+	err = store.MergeContacts("mergeowner", merged, map[string]int64{"contact3": versions["contact3"], "contact1": versions["contact1"] + 1})
+	spec.Assert(err == ErrVersionConflict, "Expected version conflict but got %v", err)
+	err = store.MergeContacts("mergeowner", merged, map[string]int64{"contact3": versions["contact3"], "DOESNOTEXIST": 1})
+	spec.Assert(err == ErrContactNotFound, "Expected contact not found but got %v", err)
+
+	err = store.MergeContacts("mergeowner", merged, map[string]int64{"contact3": versions["contact3"], "contact1": versions["contact1"]})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(merged.Version == versions["contact3"]+1, "Unexpected version %d", merged.Version)
+
+	// The merged contact keeps its place in the contact order
+	user, _ = store.Get("mergeowner")
+	spec.Assert(len(user.Contacts) == 3, "Unexpected contact count %d", len(user.Contacts))
+	spec.Assert(user.Contacts[0].Id == "contact2" && user.Contacts[1].Id == "contact3" && user.Contacts[2].Id == "contact4", "Unexpected contacts %v", user.Contacts)
+	spec.Assert(reflect.DeepEqual(user.Contacts[1].MergedIds, []string{"contact1"}), "Unexpected merged ids %v", user.Contacts[1].MergedIds)
+
+	_, err = store.GetContact("mergeowner", "contact1")
+	spec.Assert(err == ErrContactNotFound, "Expected merged contact to be deleted but got %v", err)
+
+	// MergedIds is kept by the store, whatever a later save sends
+	updated := &Contact{Id: "contact3", FirstName: "Teddy", LastName: "Toe", MergedIds: []string{"forged"}}
+	err = store.SaveContact("mergeowner", updated, AnyContactVersion)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(reflect.DeepEqual(updated.MergedIds, []string{"contact1"}), "Unexpected merged ids after save %v", updated.MergedIds)
+	err = store.SaveContacts("mergeowner", []Contact{Contact{Id: "contact3", FirstName: "Ted", LastName: "Toe"}, Contact{Id: "contact5", FirstName: "Ann", LastName: "Bee", MergedIds: []string{"forged"}}})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	stored, _ := store.GetContact("mergeowner", "contact3")
+	spec.Assert(reflect.DeepEqual(stored.MergedIds, []string{"contact1"}), "Unexpected merged ids after bulk save %v", stored.MergedIds)
+	stored, _ = store.GetContact("mergeowner", "contact5")
+	spec.Assert(stored.MergedIds == nil, "Unexpected merged ids for a new contact %v", stored.MergedIds)
+	merged, _ = store.GetContact("mergeowner", "contact3")
+
+	// The merged contact joins the groups of the contacts merged into it
+	err = store.MergeContacts("mergeowner", &Contact{Id: "contact3", FirstName: "Ted", LastName: "Toe"}, map[string]int64{"contact3": merged.Version, "contact4": versions["contact4"]})
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	group, _ := store.GetGroup("mergeowner", "group1")
+	spec.Assert(reflect.DeepEqual(group.ContactIds, []string{"contact3"}), "Unexpected group1 contacts %v", group.ContactIds)
+	group, _ = store.GetGroup("mergeowner", "group2")
+	spec.Assert(reflect.DeepEqual(group.ContactIds, []string{"contact3"}), "Unexpected group2 contacts %v", group.ContactIds)
+
+	err = store.Delete("mergeowner")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+}
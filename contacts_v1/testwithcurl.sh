@@ -7,13 +7,20 @@ function reportstatus() {
 
 cookie_file_path=/tmp/contact_cookies.txt
 
-curl http://localhost:8080/api/v1/login --cookie $cookie_file_path --cookie-jar $cookie_file_path -vv -XPOST -d '{ "UserName": "pmcgrath", "Password": "pass" }'
+# State changing requests need the session's CSRF token, GET /api/v1/login issues one in the X-CSRF-Token header
+function csrftoken() {
+	curl -s -o /dev/null -D - http://localhost:8080/api/v1/login --cookie $cookie_file_path --cookie-jar $cookie_file_path | grep -i '^x-csrf-token:' | cut -d' ' -f2 | tr -d '\r'
+}
+csrf_token=$(csrftoken)
+
+curl http://localhost:8080/api/v1/login --cookie $cookie_file_path --cookie-jar $cookie_file_path -vv -H "X-CSRF-Token: $csrf_token" -XPOST -d '{ "UserName": "pmcgrath", "Password": "pass" }'
 reportstatus "Expected a 200 - logged in"
+csrf_token=$(csrftoken) # Log in replaces the token
 
-curl http://localhost:8080/api/v1/contacts/pmcgrath --cookie $cookie_file_path --cookie-jar $cookie_file_path -vv -XPOST -d '{ "FirstName": "Tom", "LastName": "Toe" }'
+curl http://localhost:8080/api/v1/contacts/pmcgrath --cookie $cookie_file_path --cookie-jar $cookie_file_path -vv -H "X-CSRF-Token: $csrf_token" -XPOST -d '{ "FirstName": "Tom", "LastName": "Toe" }'
 reportstatus "Expected a 201 - contact created"
 
-curl http://localhost:8080/api/v1/contacts/pmcgrath/teddydoesnotexist --cookie $cookie_file_path --cookie-jar $cookie_file_path -vv -XDELETE
+curl http://localhost:8080/api/v1/contacts/pmcgrath/teddydoesnotexist --cookie $cookie_file_path --cookie-jar $cookie_file_path -vv -H "X-CSRF-Token: $csrf_token" -XDELETE
 reportstatus "Expected a 404 - contact does not exist so cannot be deleted"
 
 curl http://localhost:8080/api/v1/contacts/pmcgrath --cookie $cookie_file_path --cookie-jar $cookie_file_path -vv
@@ -37,3 +44,16 @@ reportstatus "Expected a 405 - cannot post to an asset resource"
 
 curl http://localhost:8080/api/v1/contacts/pmcgrath --cookie $cookie_file_path --cookie-jar $cookie_file_path -vv
 reportstatus "Expected a 401 - user is not logged in - we deleted the cookie so we are using a session where no user logged in"
+
+# API tokens do not need cookies or CSRF tokens, log in again to create one
+rm $cookie_file_path
+csrf_token=$(csrftoken)
+curl http://localhost:8080/api/v1/login --cookie $cookie_file_path --cookie-jar $cookie_file_path -s -o /dev/null -H "X-CSRF-Token: $csrf_token" -XPOST -d '{ "UserName": "pmcgrath", "Password": "pass" }'
+csrf_token=$(csrftoken)
+api_token=$(curl http://localhost:8080/api/v1/users/pmcgrath/tokens --cookie $cookie_file_path -s -H "X-CSRF-Token: $csrf_token" -XPOST -d '{ "Name": "testwithcurl" }' | sed -n 's/.*"Token":"\([^"]*\)".*/\1/p')
+
+curl http://localhost:8080/api/v1/contacts/pmcgrath -vv -H "Authorization: Bearer $api_token"
+reportstatus "Expected a 200 - contacts found using an API token"
+
+curl http://localhost:8080/api/v1/contacts/pmcgrath -vv -H "Authorization: Bearer notatoken"
+reportstatus "Expected a 401 - unknown API token"
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+Log in throttling - failed log ins are counted per user name and per client IP, once the free attempts are used up each
+further failure doubles how long the next attempt must wait, up to MaxDelay
+Lockouts are temporary, the wait is over without an unlock, a successful log in clears the user name's failures
+Each attempt is reserved, counted as a failure, before the password is checked, so concurrent attempts cannot all pass
+the check before any failure is recorded, a successful log in then gives the reservation back
+*/
+type LoginThrottle struct {
+	Store                LoginAttemptStore
+	Audit                *log.Logger
+	UserNameFreeAttempts int
+	IpFreeAttempts       int // Higher as many users can share an IP
+	BaseDelay            time.Duration
+	MaxDelay             time.Duration
+	ResetAfter           time.Duration // Failures are forgotten this long after the last one
+}
+
+func NewLoginThrottle(store LoginAttemptStore, audit *log.Logger) *LoginThrottle {
+	return &LoginThrottle{
+		Store:                store,
+		Audit:                audit,
+		UserNameFreeAttempts: 5,
+		IpFreeAttempts:       20,
+		BaseDelay:            time.Second,
+		MaxDelay:             15 * time.Minute,
+		ResetAfter:           24 * time.Hour,
+	}
+}
+
+// A failure count checked and reserved with others in one step, see LoginAttemptStore.ReserveLoginAttempt
+type LoginAttemptLimit struct {
+	Key          string
+	FreeAttempts int
+}
+
+type LoginBackoff struct {
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	ResetAfter time.Duration
+}
+
+// How long to wait after the last failure, zero while there are free attempts left
+func (backoff LoginBackoff) GetDelay(failures, freeAttempts int) time.Duration {
+	if failures < freeAttempts {
+		return 0
+	}
+
+	delay := backoff.BaseDelay
+	for doublings := failures - freeAttempts; doublings > 0 && delay < backoff.MaxDelay; doublings-- {
+		delay *= 2
+	}
+	if delay > backoff.MaxDelay {
+		delay = backoff.MaxDelay
+	}
+
+	return delay
+}
+
+func (throttle *LoginThrottle) GetDelay(failures, freeAttempts int) time.Duration {
+	return throttle.getBackoff().GetDelay(failures, freeAttempts)
+}
+
+/*
+Zero if a log in attempt is allowed now, the attempt is then counted as a failure for the user name and IP until
+RecordSuccess gives it back, otherwise how long until an attempt is allowed, nothing is counted for a refused attempt
+*/
+func (throttle *LoginThrottle) Reserve(userName, ip string) (time.Duration, error) {
+	limits := []LoginAttemptLimit{
+		{Key: getLoginUserNameKey(userName), FreeAttempts: throttle.UserNameFreeAttempts},
+		{Key: getLoginIpKey(ip), FreeAttempts: throttle.IpFreeAttempts},
+	}
+
+	return throttle.Store.ReserveLoginAttempt(limits, throttle.getBackoff())
+}
+
+// The failure was counted by Reserve, this audits a resulting lockout
+func (throttle *LoginThrottle) RecordFailure(c *RequestContext, userName, ip string) error {
+	attempts, err := throttle.Store.GetLoginAttempts(getLoginUserNameKey(userName))
+	if err != nil {
+		return err
+	}
+	if delay := throttle.GetDelay(attempts.Failures, throttle.UserNameFreeAttempts); delay > 0 {
+		throttle.Audit.Printf("%s login lockout user=%q ip=%q failures=%d retry_after=%ds\n", c.GetLogMessagePrefix(), userName, ip, attempts.Failures, getRetryAfterSeconds(delay))
+	}
+
+	attempts, err = throttle.Store.GetLoginAttempts(getLoginIpKey(ip))
+	if err != nil {
+		return err
+	}
+	if delay := throttle.GetDelay(attempts.Failures, throttle.IpFreeAttempts); delay > 0 {
+		throttle.Audit.Printf("%s login lockout ip=%q failures=%d retry_after=%ds\n", c.GetLogMessagePrefix(), ip, attempts.Failures, getRetryAfterSeconds(delay))
+	}
+
+	return nil
+}
+
+/*
+Clears the user name's failures and gives back the IP's reservation, the IP's earlier failures are kept so one valid
+account cannot be used to reset them
+*/
+func (throttle *LoginThrottle) RecordSuccess(c *RequestContext, userName, ip string) error {
+	if err := throttle.Store.ReleaseLoginAttempt(getLoginIpKey(ip)); err != nil {
+		return err
+	}
+
+	key := getLoginUserNameKey(userName)
+	attempts, err := throttle.Store.GetLoginAttempts(key)
+	if err != nil {
+		return err
+	}
+	if attempts.Failures == 0 {
+		return nil
+	}
+
+	if err := throttle.Store.ResetLoginAttempts(key); err != nil {
+		return err
+	}
+	// The count includes this log in's reservation
+	if failures := attempts.Failures - 1; throttle.GetDelay(failures, throttle.UserNameFreeAttempts) > 0 {
+		throttle.Audit.Printf("%s login unlock user=%q ip=%q failures=%d\n", c.GetLogMessagePrefix(), userName, ip, failures)
+	}
+
+	return nil
+}
+
+func (throttle *LoginThrottle) getBackoff() LoginBackoff {
+	return LoginBackoff{BaseDelay: throttle.BaseDelay, MaxDelay: throttle.MaxDelay, ResetAfter: throttle.ResetAfter}
+}
+
+// How long until an attempt is allowed for a count, zero if it is allowed now
+func getLoginAttemptWait(attempts *LoginAttempts, freeAttempts int, backoff LoginBackoff, now time.Time) time.Duration {
+	delay := backoff.GetDelay(attempts.Failures, freeAttempts)
+	if delay == 0 {
+		return 0
+	}
+	wait := attempts.LastFailure.Add(delay).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+
+	return wait
+}
+
+// Case insensitive so varying the case does not get more attempts
+func getLoginUserNameKey(userName string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(userName))
+}
+
+func getLoginIpKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Whole seconds rounded up, a Retry-After of 0 would invite an immediate retry
+func getRetryAfterSeconds(wait time.Duration) int64 {
+	return int64((wait + time.Second - 1) / time.Second)
+}
+
+// The connection's address, proxy headers are not trusted as clients could use them to get more attempts
+func GetClientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+/*
+Audit log for security events, appended to a file if a path is given otherwise written to stderr
+*/
+func NewAuditLogger(path string) (*log.Logger, error) {
+	prefix := fmt.Sprintf("%d AUDIT ", os.Getpid())
+	if path == "" {
+		return log.New(os.Stderr, prefix, log.LstdFlags), nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return log.New(file, prefix, log.LstdFlags), nil
+}
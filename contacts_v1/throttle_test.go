@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLoginThrottle() (*LoginThrottle, *InMemoryLoginAttemptStore, *bytes.Buffer) {
+	store := NewInMemoryLoginAttemptStore(60)
+	audit := new(bytes.Buffer)
+	throttle := NewLoginThrottle(store, log.New(audit, "", 0))
+	throttle.UserNameFreeAttempts = 2
+	throttle.IpFreeAttempts = 4
+
+	return throttle, store, audit
+}
+
+// A reserved attempt whose password was wrong
+func failLogIn(throttle *LoginThrottle, c *RequestContext, userName, ip string) time.Duration {
+	wait, _ := throttle.Reserve(userName, ip)
+	if wait == 0 {
+		throttle.RecordFailure(c, userName, ip)
+	}
+	return wait
+}
+
+func TestLoginThrottleGetDelay(t *testing.T) {
+	spec := &Spec{t}
+
+	throttle, store, _ := newTestLoginThrottle()
+	defer store.Close()
+
+	testCases := []struct {
+		// Input
+		Failures int
+		// Expected result
+		Delay time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{2, time.Second},
+		{3, 2 * time.Second},
+		{6, 16 * time.Second},
+		{12, 15 * time.Minute},
+		{1000, 15 * time.Minute},
+	}
+
+	for index, testCase := range testCases {
+		delay := throttle.GetDelay(testCase.Failures, throttle.UserNameFreeAttempts)
+
+		spec.Assert(delay == testCase.Delay, "Expected %s but got %s for test case %d", testCase.Delay, delay, index)
+	}
+}
+
+func TestLoginThrottleLocksOutUserName(t *testing.T) {
+	spec := &Spec{t}
+
+	throttle, store, audit := newTestLoginThrottle()
+	defer store.Close()
+	c := &RequestContext{Id: "r1"}
+
+	for index := 0; index < throttle.UserNameFreeAttempts; index++ {
+		wait, err := throttle.Reserve("Ted", "10.0.0.1")
+		spec.Assert(err == nil && wait == 0, "Attempt %d should be allowed, wait %s, error %v", index, wait, err)
+		throttle.RecordFailure(c, "Ted", "10.0.0.1")
+	}
+
+	// Case and the IP make no difference to the user name count
+	wait, err := throttle.Reserve(" ted", "10.0.0.2")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(wait > 0 && wait <= time.Second, "Expected a wait of up to a second but got %s", wait)
+	spec.Assert(strings.Contains(audit.String(), `login lockout user="Ted" ip="10.0.0.1" failures=2 retry_after=1s`), "Unexpected audit log %s", audit.String())
+
+	wait, _ = throttle.Reserve("alice", "10.0.0.1")
+	spec.Assert(wait == 0, "Other users from the same IP should not be locked out, wait %s", wait)
+
+	// Refused attempts are not counted, so the IP is not locked out by them
+	ipAttempts, _ := store.GetLoginAttempts(getLoginIpKey("10.0.0.2"))
+	spec.Assert(ipAttempts.Failures == 0, "Unexpected IP failures for a refused attempt %d", ipAttempts.Failures)
+}
+
+func TestLoginThrottleLocksOutIp(t *testing.T) {
+	spec := &Spec{t}
+
+	throttle, store, audit := newTestLoginThrottle()
+	defer store.Close()
+	c := &RequestContext{Id: "r1"}
+
+	for _, userName := range []string{"u1", "u2", "u3", "u4"} {
+		failLogIn(throttle, c, userName, "10.0.0.1")
+	}
+
+	wait, _ := throttle.Reserve("u5", "10.0.0.1")
+	spec.Assert(wait > 0, "Expected the IP to be locked out")
+	spec.Assert(strings.Contains(audit.String(), `login lockout ip="10.0.0.1" failures=4`), "Unexpected audit log %s", audit.String())
+
+	wait, _ = throttle.Reserve("u5", "10.0.0.2")
+	spec.Assert(wait == 0, "Other IPs should not be locked out, wait %s", wait)
+}
+
+func TestLoginThrottleLockoutExpires(t *testing.T) {
+	spec := &Spec{t}
+
+	throttle, store, _ := newTestLoginThrottle()
+	defer store.Close()
+	throttle.BaseDelay = 10 * time.Millisecond
+	c := &RequestContext{Id: "r1"}
+
+	failLogIn(throttle, c, "ted", "10.0.0.1")
+	failLogIn(throttle, c, "ted", "10.0.0.1")
+	wait, _ := throttle.Reserve("ted", "10.0.0.1")
+	spec.Assert(wait > 0, "Expected a lockout")
+
+	time.Sleep(wait)
+	wait, _ = throttle.Reserve("ted", "10.0.0.1")
+	spec.Assert(wait == 0, "Expected the lockout to have expired, wait %s", wait)
+}
+
+func TestLoginThrottleSuccessResetsUserName(t *testing.T) {
+	spec := &Spec{t}
+
+	throttle, store, audit := newTestLoginThrottle()
+	defer store.Close()
+	throttle.BaseDelay = time.Millisecond
+	c := &RequestContext{Id: "r1"}
+
+	for _, userName := range []string{"ted", "ted", "other"} {
+		failLogIn(throttle, c, userName, "10.0.0.1")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	wait, _ := throttle.Reserve("ted", "10.0.0.1")
+	spec.Assert(wait == 0, "Expected the lockout to have expired, wait %s", wait)
+	err := throttle.RecordSuccess(c, "ted", "10.0.0.1")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	userAttempts, _ := store.GetLoginAttempts(getLoginUserNameKey("ted"))
+	spec.Assert(userAttempts.Failures == 0, "Expected user name failures to be reset, got %d", userAttempts.Failures)
+	ipAttempts, _ := store.GetLoginAttempts(getLoginIpKey("10.0.0.1"))
+	spec.Assert(ipAttempts.Failures == 3, "Expected IP failures to be kept, got %d", ipAttempts.Failures)
+	spec.Assert(strings.Contains(audit.String(), `login unlock user="ted" ip="10.0.0.1" failures=2`), "Unexpected audit log %s", audit.String())
+}
+
+func TestLoginThrottleConcurrentAttemptsAreCounted(t *testing.T) {
+	spec := &Spec{t}
+
+	throttle, store, _ := newTestLoginThrottle()
+	defer store.Close()
+
+	RunConcurrentLoginAttemptsTest(spec, throttle)
+}
+
+func TestRedisLoginThrottleConcurrentAttemptsAreCounted(t *testing.T) {
+	if !isRedisRunning() {
+		t.Skip("No redis instance running")
+	}
+
+	pool := NewRedisPool(":6379", "")
+	defer pool.Close()
+
+	store := NewRedisLoginAttemptStore(pool)
+	store.ResetLoginAttempts(getLoginUserNameKey("ted"))
+	store.ResetLoginAttempts(getLoginIpKey("10.0.0.1"))
+	defer store.ResetLoginAttempts(getLoginUserNameKey("ted"))
+	defer store.ResetLoginAttempts(getLoginIpKey("10.0.0.1"))
+
+	throttle := NewLoginThrottle(store, log.New(ioutil.Discard, "", 0))
+	throttle.UserNameFreeAttempts = 2
+	RunConcurrentLoginAttemptsTest(&Spec{t}, throttle)
+}
+
+// Attempts racing past a check before any failure is recorded would get more than the free attempts
+func RunConcurrentLoginAttemptsTest(spec *Spec, throttle *LoginThrottle) {
+	const attempts = 20
+	allowed := make(chan bool, attempts)
+	var wg sync.WaitGroup
+	for index := 0; index < attempts; index++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := throttle.Reserve("ted", "10.0.0.1")
+			allowed <- err == nil && wait == 0
+		}()
+	}
+	wg.Wait()
+	close(allowed)
+
+	allowedCount := 0
+	for isAllowed := range allowed {
+		if isAllowed {
+			allowedCount++
+		}
+	}
+	spec.Assert(allowedCount == throttle.UserNameFreeAttempts, "Expected %d attempts to be allowed but got %d", throttle.UserNameFreeAttempts, allowedCount)
+
+	attemptsForUser, _ := throttle.Store.GetLoginAttempts(getLoginUserNameKey("ted"))
+	spec.Assert(attemptsForUser.Failures == throttle.UserNameFreeAttempts, "Expected refused attempts not to be counted, got %d", attemptsForUser.Failures)
+}
+
+func TestGetRetryAfterSeconds(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Wait time.Duration
+		// Expected result
+		Seconds int64
+	}{
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{15 * time.Minute, 900},
+	}
+
+	for index, testCase := range testCases {
+		seconds := getRetryAfterSeconds(testCase.Wait)
+
+		spec.Assert(seconds == testCase.Seconds, "Expected %d but got %d for test case %d", testCase.Seconds, seconds, index)
+	}
+}
+
+func TestGetClientIp(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		RemoteAddr   string
+		ForwardedFor string
+		// Expected result
+		Ip string
+	}{
+		{"10.0.0.1:5000", "", "10.0.0.1"},
+		{"[::1]:5000", "", "::1"},
+		{"10.0.0.1:5000", "192.168.1.1", "10.0.0.1"},
+		{"10.0.0.1", "", "10.0.0.1"},
+	}
+
+	for index, testCase := range testCases {
+		request, _ := http.NewRequest("POST", "/api/v1/login", nil)
+		request.RemoteAddr = testCase.RemoteAddr
+		if testCase.ForwardedFor != "" {
+			request.Header.Set("X-Forwarded-For", testCase.ForwardedFor)
+		}
+
+		ip := GetClientIp(request)
+
+		spec.Assert(ip == testCase.Ip, "Expected %s but got %s for test case %d", testCase.Ip, ip, index)
+	}
+}
+
+func TestNewAuditLoggerAppendsToFile(t *testing.T) {
+	spec := &Spec{t}
+
+	directory, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "audit.log")
+
+	for _, message := range []string{"first", "second"} {
+		audit, err := NewAuditLogger(path)
+		spec.Assert(err == nil, "Unexpected error : %s", err)
+		audit.Println(message)
+	}
+
+	content, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	spec.Assert(len(lines) == 2, "Expected 2 lines but got %d", len(lines))
+	spec.Assert(strings.Contains(lines[0], "AUDIT ") && strings.HasSuffix(lines[1], "second"), "Unexpected audit log %s", content)
+}
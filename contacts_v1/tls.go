@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+TLS serving, enabled when both the certificate and key files are configured
+
+	WEBAPP_TLS_CERT_FILE				PEM certificate chain
+	WEBAPP_TLS_KEY_FILE				PEM private key
+	WEBAPP_TLS_RELOAD_INTERVAL_IN_SECONDS		How often the files are checked for changes, default 60
+	WEBAPP_HSTS_MAX_AGE_IN_SECONDS			Strict-Transport-Security max-age, default 1 year
+	WEBAPP_HTTP_REDIRECT_ADDRESS			Optional plain http listener which redirects to https, i.e. :80
+
+Certificates are reloaded when either file's modification time changes so renewals do not need a restart
+*/
+type CertificateReloader struct {
+	certFile    string
+	keyFile     string
+	mutex       *sync.RWMutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	stopPolling chan struct{}
+	closeOnce   sync.Once
+}
+
+// Loads the certificate, failing if it cannot be loaded, and starts polling the files for changes
+func NewCertificateReloader(certFile, keyFile string, interval time.Duration) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{
+		certFile:    certFile,
+		keyFile:     keyFile,
+		mutex:       new(sync.RWMutex),
+		stopPolling: make(chan struct{}),
+	}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	go reloader.pollPeriodically(interval)
+
+	return reloader, nil
+}
+
+/*
+Loads the certificate if either file has changed since the last successful load
+On failure the current certificate is kept and the next poll retries, files are often written one at a time so a
+mismatched pair is expected for a short while during renewals
+*/
+func (reloader *CertificateReloader) Reload() error {
+	certInfo, err := os.Stat(reloader.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(reloader.keyFile)
+	if err != nil {
+		return err
+	}
+
+	reloader.mutex.RLock()
+	unchanged := reloader.certificate != nil && certInfo.ModTime().Equal(reloader.certModTime) && keyInfo.ModTime().Equal(reloader.keyModTime)
+	reloader.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading certificate [%s] and key [%s] : %s", reloader.certFile, reloader.keyFile, err)
+	}
+
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	reloader.certificate = &certificate
+	reloader.certModTime = certInfo.ModTime()
+	reloader.keyModTime = keyInfo.ModTime()
+	log.Printf("Loaded certificate [%s]\n", reloader.certFile)
+
+	return nil
+}
+
+// For tls.Config.GetCertificate
+func (reloader *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+
+	return reloader.certificate, nil
+}
+
+func (reloader *CertificateReloader) pollPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := reloader.Reload(); err != nil {
+				log.Printf("Certificate reload failed, keeping the current certificate : %s\n", err)
+			}
+		case <-reloader.stopPolling:
+			return
+		}
+	}
+}
+
+// Stops polling, safe to call more than once
+func (reloader *CertificateReloader) Close() {
+	reloader.closeOnce.Do(func() {
+		close(reloader.stopPolling)
+	})
+}
+
+func NewTlsConfig(reloader *CertificateReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+}
+
+/*
+HSTS middleware, only sent on TLS connections as browsers ignore it over plain http
+*/
+type HstsHandler struct {
+	MaxAge int
+	Next   http.Handler
+}
+
+func (h *HstsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS != nil {
+		w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", h.MaxAge))
+	}
+
+	h.Next.ServeHTTP(w, r)
+}
+
+func NewHstsHandler(maxAge int, next http.Handler) http.Handler {
+	return &HstsHandler{MaxAge: maxAge, Next: next}
+}
+
+/*
+Plain http to https redirect, the request host is kept and the port replaced with the https listener's port
+GET and HEAD get a 301, other methods a 308 so clients repeat the method and body
+*/
+type HttpsRedirectHandler struct {
+	HttpsPort string // Empty or 443 for the default port
+}
+
+func (h *HttpsRedirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]") // No port
+	}
+	if h.HttpsPort != "" && h.HttpsPort != "443" {
+		host = net.JoinHostPort(host, h.HttpsPort)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6
+	}
+
+	status := http.StatusPermanentRedirect
+	if r.Method == "GET" || r.Method == "HEAD" {
+		status = http.StatusMovedPermanently
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+}
+
+// The https address is the WEBAPP_ADDRESS value, i.e. :8443
+func NewHttpsRedirectHandler(httpsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddress)
+	return &HttpsRedirectHandler{HttpsPort: port}
+}
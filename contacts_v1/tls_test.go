@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Self signed for 127.0.0.1 and localhost, returns the PEM encoded certificate so tests can trust it
+func writeSelfSignedCertificate(t *testing.T, certFile, keyFile, commonName string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Key generation failed : %s", err)
+	}
+
+	serialNumber, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Certificate creation failed : %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Key encoding failed : %s", err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatalf("Certificate write failed : %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("Key write failed : %s", err)
+	}
+
+	return certPem
+}
+
+func getCertificateCommonName(t *testing.T, reloader *CertificateReloader) string {
+	certificate, _ := reloader.GetCertificate(nil)
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatalf("Certificate parse failed : %s", err)
+	}
+
+	return parsed.Subject.CommonName
+}
+
+// Modification times can have a coarse resolution so we move them on explicitly
+func touch(t *testing.T, offset time.Duration, files ...string) {
+	for _, file := range files {
+		if err := os.Chtimes(file, time.Now().Add(offset), time.Now().Add(offset)); err != nil {
+			t.Fatalf("Chtimes failed : %s", err)
+		}
+	}
+}
+
+func TestCertificateReloaderReloadsOnChange(t *testing.T) {
+	spec := &Spec{t}
+	dir, _ := ioutil.TempDir("", "contacts-tls")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	writeSelfSignedCertificate(t, certFile, keyFile, "first")
+	reloader, err := NewCertificateReloader(certFile, keyFile, time.Hour)
+	spec.Assert(err == nil, "Unexpected error %s", err)
+	defer reloader.Close()
+	spec.Assert(getCertificateCommonName(t, reloader) == "first", "Unexpected initial certificate")
+
+	// Unchanged files are not reloaded
+	spec.Assert(reloader.Reload() == nil, "Unexpected error on reload")
+	spec.Assert(getCertificateCommonName(t, reloader) == "first", "Unexpected certificate after reload with no change")
+
+	writeSelfSignedCertificate(t, certFile, keyFile, "second")
+	touch(t, time.Minute, certFile, keyFile)
+	spec.Assert(reloader.Reload() == nil, "Unexpected error on reload")
+	spec.Assert(getCertificateCommonName(t, reloader) == "second", "Certificate not reloaded after change")
+}
+
+func TestCertificateReloaderKeepsCurrentOnInvalidChange(t *testing.T) {
+	spec := &Spec{t}
+	dir, _ := ioutil.TempDir("", "contacts-tls")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	writeSelfSignedCertificate(t, certFile, keyFile, "first")
+	reloader, err := NewCertificateReloader(certFile, keyFile, time.Hour)
+	spec.Assert(err == nil, "Unexpected error %s", err)
+	defer reloader.Close()
+
+	// Only the certificate written so far, i.e. mid renewal
+	otherDir, _ := ioutil.TempDir("", "contacts-tls")
+	defer os.RemoveAll(otherDir)
+	writeSelfSignedCertificate(t, certFile, filepath.Join(otherDir, "key.pem"), "second")
+	touch(t, time.Minute, certFile)
+
+	spec.Assert(reloader.Reload() != nil, "Expected an error for a mismatched key")
+	spec.Assert(getCertificateCommonName(t, reloader) == "first", "Current certificate not kept")
+}
+
+func TestNewCertificateReloaderMissingFiles(t *testing.T) {
+	spec := &Spec{t}
+
+	_, err := NewCertificateReloader("/does/not/exist/cert.pem", "/does/not/exist/key.pem", time.Hour)
+	spec.Assert(err != nil, "Expected an error for missing files")
+}
+
+func TestHstsHandler(t *testing.T) {
+	spec := &Spec{t}
+	handler := NewHstsHandler(600, http.NotFoundHandler())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	spec.Assert(w.Header().Get("Strict-Transport-Security") == "", "Unexpected HSTS header over plain http")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "https://example.com/", nil))
+	spec.Assert(w.Header().Get("Strict-Transport-Security") == "max-age=600", "Unexpected HSTS header %s", w.Header().Get("Strict-Transport-Security"))
+}
+
+func TestHttpsRedirectHandler(t *testing.T) {
+	spec := &Spec{t}
+	testCases := []struct {
+		// Input
+		HttpsAddress string
+		Method       string
+		Url          string
+		// Expected result
+		StatusCode int
+		Location   string
+	}{
+		{":443", "GET", "http://example.com/contacts?a=1", http.StatusMovedPermanently, "https://example.com/contacts?a=1"},
+		{":8443", "GET", "http://example.com:8080/contacts", http.StatusMovedPermanently, "https://example.com:8443/contacts"},
+		{"", "HEAD", "http://example.com:80/", http.StatusMovedPermanently, "https://example.com/"},
+		{":8443", "POST", "http://127.0.0.1:8080/api/v1/login", http.StatusPermanentRedirect, "https://127.0.0.1:8443/api/v1/login"},
+		{":443", "GET", "http://[::1]:80/", http.StatusMovedPermanently, "https://[::1]/"},
+		{":8443", "GET", "http://[::1]/", http.StatusMovedPermanently, "https://[::1]:8443/"},
+	}
+
+	for _, testCase := range testCases {
+		w := httptest.NewRecorder()
+		NewHttpsRedirectHandler(testCase.HttpsAddress).ServeHTTP(w, httptest.NewRequest(testCase.Method, testCase.Url, nil))
+
+		spec.Assert(w.Code == testCase.StatusCode, "Unexpected status code %d for %s %s", w.Code, testCase.Method, testCase.Url)
+		spec.Assert(w.Header().Get("Location") == testCase.Location, "Unexpected location %s for %s %s", w.Header().Get("Location"), testCase.Method, testCase.Url)
+	}
+}
+
+func TestServeTlsWithSecureCookieAndHsts(t *testing.T) {
+	spec := &Spec{t}
+	dir, _ := ioutil.TempDir("", "contacts-tls")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	certPem := writeSelfSignedCertificate(t, certFile, keyFile, "localhost")
+	reloader, err := NewCertificateReloader(certFile, keyFile, time.Hour)
+	spec.Assert(err == nil, "Unexpected error %s", err)
+	defer reloader.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	spec.Assert(err == nil, "Listen failed : %s", err)
+	handler := CreateInitHandlerFunc(NewSessionHandler(NewInMemorySessionStore(60, 60), &SessionTestHandler{UserName: "ted"}))
+	server := NewServer(listener.Addr().String(), NewHstsHandler(600, handler))
+	server.TLSConfig = NewTlsConfig(reloader)
+
+	signals := make(chan os.Signal, 1)
+	serveErrors := make(chan error, 1)
+	go func() {
+		serveErrors <- ServeUntilSignalled(time.Second, signals, ServerListener{server, tls.NewListener(listener, server.TLSConfig)})
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPem)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	res, err := client.Get("https://" + listener.Addr().String() + "/")
+	spec.Assert(err == nil, "Request failed : %s", err)
+	res.Body.Close()
+
+	spec.Assert(res.Header.Get("Strict-Transport-Security") == "max-age=600", "Missing HSTS header")
+	cookies := res.Cookies()
+	spec.Assert(len(cookies) == 1, "Expected a session cookie")
+	spec.Assert(cookies[0].Secure, "Session cookie is not secure")
+	spec.Assert(cookies[0].SameSite == http.SameSiteLaxMode, "Unexpected session cookie SameSite %d", cookies[0].SameSite)
+
+	signals <- os.Interrupt
+	spec.Assert(<-serveErrors == nil, "Expected a clean shutdown")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+Field validation - errors are collected per field so clients can show them beside the offending input
+Field names are the json paths, i.e. FirstName or Emails[1].Address
+*/
+const (
+	maxContactIdLength          = 36
+	maxNameLength               = 100
+	maxDescriptionLength        = 50
+	maxEmailAddressLength       = 254 // RFC 5321 path limit
+	maxNotesLength              = 4000
+	maxTags                     = 20
+	maxTagLength                = 50
+	maxGroupNameLength          = 100
+	maxStreetLength             = 200
+	maxUrlLength                = 2000
+	maxCustomFields             = 50
+	maxCustomFieldValueLength   = 1000
+	minE164Digits               = 7
+	maxE164Digits               = 15
+	phoneNumberSeparatorCharset = " -.()/"
+)
+
+// Same as the contact editor's html pattern
+var twitterHandlePattern = regexp.MustCompile(`^@?(\w){1,15}$`)
+
+var (
+	ErrMissingPhoneCountryCode = errors.New("Phone number must include a country code")
+	ErrInvalidPhoneNumber      = errors.New("Invalid phone number")
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for index, err := range errs {
+		messages[index] = err.Message
+	}
+
+	return strings.Join(messages, ", ")
+}
+
+func (errs *ValidationErrors) Add(field, message string) {
+	*errs = append(*errs, FieldError{Field: field, Message: message})
+}
+
+func (errs *ValidationErrors) CheckLength(field, value, name string, max int) {
+	if utf8.RuneCountInString(value) > max {
+		errs.Add(field, fmt.Sprintf("%s exceeds %d characters", name, max))
+	}
+}
+
+// Nil if there are no errors, so callers can return the result as an error
+func (errs ValidationErrors) AsError() error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+func IsValidEmailAddress(address string) bool {
+	if address == "" || len(address) > maxEmailAddressLength {
+		return false
+	}
+
+	// ParseAddress also accepts display names and comments, we only want the bare address
+	parsed, err := mail.ParseAddress(address)
+	return err == nil && parsed.Address == address && strings.Contains(address[strings.LastIndex(address, "@"):], ".")
+}
+
+func IsValidTwitterHandle(handle string) bool {
+	return twitterHandlePattern.MatchString(handle)
+}
+
+/*
+Birthdays are dates, YYYY-MM-DD, or --MM-DD if the year is not known as in vCard 4.0
+Dates must exist, 2001-02-29 is rejected but --02-29 is accepted, and must not be in the future
+*/
+const (
+	birthdayLayout       = "2006-01-02"
+	birthdayNoYearLayout = "--01-02"
+)
+
+func IsValidBirthday(birthday string) bool {
+	if strings.HasPrefix(birthday, "--") {
+		// Year 0 is a leap year so the 29th of February parses
+		_, err := time.Parse(birthdayNoYearLayout, birthday)
+		return err == nil
+	}
+
+	date, err := time.Parse(birthdayLayout, birthday)
+	return err == nil && !date.After(time.Now().UTC())
+}
+
+// Absolute http or https urls only, so links are safe to show
+func IsValidWebsiteUrl(value string) bool {
+	if value == "" || len(value) > maxUrlLength {
+		return false
+	}
+
+	parsed, err := url.Parse(value)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+/*
+Normalises to E.164, i.e. +3530667132310
+
+	+353 66 713 2310, 00353 (66) 713-2310	International prefixes are accepted
+	353 66 7132310				Assumed to already start with the country code
+	066 7132310				National numbers are rejected as we do not know the country
+*/
+func NormalisePhoneNumber(number string) (string, error) {
+	number = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(number), "tel:"))
+
+	digits := make([]byte, 0, len(number))
+	for index := 0; index < len(number); index++ {
+		switch ch := number[index]; {
+		case ch >= '0' && ch <= '9':
+			digits = append(digits, ch)
+		case ch == '+' && index == 0:
+		case strings.IndexByte(phoneNumberSeparatorCharset, ch) != -1:
+		default:
+			return "", ErrInvalidPhoneNumber
+		}
+	}
+
+	result := string(digits)
+	switch {
+	case strings.HasPrefix(number, "+"):
+	case strings.HasPrefix(result, "00"):
+		result = result[2:]
+	case strings.HasPrefix(result, "0"):
+		return "", ErrMissingPhoneCountryCode
+	}
+
+	if len(result) < minE164Digits || len(result) > maxE164Digits || result[0] == '0' {
+		return "", ErrInvalidPhoneNumber
+	}
+
+	return "+" + result, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestNormalisePhoneNumber(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Number string
+		// Expected result
+		Expected      string
+		ExpectedError error
+	}{
+		{"+353 66 713 2310", "+353667132310", nil},
+		{"00353 (66) 713-2310", "+353667132310", nil},
+		{"353 066 7132310", "+3530667132310", nil},
+		{"tel:+44.20.7946.0958", "+442079460958", nil},
+		{"+3530667132310", "+3530667132310", nil},
+		{"066 7132310", "", ErrMissingPhoneCountryCode},
+		{"", "", ErrInvalidPhoneNumber},
+		{"+353 66 713 2310 x12", "", ErrInvalidPhoneNumber},
+		{"+1 23", "", ErrInvalidPhoneNumber},
+		{"+1234567890123456", "", ErrInvalidPhoneNumber},
+		{"353+667132310", "", ErrInvalidPhoneNumber},
+	}
+
+	for _, testCase := range testCases {
+		actual, err := NormalisePhoneNumber(testCase.Number)
+		spec.Assert(actual == testCase.Expected, "Unexpected result [%s] for input [%s]", actual, testCase.Number)
+		spec.Assert(err == testCase.ExpectedError, "Unexpected error [%v] for input [%s]", err, testCase.Number)
+	}
+}
+
+func TestIsValidEmailAddress(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Address string
+		// Expected result
+		Expected bool
+	}{
+		{"ted@example.com", true},
+		{"ted.toe+contacts@mail.example.ie", true},
+		{"", false},
+		{"ted", false},
+		{"ted@localhost", false},
+		{"Ted <ted@example.com>", false},
+		{"ted@example.com (Ted)", false},
+		{strings.Repeat("a", 250) + "@example.com", false},
+	}
+
+	for _, testCase := range testCases {
+		actual := IsValidEmailAddress(testCase.Address)
+		spec.Assert(actual == testCase.Expected, "Unexpected result %t for input [%s]", actual, testCase.Address)
+	}
+}
+
+func TestIsValidTwitterHandle(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Handle string
+		// Expected result
+		Expected bool
+	}{
+		{"@tedtoe", true},
+		{"ted_toe", true},
+		{"@", false},
+		{"@ted-toe", false},
+		{"@" + strings.Repeat("t", 16), false},
+	}
+
+	for _, testCase := range testCases {
+		actual := IsValidTwitterHandle(testCase.Handle)
+		spec.Assert(actual == testCase.Expected, "Unexpected result %t for input [%s]", actual, testCase.Handle)
+	}
+}
+
+func TestIsValidBirthday(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Birthday string
+		// Expected result
+		Expected bool
+	}{
+		{"1996-04-15", true},
+		{"--04-15", true},
+		{"--02-29", true},
+		{"2000-02-29", true},
+		{"2001-02-29", false},
+		{"1996-4-15", false},
+		{"15/04/1996", false},
+		{"--13-01", false},
+		{time.Now().UTC().AddDate(1, 0, 0).Format("2006-01-02"), false},
+	}
+
+	for _, testCase := range testCases {
+		actual := IsValidBirthday(testCase.Birthday)
+		spec.Assert(actual == testCase.Expected, "Unexpected result %t for input [%s]", actual, testCase.Birthday)
+	}
+}
+
+func TestIsValidWebsiteUrl(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Url string
+		// Expected result
+		Expected bool
+	}{
+		{"https://example.com", true},
+		{"http://example.com/ted?a=1", true},
+		{"example.com", false},
+		{"javascript:alert(1)", false},
+		{"ftp://example.com", false},
+		{"https://", false},
+		{"https://example.com/" + strings.Repeat("a", 2000), false},
+	}
+
+	for _, testCase := range testCases {
+		actual := IsValidWebsiteUrl(testCase.Url)
+		spec.Assert(actual == testCase.Expected, "Unexpected result %t for input [%s]", actual, testCase.Url)
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	spec := &Spec{t}
+
+	var errs ValidationErrors
+	spec.Assert(errs.AsError() == nil, "Expected nil error for no validation errors")
+
+	errs.Add("FirstName", "Missing first name")
+	errs.CheckLength("LastName", "Toe", "Last name", 3)
+	errs.CheckLength("Notes", "éééé", "Notes", 3)
+
+	spec.Assert(len(errs) == 2, "Unexpected error count %d", len(errs))
+	spec.Assert(errs.AsError().Error() == "Missing first name, Notes exceeds 3 characters", "Unexpected error text %s", errs.AsError())
+}
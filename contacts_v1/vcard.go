@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+vCard 3.0 and 4.0 encoding and decoding, see https://tools.ietf.org/html/rfc2426 and https://tools.ietf.org/html/rfc6350
+Only the properties we have contact fields for are mapped
+
+	UID		Id
+	N, FN		LastName and FirstName, FN is only used if there is no N
+	ORG		Organisation, the first component only
+	TITLE		Title
+	BDAY		Birthday, basic format (19960415, --0415) for 4.0
+	EMAIL		Emails, TYPE is the description
+	TEL		Phones, TYPE is the description
+	ADR		Addresses, TYPE is the description, the post office box and extended address are not mapped
+	URL		Websites, TYPE is the description
+	X-TWITTER	Twitter, X-SOCIALPROFILE;TYPE=twitter is also accepted on import
+	NOTE		Notes
+	CATEGORIES	Tags, all CATEGORIES properties are combined on import
+*/
+const (
+	vCardVersion3   = "3.0"
+	vCardVersion4   = "4.0"
+	vCardLineLength = 75 // Octets, excluding the CRLF
+)
+
+var ErrNoVCards = errors.New("No vCards found")
+
+// Contact fields with no vCard property, see ContactDecodeResult
+var vCardUnmappedFields = []string{"CustomFields"}
+
+func IsSupportedVCardVersion(version string) bool {
+	return version == vCardVersion3 || version == vCardVersion4
+}
+
+func EncodeVCard(w io.Writer, contact *Contact, version string) error {
+	if !IsSupportedVCardVersion(version) {
+		return fmt.Errorf("Unsupported vCard version [%s]", version)
+	}
+
+	buf := new(bytes.Buffer)
+	writeVCardLine(buf, "BEGIN:VCARD")
+	writeVCardLine(buf, "VERSION:"+version)
+	if contact.Id != "" {
+		writeVCardLine(buf, "UID:"+escapeVCardText(contact.Id))
+	}
+	writeVCardLine(buf, fmt.Sprintf("N:%s;%s;;;", escapeVCardText(contact.LastName), escapeVCardText(contact.FirstName)))
+	writeVCardLine(buf, "FN:"+escapeVCardText(strings.TrimSpace(contact.FirstName+" "+contact.LastName)))
+	if contact.Organisation != "" {
+		writeVCardLine(buf, "ORG:"+escapeVCardText(contact.Organisation))
+	}
+	if contact.Title != "" {
+		writeVCardLine(buf, "TITLE:"+escapeVCardText(contact.Title))
+	}
+	if contact.Birthday != "" {
+		writeVCardLine(buf, "BDAY:"+encodeVCardBirthday(contact.Birthday, version))
+	}
+	for _, email := range contact.Emails {
+		writeVCardLine(buf, "EMAIL"+getVCardTypeParameter(email.Description)+":"+escapeVCardText(email.Address))
+	}
+	for _, phone := range contact.Phones {
+		writeVCardLine(buf, "TEL"+getVCardTypeParameter(phone.Description)+":"+escapeVCardText(phone.Number))
+	}
+	for _, address := range contact.Addresses {
+		components := []string{"", "", address.Street, address.Locality, address.Region, address.PostalCode, address.Country}
+		for index := range components {
+			components[index] = escapeVCardText(components[index])
+		}
+		writeVCardLine(buf, "ADR"+getVCardTypeParameter(address.Description)+":"+strings.Join(components, ";"))
+	}
+	for _, website := range contact.Websites {
+		// A uri value, so not escaped
+		writeVCardLine(buf, "URL"+getVCardTypeParameter(website.Description)+":"+website.Url)
+	}
+	if contact.Twitter != "" {
+		writeVCardLine(buf, "X-TWITTER:"+escapeVCardText(contact.Twitter))
+	}
+	if contact.Notes != "" {
+		writeVCardLine(buf, "NOTE:"+escapeVCardText(contact.Notes))
+	}
+	if len(contact.Tags) > 0 {
+		tags := make([]string, len(contact.Tags))
+		for index, tag := range contact.Tags {
+			tags[index] = escapeVCardText(tag)
+		}
+		writeVCardLine(buf, "CATEGORIES:"+strings.Join(tags, ","))
+	}
+	writeVCardLine(buf, "END:VCARD")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+/*
+Decodes all cards, the error is only for an unreadable stream or no cards at all
+Each card gets its own result so one bad card does not prevent the others being imported
+*/
+func DecodeVCards(r io.Reader) ([]ContactDecodeResult, error) {
+	lines, err := readUnfoldedVCardLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]ContactDecodeResult, 0)
+	var card []vCardProperty
+	inCard := false
+	for _, line := range lines {
+		property, err := parseVCardProperty(line)
+		if err != nil {
+			if inCard {
+				card = append(card, vCardProperty{err: err})
+			}
+			continue
+		}
+
+		switch {
+		case property.name == "BEGIN" && strings.EqualFold(property.value, "VCARD"):
+			if inCard {
+				results = append(results, ContactDecodeResult{Err: errors.New("Missing END:VCARD")})
+			}
+			card, inCard = make([]vCardProperty, 0), true
+		case property.name == "END" && strings.EqualFold(property.value, "VCARD"):
+			if inCard {
+				results = append(results, decodeVCard(card))
+			}
+			inCard = false
+		case inCard:
+			card = append(card, property)
+		}
+	}
+	if inCard {
+		results = append(results, ContactDecodeResult{Err: errors.New("Missing END:VCARD")})
+	}
+
+	if len(results) == 0 {
+		return nil, ErrNoVCards
+	}
+
+	return results, nil
+}
+
+type vCardProperty struct {
+	name  string
+	types []string
+	value string
+	err   error
+}
+
+func decodeVCard(properties []vCardProperty) ContactDecodeResult {
+	var contact Contact
+	formattedName := ""
+	hasName := false
+	for _, property := range properties {
+		if property.err != nil {
+			return ContactDecodeResult{Err: property.err}
+		}
+
+		switch property.name {
+		case "VERSION":
+			if !IsSupportedVCardVersion(property.value) {
+				return ContactDecodeResult{Err: fmt.Errorf("Unsupported vCard version [%s]", property.value)}
+			}
+		case "UID":
+			contact.Id = unescapeVCardText(strings.TrimPrefix(property.value, "urn:uuid:"))
+		case "N":
+			components := splitVCardComponents(property.value)
+			contact.LastName = unescapeVCardText(components[0])
+			if len(components) > 1 {
+				contact.FirstName = unescapeVCardText(components[1])
+			}
+			hasName = true
+		case "FN":
+			formattedName = unescapeVCardText(property.value)
+		case "ORG":
+			contact.Organisation = unescapeVCardText(splitVCardComponents(property.value)[0])
+		case "TITLE":
+			contact.Title = unescapeVCardText(property.value)
+		case "BDAY":
+			contact.Birthday = decodeVCardBirthday(unescapeVCardText(property.value))
+		case "ADR":
+			components := splitVCardComponents(property.value)
+			for len(components) < 7 {
+				components = append(components, "")
+			}
+			contact.Addresses = append(contact.Addresses, Address{
+				Description: getVCardDescription(property.types),
+				Street:      unescapeVCardText(components[2]),
+				Locality:    unescapeVCardText(components[3]),
+				Region:      unescapeVCardText(components[4]),
+				PostalCode:  unescapeVCardText(components[5]),
+				Country:     unescapeVCardText(components[6]),
+			})
+		case "URL":
+			contact.Websites = append(contact.Websites, Website{Description: getVCardDescription(property.types), Url: unescapeVCardText(property.value)})
+		case "EMAIL":
+			contact.Emails = append(contact.Emails, Email{Description: getVCardDescription(property.types), Address: unescapeVCardText(property.value)})
+		case "TEL":
+			number := strings.TrimPrefix(unescapeVCardText(property.value), "tel:")
+			contact.Phones = append(contact.Phones, Phone{Description: getVCardDescription(property.types), Number: number})
+		case "X-TWITTER":
+			contact.Twitter = unescapeVCardText(property.value)
+		case "X-SOCIALPROFILE":
+			if containsFold(property.types, "twitter") {
+				contact.Twitter = unescapeVCardText(property.value)
+			}
+		case "NOTE":
+			contact.Notes = unescapeVCardText(property.value)
+		case "CATEGORIES":
+			for _, tag := range splitVCardValue(property.value, ',') {
+				contact.Tags = append(contact.Tags, unescapeVCardText(tag))
+			}
+		}
+	}
+
+	if !hasName && formattedName != "" {
+		// Best effort, last word is the last name
+		if index := strings.LastIndex(formattedName, " "); index != -1 {
+			contact.FirstName, contact.LastName = formattedName[:index], formattedName[index+1:]
+		} else {
+			contact.FirstName = formattedName
+		}
+	}
+
+	return ContactDecodeResult{Contact: contact, Unmapped: vCardUnmappedFields}
+}
+
+// vCard 4.0 uses the ISO 8601 basic format, 3.0 the extended format we store
+func encodeVCardBirthday(birthday, version string) string {
+	if version != vCardVersion4 {
+		return birthday
+	}
+	if strings.HasPrefix(birthday, "--") {
+		return "--" + strings.Replace(birthday[2:], "-", "", -1)
+	}
+
+	return strings.Replace(birthday, "-", "", -1)
+}
+
+// Accepts basic and extended dates, with or without a year, any time is dropped, other values are left for validation to report
+func decodeVCardBirthday(value string) string {
+	if index := strings.Index(value, "T"); index != -1 {
+		value = value[:index]
+	}
+
+	switch {
+	case len(value) == 8 && !strings.HasPrefix(value, "--"):
+		return value[:4] + "-" + value[4:6] + "-" + value[6:]
+	case len(value) == 6 && strings.HasPrefix(value, "--"):
+		return value[:4] + "-" + value[4:]
+	}
+
+	return value
+}
+
+func readUnfoldedVCardLines(r io.Reader) ([]string, error) {
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			// Folded continuation line
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, scanner.Err()
+}
+
+// Parses "group.NAME;PARAM=VALUE;...:value"
+func parseVCardProperty(line string) (vCardProperty, error) {
+	nameAndParameters, value, ok := cutOutsideQuotes(line, ':')
+	if !ok {
+		return vCardProperty{}, fmt.Errorf("Invalid vCard line [%s]", line)
+	}
+
+	parts := splitOutsideQuotes(nameAndParameters, ';')
+	name := strings.ToUpper(parts[0])
+	if index := strings.LastIndex(name, "."); index != -1 {
+		name = name[index+1:]
+	}
+
+	property := vCardProperty{name: name, value: value}
+	for _, parameter := range parts[1:] {
+		parameterName, parameterValue, ok := cutOutsideQuotes(parameter, '=')
+		if !ok {
+			// vCard 3.0 allows bare types such as TEL;HOME:
+			parameterName, parameterValue = "TYPE", parameter
+		}
+		if !strings.EqualFold(parameterName, "TYPE") {
+			continue
+		}
+		for _, typeValue := range splitOutsideQuotes(parameterValue, ',') {
+			if typeValue = strings.Trim(typeValue, `"`); typeValue != "" {
+				property.types = append(property.types, typeValue)
+			}
+		}
+	}
+
+	return property, nil
+}
+
+// Types that only describe the value format are not useful as a description
+var vCardIgnoredTypes = []string{"internet", "pref", "voice", "x400"}
+
+func getVCardDescription(types []string) string {
+	descriptions := make([]string, 0, len(types))
+	for _, typeValue := range types {
+		if !containsFold(vCardIgnoredTypes, typeValue) {
+			descriptions = append(descriptions, typeValue)
+		}
+	}
+
+	return strings.Join(descriptions, ",")
+}
+
+// Parameter values cannot be escaped or folded, so line breaks become spaces rather than starting a new property
+func getVCardTypeParameter(description string) string {
+	if description == "" {
+		return ""
+	}
+	description = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(description)
+	if strings.ContainsAny(description, `;:"`) {
+		return `;TYPE="` + strings.Replace(description, `"`, "'", -1) + `"`
+	}
+
+	return ";TYPE=" + description
+}
+
+func escapeVCardText(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "\r\n", `\n`, "\n", `\n`, ",", `\,`, ";", `\;`)
+	return replacer.Replace(value)
+}
+
+func unescapeVCardText(value string) string {
+	replacer := strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";")
+	return replacer.Replace(value)
+}
+
+// Splits structured values such as N on unescaped semicolons, always returns at least one component
+func splitVCardComponents(value string) []string {
+	return splitVCardValue(value, ';')
+}
+
+// Splits on unescaped separators, i.e. the commas between CATEGORIES values, always returns at least one part
+func splitVCardValue(value string, separator byte) []string {
+	parts := make([]string, 0)
+	start := 0
+	for index := 0; index < len(value); index++ {
+		switch value[index] {
+		case '\\':
+			index++
+		case separator:
+			parts = append(parts, value[start:index])
+			start = index + 1
+		}
+	}
+
+	return append(parts, value[start:])
+}
+
+// Writes a content line folding at 75 octets without splitting a utf8 sequence
+func writeVCardLine(buf *bytes.Buffer, line string) {
+	limit := vCardLineLength
+	for len(line) > limit {
+		index := limit
+		for index > 0 && !isUtf8StartByte(line[index]) {
+			index--
+		}
+		buf.WriteString(line[:index])
+		buf.WriteString("\r\n ")
+		line = line[index:]
+		limit = vCardLineLength - 1 // Continuation lines start with a space
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+func isUtf8StartByte(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+func cutOutsideQuotes(s string, separator byte) (before, after string, found bool) {
+	inQuotes := false
+	for index := 0; index < len(s); index++ {
+		switch {
+		case s[index] == '"':
+			inQuotes = !inQuotes
+		case s[index] == separator && !inQuotes:
+			return s[:index], s[index+1:], true
+		}
+	}
+
+	return s, "", false
+}
+
+func splitOutsideQuotes(s string, separator byte) []string {
+	parts := make([]string, 0)
+	for {
+		before, after, found := cutOutsideQuotes(s, separator)
+		parts = append(parts, before)
+		if !found {
+			return parts
+		}
+		s = after
+	}
+}
+
+func containsFold(values []string, value string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestEncodeVCard(t *testing.T) {
+	spec := &Spec{t}
+
+	contact := &Contact{
+		Id:        "c1",
+		FirstName: "Ted",
+		LastName:  "Toe",
+		Emails:    []Email{Email{Description: "Work", Address: "ted@example.com"}},
+		Phones:    []Phone{Phone{Description: "Home", Number: "353 066 7132310"}},
+		Twitter:   "@tedtoe",
+		Notes:     "Likes; commas, and\nnew lines",
+		Tags:      []string{"customers", "on, call"},
+	}
+
+	buf := new(bytes.Buffer)
+	err := EncodeVCard(buf, contact, "3.0")
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+
+	expected := "BEGIN:VCARD\r\nVERSION:3.0\r\nUID:c1\r\nN:Toe;Ted;;;\r\nFN:Ted Toe\r\nEMAIL;TYPE=Work:ted@example.com\r\nTEL;TYPE=Home:353 066 7132310\r\nX-TWITTER:@tedtoe\r\nNOTE:Likes\\; commas\\, and\\nnew lines\r\nCATEGORIES:customers,on\\, call\r\nEND:VCARD\r\n"
+	spec.Assert(buf.String() == expected, "Unexpected vCard %q", buf.String())
+}
+
+func TestEncodeVCardDescriptionLineBreaks(t *testing.T) {
+	spec := &Spec{t}
+
+	contact := &Contact{
+		FirstName: "Ted",
+		LastName:  "Toe",
+		Emails:    []Email{Email{Description: "Work\r\nX-INJECTED:value", Address: "ted@example.com"}},
+		Phones:    []Phone{Phone{Description: "Home\nNOTE:value", Number: "353 066 7132310"}},
+	}
+
+	buf := new(bytes.Buffer)
+	EncodeVCard(buf, contact, "3.0")
+
+	spec.Assert(strings.Contains(buf.String(), "\r\nEMAIL;TYPE=\"Work X-INJECTED:value\":ted@example.com\r\n"), "Unexpected vCard %q", buf.String())
+	spec.Assert(strings.Contains(buf.String(), "\r\nTEL;TYPE=\"Home NOTE:value\":353 066 7132310\r\n"), "Unexpected vCard %q", buf.String())
+
+	results, err := DecodeVCards(buf)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(len(results) == 1 && results[0].Contact.Notes == "", "Unexpected results %#v", results)
+}
+
+func TestEncodeVCardFoldsLongLines(t *testing.T) {
+	spec := &Spec{t}
+
+	buf := new(bytes.Buffer)
+	EncodeVCard(buf, &Contact{FirstName: "Ted", LastName: "Toe", Notes: strings.Repeat("é", 100)}, "4.0")
+
+	for _, line := range strings.Split(buf.String(), "\r\n") {
+		spec.Assert(len(line) <= 75, "Line too long %d", len(line))
+	}
+
+	results, err := DecodeVCards(buf)
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(results[0].Contact.Notes == strings.Repeat("é", 100), "Unexpected notes %s", results[0].Contact.Notes)
+}
+
+func TestEncodeVCardUnsupportedVersion(t *testing.T) {
+	spec := &Spec{t}
+
+	err := EncodeVCard(new(bytes.Buffer), &Contact{}, "2.1")
+
+	spec.Assert(err != nil, "Expected error")
+}
+
+func TestVCardRoundTrip(t *testing.T) {
+	spec := &Spec{t}
+
+	original := Contact{
+		Id:           "c1",
+		FirstName:    "Ted",
+		LastName:     "Toe",
+		Organisation: "Acme; Sales",
+		Title:        "Engineer",
+		Birthday:     "1996-04-15",
+		Emails:       []Email{Email{Description: "Work", Address: "ted@example.com"}, Email{Address: "ted@gmail.com"}},
+		Phones:       []Phone{Phone{Description: "Home", Number: "353 066 7132310"}},
+		Addresses:    []Address{Address{Description: "Work", Street: "1 Main St, Unit 2", Locality: "Tralee", Region: "Kerry", PostalCode: "V92", Country: "Ireland"}, Address{Country: "France"}},
+		Websites:     []Website{Website{Description: "Blog", Url: "https://example.com/ted?a=1,2"}},
+		Twitter:      "@tedtoe",
+		Notes:        "Likes; commas, and\nnew lines",
+		Tags:         []string{"customers", "on, call"},
+	}
+
+	for _, version := range []string{"3.0", "4.0"} {
+		buf := new(bytes.Buffer)
+		EncodeVCard(buf, &original, version)
+
+		results, err := DecodeVCards(buf)
+		spec.Assert(err == nil, "Unexpected error : %s", err)
+		spec.Assert(len(results) == 1, "Unexpected result count %d", len(results))
+		spec.Assert(reflect.DeepEqual(original, results[0].Contact), "Expected [%v] but got [%v] for version %s", original, results[0].Contact, version)
+	}
+}
+
+func TestDecodeVCardsMultipleCards(t *testing.T) {
+	spec := &Spec{t}
+
+	vcf := "BEGIN:VCARD\nVERSION:3.0\nN:Toe;Ted\nitem1.EMAIL;type=INTERNET;type=HOME:ted@example.com\nTEL;HOME;VOICE:123\nEND:VCARD\n" +
+		"BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Tom Thumb\r\nTEL;VALUE=uri;TYPE=\"work,cell\":tel:+353-1-234\r\nX-SOCIALPROFILE;TYPE=twitter:@tom\r\nCATEGORIES:friends,golf\r\nCATEGORIES:work\r\nNOTE:A long note that\r\n  is folded\r\nEND:VCARD\r\n" +
+		"BEGIN:VCARD\nVERSION:2.1\nN:Old;Card\nEND:VCARD\n" +
+		"BEGIN:VCARD\nVERSION:3.0\nN:Missing;End\n"
+
+	results, err := DecodeVCards(strings.NewReader(vcf))
+	spec.Assert(err == nil, "Unexpected error : %s", err)
+	spec.Assert(len(results) == 4, "Unexpected result count %d", len(results))
+
+	ted := results[0].Contact
+	spec.Assert(results[0].Err == nil, "Unexpected error : %s", results[0].Err)
+	spec.Assert(ted.FirstName == "Ted" && ted.LastName == "Toe", "Unexpected name %s %s", ted.FirstName, ted.LastName)
+	spec.Assert(len(ted.Emails) == 1 && ted.Emails[0].Description == "HOME" && ted.Emails[0].Address == "ted@example.com", "Unexpected emails %v", ted.Emails)
+	spec.Assert(len(ted.Phones) == 1 && ted.Phones[0].Description == "HOME" && ted.Phones[0].Number == "123", "Unexpected phones %v", ted.Phones)
+
+	tom := results[1].Contact
+	spec.Assert(results[1].Err == nil, "Unexpected error : %s", results[1].Err)
+	spec.Assert(tom.FirstName == "Tom" && tom.LastName == "Thumb", "Unexpected name %s %s", tom.FirstName, tom.LastName)
+	spec.Assert(len(tom.Phones) == 1 && tom.Phones[0].Description == "work,cell" && tom.Phones[0].Number == "+353-1-234", "Unexpected phones %v", tom.Phones)
+	spec.Assert(tom.Twitter == "@tom", "Unexpected twitter %s", tom.Twitter)
+	spec.Assert(tom.Notes == "A long note that is folded", "Unexpected notes %s", tom.Notes)
+	spec.Assert(reflect.DeepEqual(tom.Tags, []string{"friends", "golf", "work"}), "Unexpected tags %v", tom.Tags)
+
+	spec.Assert(results[2].Err != nil, "Expected unsupported version error")
+	spec.Assert(results[3].Err != nil, "Expected missing end error")
+}
+
+func TestVCardBirthdays(t *testing.T) {
+	spec := &Spec{t}
+
+	testCases := []struct {
+		// Input
+		Birthday string
+		Version  string
+		// Expected result
+		Encoded string
+	}{
+		{"1996-04-15", "3.0", "1996-04-15"},
+		{"1996-04-15", "4.0", "19960415"},
+		{"--04-15", "3.0", "--04-15"},
+		{"--04-15", "4.0", "--0415"},
+	}
+
+	for index, testCase := range testCases {
+		encoded := encodeVCardBirthday(testCase.Birthday, testCase.Version)
+		decoded := decodeVCardBirthday(encoded)
+
+		spec.Assert(encoded == testCase.Encoded, "Expected %s but got %s for test case %d", testCase.Encoded, encoded, index)
+		spec.Assert(decoded == testCase.Birthday, "Expected %s but got %s for test case %d", testCase.Birthday, decoded, index)
+	}
+
+	spec.Assert(decodeVCardBirthday("19960415T120000Z") == "1996-04-15", "Expected the time to be dropped")
+}
+
+func TestDecodeVCardsNoCards(t *testing.T) {
+	spec := &Spec{t}
+
+	_, err := DecodeVCards(strings.NewReader("Not a vCard"))
+
+	spec.Assert(err == ErrNoVCards, "Unexpected error : %v", err)
+}